@@ -0,0 +1,120 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"time"
+
+	"github.com/ssbc/go-muxrpc/v2/codec"
+)
+
+// AbortLatencyBuckets are the upper bounds of the buckets of EndpointStats.AbortLatencies.
+var AbortLatencyBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// LatencyHistogram is a snapshot of a latency distribution.
+// Counts[i] is the number of observations up to AbortLatencyBuckets[i], the last count is for everything above.
+type LatencyHistogram struct {
+	Counts []uint64
+	Count  uint64
+	Sum    time.Duration
+}
+
+// observe adds d to the histogram
+func (h *LatencyHistogram) observe(d time.Duration) {
+	if h.Counts == nil {
+		h.Counts = make([]uint64, len(AbortLatencyBuckets)+1)
+	}
+	i := 0
+	for i < len(AbortLatencyBuckets) && d > AbortLatencyBuckets[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Count++
+	h.Sum += d
+}
+
+// abortExpiry is how long a canceled stream is waited for before the remote is counted as never having ended it
+const abortExpiry = time.Minute
+
+// SlowAbortHook is called with the method of a stream whose remote took longer than the threshold to stop it after a local cancel.
+type SlowAbortHook func(m Method, took time.Duration)
+
+// WithSlowAbortHook sets a hook that is called when the remote took longer than threshold to end a stream that was canceled locally.
+// It runs on a goroutine of its own, so it doesn't hold up the session and may use the endpoint.
+func WithSlowAbortHook(threshold time.Duration, hook SlowAbortHook) HandleOption {
+	return func(r *rpc) {
+		r.slowAbort = threshold
+		r.slowAbortHook = hook
+	}
+}
+
+// abortedCall is a stream that was canceled locally and that the remote didn't end yet
+type abortedCall struct {
+	method Method
+	at     time.Time
+}
+
+// markAborted starts measuring how long the remote takes to end the stream of req.
+// Streams the remote didn't end within abortExpiry are dropped and counted as unanswered.
+func (r *rpc) markAborted(req *Request) {
+	now := r.clock.Now()
+
+	r.abortMu.Lock()
+	defer r.abortMu.Unlock()
+	if r.aborted == nil {
+		r.aborted = make(map[int32]abortedCall)
+	}
+	for id, call := range r.aborted {
+		if now.Sub(call.at) > abortExpiry {
+			delete(r.aborted, id)
+			r.unansweredAborts++
+		}
+	}
+	r.aborted[req.id] = abortedCall{method: req.Method, at: now}
+}
+
+// abortAcknowledged is called for packets of closed requests, the end of an aborted stream stops its clock.
+// rLock must not be held, the hook may call into the endpoint.
+func (r *rpc) abortAcknowledged(hdr codec.Header) {
+	if !hdr.Flag.Get(codec.FlagEndErr) {
+		return
+	}
+
+	r.abortMu.Lock()
+	call, ok := r.aborted[hdr.Req]
+	delete(r.aborted, hdr.Req)
+	var took time.Duration
+	if ok {
+		took = r.clock.Now().Sub(call.at)
+		r.abortLatencies.observe(took)
+	}
+	r.abortMu.Unlock()
+
+	if ok && r.slowAbortHook != nil && took > r.slowAbort {
+		go r.slowAbortHook(call.method, took)
+	}
+}
+
+// abortStats returns the abort latencies of the session and how many aborts the remote never answered
+func (r *rpc) abortStats() (LatencyHistogram, uint64) {
+	r.abortMu.Lock()
+	defer r.abortMu.Unlock()
+
+	h := r.abortLatencies
+	h.Counts = append([]uint64(nil), h.Counts...)
+	if h.Counts == nil {
+		h.Counts = make([]uint64, len(AbortLatencyBuckets)+1)
+	}
+	return h, r.unansweredAborts
+}
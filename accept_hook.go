@@ -0,0 +1,64 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"net"
+)
+
+// CallInfo describes an incoming call, as far as it is known before anything was set up for it.
+// Handlers get it from their context with CallInfoFromContext.
+type CallInfo struct {
+	Method Method
+	Type   CallType
+
+	// ID is the request ID of the call on the connection, negative for incoming calls
+	ID int32
+
+	// Encoding is the encoding of the packet that started the call
+	Encoding RequestEncoding
+
+	// ArgsSize is the length of the JSON encoded arguments
+	ArgsSize int
+
+	Remote net.Addr
+
+	// Identity is the authenticated key of the remote, if the transport has one (see ConnInfo.Identity)
+	Identity []byte
+}
+
+type callInfoCtxKeyType struct{}
+
+var callInfoCtxKey callInfoCtxKeyType
+
+func withCallInfo(ctx context.Context, info CallInfo) context.Context {
+	return context.WithValue(ctx, callInfoCtxKey, info)
+}
+
+// CallInfoFromContext returns the description of the incoming call that the context passed to HandleCall belongs to.
+// Handlers and their wrappers can use it to log or authorize a call without looking at the Request.
+func CallInfoFromContext(ctx context.Context) (CallInfo, bool) {
+	info, ok := ctx.Value(callInfoCtxKey).(CallInfo)
+	return info, ok
+}
+
+// AcceptHook decides if an incoming call should be handled. A returned error is sent to the remote instead.
+// It runs on the connection's read loop before a goroutine, buffers or a context are allocated for the call,
+// so it has to be fast and must not block. It also sees the manifest call every peer makes when it connects.
+type AcceptHook func(CallInfo) error
+
+// WithAcceptHook sets a hook that can reject incoming calls cheaply, before they reach the handler or its wrappers.
+// This is a first line of defense against obviously bad requests, like huge arguments or unknown peers.
+func WithAcceptHook(hook AcceptHook) HandleOption {
+	return func(r *rpc) {
+		r.acceptHook = hook
+	}
+}
+
+// callRejected is returned by parseNewRequest when the accept hook rejected the call
+type callRejected struct{ err error }
+
+func (cr callRejected) Error() string { return cr.err.Error() }
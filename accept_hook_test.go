@@ -0,0 +1,110 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcceptHook(t *testing.T) {
+	r := require.New(t)
+
+	var (
+		mu   sync.Mutex
+		seen []CallInfo
+	)
+	hook := func(ci CallInfo) error {
+		mu.Lock()
+		seen = append(seen, ci)
+		mu.Unlock()
+
+		if ci.ArgsSize > 64 {
+			return errors.New("arguments too large")
+		}
+		if ci.Type == "duplex" {
+			return errors.New("no duplex calls")
+		}
+		return nil
+	}
+
+	var srv FakeHandler
+	srv.HandledCalls(func(m Method) bool { return true })
+	srv.HandleCallCalls(func(ctx context.Context, req *Request) {
+		req.Return(ctx, "ok")
+	})
+
+	opts := []HandleOption{WithoutManifest()}
+	client, _ := connectPair(t, &FakeHandler{}, &srv, opts, append(opts, WithAcceptHook(hook)))
+
+	ctx := context.Background()
+
+	var s string
+	r.NoError(client.Async(ctx, &s, TypeString, Method{"small"}, "args"))
+	r.Equal("ok", s)
+
+	err := client.Async(ctx, &s, TypeString, Method{"big"}, strings.Repeat("x", 100))
+	r.Error(err)
+	r.True(strings.Contains(err.Error(), "arguments too large"), "unexpected error: %v", err)
+
+	src, _, err := client.Duplex(ctx, TypeString, Method{"tunnel"})
+	r.NoError(err)
+	r.False(src.Next(ctx))
+	r.Error(src.Err())
+	r.True(strings.Contains(src.Err().Error(), "no duplex calls"), "unexpected error: %v", src.Err())
+
+	// rejected calls never reached the handler
+	r.Equal(1, srv.HandleCallCallCount())
+
+	mu.Lock()
+	defer mu.Unlock()
+	r.Len(seen, 3)
+	r.Equal("small", seen[0].Method.String())
+	r.Equal(CallType("async"), seen[0].Type)
+	r.Equal(len(`["args"]`), seen[0].ArgsSize)
+	r.NotNil(seen[0].Remote)
+	r.Equal(CallType("duplex"), seen[2].Type)
+}
+
+func TestCallInfoFromContext(t *testing.T) {
+	r := require.New(t)
+
+	infos := make(chan CallInfo, 1)
+	var srv FakeHandler
+	srv.HandledCalls(func(m Method) bool { return true })
+	srv.HandleCallCalls(func(ctx context.Context, req *Request) {
+		info, ok := CallInfoFromContext(ctx)
+		if !ok {
+			req.CloseWithError(errors.New("no call info"))
+			return
+		}
+		infos <- info
+		req.Return(ctx, "ok")
+	})
+
+	opts := []HandleOption{WithoutManifest()}
+	client, _ := connectPair(t, &FakeHandler{}, &srv, opts, opts)
+
+	ctx := context.Background()
+	_, ok := CallInfoFromContext(ctx)
+	r.False(ok)
+
+	var s string
+	r.NoError(client.Async(ctx, &s, TypeString, Method{"whoami"}, "args"))
+	r.Equal("ok", s)
+
+	info := <-infos
+	r.Equal("whoami", info.Method.String())
+	r.Equal(CallType("async"), info.Type)
+	r.Equal(int32(-1), info.ID)
+	r.Equal(TypeJSON, info.Encoding)
+	r.Equal(len(`["args"]`), info.ArgsSize)
+	r.NotNil(info.Remote)
+}
@@ -0,0 +1,11 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+//go:build !muxrpcdebug
+// +build !muxrpcdebug
+
+package muxrpc
+
+// strictAccounting makes sinks number their frames, see accounting_debug.go
+const strictAccounting = false
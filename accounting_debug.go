@@ -0,0 +1,14 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+//go:build muxrpcdebug
+// +build muxrpcdebug
+
+package muxrpc
+
+// strictAccounting makes sinks append a frame counter to every stream packet and flag it with codec.FlagSeq.
+// Receivers always check the counters of flagged packets and fail the stream with ErrFrameLoss if one is missing.
+// This catches dispatcher bugs that silently drop frames under load.
+// Only use it between Go peers, JS muxrpc doesn't know about the flag and would see the counters as part of the body.
+const strictAccounting = true
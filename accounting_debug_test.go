@@ -0,0 +1,51 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+//go:build muxrpcdebug
+// +build muxrpcdebug
+
+package muxrpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/ssbc/go-muxrpc/v2/codec"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSinkSequence(t *testing.T) {
+	r := require.New(t)
+
+	var buf bytes.Buffer
+	snk := NewTestSink(&buf)
+	snk.pkt.Flag = codec.FlagString | codec.FlagStream
+
+	// single writes and a batch are numbered alike
+	for _, b := range []string{"zero", "one", "two"} {
+		_, err := snk.Write([]byte(b))
+		r.NoError(err)
+	}
+	snk.Cork()
+	for _, b := range []string{"three", "four"} {
+		_, err := snk.Write([]byte(b))
+		r.NoError(err)
+	}
+	r.NoError(snk.Uncork())
+
+	rd := codec.NewReader(&buf)
+	var body bytes.Buffer
+	for i, want := range []string{"zero", "one", "two", "three", "four"} {
+		var hdr codec.Header
+		r.NoError(rd.ReadHeader(&hdr))
+		r.True(hdr.Flag.Get(codec.FlagSeq), "frame %d", i)
+
+		body.Reset()
+		r.NoError(rd.ReadBodyInto(&body, hdr.Len))
+		b := body.Bytes()
+		r.Equal(want, string(b[:len(b)-seqTrailerLen]))
+		r.EqualValues(i, binary.BigEndian.Uint32(b[len(b)-seqTrailerLen:]), "frame %d", i)
+	}
+}
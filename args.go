@@ -0,0 +1,104 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// ErrInvalidArgs matches calls that were refused because their arguments didn't parse (see WithArgParser).
+// errors.Is matches the CallError the remote receives against it.
+var ErrInvalidArgs error = codedError{msg: "muxrpc: invalid arguments", code: CodeInvalidArgs}
+
+// ArgParser turns the JSON encoded arguments of a call into the value its handler works with.
+// An error refuses the call before it reaches the handler.
+type ArgParser func(raw json.RawMessage) (interface{}, error)
+
+// ArgValidator is implemented by argument types that check themselves after they were decoded, see ArgsOf.
+type ArgValidator interface {
+	Validate() error
+}
+
+// WithArgParser parses the arguments of incoming calls to m with p before they reach the handler, which gets the result from Request.ParsedArgs.
+// Calls whose arguments fail to parse are ended with an error that matches ErrInvalidArgs.
+// Only calls to exactly m are parsed, not the ones to methods below it.
+func WithArgParser(m Method, p ArgParser) HandleOption {
+	return func(r *rpc) {
+		if r.argParsers == nil {
+			r.argParsers = make(map[string]ArgParser)
+		}
+		r.argParsers[m.String()] = p
+	}
+}
+
+// ArgsOf returns an ArgParser that decodes the first argument of a call into a new value of the type that v points to.
+// Request.ParsedArgs then returns a pointer of the same type as v. Calls without arguments get the zero value.
+// If the type implements ArgValidator, Validate is called on the decoded value.
+//
+//	muxrpc.WithArgParser(muxrpc.Method{"get"}, muxrpc.ArgsOf(&GetArgs{}))
+func ArgsOf(v interface{}) ArgParser {
+	t := reflect.TypeOf(v)
+	if t == nil || t.Kind() != reflect.Ptr {
+		panic(fmt.Sprintf("muxrpc: ArgsOf needs a pointer, got %T", v))
+	}
+	t = t.Elem()
+
+	return func(raw json.RawMessage) (interface{}, error) {
+		var args []json.RawMessage
+		if err := json.Unmarshal(raw, &args); err != nil {
+			return nil, err
+		}
+
+		val := reflect.New(t).Interface()
+		if len(args) > 0 {
+			if err := json.Unmarshal(args[0], val); err != nil {
+				return nil, err
+			}
+		}
+
+		if av, ok := val.(ArgValidator); ok {
+			if err := av.Validate(); err != nil {
+				return nil, err
+			}
+		}
+		return val, nil
+	}
+}
+
+// ParsedArgs returns the arguments of the call as parsed by the ArgParser of its method, or nil if it has none (see WithArgParser).
+func (req *Request) ParsedArgs() interface{} { return req.args }
+
+// invalidArgsError is sent when the ArgParser of a method refused the arguments of a call
+type invalidArgsError struct {
+	method Method
+	err    error
+}
+
+func (e invalidArgsError) Error() string {
+	return fmt.Sprintf("muxrpc: invalid arguments for %s: %s", e.method, e.err)
+}
+
+func (invalidArgsError) ErrorCode() int { return CodeInvalidArgs }
+
+func (invalidArgsError) Is(target error) bool { return target == ErrInvalidArgs }
+
+func (e invalidArgsError) Unwrap() error { return e.err }
+
+// parseArgs runs the ArgParser of the method of req, if it has one
+func (r *rpc) parseArgs(req *Request) error {
+	p, ok := r.argParsers[req.Method.String()]
+	if !ok {
+		return nil
+	}
+
+	args, err := p(req.RawArgs)
+	if err != nil {
+		return invalidArgsError{method: req.Method, err: err}
+	}
+	req.args = args
+	return nil
+}
@@ -0,0 +1,67 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type getArgs struct {
+	ID    string `json:"id"`
+	Limit int    `json:"limit"`
+}
+
+func (ga getArgs) Validate() error {
+	if ga.ID == "" {
+		return errors.New("id is required")
+	}
+	return nil
+}
+
+func TestArgParser(t *testing.T) {
+	r := require.New(t)
+
+	var srv FakeHandler
+	srv.HandledCalls(func(m Method) bool { return true })
+	srv.HandleCallCalls(func(ctx context.Context, req *Request) {
+		args, ok := req.ParsedArgs().(*getArgs)
+		if !ok {
+			req.CloseWithError(fmt.Errorf("unexpected args: %T", req.ParsedArgs()))
+			return
+		}
+		req.Return(ctx, fmt.Sprintf("%s/%d", args.ID, args.Limit))
+	})
+
+	opts := []HandleOption{WithoutManifest(), WithLogger(NopLogger())}
+	client, _ := connectPair(t, &FakeHandler{}, &srv, opts, append(opts, WithArgParser(Method{"get"}, ArgsOf(&getArgs{}))))
+
+	ctx := context.Background()
+
+	var s string
+	r.NoError(client.Async(ctx, &s, TypeString, Method{"get"}, map[string]interface{}{"id": "abc", "limit": 3}))
+	r.Equal("abc/3", s)
+
+	err := client.Async(ctx, &s, TypeString, Method{"get"}, map[string]interface{}{"limit": 3})
+	r.True(errors.Is(err, ErrInvalidArgs), "unexpected error: %v", err)
+	r.Contains(err.Error(), "id is required")
+
+	err = client.Async(ctx, &s, TypeString, Method{"get"}, "not an object")
+	r.True(errors.Is(err, ErrInvalidArgs), "unexpected error: %v", err)
+
+	err = client.Async(ctx, &s, TypeString, Method{"get"})
+	r.True(errors.Is(err, ErrInvalidArgs), "unexpected error: %v", err)
+
+	// other methods get no parsed arguments
+	err = client.Async(ctx, &s, TypeString, Method{"other"})
+	r.Error(err)
+	r.Contains(err.Error(), "unexpected args: <nil>")
+
+	r.Equal(2, srv.HandleCallCallCount())
+}
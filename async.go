@@ -0,0 +1,141 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// AsyncStarter is implemented by the endpoints of this package, also by their views (see Endpoint.WithOptions).
+//
+//	starter, ok := edp.(muxrpc.AsyncStarter)
+type AsyncStarter interface {
+	// AsyncStart sends an async call and returns without waiting for its answer, see Call.
+	AsyncStart(ctx context.Context, re RequestEncoding, method Method, args ...interface{}) (*Call, error)
+}
+
+var (
+	_ AsyncStarter = (*rpc)(nil)
+	_ AsyncStarter = (*endpointView)(nil)
+)
+
+// Call is an async call whose answer might not have arrived yet, see AsyncStart.
+// It lets a caller fan out many calls and gather their answers later, without a goroutine for each of them.
+type Call struct {
+	Method Method
+
+	req  *Request
+	re   RequestEncoding
+	done <-chan struct{}
+
+	once sync.Once
+	body []byte
+	err  error
+}
+
+// AsyncStart sends an async call to the remote and returns once it was sent.
+// ctx is the context of the call, but nothing watches it while the answer is pending:
+// select on Done and ctx to give up waiting, and use WithResponseTimeout or CallTimeout to bound how long calls may take.
+func (r *rpc) AsyncStart(ctx context.Context, re RequestEncoding, method Method, args ...interface{}) (*Call, error) {
+	_, req, err := r.startAsync(ctx, re, method, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Call{
+		Method: method,
+
+		req:  req,
+		re:   re,
+		done: req.source.whenSettled(),
+	}, nil
+}
+
+// AsyncStart is like the one of the session, a CallTimeout of the view fails the call with context.DeadlineExceeded.
+func (v *endpointView) AsyncStart(ctx context.Context, re RequestEncoding, method Method, args ...interface{}) (*Call, error) {
+	ctx, re = v.prepare(ctx, re, method)
+	c, err := v.root.AsyncStart(ctx, re, method, args...)
+	if err != nil {
+		return nil, err
+	}
+	if v.opts.timeout > 0 {
+		c.expire(v.root, v.opts.timeout)
+	}
+	return c, nil
+}
+
+// Done is closed once the answer arrived or the call failed.
+func (c *Call) Done() <-chan struct{} { return c.done }
+
+// Err returns nil while the call is pending. Afterwards it returns why the call failed, if it did.
+func (c *Call) Err() error {
+	select {
+	case <-c.done:
+	default:
+		return nil
+	}
+	c.once.Do(c.read)
+	return c.err
+}
+
+// Decode waits until the call is done and decodes its answer into v, with the body codec of the encoding the call was made with.
+// It can be called more then once.
+func (c *Call) Decode(v interface{}) error {
+	<-c.done
+	c.once.Do(c.read)
+	if c.err != nil {
+		return c.err
+	}
+
+	bodyCodec, _ := LookupBodyCodec(c.re) // checked when the call was started
+	if err := bodyCodec.Unmarshal(c.body, v); err != nil {
+		return fmt.Errorf("muxrpc(%s): error decoding body from request source: %w", c.Method, err)
+	}
+	return nil
+}
+
+// received is true if something of the answer arrived, even if the call failed afterwards
+func (c *Call) received() bool { return c.req.source.hasReceived() }
+
+// read takes the answer from the source, once the call is done
+func (c *Call) read() {
+	// neither blocks anymore, the source has a frame or ended
+	if !c.req.source.Next(context.Background()) {
+		err := c.req.source.Err()
+		if err == nil {
+			c.err = fmt.Errorf("muxrpc(%s): did not receive data for request", c.Method)
+		} else {
+			c.err = fmt.Errorf("muxrpc(%s): data source errored: %w", c.Method, err)
+		}
+		return
+	}
+
+	c.body, c.err = c.req.source.Bytes()
+	if c.err != nil {
+		c.err = fmt.Errorf("muxrpc(%s): async call failed: %w", c.Method, c.err)
+	}
+}
+
+// expire fails the call with context.DeadlineExceeded if it isn't done after d
+func (c *Call) expire(r *rpc, d time.Duration) {
+	r.clock.AfterFunc(d, func() {
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+
+		c.req.source.Cancel(context.DeadlineExceeded)
+		r.rLock.RLock()
+		active := r.reqs[c.req.id] == c.req
+		r.rLock.RUnlock()
+		if active {
+			r.closeStream(c.req, context.DeadlineExceeded)
+		}
+	})
+}
@@ -0,0 +1,98 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAsyncStart(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+
+	var h FakeHandler
+	h.HandledReturns(true)
+	h.HandleCallCalls(func(ctx context.Context, req *Request) {
+		switch req.Method.String() {
+		case "double":
+			var args []int
+			if err := json.Unmarshal(req.RawArgs, &args); err != nil {
+				req.CloseWithError(err)
+				return
+			}
+			// answer the later calls first
+			time.Sleep(time.Duration(20-args[0]) * time.Millisecond)
+			req.ReturnEncoded(ctx, TypeJSON, args[0]*2)
+		case "fail":
+			req.CloseWithError(fmt.Errorf("no luck"))
+		default: // silent
+			<-ctx.Done()
+		}
+	})
+
+	opts := []HandleOption{WithoutManifest(), WithLogger(NopLogger())}
+	client, _ := connectPair(t, &FakeHandler{}, &h, opts, opts)
+	starter, ok := client.(AsyncStarter)
+	r.True(ok, "endpoint can't start calls: %T", client)
+
+	start := time.Now()
+	calls := make([]*Call, 20)
+	for i := range calls {
+		c, err := starter.AsyncStart(ctx, TypeJSON, Method{"double"}, i)
+		r.NoError(err)
+		r.NoError(c.Err(), "pending calls have no error")
+		calls[i] = c
+	}
+	r.True(time.Since(start) < 20*time.Millisecond, "starting calls waited for answers")
+
+	for i, c := range calls {
+		select {
+		case <-c.Done():
+		case <-time.After(time.Second):
+			r.FailNow("no answer", "call %d", i)
+		}
+		r.NoError(c.Err())
+
+		var v int
+		r.NoError(c.Decode(&v))
+		r.Equal(i*2, v)
+		r.NoError(c.Decode(&v), "decoding twice")
+		r.Equal(i*2, v)
+	}
+
+	// the error of the remote
+	c, err := starter.AsyncStart(ctx, TypeJSON, Method{"fail"})
+	r.NoError(err)
+	var v int
+	err = c.Decode(&v)
+	r.Error(err)
+	r.Contains(err.Error(), "no luck")
+	r.Equal(err, c.Err())
+
+	// views time their calls out
+	view := client.WithOptions(CallTimeout(20 * time.Millisecond)).(AsyncStarter)
+	c, err = view.AsyncStart(ctx, TypeJSON, Method{"silent"})
+	r.NoError(err)
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		r.FailNow("call didn't time out")
+	}
+	r.True(errors.Is(c.Err(), context.DeadlineExceeded), "unexpected error: %v", c.Err())
+
+	// pending calls fail once the session ends
+	c, err = starter.AsyncStart(ctx, TypeJSON, Method{"silent"})
+	r.NoError(err)
+	r.NoError(client.Terminate())
+	<-c.Done()
+	r.True(errors.Is(c.Err(), ErrSessionTerminated), "unexpected error: %v", c.Err())
+}
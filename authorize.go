@@ -0,0 +1,69 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// ErrNotAuthorized matches calls that the Authorizer of the remote denied, errors.Is matches the CallError it sends against it.
+var ErrNotAuthorized error = codedError{msg: "muxrpc: not authorized", code: CodeNotAuthorized}
+
+// Authorizer decides if the remote may make a call, see WithAuthorizer.
+type Authorizer interface {
+	// Authorize returns an error if the call described by info must not reach the handler.
+	// args are the JSON encoded arguments of the call.
+	Authorize(ctx context.Context, info CallInfo, args json.RawMessage) error
+}
+
+// AuthorizerFunc is an Authorizer from a function.
+type AuthorizerFunc func(ctx context.Context, info CallInfo, args json.RawMessage) error
+
+// Authorize calls af.
+func (af AuthorizerFunc) Authorize(ctx context.Context, info CallInfo, args json.RawMessage) error {
+	return af(ctx, info, args)
+}
+
+// WithAuthorizer asks a before every incoming call is passed to HandleCall, with the identity of the remote in CallInfo.
+// Denied calls are ended with the error SSB peers send for methods that are not allowed, it says nothing about why.
+// Unlike the AcceptHook it runs on the goroutine of the call, so it may block, for instance to look up the remote in a database.
+// The calls muxrpc answers itself, like keepalive pings and hello, are not authorized.
+func WithAuthorizer(a Authorizer) HandleOption {
+	return func(r *rpc) {
+		r.authorizer = a
+	}
+}
+
+// notAuthorizedError is sent when the Authorizer denied a call
+type notAuthorizedError struct{ method Method }
+
+// Error has the message of secret-stack, so that JS peers understand it
+func (e notAuthorizedError) Error() string {
+	return fmt.Sprintf("method:%s is not in list of allowed methods", e.method)
+}
+
+func (notAuthorizedError) ErrorCode() int { return CodeNotAuthorized }
+
+func (notAuthorizedError) Is(target error) bool { return target == ErrNotAuthorized }
+
+// authorize is nil if the call may reach the handler
+func (r *rpc) authorize(ctx context.Context, req *Request) error {
+	if r.authorizer == nil {
+		return nil
+	}
+	switch req.Method.String() {
+	case pingMethod.String(), HelloMethod.String(), FlowMethod.String():
+		return nil
+	}
+
+	info, _ := CallInfoFromContext(ctx)
+	if err := r.authorizer.Authorize(ctx, info, req.RawArgs); err != nil {
+		logInfo(LoggerFromContext(ctx)).Log("event", "call not authorized", "err", err)
+		return notAuthorizedError{req.Method}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthorizer(t *testing.T) {
+	r := require.New(t)
+
+	auth := AuthorizerFunc(func(ctx context.Context, info CallInfo, args json.RawMessage) error {
+		if info.Method.String() != "public" {
+			return errors.New("only public methods")
+		}
+		return nil
+	})
+
+	var srv FakeHandler
+	srv.HandledCalls(func(m Method) bool { return true })
+	srv.HandleCallCalls(func(ctx context.Context, req *Request) {
+		req.Return(ctx, "ok")
+	})
+
+	opts := []HandleOption{WithoutManifest(), WithLogger(NopLogger())}
+	client, _ := connectPair(t, &FakeHandler{}, &srv, opts, append(opts, WithAuthorizer(auth)))
+
+	ctx := context.Background()
+
+	var s string
+	r.NoError(client.Async(ctx, &s, TypeString, Method{"public"}))
+	r.Equal("ok", s)
+
+	err := client.Async(ctx, &s, TypeString, Method{"private"})
+	r.True(errors.Is(err, ErrNotAuthorized), "unexpected error: %v", err)
+	r.False(IsNoSuchMethod(err))
+	r.True(strings.Contains(err.Error(), "method:private is not in list of allowed methods"), "unexpected error: %v", err)
+	r.False(strings.Contains(err.Error(), "only public methods"))
+
+	src, err := client.Source(ctx, TypeString, Method{"private", "feed"})
+	r.NoError(err)
+	r.False(src.Next(ctx))
+	r.True(errors.Is(src.Err(), ErrNotAuthorized), "unexpected error: %v", src.Err())
+
+	r.Equal(1, srv.HandleCallCallCount())
+}
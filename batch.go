@@ -0,0 +1,130 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"fmt"
+)
+
+// defaultBatchParallelism is how many calls of a batch are open at once, unless WithBatchParallelism says otherwise
+const defaultBatchParallelism = 8
+
+// CallSpec is one async call of a batch, see Batch.
+type CallSpec struct {
+	Method Method
+	Args   []interface{}
+
+	// Encoding is the encoding of the answer, like the one that is passed to Async. The zero value is TypeBinary.
+	Encoding RequestEncoding
+}
+
+// Result is the outcome of one call of a batch.
+type Result struct {
+	// Err is why the call failed, or why it wasn't made if the batch was stopped before.
+	Err error
+
+	call *Call
+}
+
+// Decode decodes the answer of the call into v, see Call.Decode.
+func (res Result) Decode(v interface{}) error {
+	if res.Err != nil {
+		return res.Err
+	}
+	return res.call.Decode(v)
+}
+
+// Batcher is implemented by the endpoints of this package, also by their views (see Endpoint.WithOptions).
+type Batcher interface {
+	// Batch makes the calls and waits for all of them, see WithBatchParallelism.
+	Batch(ctx context.Context, calls []CallSpec) ([]Result, error)
+}
+
+var (
+	_ Batcher = (*rpc)(nil)
+	_ Batcher = (*endpointView)(nil)
+)
+
+// WithBatchParallelism sets how many calls of a Batch are open at once. The next call is only made once the oldest open one is done.
+// The default is 8.
+func WithBatchParallelism(n int) HandleOption {
+	return func(r *rpc) {
+		r.batchParallel = n
+	}
+}
+
+// Batch makes many async calls over the connection, some of them at once (see WithBatchParallelism), and returns their results in the order of calls.
+// The error is nil if all calls succeeded, otherwise it wraps the first error of the results.
+// Once ctx is canceled no new calls are made, they fail with the error of ctx.
+func (r *rpc) Batch(ctx context.Context, calls []CallSpec) ([]Result, error) {
+	return batch(ctx, r, r.batchParallel, calls)
+}
+
+// Batch is like the one of the session, with the options of the view.
+func (v *endpointView) Batch(ctx context.Context, calls []CallSpec) ([]Result, error) {
+	return batch(ctx, v, v.root.batchParallel, calls)
+}
+
+// batch starts the calls through s, keeping up to n of them open without a goroutine per call
+func batch(ctx context.Context, s AsyncStarter, n int, calls []CallSpec) ([]Result, error) {
+	if n < 1 {
+		n = defaultBatchParallelism
+	}
+
+	var (
+		results = make([]Result, len(calls))
+		open    []int // indexes of the calls that were started, oldest first
+	)
+
+	wait := func(i int) {
+		select {
+		case <-results[i].call.Done():
+			results[i].Err = results[i].call.Err()
+		case <-ctx.Done():
+			results[i].Err = fmt.Errorf("muxrpc(%s): batch stopped: %w", calls[i].Method, ctx.Err())
+		}
+	}
+
+	for i, spec := range calls {
+		if len(open) == n {
+			wait(open[0])
+			open = open[1:]
+		}
+
+		if err := ctx.Err(); err != nil {
+			results[i].Err = fmt.Errorf("muxrpc(%s): batch stopped: %w", spec.Method, err)
+			continue
+		}
+
+		c, err := s.AsyncStart(ctx, spec.Encoding, spec.Method, spec.Args...)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		results[i].call = c
+		open = append(open, i)
+	}
+	for _, i := range open {
+		wait(i)
+	}
+
+	var (
+		failed int
+		first  error
+	)
+	for _, res := range results {
+		if res.Err != nil {
+			if first == nil {
+				first = res.Err
+			}
+			failed++
+		}
+	}
+	if failed > 0 {
+		return results, fmt.Errorf("muxrpc: %d of %d calls of the batch failed: %w", failed, len(calls), first)
+	}
+	return results, nil
+}
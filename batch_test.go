@@ -0,0 +1,88 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatch(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+
+	var running, most int32
+	var h FakeHandler
+	h.HandledReturns(true)
+	h.HandleCallCalls(func(ctx context.Context, req *Request) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&most)
+			if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+
+		var args []int
+		if err := json.Unmarshal(req.RawArgs, &args); err != nil {
+			req.CloseWithError(err)
+			return
+		}
+		if args[0] == 7 {
+			req.CloseWithError(fmt.Errorf("unlucky"))
+			return
+		}
+		req.ReturnEncoded(ctx, TypeJSON, args[0]*2)
+	})
+
+	opts := []HandleOption{WithoutManifest(), WithLogger(NopLogger())}
+	client, _ := connectPair(t, &FakeHandler{}, &h, append(opts, WithBatchParallelism(3)), opts)
+	batcher, ok := client.(Batcher)
+	r.True(ok, "endpoint can't batch: %T", client)
+
+	calls := make([]CallSpec, 12)
+	for i := range calls {
+		calls[i] = CallSpec{Method: Method{"double"}, Args: []interface{}{i}, Encoding: TypeJSON}
+	}
+
+	results, err := batcher.Batch(ctx, calls)
+	r.Error(err)
+	r.Contains(err.Error(), "1 of 12 calls")
+	r.Contains(err.Error(), "unlucky")
+	r.Len(results, len(calls))
+	r.EqualValues(3, atomic.LoadInt32(&most), "wrong number of calls at once")
+
+	for i, res := range results {
+		var v int
+		if i == 7 {
+			r.Error(res.Err)
+			r.Equal(res.Err, res.Decode(&v))
+			continue
+		}
+		r.NoError(res.Err, "call %d", i)
+		r.NoError(res.Decode(&v))
+		r.Equal(i*2, v)
+	}
+
+	// nothing is called once the batch was canceled
+	before := h.HandleCallCallCount()
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	results, err = batcher.Batch(cctx, calls[:3])
+	r.True(errors.Is(err, context.Canceled), "unexpected error: %v", err)
+	for _, res := range results {
+		r.True(errors.Is(res.Err, context.Canceled))
+	}
+	r.Equal(before, h.HandleCallCallCount())
+}
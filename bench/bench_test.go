@@ -0,0 +1,227 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package bench
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/ssbc/go-muxrpc/v2"
+	"github.com/ssbc/go-muxrpc/v2/typemux"
+)
+
+var (
+	blobMethod = muxrpc.Method{"bench", "blob"}
+	echoMethod = muxrpc.Method{"bench", "echo"}
+	pingMethod = muxrpc.Method{"bench", "ping"}
+)
+
+// blobArgs asks the blob source for count frames of size bytes
+type blobArgs struct {
+	Size  int `json:"size"`
+	Count int `json:"count"`
+}
+
+// newServer returns the handler the benchmarks call: an async ping, a source of frames and a duplex echo
+func newServer() muxrpc.Handler {
+	mux := typemux.New(muxrpc.NopLogger())
+	mux.RegisterAsync(pingMethod, typemux.AsyncFunc(func(ctx context.Context, req *muxrpc.Request) (interface{}, error) {
+		return "pong", nil
+	}))
+	mux.RegisterSource(blobMethod, typemux.SourceFunc(func(ctx context.Context, req *muxrpc.Request, snk *muxrpc.ByteSink) error {
+		var args []blobArgs
+		if err := json.Unmarshal(req.RawArgs, &args); err != nil || len(args) != 1 {
+			return fmt.Errorf("bench: invalid blob arguments")
+		}
+		snk.SetEncoding(muxrpc.TypeBinary)
+		frame := bytes.Repeat([]byte{'x'}, args[0].Size)
+		for i := 0; i < args[0].Count; i++ {
+			if _, err := snk.Write(frame); err != nil {
+				return err
+			}
+		}
+		return snk.Close()
+	}))
+	mux.RegisterDuplex(echoMethod, typemux.DuplexFunc(func(ctx context.Context, req *muxrpc.Request, src *muxrpc.ByteSource, snk *muxrpc.ByteSink) error {
+		snk.SetEncoding(muxrpc.TypeBinary)
+		for src.Next(ctx) {
+			b, err := src.Bytes()
+			if err != nil {
+				return err
+			}
+			if _, err := snk.Write(b); err != nil {
+				return err
+			}
+		}
+		if err := src.Err(); err != nil {
+			return err
+		}
+		return snk.Close()
+	}))
+	return &mux
+}
+
+// connect starts a session with the benchmark server and ends it once b is done
+func connect(b *testing.B) muxrpc.Endpoint {
+	quiet := []muxrpc.HandleOption{muxrpc.WithoutManifest(), muxrpc.WithLogger(muxrpc.NopLogger())}
+	client, server := muxrpc.NewPipe(&muxrpc.FakeHandler{}, newServer(), muxrpc.WithPipeHandleOptions(quiet, quiet))
+	b.Cleanup(func() {
+		client.Terminate()
+		server.Terminate()
+	})
+	return client
+}
+
+// drain reads the frames of src until it ends and returns how many bytes they had
+func drain(ctx context.Context, src *muxrpc.ByteSource) (int, error) {
+	var n int
+	for src.Next(ctx) {
+		b, err := src.Bytes()
+		if err != nil {
+			return n, err
+		}
+		n += len(b)
+	}
+	return n, src.Err()
+}
+
+func BenchmarkAsyncBurst(b *testing.B) {
+	for _, burst := range []int{1, 16, 256} {
+		b.Run(fmt.Sprint(burst), func(b *testing.B) {
+			client := connect(b)
+			ctx := context.Background()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var wg sync.WaitGroup
+				errc := make(chan error, burst)
+				for j := 0; j < burst; j++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						var pong string
+						errc <- client.Async(ctx, &pong, muxrpc.TypeString, pingMethod)
+					}()
+				}
+				wg.Wait()
+				close(errc)
+				for err := range errc {
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			b.ReportMetric(float64(burst), "calls/op")
+		})
+	}
+}
+
+func BenchmarkLargeSource(b *testing.B) {
+	for _, size := range []int{512, 16 * 1024, 64 * 1024} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			client := connect(b)
+			ctx := context.Background()
+			args := blobArgs{Size: size, Count: 64}
+
+			b.ReportAllocs()
+			b.SetBytes(int64(args.Size * args.Count))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				src, err := client.Source(ctx, muxrpc.TypeBinary, blobMethod, args)
+				if err != nil {
+					b.Fatal(err)
+				}
+				n, err := drain(ctx, src)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if n != args.Size*args.Count {
+					b.Fatalf("got %d bytes", n)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDuplexEcho(b *testing.B) {
+	for _, size := range []int{16, 4096} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			client := connect(b)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			src, snk, err := client.Duplex(ctx, muxrpc.TypeBinary, echoMethod)
+			if err != nil {
+				b.Fatal(err)
+			}
+			frame := bytes.Repeat([]byte{'x'}, size)
+
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := snk.Write(frame); err != nil {
+					b.Fatal(err)
+				}
+				if !src.Next(ctx) {
+					b.Fatal("echo ended:", src.Err())
+				}
+				if _, err := src.Bytes(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+
+			snk.Close()
+			if _, err := drain(ctx, src); err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+func BenchmarkConcurrentStreams(b *testing.B) {
+	for _, streams := range []int{8, 64, 512} {
+		b.Run(fmt.Sprint(streams), func(b *testing.B) {
+			client := connect(b)
+			ctx := context.Background()
+			args := blobArgs{Size: 1024, Count: 16}
+
+			b.ReportAllocs()
+			b.SetBytes(int64(streams * args.Size * args.Count))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var wg sync.WaitGroup
+				errc := make(chan error, streams)
+				for j := 0; j < streams; j++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						src, err := client.Source(ctx, muxrpc.TypeBinary, blobMethod, args)
+						if err != nil {
+							errc <- err
+							return
+						}
+						if n, err := drain(ctx, src); err != nil {
+							errc <- err
+						} else if n != args.Size*args.Count {
+							errc <- fmt.Errorf("got %d bytes", n)
+						}
+					}()
+				}
+				wg.Wait()
+				close(errc)
+				for err := range errc {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
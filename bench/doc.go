@@ -0,0 +1,11 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+// Package bench has end-to-end benchmarks of muxrpc sessions, as a baseline for performance work on the buffers and the write path.
+// The sessions run over an in-memory pipe (see muxrpc.NewPipe), so the numbers don't depend on the network stack.
+//
+//	go test -run '^$' -bench . -benchmem ./bench
+//
+// Compare runs before and after a change with benchstat.
+package bench
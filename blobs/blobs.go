@@ -0,0 +1,131 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+// Package blobs has helpers for the blobs calls of SSB, which move files of up to MaxSize bytes as binary streams.
+// Blobs are addressed by the SHA256 hash of their content, in the form &<base64 hash>.sha256.
+//
+//	ref, err := blobs.AddBlob(ctx, edp, file)
+//	...
+//	n, err := blobs.FetchBlob(ctx, edp, ref, out)
+package blobs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ssbc/go-muxrpc/v2"
+)
+
+// MaxSize is the largest blob SSB peers exchange, 5MiB.
+const MaxSize = 5 * 1024 * 1024
+
+var (
+	// GetMethod is the source call that sends the content of a blob.
+	GetMethod = muxrpc.Method{"blobs", "get"}
+
+	// AddMethod is the sink call that takes the content of a new blob.
+	AddMethod = muxrpc.Method{"blobs", "add"}
+)
+
+// Ref returns the reference of the blob with the passed SHA256 hash.
+func Ref(hash []byte) string {
+	return "&" + base64.StdEncoding.EncodeToString(hash) + ".sha256"
+}
+
+// ParseRef returns the SHA256 hash of the referenced blob.
+func ParseRef(ref string) ([]byte, error) {
+	if !strings.HasPrefix(ref, "&") || !strings.HasSuffix(ref, ".sha256") {
+		return nil, fmt.Errorf("blobs: %q is not a blob reference", ref)
+	}
+
+	hash, err := base64.StdEncoding.DecodeString(strings.TrimSuffix(ref[1:], ".sha256"))
+	if err != nil {
+		return nil, fmt.Errorf("blobs: invalid hash in %q: %w", ref, err)
+	}
+	if len(hash) != sha256.Size {
+		return nil, fmt.Errorf("blobs: hash in %q has %d bytes instead of %d", ref, len(hash), sha256.Size)
+	}
+	return hash, nil
+}
+
+// getArgs are the arguments of blobs.get that limit how much the remote sends
+type getArgs struct {
+	Key string `json:"key"`
+	Max int64  `json:"max"`
+}
+
+// FetchBlob gets the blob ref from edp and copies its content to w. It returns how many bytes were copied.
+// The content is checked against the hash of ref and MaxSize while it is copied,
+// but w already got what arrived before a check failed, so it has to be discarded if an error is returned.
+func FetchBlob(ctx context.Context, edp muxrpc.Endpoint, ref string, w io.Writer) (int64, error) {
+	want, err := ParseRef(ref)
+	if err != nil {
+		return 0, err
+	}
+
+	src, err := edp.Source(ctx, muxrpc.TypeBinary, GetMethod, getArgs{Key: ref, Max: MaxSize})
+	if err != nil {
+		return 0, fmt.Errorf("blobs: failed to get %s: %w", ref, err)
+	}
+
+	h := sha256.New()
+	lw := &limitedWriter{w: io.MultiWriter(w, h), left: MaxSize}
+	n, err := src.WriteTo(lw)
+	if err != nil {
+		src.Cancel(err)
+		return n, fmt.Errorf("blobs: failed to get %s: %w", ref, err)
+	}
+
+	if got := h.Sum(nil); !bytes.Equal(got, want) {
+		return n, fmt.Errorf("blobs: got %s instead of %s", Ref(got), ref)
+	}
+	return n, nil
+}
+
+// limitedWriter fails once more than left bytes are written
+type limitedWriter struct {
+	w    io.Writer
+	left int64
+}
+
+func (lw *limitedWriter) Write(b []byte) (int, error) {
+	if int64(len(b)) > lw.left {
+		return 0, fmt.Errorf("blobs: blob is larger than %d bytes", MaxSize)
+	}
+	n, err := lw.w.Write(b)
+	lw.left -= int64(n)
+	return n, err
+}
+
+// AddBlob sends the content of r to edp as a new blob and returns its reference.
+// Content larger than MaxSize is refused before it is sent completely.
+func AddBlob(ctx context.Context, edp muxrpc.Endpoint, r io.Reader) (string, error) {
+	snk, err := edp.Sink(ctx, muxrpc.TypeBinary, AddMethod)
+	if err != nil {
+		return "", fmt.Errorf("blobs: failed to add blob: %w", err)
+	}
+	snk.SetEncoding(muxrpc.TypeBinary)
+
+	h := sha256.New()
+	lr := &io.LimitedReader{R: io.TeeReader(r, h), N: MaxSize + 1}
+	if _, err := snk.ReadFrom(lr); err != nil {
+		snk.CloseWithError(err)
+		return "", fmt.Errorf("blobs: failed to add blob: %w", err)
+	}
+	if lr.N == 0 {
+		err := fmt.Errorf("blobs: blob is larger than %d bytes", MaxSize)
+		snk.CloseWithError(err)
+		return "", err
+	}
+
+	if err := snk.Close(); err != nil {
+		return "", fmt.Errorf("blobs: failed to add blob: %w", err)
+	}
+	return Ref(h.Sum(nil)), nil
+}
@@ -0,0 +1,131 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package blobs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ssbc/go-muxrpc/v2"
+)
+
+// store is a blobs server that keeps everything in memory
+type store struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+func (s *store) Handled(m muxrpc.Method) bool {
+	return m.String() == GetMethod.String() || m.String() == AddMethod.String()
+}
+
+func (s *store) HandleConnect(context.Context, muxrpc.Endpoint) {}
+
+func (s *store) HandleCall(ctx context.Context, req *muxrpc.Request) {
+	switch req.Method.String() {
+	case GetMethod.String():
+		var args []getArgs
+		if err := json.Unmarshal(req.RawArgs, &args); err != nil || len(args) != 1 {
+			req.CloseWithError(errors.New("invalid arguments"))
+			return
+		}
+		s.mu.Lock()
+		b, ok := s.blobs[args[0].Key]
+		s.mu.Unlock()
+		if !ok {
+			req.CloseWithError(errors.New("no such blob"))
+			return
+		}
+
+		snk, _ := req.ResponseSink()
+		snk.SetEncoding(muxrpc.TypeBinary)
+		for len(b) > 0 {
+			n := 1000
+			if n > len(b) {
+				n = len(b)
+			}
+			snk.Write(b[:n])
+			b = b[n:]
+		}
+		snk.Close()
+
+	case AddMethod.String():
+		src, _ := req.ResponseSource()
+		var buf bytes.Buffer
+		if _, err := src.WriteTo(&buf); err != nil {
+			return
+		}
+		h := sha256.Sum256(buf.Bytes())
+		s.mu.Lock()
+		s.blobs[Ref(h[:])] = buf.Bytes()
+		s.mu.Unlock()
+		req.Close()
+	}
+}
+
+func TestBlobs(t *testing.T) {
+	r := require.New(t)
+
+	srv := &store{blobs: make(map[string][]byte)}
+	opts := []muxrpc.HandleOption{muxrpc.WithoutManifest(), muxrpc.WithLogger(muxrpc.NopLogger())}
+	client, _ := muxrpc.NewPipe(&muxrpc.FakeHandler{}, srv, muxrpc.WithPipeHandleOptions(opts, opts))
+	defer client.Terminate()
+
+	ctx := context.Background()
+	content := bytes.Repeat([]byte("blob"), 5000)
+
+	ref, err := AddBlob(ctx, client, bytes.NewReader(content))
+	r.NoError(err)
+	hash := sha256.Sum256(content)
+	r.Equal(Ref(hash[:]), ref)
+
+	// the sink call ends asynchronously
+	r.Eventually(func() bool {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		_, ok := srv.blobs[ref]
+		return ok
+	}, time.Second, 10*time.Millisecond)
+
+	var out bytes.Buffer
+	n, err := FetchBlob(ctx, client, ref, &out)
+	r.NoError(err)
+	r.EqualValues(len(content), n)
+	r.Equal(content, out.Bytes())
+
+	// content that doesn't match the hash is an error
+	srv.mu.Lock()
+	srv.blobs[ref] = []byte("something else")
+	srv.mu.Unlock()
+	out.Reset()
+	_, err = FetchBlob(ctx, client, ref, &out)
+	r.Error(err)
+	r.Contains(err.Error(), "instead of "+ref)
+
+	_, err = FetchBlob(ctx, client, "&nope.sha256", &out)
+	r.Error(err)
+}
+
+func TestParseRef(t *testing.T) {
+	r := require.New(t)
+
+	hash := sha256.Sum256([]byte("hello"))
+	got, err := ParseRef(Ref(hash[:]))
+	r.NoError(err)
+	r.Equal(hash[:], got)
+
+	for _, bad := range []string{"", "%abc.sha256", "&abc", "&!!!.sha256", "&" + "AAAA" + ".sha256"} {
+		_, err := ParseRef(bad)
+		r.Error(err, bad)
+	}
+}
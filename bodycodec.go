@@ -0,0 +1,108 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/ssbc/go-muxrpc/v2/codec"
+)
+
+// BodyCodec converts between values and packet bodies for one RequestEncoding.
+type BodyCodec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+
+	// Flag returns the type bits that mark bodies of this codec on the wire
+	Flag() codec.Flag
+}
+
+var bodyCodecs = struct {
+	sync.RWMutex
+	m map[RequestEncoding]BodyCodec
+}{
+	m: map[RequestEncoding]BodyCodec{
+		TypeBinary: binaryCodec{},
+		TypeString: stringCodec{},
+		TypeJSON:   jsonCodec{},
+	},
+}
+
+// RegisterBodyCodec makes c available for calls and streams that use re.
+// This way applications can use msgpack, protobuf or their own formats.
+// The wire format only knows binary, string and JSON so a custom codec has to use one of their flags, usually the binary one (zero).
+// Registering a codec for one of the built-in encodings replaces it.
+func RegisterBodyCodec(re RequestEncoding, c BodyCodec) {
+	bodyCodecs.Lock()
+	defer bodyCodecs.Unlock()
+	bodyCodecs.m[re] = c
+}
+
+// LookupBodyCodec returns the codec that was registered for re.
+func LookupBodyCodec(re RequestEncoding) (BodyCodec, bool) {
+	bodyCodecs.RLock()
+	defer bodyCodecs.RUnlock()
+	c, ok := bodyCodecs.m[re]
+	return c, ok
+}
+
+type binaryCodec struct{}
+
+func (binaryCodec) Flag() codec.Flag { return 0 }
+
+func (binaryCodec) Marshal(v interface{}) ([]byte, error) {
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("muxrpc: binary body needs []byte, got %T", v)
+	}
+	return b, nil
+}
+
+func (binaryCodec) Unmarshal(data []byte, v interface{}) error {
+	tv, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("unexpected requst encoding, need TypeBinary for %T", v)
+	}
+	*tv = append([]byte(nil), data...)
+	return nil
+}
+
+type stringCodec struct{}
+
+func (stringCodec) Flag() codec.Flag { return codec.FlagString }
+
+func (stringCodec) Marshal(v interface{}) ([]byte, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("muxrpc: string body needs string, got %T", v)
+	}
+	return []byte(s), nil
+}
+
+func (stringCodec) Unmarshal(data []byte, v interface{}) error {
+	tv, ok := v.(*string)
+	if !ok {
+		return fmt.Errorf("unexpected requst encoding, need TypeString for %T", v)
+	}
+	*tv = string(data)
+	return nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Flag() codec.Flag { return codec.FlagJSON }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	switch v.(type) {
+	case *[]byte, *string:
+		// these are most likely meant as raw bodies
+		return fmt.Errorf("unexpected requst encoding, need TypeJSON got %T", v)
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,74 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ssbc/go-muxrpc/v2/codec"
+)
+
+// csvCodec is a toy codec for lists of words
+type csvCodec struct{}
+
+func (csvCodec) Flag() codec.Flag { return 0 }
+
+func (csvCodec) Marshal(v interface{}) ([]byte, error) {
+	words, ok := v.([]string)
+	if !ok {
+		return nil, fmt.Errorf("csv: need []string, got %T", v)
+	}
+	return []byte(strings.Join(words, ",")), nil
+}
+
+func (csvCodec) Unmarshal(data []byte, v interface{}) error {
+	words, ok := v.(*[]string)
+	if !ok {
+		return fmt.Errorf("csv: need *[]string, got %T", v)
+	}
+	*words = strings.Split(string(data), ",")
+	return nil
+}
+
+const typeCSV RequestEncoding = 100
+
+func TestBodyCodecRegistry(t *testing.T) {
+	r := require.New(t)
+
+	r.False(typeCSV.IsValid())
+	RegisterBodyCodec(typeCSV, csvCodec{})
+	r.True(typeCSV.IsValid())
+
+	var fh FakeHandler
+	fh.HandledReturns(true)
+	fh.HandleCallStub = func(ctx context.Context, req *Request) {
+		if req.Method.String() != "words" {
+			req.CloseWithError(ErrNoSuchMethod{req.Method})
+			return
+		}
+
+		err := req.ReturnEncoded(ctx, typeCSV, []string{"muxrpc", "speaks", "csv"})
+		if err != nil {
+			req.CloseWithError(err)
+		}
+	}
+
+	client, _ := connectPair(t, &FakeHandler{}, &fh, nil, nil)
+
+	var words []string
+	err := client.Async(context.Background(), &words, typeCSV, Method{"words"})
+	r.NoError(err)
+	r.Equal([]string{"muxrpc", "speaks", "csv"}, words)
+
+	// the built-in ones still check the type of the result
+	var s string
+	err = client.Async(context.Background(), &s, TypeJSON, Method{"words"})
+	r.Error(err)
+}
@@ -371,8 +371,10 @@ func TestBothwaysSource(t *testing.T) {
 	ctx := context.Background()
 
 	var rpc2 Endpoint
+	rpc2started := make(chan struct{})
 	go func() {
 		rpc2 = Handle(NewPacker(c2), &fh2)
+		close(rpc2started)
 		serve(ctx, rpc2.(Server), errc, serve2)
 	}()
 
@@ -433,6 +435,7 @@ func TestBothwaysSource(t *testing.T) {
 	}()
 
 	go func() {
+		<-rpc2started
 		src, err := rpc2.Source(ctx, TypeString, Method{"whoami"})
 		ckFatal(err)
 
@@ -0,0 +1,106 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrMemoryBudgetExceeded is returned for streams that would exceed the memory budget of their connection (see WithMemoryBudget).
+var ErrMemoryBudgetExceeded = errors.New("muxrpc: memory budget exceeded")
+
+// BudgetPolicy decides what happens when the memory budget of a connection is exhausted.
+type BudgetPolicy uint
+
+const (
+	// BudgetFailStream closes the stream that received too much data with ErrMemoryBudgetExceeded.
+	BudgetFailStream BudgetPolicy = iota
+
+	// BudgetBlock stops reading from the connection until consumers drained enough of their streams.
+	BudgetBlock
+)
+
+// WithMemoryBudget limits the number of bytes that all incoming streams of a connection can buffer together.
+// Without it, a peer that floods a slow consumer can make the process run out of memory.
+func WithMemoryBudget(limit int, policy BudgetPolicy) HandleOption {
+	return func(r *rpc) {
+		r.budget = &memoryBudget{
+			limit: int64(limit),
+			block: policy == BudgetBlock,
+			freed: make(chan struct{}),
+		}
+	}
+}
+
+// memoryBudget is shared by all the frameBuffers of a connection
+type memoryBudget struct {
+	limit int64
+	block bool
+
+	mu   sync.Mutex
+	used int64
+
+	// freed is closed and replaced whenever bytes are released
+	freed chan struct{}
+}
+
+// reserve tries to account for n more bytes.
+// If that would exceed the limit, it returns false and a channel that is closed once bytes are released.
+func (mb *memoryBudget) reserve(n int64) (bool, <-chan struct{}) {
+	if mb == nil {
+		return true, nil
+	}
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	// always let a single stream make progress, even if the frame is larger then the whole budget
+	if mb.used > 0 && mb.used+n > mb.limit {
+		return false, mb.freed
+	}
+	mb.used += n
+	return true, nil
+}
+
+func (mb *memoryBudget) release(n int64) {
+	if mb == nil || n == 0 {
+		return
+	}
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	mb.used -= n
+	close(mb.freed)
+	mb.freed = make(chan struct{})
+}
+
+// headroom returns how many bytes can be reserved right away, -1 means that any amount can.
+// Budgets that block always report -1, since they wait for room instead of failing.
+func (mb *memoryBudget) headroom() int64 {
+	if mb == nil || mb.block {
+		return -1
+	}
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	// like reserve, a single stream can make progress on its own
+	if mb.used == 0 {
+		return -1
+	}
+	if mb.used >= mb.limit {
+		return 0
+	}
+	return mb.limit - mb.used
+}
+
+// Used returns the number of currently accounted bytes
+func (mb *memoryBudget) Used() int64 {
+	if mb == nil {
+		return 0
+	}
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return mb.used
+}
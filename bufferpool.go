@@ -0,0 +1,19 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import "github.com/ssbc/go-muxrpc/v2/codec"
+
+// defaultBufferPool is shared by all sessions that weren't given a pool with WithBufferPool.
+// Its sync.Pools don't have a lock that the connections would contend for.
+var defaultBufferPool = codec.NewTieredPool()
+
+// WithBufferPool sets the pool that the incoming frames of the session are buffered in.
+// By default all sessions share a pool with size tiers, see codec.NewTieredPool.
+func WithBufferPool(p codec.BufferPool) HandleOption {
+	return func(r *rpc) {
+		r.bpool = p
+	}
+}
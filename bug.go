@@ -0,0 +1,37 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrBug matches the errors of states that a correct program can't get into, like writing to a sink of a call that was never started.
+// Streams fail with them instead of taking down the program, unless the endpoint was started WithPanicOnBug.
+var ErrBug = errors.New("muxrpc: bug")
+
+// WithPanicOnBug makes streams panic when they get into a state that is a bug, instead of failing with an error that matches ErrBug.
+// The stack trace of the panic points at the culprit, which helps during development.
+func WithPanicOnBug(yes bool) HandleOption {
+	return func(r *rpc) {
+		r.panicOnBug = yes
+	}
+}
+
+type bugError struct{ msg string }
+
+func (e bugError) Error() string { return "muxrpc: bug: " + e.msg }
+
+func (bugError) Is(target error) bool { return target == ErrBug }
+
+// newBug returns the error for a state that should not be reachable, or panics with it if panicOnBug is set.
+func newBug(panicOnBug bool, format string, args ...interface{}) error {
+	err := bugError{msg: fmt.Sprintf(format, args...)}
+	if panicOnBug {
+		panic(err)
+	}
+	return err
+}
@@ -0,0 +1,102 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// the server answers outer calls by calling back into the client, concurrently
+func TestCallWithinCall(t *testing.T) {
+	r := require.New(t)
+
+	var cliH FakeHandler
+	cliH.HandledCalls(methodChecker("inner"))
+	cliH.HandleCallCalls(func(ctx context.Context, req *Request) {
+		var args []int
+		if err := json.Unmarshal(req.RawArgs, &args); err != nil {
+			req.CloseWithError(err)
+			return
+		}
+		req.Return(ctx, fmt.Sprintf("inner%d", args[0]))
+	})
+
+	connected := make(chan Endpoint, 1)
+	var srvH FakeHandler
+	srvH.HandledCalls(methodChecker("outer"))
+	srvH.HandleConnectCalls(func(ctx context.Context, edp Endpoint) {
+		fromCtx, ok := EndpointFromContext(ctx)
+		if !ok || fromCtx != edp {
+			connected <- nil
+			return
+		}
+		connected <- edp
+	})
+	srvH.HandleCallCalls(func(ctx context.Context, req *Request) {
+		edp, ok := EndpointFromContext(ctx)
+		if !ok {
+			req.CloseWithError(fmt.Errorf("no endpoint on context"))
+			return
+		}
+
+		const n = 10
+		var (
+			wg      sync.WaitGroup
+			mu      sync.Mutex
+			results = make(map[string]bool)
+			errs    []error
+		)
+		wg.Add(n)
+		for i := 0; i < n; i++ {
+			go func(i int) {
+				defer wg.Done()
+				var v string
+				err := edp.Async(ctx, &v, TypeString, Method{"inner"}, i)
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					errs = append(errs, err)
+					return
+				}
+				results[v] = true
+			}(i)
+		}
+		wg.Wait()
+
+		if len(errs) > 0 {
+			req.CloseWithError(errs[0])
+			return
+		}
+		req.Return(ctx, len(results))
+	})
+
+	client, _ := connectPair(t, &cliH, &srvH, nil, nil)
+
+	r.NotNil(<-connected, "expected endpoint on connect context")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var cnt int
+			err := client.Async(context.TODO(), &cnt, TypeJSON, Method{"outer"})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if cnt != 10 {
+				t.Errorf("expected 10 distinct results, got %d", cnt)
+			}
+		}()
+	}
+	wg.Wait()
+}
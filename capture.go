@@ -0,0 +1,185 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ssbc/go-muxrpc/v2/codec"
+)
+
+// WithCapture records the raw packet stream of the connection to cw, see codec.CaptureWriter.
+// The recording can be fed back into an endpoint with Replay.
+func WithCapture(cw *codec.CaptureWriter) HandleOption {
+	return func(r *rpc) {
+		r.capture = cw
+	}
+}
+
+func tapCapture(pkr *Packer, cw *codec.CaptureWriter) {
+	pkr.rl.Lock()
+	pkr.r.Tap(cw.Dir(codec.DirIn))
+	pkr.rl.Unlock()
+
+	pkr.w.Tap(cw.Dir(codec.DirOut))
+}
+
+// ReplayResult holds the packets a recorded endpoint sent and the ones the replayed endpoint sent in their place.
+// A goodbye packet is a Packet with all fields empty.
+type ReplayResult struct {
+	Recorded []codec.Packet
+	Replayed []codec.Packet
+}
+
+// ReplayWait is how long Replay waits for the replayed endpoint to send as many packets as the recorded one did before it moves on.
+var ReplayWait = time.Second
+
+// Replay feeds the incoming data of a capture into a new endpoint with handler h and collects what the endpoint sends.
+// The timestamps of the capture are ignored. Instead the incoming data is held back until the endpoint has sent
+// as many packets as the recorded one had at that point (or ReplayWait passed), so that the order of a session is kept
+// and a replay doesn't depend on timing.
+// Packets that the recorded endpoint only sent while shutting down, like the errors of calls it aborted, are sent by
+// the replayed one when Replay terminates it, after waiting ReplayWait for them in vain.
+// The endpoint should be configured like the recorded one, since an endpoint that asks for the manifest sends a packet
+// that one without doesn't.
+func Replay(ctx context.Context, capture io.Reader, h Handler, opts ...HandleOption) (*ReplayResult, error) {
+	cr, err := codec.NewCaptureReader(capture)
+	if err != nil {
+		return nil, err
+	}
+
+	// incoming chunks and how many packets were sent before each
+	type step struct {
+		data   []byte
+		before int
+	}
+	var (
+		steps []step
+		res   ReplayResult
+	)
+	recorded := &packetSplitter{limit: -1, packet: func(hdr codec.Header, body []byte) {
+		res.Recorded = append(res.Recorded, replayPacket(hdr, body))
+	}}
+	for {
+		rec, err := cr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, err
+		}
+		if rec.Dir == codec.DirOut {
+			recorded.Write(rec.Data)
+			continue
+		}
+		steps = append(steps, step{data: rec.Data, before: len(res.Recorded)})
+	}
+
+	conn := newReplayConn()
+	fed := make(chan struct{})
+	go func() {
+		// Handle only returns once the manifest was exchanged, so the input is fed from here
+		defer close(fed)
+		for _, s := range steps {
+			conn.waitSent(ctx, s.before)
+			if _, err := conn.in.Write(s.data); err != nil {
+				// the endpoint hung up early, which the comparison will show
+				return
+			}
+		}
+		// the goodbye is sent by Terminate below
+		want := len(res.Recorded)
+		if want > 0 && res.Recorded[want-1].Flag == 0 && res.Recorded[want-1].Req == 0 && res.Recorded[want-1].Body == nil {
+			want--
+		}
+		conn.waitSent(ctx, want)
+	}()
+
+	edp := Handle(NewPacker(conn), h, append([]HandleOption{WithContext(ctx)}, opts...)...)
+	<-fed
+
+	conn.in.Close()
+	edp.Terminate()
+	if err := edp.(Server).Serve(); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("muxrpc: replayed endpoint failed: %w", err)
+	}
+
+	res.Replayed = conn.sentPackets()
+	return &res, nil
+}
+
+func replayPacket(hdr codec.Header, body []byte) codec.Packet {
+	pkt := codec.Packet{Flag: hdr.Flag, Req: hdr.Req}
+	if len(body) > 0 {
+		pkt.Body = append(codec.Body(nil), body...)
+	}
+	return pkt
+}
+
+// replayConn is the connection of a replayed endpoint.
+// It reads what the replay writes to in and splits what the endpoint writes into packets.
+type replayConn struct {
+	*io.PipeReader
+	in *io.PipeWriter
+
+	out *packetSplitter
+
+	mu      sync.Mutex
+	sent    []codec.Packet
+	changed chan struct{}
+}
+
+func newReplayConn() *replayConn {
+	pr, pw := io.Pipe()
+	rc := &replayConn{
+		PipeReader: pr,
+		in:         pw,
+		changed:    make(chan struct{}),
+	}
+	rc.out = &packetSplitter{limit: -1, packet: func(hdr codec.Header, body []byte) {
+		rc.mu.Lock()
+		rc.sent = append(rc.sent, replayPacket(hdr, body))
+		close(rc.changed)
+		rc.changed = make(chan struct{})
+		rc.mu.Unlock()
+	}}
+	return rc
+}
+
+// Write is only called by the codec.Writer of the endpoint, which serializes the calls
+func (rc *replayConn) Write(p []byte) (int, error) {
+	return rc.out.Write(p)
+}
+
+// waitSent returns once the endpoint sent n packets, ReplayWait passed without a new one or ctx is done
+func (rc *replayConn) waitSent(ctx context.Context, n int) {
+	for {
+		rc.mu.Lock()
+		sent, changed := len(rc.sent), rc.changed
+		rc.mu.Unlock()
+		if sent >= n {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-time.After(ReplayWait):
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (rc *replayConn) sentPackets() []codec.Packet {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return append([]codec.Packet(nil), rc.sent...)
+}
@@ -0,0 +1,69 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ssbc/go-muxrpc/v2/codec"
+)
+
+func TestCaptureReplay(t *testing.T) {
+	r := require.New(t)
+
+	newHandler := func() Handler {
+		var h FakeHandler
+		h.HandledCalls(func(m Method) bool {
+			return m.String() == "whoami" || m.String() == "echo"
+		})
+		h.HandleCallCalls(func(ctx context.Context, req *Request) {
+			if req.Method.String() == "whoami" {
+				req.Return(ctx, "me")
+				return
+			}
+			Echo.HandleCall(ctx, req)
+		})
+		return &h
+	}
+
+	var capture lockedBuffer
+	cw, err := codec.NewCaptureWriter(&capture)
+	r.NoError(err)
+
+	client, server := connectPair(t, &FakeHandler{}, newHandler(), nil, []HandleOption{WithCapture(cw)})
+
+	ctx := context.Background()
+	var who string
+	r.NoError(client.Async(ctx, &who, TypeString, Method{"whoami"}))
+	r.Equal("me", who)
+
+	src, err := client.Source(ctx, TypeJSON, Method{"echo"}, 1, 2, 3)
+	r.NoError(err)
+	for i := 0; i < 3; i++ {
+		r.True(src.Next(ctx))
+		_, err := src.Bytes()
+		r.NoError(err)
+	}
+	r.False(src.Next(ctx))
+	r.NoError(src.Err())
+
+	r.NoError(client.Terminate())
+	server.Terminate()
+	r.NoError(cw.Err())
+
+	res, err := Replay(ctx, bytes.NewReader([]byte(capture.String())), newHandler())
+	r.NoError(err)
+	r.NotEmpty(res.Recorded)
+	r.Equal(res.Recorded, res.Replayed)
+}
+
+func TestReplayNoCapture(t *testing.T) {
+	_, err := Replay(context.Background(), bytes.NewReader([]byte("nope")), &FakeHandler{})
+	require.ErrorIs(t, err, codec.ErrNoCapture)
+}
@@ -0,0 +1,64 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import "time"
+
+// Clock is where endpoints and clients get the time and their timers from,
+// like for the keepalive, response and idle timeouts, frame TTLs and reconnect backoff.
+// Tests can pass a fake one (see the muxtest package) to advance time instead of sleeping.
+type Clock interface {
+	Now() time.Time
+
+	// NewTimer returns a timer that sends the time on its channel once d passed.
+	NewTimer(d time.Duration) Timer
+
+	// NewTicker returns a ticker that sends the time on its channel every d.
+	NewTicker(d time.Duration) Ticker
+
+	// AfterFunc calls f in its own goroutine once d passed. The channel of the returned timer is nil.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is the time.Timer of a Clock.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Ticker is the time.Ticker of a Clock.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// WithClock sets the clock of the endpoint. The default is RealClock.
+func WithClock(c Clock) HandleOption {
+	return func(r *rpc) {
+		r.clock = c
+	}
+}
+
+// RealClock returns the Clock of the time package.
+func RealClock() Clock { return realClock{} }
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) Timer { return realTimer{time.NewTimer(d)} }
+
+func (realClock) NewTicker(d time.Duration) Ticker { return realTicker{time.NewTicker(d)} }
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer { return realTimer{time.AfterFunc(d, f)} }
+
+type realTimer struct{ *time.Timer }
+
+func (rt realTimer) C() <-chan time.Time { return rt.Timer.C }
+
+type realTicker struct{ *time.Ticker }
+
+func (rt realTicker) C() <-chan time.Time { return rt.Ticker.C }
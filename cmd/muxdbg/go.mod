@@ -0,0 +1,19 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: Unlicense
+
+go 1.15
+
+module github.com/ssbc/go-muxrpc/v2/cmd/muxdbg
+
+require (
+	github.com/ssbc/go-muxrpc/v2 v2.0.0
+	github.com/ssbc/go-muxrpc/v2/shs v0.0.0
+	go.cryptoscope.co/secretstream v1.2.10
+)
+
+// muxdbg is developed together with the muxrpc module
+replace (
+	github.com/ssbc/go-muxrpc/v2 => ../../
+	github.com/ssbc/go-muxrpc/v2/shs => ../../shs
+)
@@ -0,0 +1,264 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+/*
+muxdbg makes ad-hoc calls to a muxrpc server and prints the results, like curl does for HTTP.
+
+	muxdbg [flags] <addr> async|source <method> [args...]
+
+Every argument is parsed as JSON, arguments that aren't valid JSON are sent as strings.
+Results that are JSON are pretty-printed, one per line for sources.
+
+	muxdbg localhost:8008 async whoami
+	muxdbg -n 10 localhost:8008 source createHistoryStream '{"id":"@...","live":true}'
+
+SSB servers need the secret-handshake. With -shs, addr is their multiserver address and muxdbg authenticates
+with a key pair that it generates for each run:
+
+	muxdbg -shs 'net:localhost:8008~shs:<base64 key of the server>' async whoami
+
+Other ways to reach a server can be set up by another program,
+muxdbg then speaks muxrpc over the stdin and stdout of that program instead of dialing addr:
+
+	muxdbg -exec 'shs-tunnel @key.ed25519 localhost:8008' async whoami
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ssbc/go-muxrpc/v2"
+	"github.com/ssbc/go-muxrpc/v2/typemux"
+)
+
+func check(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "muxdbg:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: muxdbg [flags] <addr> async|source <method> [args...]")
+	fmt.Fprintln(os.Stderr, "       muxdbg [flags] -exec <command> async|source <method> [args...]")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	var (
+		network  string
+		command  string
+		timeout  time.Duration
+		limit    int
+		raw      bool
+		trace    bool
+		manifest bool
+		useSHS   bool
+		caps     string
+	)
+	flag.StringVar(&network, "net", "tcp", "network to dial addr on, like tcp or unix")
+	flag.BoolVar(&useSHS, "shs", false, "addr is a multiserver address like net:host:8008~shs:<key>, dial it with the secret-handshake")
+	flag.StringVar(&caps, "caps", ssbCaps, "app key of the network for -shs, base64 encoded (default the main SSB network)")
+	flag.StringVar(&command, "exec", "", "run this command and talk to its stdin and stdout instead of dialing, for instance a secret-handshake tunnel")
+	flag.DurationVar(&timeout, "timeout", 0, "give up on the whole call after this long (default no timeout)")
+	flag.IntVar(&limit, "n", 0, "stop a source after this many items (default all)")
+	flag.BoolVar(&raw, "raw", false, "print results as they were received instead of pretty-printing JSON")
+	flag.BoolVar(&trace, "trace", false, "trace every packet to stderr")
+	flag.BoolVar(&manifest, "manifest", true, "ask the server for its manifest, which checks the method and call type before calling")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	var addr string
+	if command == "" {
+		if len(args) < 1 {
+			usage()
+		}
+		addr, args = args[0], args[1:]
+	}
+	if len(args) < 2 {
+		usage()
+	}
+	callType, method, callArgs := args[0], muxrpc.Method(strings.Split(args[1], ".")), parseArgs(args[2:])
+	if useSHS && command != "" {
+		check(fmt.Errorf("-shs and -exec can't be used together"))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		cancel()
+	}()
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	opts := []muxrpc.HandleOption{
+		muxrpc.WithContext(ctx),
+		muxrpc.WithIsServer(false),
+		muxrpc.WithLogger(muxrpc.FilterLevel(muxrpc.NewLogfmtLogger(os.Stderr), muxrpc.LevelWarn)),
+	}
+	if trace {
+		opts = append(opts, muxrpc.WithPacketTracer(os.Stderr))
+	}
+	if !manifest {
+		opts = append(opts, muxrpc.WithoutManifest())
+	}
+
+	// the server may call us as well, the mux answers its manifest calls and refuses everything else
+	mux := typemux.New(muxrpc.NopLogger())
+	var edp muxrpc.Endpoint
+	if useSHS {
+		hs, err := newHandshake(caps)
+		check(err)
+		edp, err = muxrpc.DialSHS(ctx, hs, addr, &mux, opts...)
+		check(err)
+	} else {
+		conn, err := connect(ctx, network, addr, command)
+		check(err)
+		edp = muxrpc.Handle(muxrpc.NewPacker(conn), &mux, opts...)
+	}
+	defer edp.Terminate()
+
+	p := printer{w: os.Stdout, raw: raw}
+	switch callType {
+	case "async":
+		var body []byte
+		check(edp.Async(ctx, &body, muxrpc.TypeBinary, method, callArgs...))
+		check(p.print(body))
+
+	case "source":
+		src, err := edp.Source(ctx, muxrpc.TypeBinary, method, callArgs...)
+		check(err)
+		for n := 0; limit == 0 || n < limit; n++ {
+			if !src.Next(ctx) {
+				check(src.Err())
+				break
+			}
+			body, err := src.Bytes()
+			check(err)
+			check(p.print(body))
+		}
+		src.Cancel(nil)
+
+	default:
+		check(fmt.Errorf("unsupported call type %q, use async or source", callType))
+	}
+}
+
+// parseArgs decodes the arguments as JSON and falls back to strings, so that names don't need to be quoted twice
+func parseArgs(args []string) []interface{} {
+	parsed := make([]interface{}, len(args))
+	for i, a := range args {
+		var v json.RawMessage
+		if json.Unmarshal([]byte(a), &v) == nil {
+			parsed[i] = v
+		} else {
+			parsed[i] = a
+		}
+	}
+	return parsed
+}
+
+func connect(ctx context.Context, network, addr, command string) (muxrpc.TransportConn, error) {
+	if command == "" {
+		return muxrpc.NetTransport{Network: network}.Dial(ctx, addr)
+	}
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %q: %w", command, err)
+	}
+
+	return muxrpc.NewTransportConn(processConn{
+		Reader: stdout,
+		Writer: stdin,
+		cmd:    cmd,
+		stdin:  stdin,
+	}, muxrpc.ConnInfo{}), nil
+}
+
+// processConn talks to a child process
+type processConn struct {
+	io.Reader
+	io.Writer
+
+	cmd   *exec.Cmd
+	stdin io.Closer
+}
+
+// Close hangs up on the process and waits for it to exit
+func (pc processConn) Close() error {
+	pc.stdin.Close()
+	done := make(chan error, 1)
+	go func() { done <- pc.cmd.Wait() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(2 * time.Second):
+		pc.cmd.Process.Kill()
+		return <-done
+	}
+}
+
+type printer struct {
+	w   io.Writer
+	raw bool
+}
+
+func (p printer) print(body []byte) error {
+	var out bytes.Buffer
+	switch {
+	case p.raw:
+		out.Write(body)
+	case json.Valid(body):
+		if err := json.Indent(&out, body, "", "  "); err != nil {
+			return err
+		}
+	case isText(body):
+		out.Write(body)
+	default:
+		out.WriteString(hex.Dump(body))
+	}
+	if !bytes.HasSuffix(out.Bytes(), []byte("\n")) {
+		out.WriteByte('\n')
+	}
+	_, err := p.w.Write(out.Bytes())
+	return err
+}
+
+func isText(b []byte) bool {
+	for _, r := range string(b) {
+		if r == utf8.RuneError || (r < ' ' && r != '\n' && r != '\t' && r != '\r') {
+			return false
+		}
+	}
+	return true
+}
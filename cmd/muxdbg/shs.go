@@ -0,0 +1,31 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+
+	"go.cryptoscope.co/secretstream/secrethandshake"
+
+	"github.com/ssbc/go-muxrpc/v2/shs"
+)
+
+// ssbCaps is the app key of the main SSB network
+const ssbCaps = "1KHLiKZvAvjbY1ziZEHMXawbCEIM6qwjCDm3VYRan/s="
+
+// newHandshake returns a secret-handshake with a key pair that only lives as long as muxdbg runs
+func newHandshake(caps string) (*shs.Handshake, error) {
+	appKey, err := base64.StdEncoding.DecodeString(caps)
+	if err != nil {
+		return nil, fmt.Errorf("invalid caps: %w", err)
+	}
+	kp, err := secrethandshake.GenEdKeyPair(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key pair: %w", err)
+	}
+	return shs.New(*kp, appKey)
+}
@@ -0,0 +1,384 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+/*
+muxrpc-gen generates a typed client and a server interface from a description of the methods of an API.
+
+The description is a JSON manifest like the ones JS peers send. Next to the call type of a method,
+it can have an object that says what the method takes and returns, as Go types of the generated package:
+
+	{
+	  "whoami": "async",
+	  "blobs": {
+	    "has": {"type": "async", "args": "string", "out": "bool"},
+	    "get": {"type": "source", "args": "GetArgs", "out": "[]byte"},
+	    "add": {"type": "sink"}
+	  },
+	  "replicate.upto": {"type": "source", "out": "Note"}
+	}
+
+Methods without an object take no arguments and return json.RawMessage.
+Answers that are []byte are sent as binary, strings as strings and everything else as JSON,
+unless "encoding" says otherwise ("binary", "string" or "json").
+
+	//go:generate muxrpc-gen -in api.json -out api_muxrpc.go -package peer -service Peer
+
+generates PeerClient, which calls the methods on a muxrpc.Endpoint,
+and PeerServer, an interface for the handlers that RegisterPeerServer registers on a typemux.HandlerMux.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/format"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"github.com/ssbc/go-muxrpc/v2"
+)
+
+// Spec describes a method of the API.
+type Spec struct {
+	Method muxrpc.Method
+	Type   muxrpc.CallType `json:"type"`
+
+	// Args is the Go type of the first argument of the call, empty if it has none
+	Args string `json:"args"`
+
+	// Out is the Go type of the answer of async calls and of the items of sources
+	Out string `json:"out"`
+
+	Encoding string `json:"encoding"`
+}
+
+// Name is the name of the Go functions of the method, blobs.get becomes BlobsGet.
+func (s Spec) Name() string {
+	var name strings.Builder
+	for _, el := range s.Method {
+		upper := true
+		for _, r := range el {
+			if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+				upper = true
+				continue
+			}
+			if upper {
+				r = unicode.ToUpper(r)
+				upper = false
+			}
+			name.WriteRune(r)
+		}
+	}
+	return name.String()
+}
+
+// MethodLiteral is the method as a muxrpc.Method literal
+func (s Spec) MethodLiteral() string {
+	quoted := make([]string, len(s.Method))
+	for i, el := range s.Method {
+		quoted[i] = fmt.Sprintf("%q", el)
+	}
+	return "muxrpc.Method{" + strings.Join(quoted, ", ") + "}"
+}
+
+// EncodingConst is the muxrpc.RequestEncoding of the answers
+func (s Spec) EncodingConst() string {
+	switch s.Encoding {
+	case "binary":
+		return "muxrpc.TypeBinary"
+	case "string":
+		return "muxrpc.TypeString"
+	case "json":
+		return "muxrpc.TypeJSON"
+	}
+	switch s.Out {
+	case "[]byte":
+		return "muxrpc.TypeBinary"
+	case "string":
+		return "muxrpc.TypeString"
+	}
+	return "muxrpc.TypeJSON"
+}
+
+// Typed is true for sources whose items are decoded from JSON
+func (s Spec) Typed() bool { return s.EncodingConst() == "muxrpc.TypeJSON" }
+
+// parseManifest walks a nested manifest and returns the methods in it, sorted by name
+func parseManifest(data []byte) ([]Spec, error) {
+	var root map[string]json.RawMessage
+	if err := json.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+
+	var specs []Spec
+	var walk func(prefix muxrpc.Method, group map[string]json.RawMessage) error
+	walk = func(prefix muxrpc.Method, group map[string]json.RawMessage) error {
+		for name, raw := range group {
+			m := append(append(muxrpc.Method{}, prefix...), strings.Split(name, ".")...)
+
+			var ct string
+			if json.Unmarshal(raw, &ct) == nil {
+				specs = append(specs, Spec{Method: m, Type: muxrpc.CallType(ct)})
+				continue
+			}
+
+			var obj map[string]json.RawMessage
+			if err := json.Unmarshal(raw, &obj); err != nil {
+				return fmt.Errorf("%s: neither a call type nor an object", m)
+			}
+			if _, isSpec := obj["type"]; !isSpec {
+				if err := walk(m, obj); err != nil {
+					return err
+				}
+				continue
+			}
+
+			spec := Spec{Method: m}
+			if err := json.Unmarshal(raw, &spec); err != nil {
+				return fmt.Errorf("%s: %w", m, err)
+			}
+			specs = append(specs, spec)
+		}
+		return nil
+	}
+	if err := walk(nil, root); err != nil {
+		return nil, err
+	}
+
+	var out []Spec
+	for _, s := range specs {
+		// the mux answers it
+		if s.Method.String() == "manifest" {
+			continue
+		}
+		switch s.Type {
+		case "async", "sync", "source", "sink", "duplex":
+		default:
+			return nil, fmt.Errorf("%s: unknown call type %q", s.Method, s.Type)
+		}
+		if s.Out == "" {
+			s.Out = "json.RawMessage"
+		}
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Method.String() < out[j].Method.String() })
+	return out, nil
+}
+
+var tpl = template.Must(template.New("").Parse(`// Code generated by muxrpc-gen. DO NOT EDIT.
+
+package {{ .Package }}
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/ssbc/go-muxrpc/v2"
+	"github.com/ssbc/go-muxrpc/v2/typemux"
+)
+
+// {{ .Service }}Client calls the methods of a {{ .Service }} on a muxrpc endpoint.
+type {{ .Service }}Client struct {
+	Endpoint muxrpc.Endpoint
+}
+
+// New{{ .Service }}Client returns a client that calls edp.
+func New{{ .Service }}Client(edp muxrpc.Endpoint) *{{ .Service }}Client {
+	return &{{ .Service }}Client{Endpoint: edp}
+}
+{{ range .Specs }}
+{{- if or (eq .Type "async") (eq .Type "sync") }}
+// {{ .Name }} calls {{ .Method }}.
+func (c *{{ $.Service }}Client) {{ .Name }}(ctx context.Context{{ with .Args }}, args {{ . }}{{ end }}) ({{ .Out }}, error) {
+	var ret {{ .Out }}
+	err := c.Endpoint.Async(ctx, &ret, {{ .EncodingConst }}, {{ .MethodLiteral }}{{ if .Args }}, args{{ end }})
+	return ret, err
+}
+{{ else if eq .Type "source" }}
+// {{ .Name }} calls {{ .Method }}.
+{{- if .Typed }}
+func (c *{{ $.Service }}Client) {{ .Name }}(ctx context.Context{{ with .Args }}, args {{ . }}{{ end }}) (*muxrpc.TypedSource[{{ .Out }}], error) {
+	src, err := c.Endpoint.Source(ctx, {{ .EncodingConst }}, {{ .MethodLiteral }}{{ if .Args }}, args{{ end }})
+	if err != nil {
+		return nil, err
+	}
+	return muxrpc.NewTypedSource[{{ .Out }}](src), nil
+}
+{{- else }}
+func (c *{{ $.Service }}Client) {{ .Name }}(ctx context.Context{{ with .Args }}, args {{ . }}{{ end }}) (*muxrpc.ByteSource, error) {
+	return c.Endpoint.Source(ctx, {{ .EncodingConst }}, {{ .MethodLiteral }}{{ if .Args }}, args{{ end }})
+}
+{{- end }}
+{{ else if eq .Type "sink" }}
+// {{ .Name }} calls {{ .Method }}.
+func (c *{{ $.Service }}Client) {{ .Name }}(ctx context.Context{{ with .Args }}, args {{ . }}{{ end }}) (*muxrpc.ByteSink, error) {
+	return c.Endpoint.Sink(ctx, {{ .EncodingConst }}, {{ .MethodLiteral }}{{ if .Args }}, args{{ end }})
+}
+{{ else if eq .Type "duplex" }}
+// {{ .Name }} calls {{ .Method }}.
+func (c *{{ $.Service }}Client) {{ .Name }}(ctx context.Context{{ with .Args }}, args {{ . }}{{ end }}) (*muxrpc.ByteSource, *muxrpc.ByteSink, error) {
+	return c.Endpoint.Duplex(ctx, {{ .EncodingConst }}, {{ .MethodLiteral }}{{ if .Args }}, args{{ end }})
+}
+{{ end }}
+{{- end }}
+// {{ .Service }}Server handles the methods of a {{ .Service }}, see Register{{ .Service }}Server.
+type {{ .Service }}Server interface {
+{{- range .Specs }}
+{{- if or (eq .Type "async") (eq .Type "sync") }}
+	{{ .Name }}(ctx context.Context{{ with .Args }}, args {{ . }}{{ end }}) ({{ .Out }}, error)
+{{- else if eq .Type "source" }}
+	{{ .Name }}(ctx context.Context{{ with .Args }}, args {{ . }}{{ end }}, snk *muxrpc.ByteSink) error
+{{- else if eq .Type "sink" }}
+	{{ .Name }}(ctx context.Context{{ with .Args }}, args {{ . }}{{ end }}, src *muxrpc.ByteSource) error
+{{- else if eq .Type "duplex" }}
+	{{ .Name }}(ctx context.Context{{ with .Args }}, args {{ . }}{{ end }}, src *muxrpc.ByteSource, snk *muxrpc.ByteSink) error
+{{- end }}
+{{- end }}
+}
+
+// Register{{ .Service }}Server registers the methods of srv on mux.
+// Calls whose arguments don't decode are refused with an error that matches muxrpc.ErrInvalidArgs.
+func Register{{ .Service }}Server(mux *typemux.HandlerMux, srv {{ .Service }}Server) {
+{{- range .Specs }}
+{{- if or (eq .Type "async") (eq .Type "sync") }}
+	mux.RegisterAsync({{ .MethodLiteral }}, typemux.AsyncFunc(func(ctx context.Context, req *muxrpc.Request) (interface{}, error) {
+{{- if .Args }}
+		var args {{ .Args }}
+		if err := {{ $.Unexported }}FirstArg(req, &args); err != nil {
+			return nil, err
+		}
+		return srv.{{ .Name }}(ctx, args)
+{{- else }}
+		return srv.{{ .Name }}(ctx)
+{{- end }}
+	}), typemux.WithEncoding({{ .EncodingConst }}))
+{{- else if eq .Type "source" }}
+	mux.RegisterSource({{ .MethodLiteral }}, typemux.SourceFunc(func(ctx context.Context, req *muxrpc.Request, snk *muxrpc.ByteSink) error {
+{{- if .Args }}
+		var args {{ .Args }}
+		if err := {{ $.Unexported }}FirstArg(req, &args); err != nil {
+			return err
+		}
+		return srv.{{ .Name }}(ctx, args, snk)
+{{- else }}
+		return srv.{{ .Name }}(ctx, snk)
+{{- end }}
+	}), typemux.WithEncoding({{ .EncodingConst }}))
+{{- else if eq .Type "sink" }}
+	mux.RegisterSink({{ .MethodLiteral }}, typemux.SinkFunc(func(ctx context.Context, req *muxrpc.Request, src *muxrpc.ByteSource) error {
+{{- if .Args }}
+		var args {{ .Args }}
+		if err := {{ $.Unexported }}FirstArg(req, &args); err != nil {
+			return err
+		}
+		return srv.{{ .Name }}(ctx, args, src)
+{{- else }}
+		return srv.{{ .Name }}(ctx, src)
+{{- end }}
+	}), typemux.WithEncoding({{ .EncodingConst }}))
+{{- else if eq .Type "duplex" }}
+	mux.RegisterDuplex({{ .MethodLiteral }}, typemux.DuplexFunc(func(ctx context.Context, req *muxrpc.Request, src *muxrpc.ByteSource, snk *muxrpc.ByteSink) error {
+{{- if .Args }}
+		var args {{ .Args }}
+		if err := {{ $.Unexported }}FirstArg(req, &args); err != nil {
+			return err
+		}
+		return srv.{{ .Name }}(ctx, args, src, snk)
+{{- else }}
+		return srv.{{ .Name }}(ctx, src, snk)
+{{- end }}
+	}), typemux.WithEncoding({{ .EncodingConst }}))
+{{- end }}
+{{- end }}
+}
+
+// {{ .Unexported }}FirstArg decodes the first argument of req into v, calls without arguments leave it as it is
+func {{ .Unexported }}FirstArg(req *muxrpc.Request, v interface{}) error {
+	var args []json.RawMessage
+	if err := json.Unmarshal(req.RawArgs, &args); err != nil {
+		return muxrpc.ErrInvalidArgs
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(args[0], v); err != nil {
+		return muxrpc.ErrInvalidArgs
+	}
+	return nil
+}
+`))
+
+type file struct {
+	Package string
+	Service string
+	Specs   []Spec
+}
+
+// Unexported is the service name with a lower case first letter, for the helpers of the generated file
+func (f file) Unexported() string {
+	if f.Service == "" {
+		return ""
+	}
+	return strings.ToLower(f.Service[:1]) + f.Service[1:]
+}
+
+// generate returns the formatted Go code for the methods in the manifest
+func generate(pkg, service string, manifest []byte) ([]byte, error) {
+	specs, err := parseManifest(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	if err := tpl.Execute(&b, file{Package: pkg, Service: service, Specs: specs}); err != nil {
+		return nil, err
+	}
+
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("generated invalid code: %w\n%s", err, b.Bytes())
+	}
+	return src, nil
+}
+
+func check(err error) {
+	if err == nil {
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "muxrpc-gen: %s\n", err)
+	os.Exit(1)
+}
+
+func main() {
+	var in, out, pkg, service string
+	flag.StringVar(&in, "in", "", "the manifest that describes the API (required)")
+	flag.StringVar(&out, "out", "", "where to write the generated code, stdout if empty")
+	flag.StringVar(&pkg, "package", "", "package of the generated code (required)")
+	flag.StringVar(&service, "service", "", "name of the API, the prefix of the generated types (required)")
+	flag.Parse()
+
+	if in == "" || pkg == "" || service == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	manifest, err := os.ReadFile(in)
+	check(err)
+
+	src, err := generate(pkg, service, manifest)
+	check(err)
+
+	if out == "" {
+		_, err = os.Stdout.Write(src)
+	} else {
+		err = os.WriteFile(out, src, 0o644)
+	}
+	check(err)
+}
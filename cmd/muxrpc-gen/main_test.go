@@ -0,0 +1,57 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerate(t *testing.T) {
+	r := require.New(t)
+
+	manifest := []byte(`{
+		"manifest": "sync",
+		"whoami": "async",
+		"blobs": {
+			"has": {"type": "async", "args": "string", "out": "bool"},
+			"get": {"type": "source", "args": "GetArgs", "out": "[]byte"},
+			"add": {"type": "sink"}
+		},
+		"replicate.upto": {"type": "source", "out": "Note"},
+		"tunnel.connect": {"type": "duplex", "args": "Target", "encoding": "binary"}
+	}`)
+
+	src, err := generate("peer", "Peer", manifest)
+	r.NoError(err)
+	code := string(src)
+
+	for _, want := range []string{
+		"package peer",
+		"func (c *PeerClient) Whoami(ctx context.Context) (json.RawMessage, error)",
+		`err := c.Endpoint.Async(ctx, &ret, muxrpc.TypeJSON, muxrpc.Method{"blobs", "has"}, args)`,
+		"func (c *PeerClient) BlobsGet(ctx context.Context, args GetArgs) (*muxrpc.ByteSource, error)",
+		"func (c *PeerClient) ReplicateUpto(ctx context.Context) (*muxrpc.TypedSource[Note], error)",
+		"func (c *PeerClient) TunnelConnect(ctx context.Context, args Target) (*muxrpc.ByteSource, *muxrpc.ByteSink, error)",
+		"BlobsAdd(ctx context.Context, src *muxrpc.ByteSource) error",
+		"BlobsGet(ctx context.Context, args GetArgs, snk *muxrpc.ByteSink) error",
+		"typemux.WithEncoding(muxrpc.TypeBinary)",
+		"func peerFirstArg(",
+	} {
+		r.Contains(code, want)
+	}
+	r.NotContains(code, "Manifest(", "the mux answers manifest calls")
+
+	// the output doesn't depend on the order of the manifest
+	again, err := generate("peer", "Peer", manifest)
+	r.NoError(err)
+	r.Equal(code, string(again))
+
+	_, err = generate("peer", "Peer", []byte(`{"whoami": "stream"}`))
+	r.Error(err)
+	_, err = generate("peer", "Peer", []byte(`{"whoami": 23}`))
+	r.Error(err)
+}
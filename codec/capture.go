@@ -0,0 +1,175 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// captureMagic starts every capture file
+const captureMagic = "muxrpc-capture/1\n"
+
+// Direction says if captured data was read from or written to a connection.
+type Direction byte
+
+// The directions of captured data.
+const (
+	DirIn  Direction = 'i'
+	DirOut Direction = 'o'
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirIn:
+		return "in"
+	case DirOut:
+		return "out"
+	}
+	return fmt.Sprintf("Direction(%d)", byte(d))
+}
+
+// CaptureRecord is a chunk of data as it was read from or written to a connection.
+// The chunks don't line up with packets, they are what the individual Read and Write calls saw.
+type CaptureRecord struct {
+	Time time.Time
+	Dir  Direction
+	Data []byte
+}
+
+// captureRecordHeader is the direction, the time in unix nanoseconds and the size of the data
+const captureRecordHeader = 1 + 8 + 4
+
+// CaptureWriter records the raw packet stream of a connection, both directions into one file.
+// Use TeeReader and TeeWriter to feed it and CaptureReader to read the file back.
+type CaptureWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	err error
+}
+
+// NewCaptureWriter starts a capture file on w.
+func NewCaptureWriter(w io.Writer) (*CaptureWriter, error) {
+	if _, err := io.WriteString(w, captureMagic); err != nil {
+		return nil, fmt.Errorf("pkt-codec: failed to start capture: %w", err)
+	}
+	return &CaptureWriter{w: w}, nil
+}
+
+// Record adds a chunk of data to the capture. After the first failed write all further records are dropped and the error is returned.
+func (cw *CaptureWriter) Record(dir Direction, data []byte) error {
+	var hdr [captureRecordHeader]byte
+	hdr[0] = byte(dir)
+	binary.BigEndian.PutUint64(hdr[1:9], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(hdr[9:13], uint32(len(data)))
+
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if cw.err != nil {
+		return cw.err
+	}
+	if _, err := cw.w.Write(hdr[:]); err != nil {
+		cw.err = fmt.Errorf("pkt-codec: capture write failed: %w", err)
+		return cw.err
+	}
+	if _, err := cw.w.Write(data); err != nil {
+		cw.err = fmt.Errorf("pkt-codec: capture write failed: %w", err)
+		return cw.err
+	}
+	return nil
+}
+
+// Dir returns a writer that records everything that is written to it as data of direction dir, for instance for Reader.Tap and Writer.Tap.
+// Failing records don't fail the writes, check Err afterwards.
+func (cw *CaptureWriter) Dir(dir Direction) io.Writer {
+	return captureDir{cw: cw, dir: dir}
+}
+
+// Err returns the error that stopped the capture, if any.
+func (cw *CaptureWriter) Err() error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	return cw.err
+}
+
+type captureDir struct {
+	cw  *CaptureWriter
+	dir Direction
+}
+
+func (cd captureDir) Write(p []byte) (int, error) {
+	cd.cw.Record(cd.dir, p)
+	return len(p), nil
+}
+
+// TeeReader returns a reader that records what is read from r as incoming data.
+func TeeReader(r io.Reader, cw *CaptureWriter) io.Reader {
+	return io.TeeReader(r, cw.Dir(DirIn))
+}
+
+// TeeWriter returns a writer that records what is written to w as outgoing data.
+func TeeWriter(w io.Writer, cw *CaptureWriter) io.Writer {
+	return teeWriter{w: w, cw: cw}
+}
+
+type teeWriter struct {
+	w  io.Writer
+	cw *CaptureWriter
+}
+
+func (tw teeWriter) Write(p []byte) (int, error) {
+	n, err := tw.w.Write(p)
+	if n > 0 {
+		tw.cw.Record(DirOut, p[:n])
+	}
+	return n, err
+}
+
+// ErrNoCapture is returned by NewCaptureReader for data that doesn't start like a capture file.
+var ErrNoCapture = errors.New("pkt-codec: not a capture file")
+
+// CaptureReader reads back the records of a capture file.
+type CaptureReader struct {
+	r *bufio.Reader
+}
+
+// NewCaptureReader checks that r starts like a capture file.
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != captureMagic {
+		return nil, ErrNoCapture
+	}
+	return &CaptureReader{r: br}, nil
+}
+
+// Next returns the next record or io.EOF after the last one.
+func (cr *CaptureReader) Next() (*CaptureRecord, error) {
+	var hdr [captureRecordHeader]byte
+	if _, err := io.ReadFull(cr.r, hdr[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("pkt-codec: capture record header read failed: %w", err)
+	}
+
+	rec := CaptureRecord{
+		Dir:  Direction(hdr[0]),
+		Time: time.Unix(0, int64(binary.BigEndian.Uint64(hdr[1:9]))),
+		Data: make([]byte, binary.BigEndian.Uint32(hdr[9:13])),
+	}
+	if rec.Dir != DirIn && rec.Dir != DirOut {
+		return nil, fmt.Errorf("pkt-codec: capture record with invalid direction %d", hdr[0])
+	}
+	if _, err := io.ReadFull(cr.r, rec.Data); err != nil {
+		return nil, fmt.Errorf("pkt-codec: capture record data read failed: %w", err)
+	}
+	return &rec, nil
+}
@@ -0,0 +1,54 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package codec
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCaptureRoundtrip(t *testing.T) {
+	r := require.New(t)
+
+	var file bytes.Buffer
+	cw, err := NewCaptureWriter(&file)
+	r.NoError(err)
+
+	var conn bytes.Buffer
+	w := NewWriter(TeeWriter(&conn, cw))
+	for _, p := range testPkts {
+		r.NoError(w.WritePacket(p))
+	}
+
+	rd := NewReader(TeeReader(bytes.NewReader(conn.Bytes()), cw))
+	for range testPkts {
+		_, err := rd.ReadPacket()
+		r.NoError(err)
+	}
+	r.NoError(cw.Err())
+
+	cr, err := NewCaptureReader(&file)
+	r.NoError(err)
+	var in, out []byte
+	for {
+		rec, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		r.NoError(err)
+		r.False(rec.Time.IsZero())
+		switch rec.Dir {
+		case DirIn:
+			in = append(in, rec.Data...)
+		case DirOut:
+			out = append(out, rec.Data...)
+		}
+	}
+	r.Equal(conn.Bytes(), out)
+	r.Equal(conn.Bytes(), in)
+}
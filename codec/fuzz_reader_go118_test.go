@@ -0,0 +1,24 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+//go:build go1.18
+// +build go1.18
+
+package codec
+
+import "testing"
+
+// FuzzReader feeds arbitrary bytes into a Reader. Run it with
+//
+//	go test -run XXX -fuzz FuzzReader
+//
+// The fuzzer minimizes crashers and stores them in testdata/fuzz/FuzzReader, from where go test replays them.
+func FuzzReader(f *testing.F) {
+	for _, seed := range readerSeeds() {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		replayReader(t, data)
+	})
+}
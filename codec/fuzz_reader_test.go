@@ -0,0 +1,154 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// readerCorpus holds inputs that once broke the reader. Crashers found by FuzzReader land in testdata/fuzz/FuzzReader,
+// copy the interesting ones here so that toolchains without fuzzing replay them, too.
+const readerCorpus = "testdata/reader-corpus"
+
+// readerAllocs is how many bytes reading an input may allocate, on top of a multiple of its size
+const readerAllocs = 1 << 20
+
+// replayReader reads all packets of data and checks that
+//   - reading ends with io.EOF or one of the errors for broken input,
+//   - the packets encode back to the bytes they were read from,
+//   - ReadPacketInto reads the same packets and
+//   - the reader didn't allocate much more than the input.
+func replayReader(t testing.TB, data []byte) {
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	rd := NewReader(bytes.NewReader(data))
+	var pkts []Packet
+	var consumed uint64
+	for {
+		pkt, err := rd.ReadPacket()
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, ErrInvalidFlags) {
+				t.Fatalf("unexpected error after %d packets: %v", len(pkts), err)
+			}
+			break
+		}
+		pkts = append(pkts, *pkt)
+		consumed = rd.BytesRead()
+	}
+
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > readerAllocs+uint64(8*len(data)) {
+		t.Fatalf("reader allocated %d bytes for %d bytes of input", allocated, len(data))
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	if err := w.WritePackets(pkts...); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data[:consumed]) {
+		t.Fatalf("packets encode to different bytes\n got: %x\nwant: %x", buf.Bytes(), data[:consumed])
+	}
+
+	pool := NewTieredPool()
+	rd = NewReader(bytes.NewReader(data))
+	for i := range pkts {
+		pp, err := rd.ReadPacketInto(pool)
+		if err != nil {
+			t.Fatalf("ReadPacketInto failed on packet %d: %v", i, err)
+		}
+		if pp.Flag != pkts[i].Flag || pp.Req != pkts[i].Req || !bytes.Equal(pp.Body, pkts[i].Body) {
+			t.Fatalf("ReadPacketInto read packet %d as %+v, ReadPacket as %+v", i, pp.Packet, pkts[i])
+		}
+		pp.Release()
+	}
+}
+
+// readerSeeds are well-formed streams the fuzzer starts from
+func readerSeeds() [][]byte {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.WritePackets(testPkts...)
+	w.Goodbye()
+	return [][]byte{buf.Bytes(), buf.Bytes()[:HeaderLength+10]}
+}
+
+func TestReaderCorpus(t *testing.T) {
+	for _, seed := range readerSeeds() {
+		replayReader(t, seed)
+	}
+
+	files, err := filepath.Glob(filepath.Join(readerCorpus, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no files in", readerCorpus)
+	}
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Run(filepath.Base(f), func(t *testing.T) {
+			replayReader(t, data)
+		})
+	}
+}
+
+func header(flag Flag, length uint32, req int32) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, Header{Flag: flag, Len: length, Req: req})
+	return buf.Bytes()
+}
+
+func TestReaderErrors(t *testing.T) {
+	read := func(data []byte, max uint32) error {
+		rd := NewReader(bytes.NewReader(data))
+		rd.SetMaxBodySize(max)
+		_, err := rd.ReadPacket()
+		return err
+	}
+
+	if err := read(nil, 0); err != io.EOF {
+		t.Errorf("empty input: %v", err)
+	}
+	if err := read(header(FlagJSON, 2, 1)[:5], 0); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("truncated header: %v", err)
+	}
+	if err := read(header(FlagJSON, 2, 1), 0); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("missing body: %v", err)
+	}
+	if err := read(append(header(0, 1<<31, 1), "short"...), 0); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("absurd length: %v", err)
+	}
+	if err := read(append(header(0, 100, 1), make([]byte, 100)...), 99); !errors.Is(err, ErrBodyTooLarge) {
+		t.Errorf("over the limit: %v", err)
+	}
+	if err := read(append(header(0, 100, 1), make([]byte, 100)...), 100); err != nil {
+		t.Errorf("at the limit: %v", err)
+	}
+	if err := read(append(header(FlagString|FlagJSON, 1, 1), 'x'), 0); !errors.Is(err, ErrInvalidFlags) {
+		t.Errorf("both type bits: %v", err)
+	}
+
+	rd := NewReader(bytes.NewReader(append(header(0, 10, 1), "short"...)))
+	var hdr Header
+	if err := rd.ReadHeader(&hdr); err != nil {
+		t.Fatal(err)
+	}
+	if err := rd.ReadBodyInto(ioutil.Discard, hdr.Len); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("ReadBodyInto of a truncated body: %v", err)
+	}
+}
@@ -52,6 +52,15 @@ func (f Flag) String() string {
 	if f.Get(FlagEndErr) {
 		flags = append(flags, "FlagEndErr")
 	}
+	if f.Get(FlagSeq) {
+		flags = append(flags, "FlagSeq")
+	}
+	if f.Get(FlagMore) {
+		flags = append(flags, "FlagMore")
+	}
+	if f.Get(FlagGzip) {
+		flags = append(flags, "FlagGzip")
+	}
 
 	return "{" + strings.Join(flags, ", ") + "}"
 }
@@ -62,6 +71,18 @@ const (
 	FlagJSON                    // bits
 	FlagEndErr
 	FlagStream
+
+	// FlagSeq marks packets whose body ends with a 4 byte frame counter.
+	// It is not part of the muxrpc protocol and only sent by Go peers that were built with the muxrpcdebug tag.
+	FlagSeq
+
+	// FlagMore marks packets that are followed by more chunks of the same frame.
+	// Like FlagSeq it is not part of the muxrpc protocol, only Go sinks with a chunk size send it.
+	FlagMore
+
+	// FlagGzip marks packets whose body is gzip compressed. It is not part of the muxrpc protocol either,
+	// only Go sinks that were set up for compression send it.
+	FlagGzip
 )
 
 // Header is the wire representation of a packet header
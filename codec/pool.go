@@ -0,0 +1,73 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package codec
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+)
+
+// BufferPool hands out buffers for packet bodies and takes them back once they aren't needed anymore.
+// Get returns an empty buffer that holds at least size bytes without growing. Implementations have to be safe for concurrent use.
+type BufferPool interface {
+	Get(size int) *bytes.Buffer
+	Put(*bytes.Buffer)
+}
+
+// DefaultTiers are the buffer sizes of NewTieredPool if it isn't given any.
+var DefaultTiers = []int{512, 4 * 1024, 32 * 1024, 256 * 1024, 1024 * 1024}
+
+// NewTieredPool returns a BufferPool that keeps buffers in a sync.Pool per size tier, so that concurrent streams don't contend for a lock
+// and small bodies don't pin large buffers. Get hands out buffers of the smallest tier that fits.
+// Larger buffers are allocated as they are needed and dropped again, so that the pool doesn't hold on to them.
+func NewTieredPool(tiers ...int) BufferPool {
+	if len(tiers) == 0 {
+		tiers = DefaultTiers
+	}
+	tp := &tieredPool{sizes: append([]int(nil), tiers...)}
+	sort.Ints(tp.sizes)
+	tp.pools = make([]sync.Pool, len(tp.sizes))
+	return tp
+}
+
+type tieredPool struct {
+	sizes []int
+	pools []sync.Pool
+}
+
+// tier returns the index of the smallest tier that holds size bytes, or -1 if none does
+func (tp *tieredPool) tier(size int) int {
+	i := sort.SearchInts(tp.sizes, size)
+	if i == len(tp.sizes) {
+		return -1
+	}
+	return i
+}
+
+func (tp *tieredPool) Get(size int) *bytes.Buffer {
+	i := tp.tier(size)
+	if i < 0 {
+		return bytes.NewBuffer(make([]byte, 0, size))
+	}
+	if buf, ok := tp.pools[i].Get().(*bytes.Buffer); ok {
+		return buf
+	}
+	return bytes.NewBuffer(make([]byte, 0, tp.sizes[i]))
+}
+
+// Put files buf under the largest tier it can serve. Buffers that grew past the largest tier are dropped.
+func (tp *tieredPool) Put(buf *bytes.Buffer) {
+	if buf == nil {
+		return
+	}
+	c := buf.Cap()
+	i := sort.SearchInts(tp.sizes, c+1) - 1
+	if i < 0 || c > tp.sizes[len(tp.sizes)-1] {
+		return
+	}
+	buf.Reset()
+	tp.pools[i].Put(buf)
+}
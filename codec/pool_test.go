@@ -0,0 +1,93 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package codec
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestTieredPool(t *testing.T) {
+	pool := NewTieredPool(64, 1024)
+
+	for _, tc := range []struct{ size, cap int }{
+		{0, 64},
+		{64, 64},
+		{65, 1024},
+		{5000, 5000},
+	} {
+		buf := pool.Get(tc.size)
+		if buf.Len() != 0 || buf.Cap() < tc.cap {
+			t.Errorf("Get(%d): len %d cap %d, want an empty buffer with room for %d", tc.size, buf.Len(), buf.Cap(), tc.cap)
+		}
+	}
+
+	// a buffer that grew is filed under the tier it can serve and comes back empty
+	buf := pool.Get(64)
+	buf.Write(bytes.Repeat([]byte("a"), 1000))
+	buf.Grow(1024)
+	pool.Put(buf)
+	if got := pool.Get(1024); got.Len() != 0 || got.Cap() < 1024 {
+		t.Errorf("got len %d cap %d", got.Len(), got.Cap())
+	}
+
+	// too small and too large ones aren't kept
+	pool.Put(bytes.NewBuffer(make([]byte, 0, 10)))
+	pool.Put(bytes.NewBuffer(make([]byte, 0, 4096)))
+	pool.Put(nil)
+}
+
+// lockedPool is a free list behind a mutex, like the pools of karrick/bufpool that the tiered pool replaced
+type lockedPool struct {
+	mu   sync.Mutex
+	free []*bytes.Buffer
+}
+
+func (lp *lockedPool) Get(size int) *bytes.Buffer {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	if n := len(lp.free); n > 0 {
+		buf := lp.free[n-1]
+		lp.free = lp.free[:n-1]
+		buf.Grow(size)
+		return buf
+	}
+	return bytes.NewBuffer(make([]byte, 0, size))
+}
+
+func (lp *lockedPool) Put(buf *bytes.Buffer) {
+	buf.Reset()
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	lp.free = append(lp.free, buf)
+}
+
+// BenchmarkBufferPool gets and puts buffers from all procs at once, run it with -cpu 1,4,16 to see the contention.
+func BenchmarkBufferPool(b *testing.B) {
+	for _, size := range []int{512, 16 * 1024} {
+		body := bytes.Repeat([]byte("a"), size)
+		for _, pool := range []struct {
+			name string
+			p    BufferPool
+		}{
+			{"tiered", NewTieredPool()},
+			{"locked", &lockedPool{}},
+		} {
+			b.Run(fmt.Sprintf("%s/%d", pool.name, size), func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(int64(size))
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						buf := pool.p.Get(size)
+						buf.Write(body)
+						pool.p.Put(buf)
+					}
+				})
+			})
+		}
+	}
+}
@@ -5,20 +5,57 @@
 package codec
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"sync/atomic"
 )
 
-type Reader struct{ r io.Reader }
+// ErrInvalidFlags is returned for headers that set both type bits, which is no body type.
+var ErrInvalidFlags = errors.New("pkt-codec: invalid packet flags")
 
-func NewReader(r io.Reader) *Reader { return &Reader{r} }
+// ErrBodyTooLarge is returned for headers that announce a body larger than the limit of the Reader, see SetMaxBodySize.
+var ErrBodyTooLarge = errors.New("pkt-codec: packet body too large")
+
+// bodyChunk is how much of a body is allocated up front.
+// Larger bodies grow while their bytes arrive, so that a header alone can't make the reader allocate gigabytes.
+const bodyChunk = 64 * 1024
+
+type Reader struct {
+	// packets counts the headers that were read, accessed atomically
+	packets uint64
+	// bytes counts the headers and the bodies they announced, accessed atomically
+	bytes uint64
+
+	// maxBody is the largest body ReadHeader accepts, zero means no limit
+	maxBody uint32
+
+	r io.Reader
+}
+
+func NewReader(r io.Reader) *Reader { return &Reader{r: r} }
+
+// SetMaxBodySize makes ReadHeader fail with ErrBodyTooLarge for packets with a body larger than n bytes.
+// Zero (the default) means no limit. It must be called before the first read.
+func (r *Reader) SetMaxBodySize(n uint32) { r.maxBody = n }
+
+// PacketsRead returns how many packets were read so far. It is safe to call while reading.
+func (r *Reader) PacketsRead() uint64 { return atomic.LoadUint64(&r.packets) }
+
+// BytesRead returns the size of the packets that were read so far, headers included.
+// A body counts as soon as its header was read.
+func (r *Reader) BytesRead() uint64 { return atomic.LoadUint64(&r.bytes) }
+
+// Tap copies everything that is read from the underlying reader to w, for instance to trace the packets.
+// It must be called before the first read.
+func (r *Reader) Tap(w io.Writer) { r.r = io.TeeReader(r.r, w) }
 
 // ReadPacket decodes the header from the underlying reader, and reads as many bytes as specified in it
 // TODO: pass in packet pointer as arg to reduce allocations
-func (r Reader) ReadPacket() (*Packet, error) {
+func (r *Reader) ReadPacket() (*Packet, error) {
 	var hdr Header
 	err := r.ReadHeader(&hdr)
 	if err != nil {
@@ -29,49 +66,145 @@ func (r Reader) ReadPacket() (*Packet, error) {
 	var p = Packet{
 		Flag: hdr.Flag,
 		Req:  hdr.Req,
-		Body: make([]byte, hdr.Len), // yiiikes! lot's of single-use allocations
 	}
 
-	_, err = io.ReadFull(r.r, p.Body)
+	if hdr.Len <= bodyChunk {
+		p.Body = make([]byte, hdr.Len) // yiiikes! lot's of single-use allocations
+		_, err = io.ReadFull(r.r, p.Body)
+	} else {
+		var buf bytes.Buffer
+		err = r.readLargeBody(&buf, hdr.Len)
+		p.Body = buf.Bytes()
+	}
 	if err != nil {
-		if errors.Is(err, os.ErrClosed) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) {
-			return nil, err
-		}
-		return nil, fmt.Errorf("pkt-codec: read body failed: %w", err)
+		return nil, r.bodyError(err)
+	}
+
+	return &p, nil
+}
+
+// readLargeBody copies a body of n bytes to buf, which grows with the bytes that actually arrive
+func (r *Reader) readLargeBody(buf *bytes.Buffer, n uint32) error {
+	buf.Grow(bodyChunk)
+	_, err := io.CopyN(buf, r.r, int64(n))
+	return err
+}
+
+// bodyError wraps err of reading a body. The header promised the body, so an EOF means the stream was cut off.
+func (r *Reader) bodyError(err error) error {
+	if errors.Is(err, os.ErrClosed) || errors.Is(err, io.ErrClosedPipe) {
+		return err
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("pkt-codec: read body of packet %d failed: %w", r.PacketsRead(), err)
+}
+
+// PooledPacket is a Packet whose body is borrowed from a buffer pool.
+// The body is only valid until Release is called.
+type PooledPacket struct {
+	Packet
+
+	pool BufferPool
+	buf  *bytes.Buffer
+}
+
+// Release hands the body buffer back to the pool. It is safe to call it more than once.
+func (p *PooledPacket) Release() {
+	if p.buf == nil {
+		return
+	}
+	p.pool.Put(p.buf)
+	p.buf = nil
+	p.Body = nil
+}
+
+// ReadPacketInto works like ReadPacket but reads the body into a buffer from pool instead of allocating a new one for every packet.
+// The caller has to Release the packet once it is done with it.
+func (r *Reader) ReadPacketInto(pool BufferPool) (*PooledPacket, error) {
+	var hdr Header
+	err := r.ReadHeader(&hdr)
+	if err != nil {
+		return nil, err
+	}
+	return r.ReadPooledBody(pool, hdr)
+}
+
+// ReadPooledBody is the second half of ReadPacketInto, for callers that read the header with ReadHeader themselves.
+// It reads the body of the packet of hdr into a buffer from pool. The caller has to Release the packet once it is done with it.
+func (r *Reader) ReadPooledBody(pool BufferPool, hdr Header) (*PooledPacket, error) {
+	var err error
+
+	// like with ReadPacket, the header alone doesn't get a large body its buffer
+	size := int(hdr.Len)
+	if hdr.Len > bodyChunk {
+		size = bodyChunk
+	}
+	buf := pool.Get(size)
+
+	var p = PooledPacket{
+		Packet: Packet{
+			Flag: hdr.Flag,
+			Req:  hdr.Req,
+		},
+		pool: pool,
+		buf:  buf,
+	}
+
+	if hdr.Len <= bodyChunk {
+		buf.Grow(int(hdr.Len))
+		p.Body = buf.Bytes()[:hdr.Len]
+		_, err = io.ReadFull(r.r, p.Body)
+	} else {
+		err = r.readLargeBody(buf, hdr.Len)
+		p.Body = buf.Bytes()
+	}
+	if err != nil {
+		p.Release()
+		return nil, r.bodyError(err)
 	}
 
 	return &p, nil
 }
 
 // ReadHeader only reads the header packet data (flag, len, req id). Use the exposed io.Reader to read the body.
-func (r Reader) ReadHeader(hdr *Header) error {
+func (r *Reader) ReadHeader(hdr *Header) error {
 	err := binary.Read(r.r, binary.BigEndian, hdr)
 	if err != nil {
 		if errors.Is(err, os.ErrClosed) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) {
 			return io.EOF
 		}
-		return fmt.Errorf("pkt-codec: header read failed: %w", err)
+		return fmt.Errorf("pkt-codec: header read failed after %d packets: %w", r.PacketsRead(), err)
 	}
 
 	// detect EOF pkt
 	if hdr.Flag == 0 && hdr.Len == 0 && hdr.Req == 0 {
 		return io.EOF
 	}
+	if hdr.Flag.Get(FlagString | FlagJSON) {
+		return fmt.Errorf("pkt-codec: packet %d has flags %08b: %w", r.PacketsRead()+1, byte(hdr.Flag), ErrInvalidFlags)
+	}
+	if r.maxBody > 0 && hdr.Len > r.maxBody {
+		return fmt.Errorf("pkt-codec: packet %d announced %d bytes, the limit is %d: %w", r.PacketsRead()+1, hdr.Len, r.maxBody, ErrBodyTooLarge)
+	}
+	atomic.AddUint64(&r.packets, 1)
+	atomic.AddUint64(&r.bytes, HeaderLength+uint64(hdr.Len))
 	return nil
 }
 
-func (r Reader) NextBodyReader(pktLen uint32) io.Reader {
+func (r *Reader) NextBodyReader(pktLen uint32) io.Reader {
 	return io.LimitReader(r.r, int64(pktLen))
 }
 
-func (r Reader) ReadBodyInto(w io.Writer, pktLen uint32) error {
+func (r *Reader) ReadBodyInto(w io.Writer, pktLen uint32) error {
 	n, err := io.Copy(w, r.NextBodyReader(pktLen))
 	if err != nil {
 		return fmt.Errorf("pkt-codec: failed to read full body: %w", err)
 	}
 
 	if uint32(n) != pktLen {
-		return errors.New("pkt-codec: failed to read full body")
+		return fmt.Errorf("pkt-codec: body ended after %d of %d bytes: %w", n, pktLen, io.ErrUnexpectedEOF)
 	}
 
 	return nil
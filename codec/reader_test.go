@@ -11,13 +11,11 @@ import (
 	"os/exec"
 	"reflect"
 	"testing"
-
-	"go.mindeco.de/logging/logtest"
 )
 
 func TestReader(t *testing.T) {
 	cmd := exec.Command("node", "reader_test.js")
-	cmd.Stderr = logtest.Logger("reader_test.js", t)
+	cmd.Stderr = testLogger("reader_test.js", t)
 	out, err := cmd.StdoutPipe()
 	if err != nil {
 		t.Fatal(err)
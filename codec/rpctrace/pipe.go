@@ -6,22 +6,24 @@ package main
 
 import (
 	"io"
+	"log"
 	"os"
+	"os/exec"
 
-	"go.mindeco.de/logging"
-	"go.mindeco.de/proc"
-
+	"github.com/ssbc/go-muxrpc/v2"
 	"github.com/ssbc/go-muxrpc/v2/codec"
 )
 
 func main() {
-	logging.SetupLogging(nil)
-
-	serverConn, err := proc.StartStdioProcess("node", os.Stderr, "server.js")
-	logging.CheckFatal(err)
+	serverConn, err := startNode("server.js")
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	clientConn, err := proc.StartStdioProcess("node", os.Stderr, "client.js")
-	logging.CheckFatal(err)
+	clientConn, err := startNode("client.js")
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	server2client := io.TeeReader(serverConn, clientConn)
 	client2server := io.TeeReader(clientConn, serverConn)
@@ -29,13 +31,36 @@ func main() {
 	consume("c2s", client2server)
 }
 
+// startNode runs script with node and returns its stdout and stdin
+func startNode(script string) (io.ReadWriter, error) {
+	cmd := exec.Command("node", script)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Writer
+	}{stdout, stdin}, nil
+}
+
 func consume(prefix string, r io.Reader) {
 	pr := codec.NewReader(r)
-	l := logging.Logger(prefix)
+	l := muxrpc.LoggerWith(muxrpc.NewLogfmtLogger(os.Stderr), "module", prefix)
 	i := 0
 	for {
 		pkt, err := pr.ReadPacket()
-		logging.CheckFatal(err)
+		if err != nil {
+			log.Fatal(err)
+		}
 		l.Log("i", i, "pkt", pkt)
 		i++
 	}
@@ -57,3 +57,84 @@ func TestSelf(t *testing.T) {
 	}
 	t.Logf("done. tested %d pkts", i)
 }
+
+func TestWritePackets(t *testing.T) {
+	var single, batch bytes.Buffer
+
+	w := NewWriter(&single)
+	for _, p := range testPkts {
+		if err := w.WritePacket(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := NewWriter(&batch).WritePackets(testPkts...); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(single.Bytes(), batch.Bytes()) {
+		t.Errorf("batch encoding differs\nsingle: %x\n batch: %x", single.Bytes(), batch.Bytes())
+	}
+}
+
+func TestReadPacketInto(t *testing.T) {
+	var b bytes.Buffer
+	w := NewWriter(&b)
+	for _, p := range testPkts {
+		if err := w.WritePacket(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pool := NewTieredPool()
+
+	r := NewReader(&b)
+	for i, want := range testPkts {
+		got, err := r.ReadPacketInto(pool)
+		if err != nil {
+			t.Fatalf("pkt %d: %s", i, err)
+		}
+		if !reflect.DeepEqual(got.Packet, want) {
+			t.Errorf("pkt %d differs\ngot: %+v\nwant: %+v", i, got.Packet, want)
+		}
+		got.Release()
+		got.Release()
+		if got.Body != nil {
+			t.Errorf("pkt %d: body still set after release", i)
+		}
+	}
+
+	if _, err := r.ReadPacketInto(pool); err != io.EOF {
+		t.Fatal("expected EOF, got:", err)
+	}
+}
+
+func BenchmarkReadPacket(b *testing.B) {
+	var enc bytes.Buffer
+	w := NewWriter(&enc)
+	if err := w.WritePacket(Packet{Flag: FlagJSON | FlagStream, Req: 23, Body: bytes.Repeat([]byte("a"), 4096)}); err != nil {
+		b.Fatal(err)
+	}
+	raw := enc.Bytes()
+
+	b.Run("alloc", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := NewReader(bytes.NewReader(raw)).ReadPacket(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("pooled", func(b *testing.B) {
+		pool := NewTieredPool()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			p, err := NewReader(bytes.NewReader(raw)).ReadPacketInto(pool)
+			if err != nil {
+				b.Fatal(err)
+			}
+			p.Release()
+		}
+	})
+}
@@ -0,0 +1,28 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package codec
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// testLogger returns a writer that logs what is written to it with t, one line at a time, prefixed with name
+func testLogger(name string, t testing.TB) io.Writer {
+	return testWriter{name: name, t: t}
+}
+
+type testWriter struct {
+	name string
+	t    testing.TB
+}
+
+func (tw testWriter) Write(p []byte) (int, error) {
+	for _, line := range bytes.Split(bytes.TrimRight(p, "\n"), []byte("\n")) {
+		tw.t.Logf("%s: %q", tw.name, line)
+	}
+	return len(p), nil
+}
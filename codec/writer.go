@@ -5,21 +5,101 @@
 package codec
 
 import (
+	"bufio"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"math"
+	"net"
 	"sync"
+	"sync/atomic"
 )
 
 type Writer struct {
+	// packets counts the written packets, accessed atomically
+	packets uint64
+	// bytes counts the written packets with their headers, accessed atomically
+	bytes uint64
+
 	mu sync.Mutex
 
 	w io.Writer
+
+	// set by NewBufferedWriter. w is then the buffer and dst the actual destination.
+	buf *bufio.Writer
+	dst io.Writer
 }
 
 // NewWriter creates a new packet-stream writer
-func NewWriter(w io.Writer) *Writer { return &Writer{w: w} }
+func NewWriter(w io.Writer) *Writer { return &Writer{w: w, dst: w} }
+
+// NewBufferedWriter creates a packet-stream writer that collects packets in a buffer of the passed size
+// and only hands them to w once it is full, Flush is called or a packet ends a call or stream.
+// This trades a bit of latency for much less syscalls on busy connections.
+func NewBufferedWriter(w io.Writer, size int) *Writer {
+	buf := bufio.NewWriterSize(w, size)
+	return &Writer{w: buf, buf: buf, dst: w}
+}
+
+// PacketsWritten returns how many packets were written so far. It is safe to call while writing.
+func (w *Writer) PacketsWritten() uint64 { return atomic.LoadUint64(&w.packets) }
+
+// BytesWritten returns the size of the packets that were written so far, headers included.
+func (w *Writer) BytesWritten() uint64 { return atomic.LoadUint64(&w.bytes) }
+
+// Flush writes all buffered packets to the underlying writer. It is a no-op on unbuffered writers.
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.flush()
+}
+
+// Buffered returns how many bytes are held in the buffer and weren't handed to the underlying writer yet.
+// It is always zero for unbuffered writers.
+func (w *Writer) Buffered() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.buf == nil {
+		return 0
+	}
+	return w.buf.Buffered()
+}
+
+// Tap copies everything that is handed to the underlying writer to t as well, for instance to trace the packets.
+// It must be called before the first write. Buffered writers pass data on to t when they flush.
+func (w *Writer) Tap(t io.Writer) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.buf != nil {
+		w.buf = bufio.NewWriterSize(io.MultiWriter(w.dst, t), w.buf.Size())
+		w.w = w.buf
+		return
+	}
+	w.w = io.MultiWriter(w.w, t)
+}
+
+func (w *Writer) flush() error {
+	if w.buf == nil {
+		return nil
+	}
+	if err := w.buf.Flush(); err != nil {
+		return fmt.Errorf("pkt-codec: flush failed: %w", err)
+	}
+	return nil
+}
+
+// flushAfter flushes a buffered writer if p ends a call or a stream, so that the remote doesn't wait for it.
+func (w *Writer) flushAfter(pkts ...Packet) error {
+	if w.buf == nil {
+		return nil
+	}
+	for _, p := range pkts {
+		if !p.Flag.Get(FlagStream) || p.Flag.Get(FlagEndErr) {
+			return w.flush()
+		}
+	}
+	return nil
+}
 
 // WritePacket creates an header for the Packet and writes it and the body to the underlying writer
 func (w *Writer) WritePacket(r Packet) error {
@@ -37,28 +117,130 @@ func (w *Writer) WritePacket(r Packet) error {
 		Req:  r.Req,
 	}
 
-	if err := binary.Write(w.w, binary.BigEndian, hdr); err != nil {
-		return fmt.Errorf("pkt-codec: header write failed: %w", err)
+	// the buffer already takes care of collecting small writes
+	if w.buf != nil {
+		var hdrBuf [HeaderLength]byte
+		if _, err := w.buf.Write(appendHeader(hdrBuf[:0], hdr)); err != nil {
+			return fmt.Errorf("pkt-codec: header write failed: %w", err)
+		}
+		if _, err := w.buf.Write(r.Body); err != nil {
+			return fmt.Errorf("pkt-codec: packet write failed: %w", err)
+		}
+		atomic.AddUint64(&w.packets, 1)
+		atomic.AddUint64(&w.bytes, HeaderLength+uint64(bodyLen))
+		return w.flushAfter(r)
+	}
+
+	// small packets are copied behind the header so that both go out with one write
+	if bodyLen <= maxCoalesceSize {
+		bp := coalescePool.Get().(*[]byte)
+		buf := appendHeader((*bp)[:0], hdr)
+		buf = append(buf, r.Body...)
+
+		_, err := w.w.Write(buf)
+		*bp = buf
+		coalescePool.Put(bp)
+		if err != nil {
+			return fmt.Errorf("pkt-codec: packet write failed: %w", err)
+		}
+		atomic.AddUint64(&w.packets, 1)
+		atomic.AddUint64(&w.bytes, HeaderLength+uint64(bodyLen))
+		return nil
 	}
 
-	if _, err := w.w.Write(r.Body); err != nil {
-		return fmt.Errorf("pkt-codec: body write failed: %w", err)
+	// large ones are handed over as a vector, which uses writev(2) on network connections
+	var hdrBuf [HeaderLength]byte
+	bufs := net.Buffers{appendHeader(hdrBuf[:0], hdr), r.Body}
+	if _, err := bufs.WriteTo(w.w); err != nil {
+		return fmt.Errorf("pkt-codec: packet write failed: %w", err)
 	}
+	atomic.AddUint64(&w.packets, 1)
+	atomic.AddUint64(&w.bytes, HeaderLength+uint64(bodyLen))
 
 	return nil
 }
 
-// Close sends 9 zero bytes and also closes it's underlying writer if it is also an io.Closer
-func (w *Writer) Close() error {
+// maxCoalesceSize is the largest body that is copied into one buffer together with the header
+const maxCoalesceSize = 16 * 1024
+
+var coalescePool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, HeaderLength+maxCoalesceSize)
+		return &b
+	},
+}
+
+// WritePackets encodes all the passed packets into one buffer and writes it with a single call to the underlying writer.
+// This saves syscalls and network segments when many small packets are sent at once.
+func (w *Writer) WritePackets(pkts ...Packet) error {
+	total := 0
+	for _, p := range pkts {
+		bodyLen := len(p.Body)
+		if bodyLen > math.MaxUint32 {
+			return fmt.Errorf("pkt-codec: body too large (%d)", bodyLen)
+		}
+		total += HeaderLength + bodyLen
+	}
+
+	buf := make([]byte, 0, total)
+	for _, p := range pkts {
+		buf = appendHeader(buf, Header{
+			Flag: p.Flag,
+			Len:  uint32(len(p.Body)),
+			Req:  p.Req,
+		})
+		buf = append(buf, p.Body...)
+	}
+
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
+	if _, err := w.w.Write(buf); err != nil {
+		return fmt.Errorf("pkt-codec: batch write failed: %w", err)
+	}
+	atomic.AddUint64(&w.packets, uint64(len(pkts)))
+	atomic.AddUint64(&w.bytes, uint64(total))
+
+	return w.flushAfter(pkts...)
+}
+
+// HeaderLength is the size of an encoded Header
+const HeaderLength = 9
+
+func appendHeader(buf []byte, hdr Header) []byte {
+	var enc [HeaderLength]byte
+	enc[0] = byte(hdr.Flag)
+	binary.BigEndian.PutUint32(enc[1:5], hdr.Len)
+	binary.BigEndian.PutUint32(enc[5:9], uint32(hdr.Req))
+	return append(buf, enc[:]...)
+}
+
+// Goodbye sends the packet that ends a packet-stream, without closing the underlying writer.
+// The remote should close the connection once it sees it.
+func (w *Writer) Goodbye() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.goodbye()
+}
+
+func (w *Writer) goodbye() error {
 	_, err := w.w.Write([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0})
 	if err != nil {
 		return fmt.Errorf("pkt-codec: failed to write Close() packet: %w", err)
 	}
+	return w.flush()
+}
+
+// Close sends 9 zero bytes and also closes it's underlying writer if it is also an io.Closer
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.goodbye(); err != nil {
+		return err
+	}
 
-	if c, ok := w.w.(io.Closer); ok {
+	if c, ok := w.dst.(io.Closer); ok {
 		if err := c.Close(); err != nil {
 			return fmt.Errorf("pkt-codec: failed to close underlying writer: %w", err)
 		}
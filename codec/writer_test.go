@@ -6,19 +6,20 @@ package codec
 
 import (
 	"bytes"
+	"fmt"
+	"io"
 	"math"
 	"os/exec"
 	"testing"
 
 	"github.com/stretchr/testify/require"
-	"go.mindeco.de/logging/logtest"
 )
 
 func TestWriter(t *testing.T) {
 	// setup node receiver
 	cmd := exec.Command("node", "writer_test.js")
-	cmd.Stdout = logtest.Logger("writer_test.js", t)
-	cmd.Stderr = logtest.Logger("writer_test.js", t)
+	cmd.Stdout = testLogger("writer_test.js", t)
+	cmd.Stderr = testLogger("writer_test.js", t)
 	in, err := cmd.StdinPipe()
 	if err != nil {
 		t.Fatal(err)
@@ -62,3 +63,122 @@ func TestWriteTooLarge(t *testing.T) {
 
 	r.Equal(0, in.Len(), "expected no bytes written")
 }
+
+// countingWriter counts the writes and bytes that it gets and passes them on to w, if it is set
+type countingWriter struct {
+	writes int
+	n      int
+
+	w io.Writer
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	cw.writes++
+	cw.n += len(b)
+	if cw.w != nil {
+		return cw.w.Write(b)
+	}
+	return len(b), nil
+}
+
+// TestWriterCoalescing checks that header and body, and a burst of packets, reach the connection with a single Write
+func TestWriterCoalescing(t *testing.T) {
+	r := require.New(t)
+
+	var out bytes.Buffer
+	cw := countingWriter{w: &out}
+	w := NewWriter(&cw)
+
+	frame := Packet{Flag: FlagString | FlagStream, Req: 5, Body: []byte("frame")}
+	r.NoError(w.WritePacket(frame))
+	r.Equal(1, cw.writes, "header and body should go out together")
+
+	burst := make([]Packet, 100)
+	for i := range burst {
+		burst[i] = Packet{Flag: FlagString | FlagStream, Req: 5, Body: []byte(fmt.Sprint(i))}
+	}
+	r.NoError(w.WritePackets(burst...))
+	r.Equal(2, cw.writes, "the burst should go out at once")
+	r.EqualValues(101, w.PacketsWritten())
+
+	pkts, err := ReadAllPackets(NewReader(&out))
+	r.NoError(err)
+	r.Len(pkts, 101)
+	r.Equal("frame", string(pkts[0].Body))
+	for i, pkt := range pkts[1:] {
+		r.Equal(fmt.Sprint(i), string(pkt.Body))
+		r.EqualValues(5, pkt.Req)
+	}
+}
+
+func BenchmarkWritePacket(b *testing.B) {
+	for _, size := range []int{16, 512, 64 * 1024} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			var cw countingWriter
+			w := NewWriter(&cw)
+			pkt := Packet{
+				Flag: FlagJSON | FlagStream,
+				Req:  23,
+				Body: bytes.Repeat([]byte("a"), size),
+			}
+
+			b.ReportAllocs()
+			b.SetBytes(int64(HeaderLength + size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := w.WritePacket(pkt); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(cw.writes)/float64(b.N), "writes/op")
+		})
+	}
+}
+
+// TestWritePacketAllocs guards the allocations of the hot path of the writer, they only add up under load
+func TestWritePacketAllocs(t *testing.T) {
+	pkt := Packet{Flag: FlagJSON | FlagStream, Req: 23, Body: bytes.Repeat([]byte("a"), 512)}
+
+	var cw countingWriter
+	w := NewWriter(&cw)
+	if n := testing.AllocsPerRun(100, func() { w.WritePacket(pkt) }); n > 0 {
+		t.Errorf("unbuffered WritePacket allocates %v times", n)
+	}
+
+	// the header escapes into the bufio.Writer
+	bw := NewBufferedWriter(&cw, 64*1024)
+	if n := testing.AllocsPerRun(100, func() { bw.WritePacket(pkt) }); n > 1 {
+		t.Errorf("buffered WritePacket allocates %v times", n)
+	}
+}
+
+func TestBufferedWriter(t *testing.T) {
+	r := require.New(t)
+
+	var cw countingWriter
+	w := NewBufferedWriter(&cw, 4096)
+
+	frame := Packet{Flag: FlagString | FlagStream, Req: 5, Body: []byte("frame")}
+	for i := 0; i < 10; i++ {
+		r.NoError(w.WritePacket(frame))
+	}
+	r.Equal(0, cw.writes, "stream frames should stay in the buffer")
+
+	r.NoError(w.Flush())
+	r.Equal(1, cw.writes)
+	r.Equal(10*(HeaderLength+5), cw.n)
+
+	r.NoError(w.WritePacket(frame))
+	end := Packet{Flag: FlagJSON | FlagStream | FlagEndErr, Req: 5, Body: []byte("true")}
+	r.NoError(w.WritePacket(end))
+	r.Equal(2, cw.writes, "end of stream should flush")
+
+	r.NoError(w.WritePacket(Packet{Flag: FlagJSON, Req: -6, Body: []byte("{}")}))
+	r.Equal(3, cw.writes, "async reply should flush")
+
+	r.NoError(w.WritePacket(frame))
+	r.NoError(w.Close())
+	r.Equal(4, cw.writes, "close should write goodbye and pending frames at once")
+	frames := 12 * (HeaderLength + 5)
+	r.Equal(frames+(HeaderLength+4)+(HeaderLength+2)+HeaderLength, cw.n)
+}
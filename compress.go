@@ -0,0 +1,84 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// WithCompression compresses the bodies larger than threshold bytes that are sent in reply to calls of the passed methods,
+// see ByteSink.SetCompression. It only does so if both ends negotiated FeatureCompression (see WithHello),
+// the other end refuses compressed bodies otherwise.
+func WithCompression(threshold int, methods ...Method) HandleOption {
+	return func(r *rpc) {
+		if r.compressMethods == nil {
+			r.compressMethods = make(map[string]struct{})
+		}
+		for _, m := range methods {
+			r.compressMethods[m.String()] = struct{}{}
+		}
+		r.compressAbove = threshold
+	}
+}
+
+// SetCompression makes the sink gzip the bodies of writes that are larger than threshold bytes, if that makes them smaller.
+// They are flagged with codec.FlagGzip and the receiving ByteSource decompresses them again. Compression happens before chunking (see SetChunkSize).
+// Only use it if the session negotiated FeatureCompression (see WithHello), endpoints refuse compressed bodies otherwise.
+// Zero (the default) disables it.
+func (bs *ByteSink) SetCompression(threshold int) {
+	bs.closedMu.Lock()
+	defer bs.closedMu.Unlock()
+	bs.compressAbove = threshold
+}
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(nil) },
+}
+
+func compressBody(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(zw)
+	zw.Reset(&buf)
+
+	if _, err := zw.Write(b); err != nil {
+		return nil, fmt.Errorf("muxrpc: failed to compress body: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("muxrpc: failed to compress body: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// inflateBody decompresses a body with codec.FlagGzip. Bodies that grow beyond max bytes fail with ErrPacketTooLarge.
+func inflateBody(pktLen uint32, r io.Reader, max uint32) ([]byte, error) {
+	zr, err := gzip.NewReader(io.LimitReader(r, int64(pktLen)))
+	if err != nil {
+		return nil, fmt.Errorf("muxrpc: failed to decompress body: %w", err)
+	}
+	defer zr.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(zr, int64(max)+1))
+	if err != nil {
+		return nil, fmt.Errorf("muxrpc: failed to decompress body: %w", err)
+	}
+	if uint64(len(body)) > uint64(max) {
+		return nil, fmt.Errorf("muxrpc: decompressed body exceeds %d bytes: %w", max, ErrPacketTooLarge)
+	}
+	return body, nil
+}
+
+// compressionFor returns the compression threshold for the sinks of incoming calls to m
+func (r *rpc) compressionFor(m Method) int {
+	if _, ok := r.compressMethods[m.String()]; ok && r.negotiated(FeatureCompression) {
+		return r.compressAbove
+	}
+	return 0
+}
@@ -0,0 +1,134 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ssbc/go-muxrpc/v2/codec"
+)
+
+func TestCompression(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+
+	opts := []HandleOption{WithoutManifest(), WithLogger(NopLogger())}
+	client, _ := NewPipe(&FakeHandler{}, Echo, WithPipeHandleOptions(
+		append(opts, WithHello(FeatureCompression)),
+		append(opts, WithHello(FeatureCompression), WithCompression(64, Method{"echo"})),
+	))
+	defer client.Terminate()
+
+	verbose := strings.Repeat(`{"author":"@feed","sequence":1}`, 100)
+	before := ConnStats(client).BytesRead
+
+	src, err := client.Source(ctx, TypeJSON, Method{"echo"}, verbose, "short")
+	r.NoError(err)
+	var got []string
+	for src.Next(ctx) {
+		b, err := src.Bytes()
+		r.NoError(err)
+		got = append(got, string(b))
+	}
+	r.NoError(src.Err())
+	quoted, err := json.Marshal(verbose)
+	r.NoError(err)
+	r.Equal([]string{string(quoted), `"short"`}, got)
+
+	read := ConnStats(client).BytesRead - before
+	r.True(read < uint64(len(verbose)), "read %d bytes for %d bytes of frames", read, len(verbose))
+
+	// other methods are sent as they are
+	var v interface{}
+	before = ConnStats(client).BytesRead
+	r.NoError(client.Async(ctx, &v, TypeJSON, Method{"other"}, verbose))
+	r.Equal(verbose, v)
+	r.True(ConnStats(client).BytesRead-before > uint64(len(verbose)))
+}
+
+func TestCompressionLimit(t *testing.T) {
+	r := require.New(t)
+
+	zb, err := compressBody(make([]byte, 1024))
+	r.NoError(err)
+
+	ctx := context.Background()
+	bpool := codec.NewTieredPool()
+	src := newByteSource(ctx, bpool)
+	src.maxFrame = 512
+
+	err = src.consume(uint32(len(zb)), codec.FlagStream|codec.FlagGzip, bytes.NewReader(zb))
+	r.True(errors.Is(err, ErrPacketTooLarge), "unexpected error: %v", err)
+
+	src.maxFrame = 1024
+	r.NoError(src.consume(uint32(len(zb)), codec.FlagStream|codec.FlagGzip, bytes.NewReader(zb)))
+	r.True(src.Next(ctx))
+	b, err := src.Bytes()
+	r.NoError(err)
+	r.Len(b, 1024)
+}
+
+func TestCompressionDefaultLimit(t *testing.T) {
+	r := require.New(t)
+
+	// a small packet that would inflate to more than the default limit
+	zb, err := compressBody(make([]byte, defaultFrameLimit+1))
+	r.NoError(err)
+	r.True(len(zb) < 1<<20)
+
+	ctx := context.Background()
+	src := newByteSource(ctx, codec.NewTieredPool())
+	err = src.consume(uint32(len(zb)), codec.FlagStream|codec.FlagGzip, bytes.NewReader(zb))
+	r.True(errors.Is(err, ErrPacketTooLarge), "unexpected error: %v", err)
+}
+
+func TestCompressionBudget(t *testing.T) {
+	r := require.New(t)
+
+	zb, err := compressBody(make([]byte, 1024))
+	r.NoError(err)
+
+	ctx := context.Background()
+	src := newByteSource(ctx, codec.NewTieredPool())
+	src.buf.budget = &memoryBudget{limit: 512, freed: make(chan struct{})}
+
+	// with something already buffered, the inflated frame has to fit into what is left
+	r.NoError(src.consume(4, codec.FlagStream, strings.NewReader("{}{}")))
+	err = src.consume(uint32(len(zb)), codec.FlagStream|codec.FlagGzip, bytes.NewReader(zb))
+	r.True(errors.Is(err, ErrMemoryBudgetExceeded), "unexpected error: %v", err)
+}
+
+func TestCompressionNotNegotiated(t *testing.T) {
+	r := require.New(t)
+
+	zb, err := compressBody([]byte(`"hello"`))
+	r.NoError(err)
+
+	ctx := context.Background()
+	src := newByteSource(ctx, codec.NewTieredPool())
+	src.features = func(Feature) bool { return false }
+
+	err = src.consume(uint32(len(zb)), codec.FlagStream|codec.FlagGzip, bytes.NewReader(zb))
+	r.True(errors.Is(err, ErrFeatureNotNegotiated), "unexpected error: %v", err)
+
+	// without hello on both ends, the option doesn't compress anything
+	opts := []HandleOption{WithoutManifest(), WithLogger(NopLogger())}
+	client, _ := NewPipe(&FakeHandler{}, Echo, WithPipeHandleOptions(
+		opts,
+		append(opts, WithHello(FeatureCompression), WithCompression(8, Method{"echo"})),
+	))
+	defer client.Terminate()
+
+	var v interface{}
+	r.NoError(client.Async(ctx, &v, TypeJSON, Method{"echo"}, strings.Repeat("a", 100)))
+	r.Equal(strings.Repeat("a", 100), v)
+}
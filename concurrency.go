@@ -0,0 +1,91 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"sync"
+)
+
+// ErrTooManyCalls is returned to calls that exceed the concurrency limit of their method (see WithMethodConcurrency)
+// or the limit of open calls on the connection (see WithMaxOpenCalls).
+// The remote can retry them later, errors.Is matches the CallError it receives against it.
+var ErrTooManyCalls error = codedError{msg: "muxrpc: too many concurrent calls", code: CodeTooManyCalls}
+
+// WithMethodConcurrency limits how many calls to m from the remote run at once, to protect expensive handlers.
+// Up to queue calls over the limit wait for a slot, the ones after that are refused with ErrTooManyCalls.
+// A call holds its slot while HandleCall runs, so handlers of limited methods should not return before they are done with the call.
+// Only calls to exactly m are limited, not the ones to methods below it.
+func WithMethodConcurrency(m Method, max, queue int) HandleOption {
+	return func(r *rpc) {
+		if r.callLimits == nil {
+			r.callLimits = make(map[string]*callLimiter)
+		}
+		r.callLimits[m.String()] = &callLimiter{
+			slots: make(chan struct{}, max),
+			queue: queue,
+		}
+	}
+}
+
+// WithMaxOpenCalls limits how many calls can be open on the connection at once, in both directions together.
+// Calls from the remote over the limit are refused with ErrTooManyCalls, like local calls, which fail without being sent.
+// This keeps peers that open calls without ever closing them from growing the state of the connection without bounds.
+// Zero (the default) means no limit.
+func WithMaxOpenCalls(n int) HandleOption {
+	return func(r *rpc) {
+		r.maxOpen = n
+	}
+}
+
+// tooManyOpen is true if another call would exceed the limit of WithMaxOpenCalls. rLock needs to be held.
+func (r *rpc) tooManyOpen() bool {
+	return r.maxOpen > 0 && len(r.reqs) >= r.maxOpen
+}
+
+// callLimiter counts the running and waiting calls of a method
+type callLimiter struct {
+	slots chan struct{}
+
+	mu      sync.Mutex
+	queue   int
+	waiting int
+}
+
+// reserve takes a slot right away if there is one, otherwise it reserves a place in the queue.
+// It returns false if the queue is full as well.
+func (cl *callLimiter) reserve() (queued bool, ok bool) {
+	select {
+	case cl.slots <- struct{}{}:
+		return false, true
+	default:
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.waiting >= cl.queue {
+		return false, false
+	}
+	cl.waiting++
+	return true, true
+}
+
+// wait turns a place in the queue into a slot. It gives up the place if ctx is done before that.
+func (cl *callLimiter) wait(ctx context.Context) error {
+	defer func() {
+		cl.mu.Lock()
+		cl.waiting--
+		cl.mu.Unlock()
+	}()
+
+	select {
+	case cl.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (cl *callLimiter) release() { <-cl.slots }
@@ -0,0 +1,119 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMethodConcurrency(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+
+	entered := make(chan struct{}, 3)
+	unblock := make(chan struct{})
+
+	var h FakeHandler
+	h.HandledReturns(true)
+	h.HandleCallCalls(func(ctx context.Context, req *Request) {
+		entered <- struct{}{}
+		<-unblock
+		req.Return(ctx, "done")
+	})
+
+	opts := []HandleOption{WithoutManifest(), WithLogger(NopLogger())}
+	client, server := NewPipe(&FakeHandler{}, &h, WithPipeHandleOptions(
+		opts,
+		append(opts, WithMethodConcurrency(Method{"slow"}, 1, 1)),
+	))
+	defer client.Terminate()
+
+	results := make(chan error, 3)
+	call := func(m string) {
+		var s string
+		results <- client.Async(ctx, &s, TypeString, Method{m})
+	}
+
+	// the first call runs
+	go call("slow")
+	<-entered
+
+	// the second one waits for it
+	go call("slow")
+	limit := server.(*rpc).callLimits["slow"]
+	r.Eventually(func() bool {
+		limit.mu.Lock()
+		defer limit.mu.Unlock()
+		return limit.waiting == 1
+	}, time.Second, time.Millisecond)
+
+	// the third one is refused
+	var s string
+	err := client.Async(ctx, &s, TypeString, Method{"slow"})
+	r.Error(err)
+	r.True(errors.Is(err, ErrTooManyCalls), "unexpected error: %v", err)
+
+	// other methods are not limited
+	go call("fast")
+	<-entered
+
+	close(unblock)
+	for i := 0; i < 3; i++ {
+		r.NoError(<-results)
+	}
+	r.Equal(3, h.HandleCallCallCount())
+}
+
+func TestMaxOpenCalls(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+
+	entered := make(chan struct{}, 3)
+	var h FakeHandler
+	h.HandledReturns(true)
+	h.HandleCallCalls(func(ctx context.Context, req *Request) {
+		entered <- struct{}{}
+		<-ctx.Done()
+	})
+
+	opts := []HandleOption{WithoutManifest(), WithLogger(NopLogger())}
+	client, server := NewPipe(&FakeHandler{}, &h, WithPipeHandleOptions(
+		opts,
+		append(opts, WithMaxOpenCalls(2)),
+	))
+	defer client.Terminate()
+
+	firstCtx, cancelFirst := context.WithCancel(ctx)
+	for _, ctx := range []context.Context{firstCtx, ctx} {
+		_, err := client.Source(ctx, TypeJSON, Method{"feed"})
+		r.NoError(err)
+		<-entered
+	}
+
+	// the third one is refused
+	src, err := client.Source(ctx, TypeJSON, Method{"feed"})
+	r.NoError(err)
+	r.False(src.Next(ctx))
+	r.True(errors.Is(src.Err(), ErrTooManyCalls), "unexpected error: %v", src.Err())
+
+	// closing one makes room for another
+	cancelFirst()
+	r.Eventually(func() bool {
+		return server.Stats().ActiveStreams == 1
+	}, time.Second, time.Millisecond)
+	_, err = client.Source(ctx, TypeJSON, Method{"feed"})
+	r.NoError(err)
+	<-entered
+
+	// the server can't open calls over the limit either
+	_, err = server.Source(ctx, TypeJSON, Method{"feed"})
+	r.True(errors.Is(err, ErrTooManyCalls), "unexpected error: %v", err)
+	r.Equal(3, h.HandleCallCallCount())
+}
@@ -0,0 +1,85 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"time"
+)
+
+// ConnectHook runs once a session started, usually to call the remote, like asking a connecting peer for its feeds.
+// edp can be used until ctx is done, which happens when the session ends.
+type ConnectHook func(ctx context.Context, edp Endpoint) error
+
+// ConnectHookOption configures a hook of WithConnectHook.
+type ConnectHookOption func(*connectHook)
+
+// HookRetry runs a hook that failed up to attempts more times.
+// The wait before the first retry is backoff and it doubles with every retry. Hooks are not retried once the session ended.
+func HookRetry(attempts int, backoff time.Duration) ConnectHookOption {
+	return func(ch *connectHook) {
+		ch.attempts, ch.backoff = attempts, backoff
+	}
+}
+
+// HookErrorHandler is told about hooks that failed for the last time. The error is logged in any case.
+func HookErrorHandler(fn func(name string, err error)) ConnectHookOption {
+	return func(ch *connectHook) {
+		ch.onError = fn
+	}
+}
+
+// WithConnectHook runs hook on a goroutine of its own once the session started, next to HandleConnect of the handler.
+// The manifest and hello of the remote are known by then. name identifies the hook in logs.
+// Hooks are an alternative to HandleConnect for things that don't belong to a handler, each with its own error handling.
+func WithConnectHook(name string, hook ConnectHook, opts ...ConnectHookOption) HandleOption {
+	ch := connectHook{name: name, fn: hook}
+	for _, o := range opts {
+		o(&ch)
+	}
+	return func(r *rpc) {
+		r.connectHooks = append(r.connectHooks, ch)
+	}
+}
+
+type connectHook struct {
+	name string
+	fn   ConnectHook
+
+	attempts int
+	backoff  time.Duration
+	onError  func(name string, err error)
+}
+
+// runConnectHook runs ch until it succeeds, its retries are used up or the session ended
+func (r *rpc) runConnectHook(ch connectHook) {
+	ctx := r.serveCtx
+	logger := LoggerWith(r.logger, "hook", ch.name)
+
+	backoff := ch.backoff
+	for attempt := 0; ; attempt++ {
+		err := ch.fn(ctx, r)
+		if err == nil {
+			return
+		}
+
+		if ctx.Err() != nil || attempt >= ch.attempts {
+			logWarn(logger).Log("event", "connect hook failed", "attempts", attempt+1, "err", err)
+			if ch.onError != nil {
+				ch.onError(ch.name, err)
+			}
+			return
+		}
+		logDebug(logger).Log("event", "connect hook failed", "retry", backoff, "err", err)
+
+		wait := r.clock.NewTimer(backoff)
+		select {
+		case <-wait.C():
+		case <-ctx.Done():
+			wait.Stop()
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,65 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectHook(t *testing.T) {
+	r := require.New(t)
+
+	var client FakeHandler
+	client.HandledCalls(func(m Method) bool { return true })
+	client.HandleCallCalls(func(ctx context.Context, req *Request) {
+		req.Return(ctx, "client")
+	})
+
+	var attempts int32
+	whoami := make(chan string, 1)
+	hook := func(ctx context.Context, edp Endpoint) error {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			return errors.New("not yet")
+		}
+		var who string
+		if err := edp.Async(ctx, &who, TypeString, Method{"whoami"}); err != nil {
+			return err
+		}
+		whoami <- who
+		return nil
+	}
+
+	failed := make(chan string, 1)
+	broken := func(context.Context, Endpoint) error { return errors.New("broken") }
+
+	opts := []HandleOption{WithoutManifest(), WithLogger(NopLogger())}
+	_, _ = NewPipe(&client, &FakeHandler{}, WithPipeHandleOptions(opts, append(opts,
+		WithConnectHook("whoami", hook, HookRetry(5, time.Millisecond)),
+		WithConnectHook("broken", broken, HookRetry(1, time.Millisecond), HookErrorHandler(func(name string, err error) {
+			failed <- name
+		})),
+	)))
+
+	select {
+	case who := <-whoami:
+		r.Equal("client", who)
+	case <-time.After(5 * time.Second):
+		t.Fatal("hook didn't call the client")
+	}
+	r.EqualValues(3, atomic.LoadInt32(&attempts))
+
+	select {
+	case name := <-failed:
+		r.Equal("broken", name)
+	case <-time.After(5 * time.Second):
+		t.Fatal("error handler wasn't called")
+	}
+}
@@ -0,0 +1,79 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// Keys of ConnMeta that the endpoint fills when the session starts.
+// The entries of ConnInfo.Meta of the transport are copied with their own keys.
+const (
+	// MetaRemoteKey is the authenticated key of the remote as a []byte, if the transport has one (see ConnInfo.Identity).
+	MetaRemoteKey = "muxrpc.remote-key"
+
+	// MetaFeatures are the features that both ends support as a []Feature, if the session was started WithHello.
+	MetaFeatures = "muxrpc.features"
+
+	// MetaConnectedAt is the time.Time at which the session was started.
+	MetaConnectedAt = "muxrpc.connected-at"
+)
+
+// ConnMeta is a key/value store for information about a connection, see Endpoint.Meta.
+// Applications can add their own entries, for instance the name of an authenticated user. It is safe for concurrent use.
+type ConnMeta struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+// Get returns the value of key.
+func (cm *ConnMeta) Get(key string) (interface{}, bool) {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	v, ok := cm.values[key]
+	return v, ok
+}
+
+// Set stores v under key, replacing what was there.
+func (cm *ConnMeta) Set(key string, v interface{}) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.values == nil {
+		cm.values = make(map[string]interface{})
+	}
+	cm.values[key] = v
+}
+
+// Keys returns the keys that are set, sorted.
+func (cm *ConnMeta) Keys() []string {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	keys := make([]string, 0, len(cm.values))
+	for k := range cm.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (cm *ConnMeta) fromConnInfo(info ConnInfo) {
+	for k, v := range info.Meta {
+		cm.Set(k, v)
+	}
+	if len(info.Identity) > 0 {
+		cm.Set(MetaRemoteKey, info.Identity)
+	}
+}
+
+// ConnMetaFromContext returns the metadata of the connection that the context passed to HandleCall or HandleConnect belongs to.
+func ConnMetaFromContext(ctx context.Context) (*ConnMeta, bool) {
+	edp, ok := EndpointFromContext(ctx)
+	if !ok {
+		return nil, false
+	}
+	return edp.Meta(), true
+}
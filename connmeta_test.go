@@ -0,0 +1,84 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnMeta(t *testing.T) {
+	r := require.New(t)
+
+	l, err := net.Listen("tcp", "localhost:0")
+	r.NoError(err)
+	t.Cleanup(func() { l.Close() })
+
+	srvTransport := StackTransport(NetTransport{Network: "tcp", Listener: l}, xorLayer(0x42, "client"))
+	clientTransport := StackTransport(NetTransport{Network: "tcp"}, xorLayer(0x42, "server"))
+
+	var srv FakeHandler
+	srv.HandledCalls(func(m Method) bool { return true })
+	srv.HandleCallCalls(func(ctx context.Context, req *Request) {
+		meta, ok := ConnMetaFromContext(ctx)
+		if !ok {
+			req.CloseWithError(errors.New("no conn meta"))
+			return
+		}
+		key, _ := meta.Get(MetaRemoteKey)
+		req.Return(ctx, string(key.([]byte)))
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := []HandleOption{WithoutManifest(), WithLogger(NopLogger()), WithHello(FeatureCompression)}
+	srvEdp := make(chan Endpoint, 1)
+	go func() {
+		edp, err := AcceptEndpoint(ctx, srvTransport, &srv, opts...)
+		if err != nil {
+			t.Error(err)
+			close(srvEdp)
+			return
+		}
+		srvEdp <- edp
+	}()
+
+	before := time.Now()
+	edp, err := DialEndpoint(ctx, clientTransport, l.Addr().String(), &FakeHandler{}, opts...)
+	r.NoError(err)
+	defer edp.Terminate()
+
+	var who string
+	r.NoError(edp.Async(ctx, &who, TypeString, Method{"whoami"}))
+	r.Equal("client", who)
+
+	r.Equal(l.Addr().String(), edp.RemoteAddr().String())
+	s := <-srvEdp
+	r.NotNil(s)
+	r.Equal(edp.LocalAddr().String(), s.RemoteAddr().String())
+	r.Equal(s.LocalAddr().String(), edp.RemoteAddr().String())
+
+	meta := edp.WithOptions(CallPriority(PriorityLow)).Meta()
+	key, ok := meta.Get(MetaRemoteKey)
+	r.True(ok)
+	r.Equal([]byte("server"), key)
+
+	features, ok := meta.Get(MetaFeatures)
+	r.True(ok)
+	r.Equal([]Feature{FeatureCompression}, features)
+
+	at, ok := meta.Get(MetaConnectedAt)
+	r.True(ok)
+	r.False(at.(time.Time).Before(before))
+
+	meta.Set("user", "alice")
+	r.Equal([]string{MetaConnectedAt, MetaFeatures, MetaRemoteKey, "user"}, edp.Meta().Keys())
+}
@@ -0,0 +1,40 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+type correlationCtxKeyType struct{}
+
+var correlationCtxKey correlationCtxKeyType
+
+// WithCorrelation returns a context that marks the calls started with it as part of the correlation id.
+// Their log lines carry it as the correlation field and Request.Correlation returns it.
+// ProxyTo does this for every call it forwards, so that the request ids on both connections can be linked.
+func WithCorrelation(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationCtxKey, id)
+}
+
+// CorrelationFromContext returns the id that was set with WithCorrelation.
+func CorrelationFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(correlationCtxKey).(string)
+	return id, ok && id != ""
+}
+
+// Correlation returns the id that links the request to calls on other connections, see WithCorrelation.
+// It is empty for requests that were not forwarded.
+func (req *Request) Correlation() string { return req.correlation }
+
+func newCorrelationID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
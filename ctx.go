@@ -65,3 +65,44 @@ func (ctx *closeCtx) Err() error {
 		return nil
 	}
 }
+
+type loggerCtxKeyType struct{}
+
+var loggerCtxKey loggerCtxKeyType
+
+func withLogger(ctx context.Context, l Logger) context.Context {
+	return context.WithValue(ctx, loggerCtxKey, l)
+}
+
+// LoggerFromContext returns the logger of the call that ctx was passed to, see WithLoggerProvider.
+// If ctx doesn't belong to a call, a no-op logger is returned.
+func LoggerFromContext(ctx context.Context) Logger {
+	l, ok := ctx.Value(loggerCtxKey).(Logger)
+	if !ok {
+		return NopLogger()
+	}
+	return l
+}
+
+// callLogger returns the logger that was put into ctx, for instance by an endpoint view with CallLogger, or the one of the session.
+func (r *rpc) callLogger(ctx context.Context) Logger {
+	if l, ok := ctx.Value(loggerCtxKey).(Logger); ok {
+		return l
+	}
+	return r.logger
+}
+
+type endpointCtxKeyType struct{}
+
+var endpointCtxKey endpointCtxKeyType
+
+func withEndpoint(ctx context.Context, edp Endpoint) context.Context {
+	return context.WithValue(ctx, endpointCtxKey, edp)
+}
+
+// EndpointFromContext returns the endpoint of the connection that the context passed to HandleCall or HandleConnect belongs to.
+// It can be used to call back to the peer and is safe to use concurrently from multiple goroutines, until the connection is terminated.
+func EndpointFromContext(ctx context.Context) (Endpoint, bool) {
+	edp, ok := ctx.Value(endpointCtxKey).(Endpoint)
+	return edp, ok
+}
@@ -5,13 +5,16 @@
 package muxrpc
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/ssbc/go-luigi"
+	"github.com/stretchr/testify/require"
 )
 
 func TestCloseContext(t *testing.T) {
@@ -74,3 +77,63 @@ func TestCloseContext(t *testing.T) {
 		t.Run(fmt.Sprintf("%d-%s", i, strings.Join(tc.closes, ",")), mkTest(tc))
 	}
 }
+
+type tenantKey struct{}
+
+// lockedBuffer is shared by the loggers of both ends of a test session.
+// The buffer isn't embedded, so that only the locked methods can be used.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (lb *lockedBuffer) Write(b []byte) (int, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.buf.Write(b)
+}
+
+func (lb *lockedBuffer) String() string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.buf.String()
+}
+
+func TestLoggerProvider(t *testing.T) {
+	r := require.New(t)
+
+	var logs lockedBuffer
+	srvLogger := NewLogfmtLogger(&logs)
+
+	sessCtx := context.WithValue(context.Background(), tenantKey{}, "acme")
+	provider := func(ctx context.Context, base Logger) Logger {
+		tenant, _ := ctx.Value(tenantKey{}).(string)
+		return LoggerWith(base, "tenant", tenant)
+	}
+
+	var srvH FakeHandler
+	srvH.HandledCalls(methodChecker("whoami"))
+	srvH.HandleCallCalls(func(ctx context.Context, req *Request) {
+		LoggerFromContext(ctx).Log("event", "handling")
+		req.Return(ctx, "test")
+	})
+
+	client, _ := connectPair(t, &FakeHandler{}, &srvH, nil, []HandleOption{
+		WithContext(sessCtx),
+		WithLogger(srvLogger),
+		WithLoggerProvider(provider),
+	})
+
+	var v string
+	err := client.Async(context.TODO(), &v, TypeString, Method{"whoami"})
+	r.NoError(err)
+	r.Equal("test", v)
+
+	out := logs.String()
+	r.Contains(out, "tenant=acme")
+	r.Contains(out, "method=whoami")
+	r.Contains(out, "event=handling")
+
+	// outside of a call there is nothing to log to
+	r.NotNil(LoggerFromContext(context.TODO()))
+}
@@ -12,12 +12,28 @@ import (
 
 	multierror "github.com/hashicorp/go-multierror"
 	"github.com/pkg/errors"
-	"go.mindeco.de/log"
 
 	"github.com/ssbc/go-muxrpc/v2/codec"
 )
 
-func newLogWriter(l log.Logger) *logWriter {
+// Logger receives the decoded packets as alternating keys and values.
+// It has the shape of muxrpc.Logger, which can be passed as it is.
+type Logger interface {
+	Log(keyvals ...interface{}) error
+}
+
+// with returns a Logger that prepends keyvals to every event
+func with(l Logger, keyvals ...interface{}) Logger {
+	return loggerFunc(func(kvs ...interface{}) error {
+		return l.Log(append(append([]interface{}(nil), keyvals...), kvs...)...)
+	})
+}
+
+type loggerFunc func(keyvals ...interface{}) error
+
+func (f loggerFunc) Log(keyvals ...interface{}) error { return f(keyvals...) }
+
+func newLogWriter(l Logger) *logWriter {
 	r, w := io.Pipe()
 
 	return &logWriter{
@@ -28,7 +44,7 @@ func newLogWriter(l log.Logger) *logWriter {
 }
 
 type logWriter struct {
-	l log.Logger
+	l Logger
 	r *codec.Reader
 	io.WriteCloser
 }
@@ -88,11 +104,11 @@ type closer func() error
 func (c closer) Close() error { return c() }
 
 // Wrap decodes every packet that passes through it and logs it
-func Wrap(l log.Logger, rwc io.ReadWriteCloser) io.ReadWriteCloser {
-	lwIn := newLogWriter(log.With(l, "dir", "in"))
+func Wrap(l Logger, rwc io.ReadWriteCloser) io.ReadWriteCloser {
+	lwIn := newLogWriter(with(l, "dir", "in"))
 	cnclIn, errChIn := lwIn.work()
 
-	lwOut := newLogWriter(log.With(l, "dir", "out"))
+	lwOut := newLogWriter(with(l, "dir", "out"))
 	cnclOut, errChOut := lwOut.work()
 
 	return struct {
@@ -165,6 +181,6 @@ func (conn *wrappedConn) Close() error {
 	return conn.rwc.Close()
 }
 
-func WrapConn(l log.Logger, conn net.Conn) net.Conn {
+func WrapConn(l Logger, conn net.Conn) net.Conn {
 	return &wrappedConn{conn, Wrap(l, conn)}
 }
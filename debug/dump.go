@@ -6,11 +6,10 @@ package debug
 
 import (
 	"io"
+	"log"
 	"net"
 	"os"
 	"path/filepath"
-
-	"go.mindeco.de/logging"
 )
 
 // Dump decodes every packet that passes through it and logs it
@@ -19,9 +18,13 @@ import (
 func Dump(path string, rwc io.ReadWriteCloser) io.ReadWriteCloser {
 	os.MkdirAll(path, 0700)
 	rx, err := os.Create(filepath.Join(path, "rx"))
-	logging.CheckFatal(err)
+	if err != nil {
+		log.Fatal(err)
+	}
 	tx, err := os.Create(filepath.Join(path, "tx"))
-	logging.CheckFatal(err)
+	if err != nil {
+		log.Fatal(err)
+	}
 	return struct {
 		io.Reader
 		io.Writer
@@ -0,0 +1,105 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+//go:build go1.18
+// +build go1.18
+
+package muxrpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// DuplexJSON is a duplex stream that receives values of type TIn and sends values of type TOut, both encoded as JSON.
+// It is meant for protocols like ebt.replicate where both sides send a stream of messages.
+type DuplexJSON[TIn, TOut any] struct {
+	src *ByteSource
+	snk *ByteSink
+
+	mu  sync.Mutex
+	err error
+}
+
+// NewDuplexJSON wraps the two halves of a duplex stream, for instance the ones of Request.ResponseSource and Request.ResponseSink.
+func NewDuplexJSON[TIn, TOut any](src *ByteSource, snk *ByteSink) *DuplexJSON[TIn, TOut] {
+	snk.SetEncoding(TypeJSON)
+	return &DuplexJSON[TIn, TOut]{src: src, snk: snk}
+}
+
+// CallDuplexJSON starts a duplex call to method on edp and wraps the returned stream.
+func CallDuplexJSON[TIn, TOut any](ctx context.Context, edp Endpoint, method Method, args ...interface{}) (*DuplexJSON[TIn, TOut], error) {
+	src, snk, err := edp.Duplex(ctx, TypeJSON, method, args...)
+	if err != nil {
+		return nil, err
+	}
+	return NewDuplexJSON[TIn, TOut](src, snk), nil
+}
+
+// Receive returns a channel with the values the remote sends. It is closed once the remote ends its side, the stream fails or ctx is done, Err tells which.
+// A frame that isn't a valid TIn ends the receiving side with an error. Receive must only be called once.
+func (d *DuplexJSON[TIn, TOut]) Receive(ctx context.Context) <-chan TIn {
+	ch := make(chan TIn)
+	go func() {
+		defer close(ch)
+		for d.src.Next(ctx) {
+			var v TIn
+			err := d.src.Reader(func(rd io.Reader) error {
+				return json.NewDecoder(rd).Decode(&v)
+			})
+			if err != nil {
+				err = fmt.Errorf("muxrpc: failed to decode frame: %w", err)
+				d.setErr(err)
+				d.src.Cancel(err)
+				return
+			}
+
+			select {
+			case ch <- v:
+			case <-ctx.Done():
+				d.setErr(ctx.Err())
+				return
+			}
+		}
+		d.setErr(d.src.Err())
+	}()
+	return ch
+}
+
+// Send encodes v as JSON and sends it to the remote.
+func (d *DuplexJSON[TIn, TOut]) Send(v TOut) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("muxrpc: failed to encode value: %w", err)
+	}
+	_, err = d.snk.Write(b)
+	return err
+}
+
+// Close ends the sending side, the remote can still send until it ends its side.
+func (d *DuplexJSON[TIn, TOut]) Close() error { return d.snk.Close() }
+
+// CloseWithError ends both sides and sends err to the remote.
+func (d *DuplexJSON[TIn, TOut]) CloseWithError(err error) error {
+	d.src.Cancel(err)
+	return d.snk.CloseWithError(err)
+}
+
+// Err returns why the channel of Receive was closed, or nil if the remote ended its side.
+func (d *DuplexJSON[TIn, TOut]) Err() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.err
+}
+
+func (d *DuplexJSON[TIn, TOut]) setErr(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err == nil {
+		d.err = err
+	}
+}
@@ -0,0 +1,62 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+//go:build go1.18
+// +build go1.18
+
+package muxrpc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDuplexJSON(t *testing.T) {
+	r := require.New(t)
+
+	var srv FakeHandler
+	srv.HandledCalls(func(m Method) bool { return true })
+	srv.HandleCallCalls(func(ctx context.Context, req *Request) {
+		src, err := req.ResponseSource()
+		if err != nil {
+			req.CloseWithError(err)
+			return
+		}
+		snk, err := req.ResponseSink()
+		if err != nil {
+			req.CloseWithError(err)
+			return
+		}
+
+		d := NewDuplexJSON[int, int](src, snk)
+		for v := range d.Receive(ctx) {
+			if err := d.Send(v * 2); err != nil {
+				return
+			}
+		}
+		d.Close()
+	})
+
+	opts := []HandleOption{WithoutManifest(), WithLogger(NopLogger())}
+	client, _ := connectPair(t, &FakeHandler{}, &srv, opts, opts)
+
+	ctx := context.Background()
+	d, err := CallDuplexJSON[int, int](ctx, client, Method{"double"})
+	r.NoError(err)
+
+	recv := d.Receive(ctx)
+	var got []int
+	for i := 1; i <= 3; i++ {
+		r.NoError(d.Send(i))
+		got = append(got, <-recv)
+	}
+	r.NoError(d.Close())
+
+	_, open := <-recv
+	r.False(open)
+	r.NoError(d.Err())
+	r.Equal([]int{2, 4, 6}, got)
+}
@@ -0,0 +1,224 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+// Package ebt implements the framing of ebt.replicate, the duplex call SSB peers use for epidemic broadcast tree replication.
+//
+// Both sides send notes, which tell the other side how far they got with every feed and whether they want to receive it,
+// and the messages the other side asked for. Notes are always JSON objects that map feed references to numbers.
+// Messages are JSON objects for the classic feed format and binary frames for formats like bendy butt.
+//
+//	s, err := ebt.Replicate(ctx, edp, ebt.Args{Version: 3, Format: "classic"})
+//	s.SendClock(ebt.Clock{feedRef: ebt.Note{Replicate: true, Receive: true, Seq: 42}})
+//	for s.Next(ctx) {
+//		f := s.Frame()
+//		...
+//	}
+//
+// This package only handles the framing, what to replicate is up to the application.
+package ebt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ssbc/go-muxrpc/v2"
+)
+
+// Method is the name of the replication call.
+var Method = muxrpc.Method{"ebt", "replicate"}
+
+// Args are the arguments of the replication call.
+type Args struct {
+	Version int    `json:"version"`
+	Format  string `json:"format,omitempty"`
+}
+
+// Note is what one side knows and wants of a feed.
+// On the wire it is a single number: -1 if the feed isn't replicated, otherwise the sequence shifted left by one,
+// with the lowest bit set if the sender doesn't want to receive messages of the feed.
+type Note struct {
+	// Replicate is false if the sender doesn't replicate the feed at all, the other fields are ignored then
+	Replicate bool
+
+	// Receive is true if the sender wants to get the messages of the feed that follow Seq
+	Receive bool
+
+	// Seq is the latest sequence of the feed that the sender has
+	Seq int64
+}
+
+// MarshalJSON encodes the note as a number.
+func (n Note) MarshalJSON() ([]byte, error) {
+	if !n.Replicate {
+		return []byte("-1"), nil
+	}
+	if n.Seq < 0 {
+		return nil, fmt.Errorf("ebt: negative sequence %d", n.Seq)
+	}
+	v := n.Seq << 1
+	if !n.Receive {
+		v |= 1
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON decodes a note from its number.
+func (n *Note) UnmarshalJSON(b []byte) error {
+	var v int64
+	if err := json.Unmarshal(b, &v); err != nil {
+		return fmt.Errorf("ebt: invalid note: %w", err)
+	}
+	if v < 0 {
+		*n = Note{}
+		return nil
+	}
+	*n = Note{
+		Replicate: true,
+		Receive:   v&1 == 0,
+		Seq:       v >> 1,
+	}
+	return nil
+}
+
+// Clock holds the notes of the feeds a side replicates, by feed reference.
+type Clock map[string]Note
+
+// Frame is something the remote sent, either a note or a message.
+type Frame struct {
+	// Clock is set if the frame was a note
+	Clock Clock
+
+	// Message is the encoded message if the frame wasn't a note.
+	// It is JSON for the classic format and Binary is false then.
+	Message []byte
+	Binary  bool
+}
+
+// IsNote is true if the frame is a clock update.
+func (f Frame) IsNote() bool { return f.Clock != nil }
+
+// Stream is the duplex stream of a replication call, on either side of it.
+type Stream struct {
+	src *muxrpc.ByteSource
+	snk *muxrpc.ByteSink
+
+	// sendMu keeps the encoding of a write together with it
+	sendMu sync.Mutex
+
+	cur Frame
+	err error
+}
+
+// NewStream wraps the halves of a replication call.
+// Handlers of Method pass the ones of Request.ResponseSource and Request.ResponseSink.
+func NewStream(src *muxrpc.ByteSource, snk *muxrpc.ByteSink) *Stream {
+	snk.SetEncoding(muxrpc.TypeJSON)
+	return &Stream{src: src, snk: snk}
+}
+
+// Replicate starts a replication call to edp.
+func Replicate(ctx context.Context, edp muxrpc.Endpoint, args Args) (*Stream, error) {
+	src, snk, err := edp.Duplex(ctx, muxrpc.TypeJSON, Method, args)
+	if err != nil {
+		return nil, err
+	}
+	return NewStream(src, snk), nil
+}
+
+// ParseArgs decodes the arguments of an incoming replication call.
+func ParseArgs(req *muxrpc.Request) (Args, error) {
+	var args []Args
+	if err := json.Unmarshal(req.RawArgs, &args); err != nil {
+		return Args{}, fmt.Errorf("ebt: invalid arguments: %w", err)
+	}
+	if len(args) != 1 {
+		return Args{}, errors.New("ebt: expected one argument")
+	}
+	return args[0], nil
+}
+
+// Next blocks until the remote sent the next frame. It returns false once the stream ended or failed, see Err.
+func (s *Stream) Next(ctx context.Context) bool {
+	if s.err != nil || !s.src.Next(ctx) {
+		return false
+	}
+
+	body, err := s.src.Bytes()
+	if err != nil {
+		s.err = err
+		return false
+	}
+
+	s.cur = parseFrame(body)
+	return true
+}
+
+// Frame returns what Next read.
+func (s *Stream) Frame() Frame { return s.cur }
+
+// Err returns why Next returned false, or nil if the remote ended the stream.
+func (s *Stream) Err() error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.src.Err()
+}
+
+// parseFrame tells notes from messages. Notes are JSON objects with only numbers as values,
+// everything else, including JSON objects of the classic format, is a message.
+func parseFrame(body []byte) Frame {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return Frame{Message: body, Binary: !json.Valid(body)}
+	}
+
+	clock := make(Clock, len(obj))
+	for ref, raw := range obj {
+		var n Note
+		if err := n.UnmarshalJSON(raw); err != nil {
+			return Frame{Message: body}
+		}
+		clock[ref] = n
+	}
+	return Frame{Clock: clock}
+}
+
+// SendClock sends notes for the feeds in c.
+func (s *Stream) SendClock(c Clock) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return s.send(muxrpc.TypeJSON, b)
+}
+
+// SendMessage sends a message of the classic format, msg has to be its JSON encoding.
+func (s *Stream) SendMessage(msg json.RawMessage) error {
+	return s.send(muxrpc.TypeJSON, msg)
+}
+
+// SendBinaryMessage sends a message of a binary format, like bendy butt.
+func (s *Stream) SendBinaryMessage(msg []byte) error {
+	return s.send(muxrpc.TypeBinary, msg)
+}
+
+func (s *Stream) send(re muxrpc.RequestEncoding, b []byte) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	s.snk.SetEncoding(re)
+	_, err := s.snk.Write(b)
+	return err
+}
+
+// Close ends the sending side of the stream.
+func (s *Stream) Close() error { return s.snk.Close() }
+
+// CloseWithError ends both sides of the stream and sends err to the remote.
+func (s *Stream) CloseWithError(err error) error {
+	s.src.Cancel(err)
+	return s.snk.CloseWithError(err)
+}
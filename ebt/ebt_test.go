@@ -0,0 +1,113 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package ebt
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ssbc/go-muxrpc/v2"
+)
+
+func TestNoteEncoding(t *testing.T) {
+	r := require.New(t)
+
+	for _, tc := range []struct {
+		note Note
+		wire string
+	}{
+		{Note{}, "-1"},
+		{Note{Replicate: true, Receive: true, Seq: 0}, "0"},
+		{Note{Replicate: true, Receive: true, Seq: 42}, "84"},
+		{Note{Replicate: true, Receive: false, Seq: 42}, "85"},
+	} {
+		b, err := json.Marshal(tc.note)
+		r.NoError(err)
+		r.Equal(tc.wire, string(b))
+
+		var n Note
+		r.NoError(json.Unmarshal(b, &n))
+		r.Equal(tc.note, n)
+	}
+}
+
+func TestParseFrame(t *testing.T) {
+	r := require.New(t)
+
+	f := parseFrame([]byte(`{"@feed.ed25519":84,"@other.ed25519":-1}`))
+	r.True(f.IsNote())
+	r.Equal(Clock{
+		"@feed.ed25519":  {Replicate: true, Receive: true, Seq: 42},
+		"@other.ed25519": {},
+	}, f.Clock)
+
+	f = parseFrame([]byte(`{}`))
+	r.True(f.IsNote())
+
+	msg := `{"key":"%msg","value":{"author":"@feed.ed25519","sequence":43}}`
+	f = parseFrame([]byte(msg))
+	r.False(f.IsNote())
+	r.False(f.Binary)
+	r.Equal(msg, string(f.Message))
+
+	f = parseFrame([]byte{0x06, 0x03, 0xff})
+	r.False(f.IsNote())
+	r.True(f.Binary)
+}
+
+func TestReplicate(t *testing.T) {
+	r := require.New(t)
+
+	var srv muxrpc.FakeHandler
+	srv.HandledCalls(func(m muxrpc.Method) bool { return m.String() == Method.String() })
+	srv.HandleCallCalls(func(ctx context.Context, req *muxrpc.Request) {
+		args, err := ParseArgs(req)
+		if err != nil || args.Version != 3 {
+			req.CloseWithError(err)
+			return
+		}
+		src, _ := req.ResponseSource()
+		snk, _ := req.ResponseSink()
+		s := NewStream(src, snk)
+
+		s.SendClock(Clock{"@feed.ed25519": {Replicate: true, Receive: false, Seq: 1}})
+		for s.Next(ctx) {
+			f := s.Frame()
+			if f.IsNote() {
+				s.SendMessage(json.RawMessage(`{"author":"@feed.ed25519","sequence":2}`))
+				s.SendBinaryMessage([]byte{0x06, 0x03, 0xff})
+				s.Close()
+			}
+		}
+	})
+
+	opts := []muxrpc.HandleOption{muxrpc.WithoutManifest(), muxrpc.WithLogger(muxrpc.NopLogger())}
+	client, _ := muxrpc.NewPipe(&muxrpc.FakeHandler{}, &srv, muxrpc.WithPipeHandleOptions(opts, opts))
+	defer client.Terminate()
+
+	ctx := context.Background()
+	s, err := Replicate(ctx, client, Args{Version: 3, Format: "classic"})
+	r.NoError(err)
+
+	r.True(s.Next(ctx))
+	r.Equal(Clock{"@feed.ed25519": {Replicate: true, Receive: false, Seq: 1}}, s.Frame().Clock)
+
+	r.NoError(s.SendClock(Clock{"@feed.ed25519": {Replicate: true, Receive: true, Seq: 1}}))
+
+	r.True(s.Next(ctx))
+	r.False(s.Frame().IsNote())
+	r.False(s.Frame().Binary)
+
+	r.True(s.Next(ctx))
+	r.True(s.Frame().Binary)
+	r.Equal([]byte{0x06, 0x03, 0xff}, s.Frame().Message)
+
+	r.False(s.Next(ctx))
+	r.NoError(s.Err())
+	r.NoError(s.Close())
+}
@@ -0,0 +1,111 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// Echo is a Handler that answers every call with what it was sent.
+// Async calls return their first argument, sources send back each of their arguments as a frame,
+// sinks drain everything and duplex streams send back every frame they receive.
+// It is useful for tests and benchmarks.
+// The only call it doesn't handle is manifest, since there is no list of what it handles, so peers don't restrict their calls to one.
+var Echo Handler = echoHandler{}
+
+type echoHandler struct{}
+
+func (echoHandler) Handled(m Method) bool { return m.String() != "manifest" }
+
+func (echoHandler) HandleConnect(context.Context, Endpoint) {}
+
+func (echoHandler) HandleCall(ctx context.Context, req *Request) {
+	var args []json.RawMessage
+	if err := json.Unmarshal(req.RawArgs, &args); err != nil {
+		req.CloseWithError(fmt.Errorf("echo: invalid arguments: %w", err))
+		return
+	}
+
+	switch req.Type {
+	case "async", "sync":
+		var v json.RawMessage = []byte("null")
+		if len(args) > 0 {
+			v = args[0]
+		}
+		req.Return(ctx, v)
+
+	case "source":
+		snk, err := req.ResponseSink()
+		if err != nil {
+			req.CloseWithError(err)
+			return
+		}
+		snk.SetEncoding(TypeJSON)
+		for _, a := range args {
+			if _, err := snk.Write(a); err != nil {
+				req.CloseWithError(err)
+				return
+			}
+		}
+		snk.Close()
+
+	case "sink":
+		src, err := req.ResponseSource()
+		if err != nil {
+			req.CloseWithError(err)
+			return
+		}
+		for src.Next(ctx) {
+			if _, err := src.Bytes(); err != nil {
+				req.CloseWithError(err)
+				return
+			}
+		}
+		req.CloseWithError(src.Err())
+
+	case "duplex":
+		src, err := req.ResponseSource()
+		if err != nil {
+			req.CloseWithError(err)
+			return
+		}
+		snk, err := req.ResponseSink()
+		if err != nil {
+			req.CloseWithError(err)
+			return
+		}
+		req.CloseWithError(pumpFrames(ctx, snk, src))
+
+	default:
+		req.CloseWithError(ErrWrongStreamType{req.Type})
+	}
+}
+
+// noEncoding doesn't match the encoding of any frame, so that the first one always sets that of the sink
+const noEncoding = ^RequestEncoding(0)
+
+// pumpFrames copies all frames from src to snk, keeping their encoding.
+// It doesn't close snk and returns the error of src, if it has one.
+func pumpFrames(ctx context.Context, snk *ByteSink, src *ByteSource) error {
+	enc := noEncoding
+	for src.Next(ctx) {
+		b, err := src.Bytes()
+		if err != nil {
+			return err
+		}
+
+		if srcEnc := src.Encoding(); srcEnc != enc {
+			snk.SetEncoding(srcEnc)
+			enc = srcEnc
+		}
+
+		if _, err := snk.Write(b); err != nil {
+			return err
+		}
+	}
+	return src.Err()
+}
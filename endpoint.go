@@ -26,11 +26,29 @@ type Endpoint interface {
 
 	// Remote returns the network address of the remote
 	Remote() net.Addr
+
+	// RemoteAddr returns the network address of the remote, like Remote.
+	RemoteAddr() net.Addr
+
+	// LocalAddr returns the network address of this end of the connection, if the connection has one.
+	LocalAddr() net.Addr
+
+	// Meta returns what is known about the connection, like the key of the remote or when it connected.
+	// It is shared by all views of the endpoint.
+	Meta() *ConnMeta
+
+	// Stats returns a snapshot of the counters and open calls of the connection, see EndpointStats.
+	// It is safe to call at any time, also after the session ended.
+	Stats() EndpointStats
+
+	// WithOptions returns a view of the endpoint that applies the options to all calls made through it.
+	// Views are cheap and share the connection, so subsystems of an application can each have their own defaults.
+	WithOptions(opts ...CallOption) Endpoint
 }
 
 // HasMethod returns true if an endpoint supports a specific method
 func HasMethod(edp Endpoint, m Method) bool {
-	rpc, ok := edp.(*rpc)
+	rpc, ok := asRPC(edp)
 	if !ok {
 		log.Printf("[warning] muxrpc: %T is not a *rpc", edp)
 		return false
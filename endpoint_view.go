@@ -0,0 +1,167 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// CallOption changes how calls are made through an endpoint view, see Endpoint.WithOptions.
+type CallOption func(*callOptions)
+
+type callOptions struct {
+	encoding    RequestEncoding
+	hasEncoding bool
+
+	methodEncoding func(Method) (RequestEncoding, bool)
+
+	timeout     time.Duration
+	idleTimeout time.Duration
+
+	logger Logger
+
+	priority    Priority
+	hasPriority bool
+}
+
+// CallEncoding makes all calls of the view use re, regardless of the encoding that is passed to them.
+// Together with RegisterBodyCodec this lets a subsystem use its own codec.
+func CallEncoding(re RequestEncoding) CallOption {
+	return func(o *callOptions) {
+		o.encoding = re
+		o.hasEncoding = true
+	}
+}
+
+// CallEncodings looks up the encoding of each call by its method, like typemux.HandlerMux.Encoding does.
+// Methods it doesn't know use the encoding that is passed to the call. CallEncoding takes precedence over it.
+func CallEncodings(lookup func(Method) (RequestEncoding, bool)) CallOption {
+	return func(o *callOptions) {
+		o.methodEncoding = lookup
+	}
+}
+
+// CallTimeout limits how long async calls of the view may take.
+func CallTimeout(d time.Duration) CallOption {
+	return func(o *callOptions) {
+		o.timeout = d
+	}
+}
+
+// CallIdleTimeout sets the idle timeout of the sources returned by the view, see ByteSource.SetIdleTimeout.
+func CallIdleTimeout(d time.Duration) CallOption {
+	return func(o *callOptions) {
+		o.idleTimeout = d
+	}
+}
+
+// CallLogger sets the logger that is used for debug messages about the calls of the view.
+func CallLogger(l Logger) CallOption {
+	return func(o *callOptions) {
+		o.logger = l
+	}
+}
+
+// endpointView applies its options to the calls it passes on to the session
+type endpointView struct {
+	root *rpc
+	opts callOptions
+}
+
+var _ Endpoint = (*endpointView)(nil)
+
+// asRPC returns the session behind edp, looking through views
+func asRPC(edp Endpoint) (*rpc, bool) {
+	if view, ok := edp.(*endpointView); ok {
+		return view.root, true
+	}
+	r, ok := edp.(*rpc)
+	return r, ok
+}
+
+// WithOptions returns a view of the session with the passed options.
+func (r *rpc) WithOptions(opts ...CallOption) Endpoint {
+	v := &endpointView{root: r}
+	for _, o := range opts {
+		o(&v.opts)
+	}
+	return v
+}
+
+// WithOptions returns a new view that has the options of this one and the passed ones, the latter taking precedence.
+func (v *endpointView) WithOptions(opts ...CallOption) Endpoint {
+	nv := &endpointView{root: v.root, opts: v.opts}
+	for _, o := range opts {
+		o(&nv.opts)
+	}
+	return nv
+}
+
+func (v *endpointView) prepare(ctx context.Context, re RequestEncoding, method Method) (context.Context, RequestEncoding) {
+	if v.opts.logger != nil {
+		ctx = withLogger(ctx, v.opts.logger)
+	}
+	if v.opts.hasPriority {
+		ctx = withPriority(ctx, v.opts.priority)
+	}
+	if v.opts.hasEncoding {
+		re = v.opts.encoding
+	} else if v.opts.methodEncoding != nil {
+		if mre, ok := v.opts.methodEncoding(method); ok {
+			re = mre
+		}
+	}
+	return ctx, re
+}
+
+func (v *endpointView) idle(src *ByteSource) {
+	if src != nil && v.opts.idleTimeout > 0 {
+		src.SetIdleTimeout(v.opts.idleTimeout)
+	}
+}
+
+func (v *endpointView) Async(ctx context.Context, ret interface{}, re RequestEncoding, method Method, args ...interface{}) error {
+	ctx, re = v.prepare(ctx, re, method)
+	if v.opts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, v.opts.timeout)
+		defer cancel()
+	}
+	return v.root.Async(ctx, ret, re, method, args...)
+}
+
+func (v *endpointView) Source(ctx context.Context, re RequestEncoding, method Method, args ...interface{}) (*ByteSource, error) {
+	ctx, re = v.prepare(ctx, re, method)
+	src, err := v.root.Source(ctx, re, method, args...)
+	v.idle(src)
+	return src, err
+}
+
+func (v *endpointView) Sink(ctx context.Context, re RequestEncoding, method Method, args ...interface{}) (*ByteSink, error) {
+	ctx, re = v.prepare(ctx, re, method)
+	return v.root.Sink(ctx, re, method, args...)
+}
+
+func (v *endpointView) Duplex(ctx context.Context, re RequestEncoding, method Method, args ...interface{}) (*ByteSource, *ByteSink, error) {
+	ctx, re = v.prepare(ctx, re, method)
+	src, snk, err := v.root.Duplex(ctx, re, method, args...)
+	v.idle(src)
+	return src, snk, err
+}
+
+// Terminate ends the whole session, not just the view.
+func (v *endpointView) Terminate() error { return v.root.Terminate() }
+
+func (v *endpointView) Remote() net.Addr { return v.root.Remote() }
+
+func (v *endpointView) RemoteAddr() net.Addr { return v.root.RemoteAddr() }
+
+func (v *endpointView) LocalAddr() net.Addr { return v.root.LocalAddr() }
+
+func (v *endpointView) Meta() *ConnMeta { return v.root.Meta() }
+
+func (v *endpointView) Stats() EndpointStats { return v.root.Stats() }
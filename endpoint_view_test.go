@@ -0,0 +1,59 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEndpointView(t *testing.T) {
+	r := require.New(t)
+
+	var fh FakeHandler
+	fh.HandledReturns(true)
+	fh.HandleCallStub = func(ctx context.Context, req *Request) {
+		switch req.Method.String() {
+		case "hello":
+			req.Return(ctx, "world")
+		case "block":
+			// never answers, neither async nor source
+			<-ctx.Done()
+		default:
+			req.CloseWithError(ErrNoSuchMethod{req.Method})
+		}
+	}
+
+	client, _ := connectPair(t, &FakeHandler{}, &fh, nil, nil)
+	ctx := context.Background()
+
+	asStrings := client.WithOptions(CallEncoding(TypeString))
+	var s string
+	r.NoError(asStrings.Async(ctx, &s, TypeJSON, Method{"hello"}))
+	r.Equal("world", s)
+
+	hasty := asStrings.WithOptions(CallTimeout(50*time.Millisecond), CallIdleTimeout(50*time.Millisecond))
+	err := hasty.Async(ctx, &s, TypeJSON, Method{"block"})
+	r.True(errors.Is(err, context.DeadlineExceeded), "wrong error: %v", err)
+
+	src, err := hasty.Source(ctx, TypeJSON, Method{"block"})
+	r.NoError(err)
+	r.False(src.Next(ctx))
+	r.True(errors.Is(src.Err(), ErrStreamStalled), "wrong error: %v", src.Err())
+
+	// the options of the parent view are kept and the session isn't affected
+	r.NoError(hasty.Async(ctx, &s, TypeJSON, Method{"hello"}))
+	r.Equal("world", s)
+	err = client.Async(ctx, &s, TypeJSON, Method{"hello"})
+	r.Error(err, "the session shouldn't use the encoding of the view")
+
+	r.Equal(client.Remote(), hasty.Remote())
+	r.Equal(IsServer(client), IsServer(hasty))
+	r.Equal(HasMethod(client, Method{"hello"}), HasMethod(hasty, Method{"hello"}))
+}
@@ -12,14 +12,102 @@ import (
 	"io"
 	"net"
 	"os"
+	"strings"
 	"syscall"
+
+	"github.com/ssbc/go-muxrpc/v2/codec"
 )
 
 // ErrSessionTerminated is returned once Terminate() was called  or the connection dies
 var ErrSessionTerminated = errors.New("muxrpc: session terminated")
 
+// sessionTerminatedError matches ErrSessionTerminated but also carries the reason why the connection ended
+type sessionTerminatedError struct{ cause error }
+
+func newSessionTerminated(cause error) error {
+	if cause == nil {
+		return ErrSessionTerminated
+	}
+	return sessionTerminatedError{cause}
+}
+
+func (e sessionTerminatedError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrSessionTerminated, e.cause)
+}
+
+func (e sessionTerminatedError) Is(target error) bool { return target == ErrSessionTerminated }
+
+func (e sessionTerminatedError) Unwrap() error { return e.cause }
+
+// ErrPacketTooLarge is why a session ends if the remote sent a packet over the limit set with WithMaxPacketSize.
+// Calls that were open then fail with an error that matches it and ErrSessionTerminated.
+var ErrPacketTooLarge = codec.ErrBodyTooLarge
+
+// ErrNoResponse is returned when the remote didn't send anything for a call within the response timeout (see WithResponseTimeout).
+// Some peers silently drop calls to methods they don't know instead of answering with an error.
+var ErrNoResponse = errors.New("muxrpc: no response from remote")
+
+// ErrStreamStalled is returned by sources that didn't receive a frame within their idle timeout (see WithStreamIdleTimeout).
+// It tells a silent remote apart from a canceled context or a stream the remote ended.
+var ErrStreamStalled = errors.New("muxrpc: stream stalled")
+
+// ErrReadTimeout is what Err of a source returns after Next gave up because of the read deadline (see ByteSource.SetReadDeadline).
+// Unlike the other errors of a source it doesn't end the stream, Next can be called again.
+var ErrReadTimeout = errors.New("muxrpc: read deadline exceeded")
+
+// ErrWriteTimeout is returned by writes to a sink that didn't get their turn at the connection before the write deadline (see ByteSink.SetWriteDeadline).
+// Nothing of the write was sent and the stream stays open.
+var ErrWriteTimeout = errors.New("muxrpc: write deadline exceeded")
+
+// ErrWouldBlock is returned by ByteSink.TryWrite if the connection is busy with other writes. Nothing was sent.
+var ErrWouldBlock = errors.New("muxrpc: write would block")
+
+// ErrKeepAliveTimeout is the cause of sessions that were terminated because the remote didn't answer pings (see WithKeepAlive).
+var ErrKeepAliveTimeout = errors.New("muxrpc: keepalive timeout")
+
+// ErrIdleTimeout is the cause of sessions that were terminated because they weren't used for their idle timeout (see WithIdleTimeout).
+var ErrIdleTimeout = errors.New("muxrpc: idle timeout")
+
+// ErrFrameLoss is returned by sources that noticed a missing frame, which can only be detected in builds with the muxrpcdebug tag.
+var ErrFrameLoss = errors.New("muxrpc: frame loss detected")
+
+// ErrFeatureNotNegotiated is returned for streams that received packets using a protocol extension the session didn't agree on, see WithHello.
+var ErrFeatureNotNegotiated = errors.New("muxrpc: feature not negotiated")
+
+// ErrSourceHighWater is returned for incoming streams whose consumer fell behind by more than the high-water mark, see HighWaterFailStream.
+var ErrSourceHighWater = errors.New("muxrpc: stream buffered past its high-water mark")
+
 var errSinkClosed = stderr.New("muxrpc: pour to closed sink")
 
+// ErrWriteAfterClose matches the errors of writes to a ByteSink that was already closed.
+// If the sink was closed with an error, or because the session ended, the error wraps that as well.
+var ErrWriteAfterClose = errors.New("muxrpc: write after close")
+
+// ErrAlreadyClosed is returned by closing a ByteSink a second time. The end of the stream is only sent once.
+var ErrAlreadyClosed = errors.New("muxrpc: stream already closed")
+
+// writeAfterCloseError matches ErrWriteAfterClose and wraps the error the sink was closed with, if any
+type writeAfterCloseError struct{ cause error }
+
+func (e writeAfterCloseError) Error() string {
+	if e.cause == nil {
+		return ErrWriteAfterClose.Error()
+	}
+	return fmt.Sprintf("%s: %s", ErrWriteAfterClose, e.cause)
+}
+
+func (e writeAfterCloseError) Is(target error) bool { return target == ErrWriteAfterClose }
+
+func (e writeAfterCloseError) Unwrap() error { return e.cause }
+
+// ErrMethodNotFound matches calls to methods the remote doesn't offer, whether the local manifest check or the remote refused them.
+// Use it with errors.Is, ErrNoSuchMethod carries the method.
+var ErrMethodNotFound = errors.New("muxrpc: method not found")
+
+// ErrCallTypeMismatch matches calls that used a different type than the method has, whether the local manifest check or the remote refused them.
+// Use it with errors.Is, ErrWrongCallType carries the details.
+var ErrCallTypeMismatch = errors.New("muxrpc: wrong call type")
+
 type ErrNoSuchMethod struct {
 	Method Method
 }
@@ -28,17 +116,119 @@ func (e ErrNoSuchMethod) Error() string {
 	return fmt.Sprintf("muxrpc: no such command: %s", e.Method)
 }
 
-// CallError is returned when a call fails
+func (e ErrNoSuchMethod) Is(target error) bool { return target == ErrMethodNotFound }
+
+// ErrWrongCallType is returned when a method is called with a different type than the remote declared in its manifest,
+// like calling a source method with Async.
+type ErrWrongCallType struct {
+	Method Method
+
+	Called, Declared string
+}
+
+func (e ErrWrongCallType) Error() string {
+	return fmt.Sprintf("muxrpc: %s is a %s method, can't call it as %s", e.Method, e.Declared, e.Called)
+}
+
+func (e ErrWrongCallType) Is(target error) bool { return target == ErrCallTypeMismatch }
+
+// CallError is returned when a call fails. It is what the remote sent in the EndErr packet,
+// use errors.As with a *CallError to get to it.
 type CallError struct {
 	Name    string `json:"name"`
 	Message string `json:"message"`
 	Stack   string `json:"stack"`
+
+	// Code is optional, JS peers don't send one. See the Code constants.
+	Code int `json:"code,omitempty"`
 }
 
 func (e CallError) Error() string {
 	return fmt.Sprintf("muxrpc CallError: %s - %s", e.Name, e.Message)
 }
 
+// Codes of the errors this package sends. Handlers can send their own by returning errors that implement ErrorCoder.
+const (
+	CodeInvalidArgs   = 400
+	CodeNotAuthorized = 403
+	CodeNoSuchMethod  = 404
+	CodeWrongCallType = 405
+	CodeTooManyCalls  = 429
+	CodeShuttingDown  = 503
+)
+
+// ErrorCoder is implemented by errors that want to send a code with their CallError.
+type ErrorCoder interface {
+	ErrorCode() int
+}
+
+func (ErrNoSuchMethod) ErrorCode() int  { return CodeNoSuchMethod }
+func (ErrWrongCallType) ErrorCode() int { return CodeWrongCallType }
+
+// codedError is a sentinel error that is sent with a code
+type codedError struct {
+	msg  string
+	code int
+}
+
+func (e codedError) Error() string  { return e.msg }
+func (e codedError) ErrorCode() int { return e.code }
+
+// NoSuchMethod is true if the remote didn't know the called method.
+// Go peers send CodeNoSuchMethod, for JS peers the message is checked.
+func (e CallError) NoSuchMethod() bool {
+	if e.Code != 0 {
+		return e.Code == CodeNoSuchMethod
+	}
+	for _, msg := range []string{"no such command", "no such method", "not in list of allowed methods", "no method:"} {
+		if strings.Contains(e.Message, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// Is lets errors.Is match what the remote sent against ErrMethodNotFound, ErrCallTypeMismatch, ErrTooManyCalls, ErrNotAuthorized and ErrInvalidArgs.
+func (e CallError) Is(target error) bool {
+	switch target {
+	case ErrMethodNotFound:
+		return e.NoSuchMethod()
+	case ErrCallTypeMismatch:
+		return e.Code == CodeWrongCallType
+	case ErrTooManyCalls:
+		return e.Code == CodeTooManyCalls
+	case ErrNotAuthorized:
+		return e.Code == CodeNotAuthorized
+	case ErrInvalidArgs:
+		return e.Code == CodeInvalidArgs
+	}
+	return false
+}
+
+// IsNoSuchMethod is true if err says that the method wasn't found, either by the local manifest check or by the remote.
+// It is the same as errors.Is(err, ErrMethodNotFound).
+func IsNoSuchMethod(err error) bool {
+	return errors.Is(err, ErrMethodNotFound)
+}
+
+// newCallError turns err into what is sent to the remote. CallErrors, for instance from a proxied call, are passed on as they are.
+func newCallError(err error) CallError {
+	var ce *CallError
+	if errors.As(err, &ce) {
+		return *ce
+	}
+
+	e := CallError{
+		Name:    "Error",
+		Message: err.Error(),
+	}
+	var coder ErrorCoder
+	if errors.As(err, &coder) {
+		e.Code = coder.ErrorCode()
+	}
+	return e
+}
+
 func parseError(data []byte) (*CallError, error) {
 	var e CallError
 
@@ -71,7 +261,7 @@ func IsSinkClosed(err error) bool {
 		return true
 	}
 
-	if err == ErrSessionTerminated {
+	if errors.Is(err, ErrSessionTerminated) {
 		return true
 	}
 
@@ -0,0 +1,96 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type quotaError struct{}
+
+func (quotaError) Error() string  { return "quota exceeded" }
+func (quotaError) ErrorCode() int { return 429 }
+
+func TestCallErrorCodes(t *testing.T) {
+	r := require.New(t)
+
+	var srv FakeHandler
+	srv.HandledCalls(methodChecker("upload"))
+	srv.HandleCallCalls(func(ctx context.Context, req *Request) {
+		req.CloseWithError(fmt.Errorf("upload failed: %w", quotaError{}))
+	})
+
+	opts := []HandleOption{WithoutManifest()}
+	client, _ := connectPair(t, &FakeHandler{}, &srv, opts, opts)
+
+	ctx := context.Background()
+	var s string
+
+	err := client.Async(ctx, &s, TypeString, Method{"nope"})
+	r.True(IsNoSuchMethod(err), "unexpected error: %v", err)
+	var ce *CallError
+	r.True(errors.As(err, &ce))
+	r.Equal(CodeNoSuchMethod, ce.Code)
+
+	err = client.Async(ctx, &s, TypeString, Method{"upload"})
+	r.False(IsNoSuchMethod(err), "unexpected error: %v", err)
+	r.True(errors.As(err, &ce))
+	r.Equal(429, ce.Code)
+	r.Equal("upload failed: quota exceeded", ce.Message)
+	r.Equal("Error", ce.Name)
+}
+
+func TestCallErrorNoSuchMethod(t *testing.T) {
+	r := require.New(t)
+
+	// what JS peers send, without a code
+	r.True(CallError{Name: "Error", Message: "no method:blobs.nope"}.NoSuchMethod())
+	r.True(CallError{Name: "Error", Message: "method:blobs.nope is not in list of allowed methods"}.NoSuchMethod())
+	r.False(CallError{Name: "TypeError", Message: "cannot read property of undefined"}.NoSuchMethod())
+
+	// the code wins over the message
+	r.False(CallError{Message: "no such method", Code: 500}.NoSuchMethod())
+
+	// the local manifest check
+	r.True(IsNoSuchMethod(fmt.Errorf("call: %w", ErrNoSuchMethod{Method{"x"}})))
+	r.False(IsNoSuchMethod(errors.New("no such method")))
+}
+
+func TestNewCallErrorPassesOn(t *testing.T) {
+	r := require.New(t)
+
+	remote := &CallError{Name: "TypeError", Message: "boom", Stack: "at foo.js:1"}
+	r.Equal(*remote, newCallError(fmt.Errorf("proxied: %w", remote)))
+
+	r.Equal(CodeShuttingDown, newCallError(ErrShuttingDown).Code)
+}
+
+func TestCallErrorSentinels(t *testing.T) {
+	r := require.New(t)
+
+	// the body is what JS muxrpc sends as well, plus the code
+	body, err := json.Marshal(newCallError(ErrWrongCallType{Method: Method{"feed"}, Called: "async", Declared: "source"}))
+	r.NoError(err)
+	r.JSONEq(`{"name":"Error","message":"muxrpc: feed is a source method, can't call it as async","stack":"","code":405}`, string(body))
+
+	ce, err := parseError(body)
+	r.NoError(err)
+	r.True(errors.Is(ce, ErrCallTypeMismatch))
+	r.False(errors.Is(ce, ErrMethodNotFound))
+
+	ce, err = parseError([]byte(`{"name":"Error","message":"no method:blobs.nope"}`))
+	r.NoError(err)
+	r.True(errors.Is(fmt.Errorf("call failed: %w", ce), ErrMethodNotFound))
+	r.False(errors.Is(ce, ErrCallTypeMismatch))
+
+	r.True(errors.Is(ErrNoSuchMethod{Method{"x"}}, ErrMethodNotFound))
+	r.False(errors.Is(ErrNoSuchMethod{Method{"x"}}, ErrCallTypeMismatch))
+}
@@ -0,0 +1,117 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// ConnEventType is what happened to a connection, see ConnEvent.
+type ConnEventType uint
+
+// The events of a connection, in the order they happen.
+const (
+	// ConnEstablished is published when Handle set up the session, before anything was exchanged with the remote.
+	ConnEstablished ConnEventType = iota
+
+	// ConnHandshakeDone is published once the manifest and hello of the remote are known, right before HandleConnect.
+	ConnHandshakeDone
+
+	// ConnTerminated is published once when the session ended.
+	ConnTerminated
+)
+
+func (t ConnEventType) String() string {
+	switch t {
+	case ConnEstablished:
+		return "established"
+	case ConnHandshakeDone:
+		return "handshake-done"
+	case ConnTerminated:
+		return "terminated"
+	default:
+		return "unknown"
+	}
+}
+
+// ConnEvent tells the subscribers of an EventBus about a connection.
+type ConnEvent struct {
+	Type ConnEventType
+
+	// Endpoint is the session the event is about. Compare it to tell connections apart.
+	Endpoint Endpoint
+
+	Remote net.Addr
+	Time   time.Time
+
+	// Err is why the session ended, for ConnTerminated. It is nil if it was terminated locally.
+	Err error
+
+	// Streams is the number of calls that were still open when the session ended, for ConnTerminated.
+	Streams int
+}
+
+// EventBus passes the lifecycle events of connections to its subscribers.
+// One bus is usually shared by all the connections of an application (see WithEventBus), for instance to keep track of the connected peers.
+type EventBus struct {
+	mu     sync.Mutex
+	nextID uint
+	subs   map[uint]func(ConnEvent)
+}
+
+// NewEventBus returns a bus without subscribers.
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[uint]func(ConnEvent))}
+}
+
+// Subscribe calls fn for every event that is published from now on, until the returned function is called.
+// fn is called synchronously by the connection, so it must not block. It may call the endpoint of the event.
+func (b *EventBus) Subscribe(fn func(ConnEvent)) (unsubscribe func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.nextID
+	b.nextID++
+	b.subs[id] = fn
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subs, id)
+	}
+}
+
+// Publish passes ev to all current subscribers.
+func (b *EventBus) Publish(ev ConnEvent) {
+	b.mu.Lock()
+	subs := make([]func(ConnEvent), 0, len(b.subs))
+	for _, fn := range b.subs {
+		subs = append(subs, fn)
+	}
+	b.mu.Unlock()
+
+	for _, fn := range subs {
+		fn(ev)
+	}
+}
+
+// WithEventBus publishes the lifecycle events of the connection on b.
+func WithEventBus(b *EventBus) HandleOption {
+	return func(r *rpc) {
+		r.events = b
+	}
+}
+
+// publishEvent fills in what is known about the connection and publishes ev, if there is a bus
+func (r *rpc) publishEvent(ev ConnEvent) {
+	if r.events == nil {
+		return
+	}
+	ev.Endpoint = r
+	ev.Remote = r.remote
+	ev.Time = r.clock.Now()
+	r.events.Publish(ev)
+}
@@ -0,0 +1,70 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventBus(t *testing.T) {
+	r := require.New(t)
+
+	bus := NewEventBus()
+	events := make(chan ConnEvent, 10)
+	unsubscribe := bus.Subscribe(func(ev ConnEvent) { events <- ev })
+
+	next := func() ConnEvent {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+			return ConnEvent{}
+		}
+	}
+
+	called := make(chan struct{})
+	var srv FakeHandler
+	srv.HandledCalls(func(m Method) bool { return true })
+	srv.HandleCallCalls(func(ctx context.Context, req *Request) {
+		close(called)
+		<-ctx.Done()
+	})
+
+	opts := []HandleOption{WithoutManifest(), WithLogger(NopLogger())}
+	client, server := connectPair(t, &FakeHandler{}, &srv, opts, append(opts, WithEventBus(bus)))
+
+	ev := next()
+	r.Equal(ConnEstablished, ev.Type)
+	r.Equal(server, ev.Endpoint)
+	ev = next()
+	r.Equal(ConnHandshakeDone, ev.Type)
+
+	ctx := context.Background()
+	_, err := client.Source(ctx, TypeJSON, Method{"open"})
+	r.NoError(err)
+	<-called
+
+	server.Terminate()
+	ev = next()
+	r.Equal(ConnTerminated, ev.Type)
+	r.Equal(server, ev.Endpoint)
+	r.Equal(1, ev.Streams)
+	r.NoError(ev.Err, "terminated locally")
+
+	// the session ends only once
+	server.Terminate()
+	unsubscribe()
+	bus.Publish(ConnEvent{})
+	select {
+	case ev := <-events:
+		t.Fatalf("unexpected event: %v", ev.Type)
+	default:
+	}
+}
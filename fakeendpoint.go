@@ -45,6 +45,26 @@ type FakeEndpoint struct {
 		result2 *ByteSink
 		result3 error
 	}
+	LocalAddrStub        func() net.Addr
+	localAddrMutex       sync.RWMutex
+	localAddrArgsForCall []struct {
+	}
+	localAddrReturns struct {
+		result1 net.Addr
+	}
+	localAddrReturnsOnCall map[int]struct {
+		result1 net.Addr
+	}
+	MetaStub        func() *ConnMeta
+	metaMutex       sync.RWMutex
+	metaArgsForCall []struct {
+	}
+	metaReturns struct {
+		result1 *ConnMeta
+	}
+	metaReturnsOnCall map[int]struct {
+		result1 *ConnMeta
+	}
 	RemoteStub        func() net.Addr
 	remoteMutex       sync.RWMutex
 	remoteArgsForCall []struct {
@@ -55,6 +75,16 @@ type FakeEndpoint struct {
 	remoteReturnsOnCall map[int]struct {
 		result1 net.Addr
 	}
+	RemoteAddrStub        func() net.Addr
+	remoteAddrMutex       sync.RWMutex
+	remoteAddrArgsForCall []struct {
+	}
+	remoteAddrReturns struct {
+		result1 net.Addr
+	}
+	remoteAddrReturnsOnCall map[int]struct {
+		result1 net.Addr
+	}
 	SinkStub        func(context.Context, RequestEncoding, Method, ...interface{}) (*ByteSink, error)
 	sinkMutex       sync.RWMutex
 	sinkArgsForCall []struct {
@@ -87,6 +117,16 @@ type FakeEndpoint struct {
 		result1 *ByteSource
 		result2 error
 	}
+	StatsStub        func() EndpointStats
+	statsMutex       sync.RWMutex
+	statsArgsForCall []struct {
+	}
+	statsReturns struct {
+		result1 EndpointStats
+	}
+	statsReturnsOnCall map[int]struct {
+		result1 EndpointStats
+	}
 	TerminateStub        func() error
 	terminateMutex       sync.RWMutex
 	terminateArgsForCall []struct {
@@ -97,6 +137,17 @@ type FakeEndpoint struct {
 	terminateReturnsOnCall map[int]struct {
 		result1 error
 	}
+	WithOptionsStub        func(...CallOption) Endpoint
+	withOptionsMutex       sync.RWMutex
+	withOptionsArgsForCall []struct {
+		arg1 []CallOption
+	}
+	withOptionsReturns struct {
+		result1 Endpoint
+	}
+	withOptionsReturnsOnCall map[int]struct {
+		result1 Endpoint
+	}
 	invocations      map[string][][]interface{}
 	invocationsMutex sync.RWMutex
 }
@@ -236,6 +287,112 @@ func (fake *FakeEndpoint) DuplexReturnsOnCall(i int, result1 *ByteSource, result
 	}{result1, result2, result3}
 }
 
+func (fake *FakeEndpoint) LocalAddr() net.Addr {
+	fake.localAddrMutex.Lock()
+	ret, specificReturn := fake.localAddrReturnsOnCall[len(fake.localAddrArgsForCall)]
+	fake.localAddrArgsForCall = append(fake.localAddrArgsForCall, struct {
+	}{})
+	stub := fake.LocalAddrStub
+	fakeReturns := fake.localAddrReturns
+	fake.recordInvocation("LocalAddr", []interface{}{})
+	fake.localAddrMutex.Unlock()
+	if stub != nil {
+		return stub()
+	}
+	if specificReturn {
+		return ret.result1
+	}
+	return fakeReturns.result1
+}
+
+func (fake *FakeEndpoint) LocalAddrCallCount() int {
+	fake.localAddrMutex.RLock()
+	defer fake.localAddrMutex.RUnlock()
+	return len(fake.localAddrArgsForCall)
+}
+
+func (fake *FakeEndpoint) LocalAddrCalls(stub func() net.Addr) {
+	fake.localAddrMutex.Lock()
+	defer fake.localAddrMutex.Unlock()
+	fake.LocalAddrStub = stub
+}
+
+func (fake *FakeEndpoint) LocalAddrReturns(result1 net.Addr) {
+	fake.localAddrMutex.Lock()
+	defer fake.localAddrMutex.Unlock()
+	fake.LocalAddrStub = nil
+	fake.localAddrReturns = struct {
+		result1 net.Addr
+	}{result1}
+}
+
+func (fake *FakeEndpoint) LocalAddrReturnsOnCall(i int, result1 net.Addr) {
+	fake.localAddrMutex.Lock()
+	defer fake.localAddrMutex.Unlock()
+	fake.LocalAddrStub = nil
+	if fake.localAddrReturnsOnCall == nil {
+		fake.localAddrReturnsOnCall = make(map[int]struct {
+			result1 net.Addr
+		})
+	}
+	fake.localAddrReturnsOnCall[i] = struct {
+		result1 net.Addr
+	}{result1}
+}
+
+func (fake *FakeEndpoint) Meta() *ConnMeta {
+	fake.metaMutex.Lock()
+	ret, specificReturn := fake.metaReturnsOnCall[len(fake.metaArgsForCall)]
+	fake.metaArgsForCall = append(fake.metaArgsForCall, struct {
+	}{})
+	stub := fake.MetaStub
+	fakeReturns := fake.metaReturns
+	fake.recordInvocation("Meta", []interface{}{})
+	fake.metaMutex.Unlock()
+	if stub != nil {
+		return stub()
+	}
+	if specificReturn {
+		return ret.result1
+	}
+	return fakeReturns.result1
+}
+
+func (fake *FakeEndpoint) MetaCallCount() int {
+	fake.metaMutex.RLock()
+	defer fake.metaMutex.RUnlock()
+	return len(fake.metaArgsForCall)
+}
+
+func (fake *FakeEndpoint) MetaCalls(stub func() *ConnMeta) {
+	fake.metaMutex.Lock()
+	defer fake.metaMutex.Unlock()
+	fake.MetaStub = stub
+}
+
+func (fake *FakeEndpoint) MetaReturns(result1 *ConnMeta) {
+	fake.metaMutex.Lock()
+	defer fake.metaMutex.Unlock()
+	fake.MetaStub = nil
+	fake.metaReturns = struct {
+		result1 *ConnMeta
+	}{result1}
+}
+
+func (fake *FakeEndpoint) MetaReturnsOnCall(i int, result1 *ConnMeta) {
+	fake.metaMutex.Lock()
+	defer fake.metaMutex.Unlock()
+	fake.MetaStub = nil
+	if fake.metaReturnsOnCall == nil {
+		fake.metaReturnsOnCall = make(map[int]struct {
+			result1 *ConnMeta
+		})
+	}
+	fake.metaReturnsOnCall[i] = struct {
+		result1 *ConnMeta
+	}{result1}
+}
+
 func (fake *FakeEndpoint) Remote() net.Addr {
 	fake.remoteMutex.Lock()
 	ret, specificReturn := fake.remoteReturnsOnCall[len(fake.remoteArgsForCall)]
@@ -289,6 +446,59 @@ func (fake *FakeEndpoint) RemoteReturnsOnCall(i int, result1 net.Addr) {
 	}{result1}
 }
 
+func (fake *FakeEndpoint) RemoteAddr() net.Addr {
+	fake.remoteAddrMutex.Lock()
+	ret, specificReturn := fake.remoteAddrReturnsOnCall[len(fake.remoteAddrArgsForCall)]
+	fake.remoteAddrArgsForCall = append(fake.remoteAddrArgsForCall, struct {
+	}{})
+	stub := fake.RemoteAddrStub
+	fakeReturns := fake.remoteAddrReturns
+	fake.recordInvocation("RemoteAddr", []interface{}{})
+	fake.remoteAddrMutex.Unlock()
+	if stub != nil {
+		return stub()
+	}
+	if specificReturn {
+		return ret.result1
+	}
+	return fakeReturns.result1
+}
+
+func (fake *FakeEndpoint) RemoteAddrCallCount() int {
+	fake.remoteAddrMutex.RLock()
+	defer fake.remoteAddrMutex.RUnlock()
+	return len(fake.remoteAddrArgsForCall)
+}
+
+func (fake *FakeEndpoint) RemoteAddrCalls(stub func() net.Addr) {
+	fake.remoteAddrMutex.Lock()
+	defer fake.remoteAddrMutex.Unlock()
+	fake.RemoteAddrStub = stub
+}
+
+func (fake *FakeEndpoint) RemoteAddrReturns(result1 net.Addr) {
+	fake.remoteAddrMutex.Lock()
+	defer fake.remoteAddrMutex.Unlock()
+	fake.RemoteAddrStub = nil
+	fake.remoteAddrReturns = struct {
+		result1 net.Addr
+	}{result1}
+}
+
+func (fake *FakeEndpoint) RemoteAddrReturnsOnCall(i int, result1 net.Addr) {
+	fake.remoteAddrMutex.Lock()
+	defer fake.remoteAddrMutex.Unlock()
+	fake.RemoteAddrStub = nil
+	if fake.remoteAddrReturnsOnCall == nil {
+		fake.remoteAddrReturnsOnCall = make(map[int]struct {
+			result1 net.Addr
+		})
+	}
+	fake.remoteAddrReturnsOnCall[i] = struct {
+		result1 net.Addr
+	}{result1}
+}
+
 func (fake *FakeEndpoint) Sink(arg1 context.Context, arg2 RequestEncoding, arg3 Method, arg4 ...interface{}) (*ByteSink, error) {
 	fake.sinkMutex.Lock()
 	ret, specificReturn := fake.sinkReturnsOnCall[len(fake.sinkArgsForCall)]
@@ -423,6 +633,59 @@ func (fake *FakeEndpoint) SourceReturnsOnCall(i int, result1 *ByteSource, result
 	}{result1, result2}
 }
 
+func (fake *FakeEndpoint) Stats() EndpointStats {
+	fake.statsMutex.Lock()
+	ret, specificReturn := fake.statsReturnsOnCall[len(fake.statsArgsForCall)]
+	fake.statsArgsForCall = append(fake.statsArgsForCall, struct {
+	}{})
+	stub := fake.StatsStub
+	fakeReturns := fake.statsReturns
+	fake.recordInvocation("Stats", []interface{}{})
+	fake.statsMutex.Unlock()
+	if stub != nil {
+		return stub()
+	}
+	if specificReturn {
+		return ret.result1
+	}
+	return fakeReturns.result1
+}
+
+func (fake *FakeEndpoint) StatsCallCount() int {
+	fake.statsMutex.RLock()
+	defer fake.statsMutex.RUnlock()
+	return len(fake.statsArgsForCall)
+}
+
+func (fake *FakeEndpoint) StatsCalls(stub func() EndpointStats) {
+	fake.statsMutex.Lock()
+	defer fake.statsMutex.Unlock()
+	fake.StatsStub = stub
+}
+
+func (fake *FakeEndpoint) StatsReturns(result1 EndpointStats) {
+	fake.statsMutex.Lock()
+	defer fake.statsMutex.Unlock()
+	fake.StatsStub = nil
+	fake.statsReturns = struct {
+		result1 EndpointStats
+	}{result1}
+}
+
+func (fake *FakeEndpoint) StatsReturnsOnCall(i int, result1 EndpointStats) {
+	fake.statsMutex.Lock()
+	defer fake.statsMutex.Unlock()
+	fake.StatsStub = nil
+	if fake.statsReturnsOnCall == nil {
+		fake.statsReturnsOnCall = make(map[int]struct {
+			result1 EndpointStats
+		})
+	}
+	fake.statsReturnsOnCall[i] = struct {
+		result1 EndpointStats
+	}{result1}
+}
+
 func (fake *FakeEndpoint) Terminate() error {
 	fake.terminateMutex.Lock()
 	ret, specificReturn := fake.terminateReturnsOnCall[len(fake.terminateArgsForCall)]
@@ -476,6 +739,67 @@ func (fake *FakeEndpoint) TerminateReturnsOnCall(i int, result1 error) {
 	}{result1}
 }
 
+func (fake *FakeEndpoint) WithOptions(arg1 ...CallOption) Endpoint {
+	fake.withOptionsMutex.Lock()
+	ret, specificReturn := fake.withOptionsReturnsOnCall[len(fake.withOptionsArgsForCall)]
+	fake.withOptionsArgsForCall = append(fake.withOptionsArgsForCall, struct {
+		arg1 []CallOption
+	}{arg1})
+	stub := fake.WithOptionsStub
+	fakeReturns := fake.withOptionsReturns
+	fake.recordInvocation("WithOptions", []interface{}{arg1})
+	fake.withOptionsMutex.Unlock()
+	if stub != nil {
+		return stub(arg1...)
+	}
+	if specificReturn {
+		return ret.result1
+	}
+	return fakeReturns.result1
+}
+
+func (fake *FakeEndpoint) WithOptionsCallCount() int {
+	fake.withOptionsMutex.RLock()
+	defer fake.withOptionsMutex.RUnlock()
+	return len(fake.withOptionsArgsForCall)
+}
+
+func (fake *FakeEndpoint) WithOptionsCalls(stub func(...CallOption) Endpoint) {
+	fake.withOptionsMutex.Lock()
+	defer fake.withOptionsMutex.Unlock()
+	fake.WithOptionsStub = stub
+}
+
+func (fake *FakeEndpoint) WithOptionsArgsForCall(i int) []CallOption {
+	fake.withOptionsMutex.RLock()
+	defer fake.withOptionsMutex.RUnlock()
+	argsForCall := fake.withOptionsArgsForCall[i]
+	return argsForCall.arg1
+}
+
+func (fake *FakeEndpoint) WithOptionsReturns(result1 Endpoint) {
+	fake.withOptionsMutex.Lock()
+	defer fake.withOptionsMutex.Unlock()
+	fake.WithOptionsStub = nil
+	fake.withOptionsReturns = struct {
+		result1 Endpoint
+	}{result1}
+}
+
+func (fake *FakeEndpoint) WithOptionsReturnsOnCall(i int, result1 Endpoint) {
+	fake.withOptionsMutex.Lock()
+	defer fake.withOptionsMutex.Unlock()
+	fake.WithOptionsStub = nil
+	if fake.withOptionsReturnsOnCall == nil {
+		fake.withOptionsReturnsOnCall = make(map[int]struct {
+			result1 Endpoint
+		})
+	}
+	fake.withOptionsReturnsOnCall[i] = struct {
+		result1 Endpoint
+	}{result1}
+}
+
 func (fake *FakeEndpoint) Invocations() map[string][][]interface{} {
 	fake.invocationsMutex.RLock()
 	defer fake.invocationsMutex.RUnlock()
@@ -483,14 +807,24 @@ func (fake *FakeEndpoint) Invocations() map[string][][]interface{} {
 	defer fake.asyncMutex.RUnlock()
 	fake.duplexMutex.RLock()
 	defer fake.duplexMutex.RUnlock()
+	fake.localAddrMutex.RLock()
+	defer fake.localAddrMutex.RUnlock()
+	fake.metaMutex.RLock()
+	defer fake.metaMutex.RUnlock()
 	fake.remoteMutex.RLock()
 	defer fake.remoteMutex.RUnlock()
+	fake.remoteAddrMutex.RLock()
+	defer fake.remoteAddrMutex.RUnlock()
 	fake.sinkMutex.RLock()
 	defer fake.sinkMutex.RUnlock()
 	fake.sourceMutex.RLock()
 	defer fake.sourceMutex.RUnlock()
+	fake.statsMutex.RLock()
+	defer fake.statsMutex.RUnlock()
 	fake.terminateMutex.RLock()
 	defer fake.terminateMutex.RUnlock()
+	fake.withOptionsMutex.RLock()
+	defer fake.withOptionsMutex.RUnlock()
 	copiedInvocations := map[string][][]interface{}{}
 	for key, value := range fake.invocations {
 		copiedInvocations[key] = value
@@ -0,0 +1,136 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+//go:build go1.18
+// +build go1.18
+
+// Package feeds has typed clients for the sources of SSB that stream messages, createHistoryStream and createLogStream.
+//
+//	src, err := feeds.CreateHistoryStream[Post](ctx, edp, feeds.HistoryArgs{ID: feedRef, Keys: true, Values: true})
+//	for src.Next(ctx) {
+//		msg := src.Value()
+//		...
+//	}
+//
+// The frames are decoded into Message, whatever the Keys and Values options made the remote send.
+package feeds
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/ssbc/go-muxrpc/v2"
+)
+
+var (
+	// HistoryMethod streams the messages of one feed.
+	HistoryMethod = muxrpc.Method{"createHistoryStream"}
+
+	// LogMethod streams the messages of all feeds in the order they were received.
+	LogMethod = muxrpc.Method{"createLogStream"}
+)
+
+// Message is a message of a feed with a value of type T.
+// Key is empty if only values were requested and Value is the zero value if only keys were requested.
+type Message[T any] struct {
+	Key       string  `json:"key"`
+	Value     T       `json:"value"`
+	Timestamp float64 `json:"timestamp"`
+}
+
+// Options are what createHistoryStream and createLogStream have in common.
+type Options struct {
+	// Keys and Values select what is sent of each message. If neither is set, only values are sent.
+	Keys   bool
+	Values bool
+
+	// Limit is the most messages that are sent, zero means no limit.
+	Limit int64
+
+	// Live keeps the stream open and sends new messages as they arrive.
+	Live bool
+
+	// Old is false by default for live streams, to only get new messages. Set it to get the existing messages too.
+	Old bool
+}
+
+// HistoryArgs are the arguments of createHistoryStream.
+type HistoryArgs struct {
+	// ID is the reference of the feed
+	ID string
+
+	// Seq is the first sequence that is sent
+	Seq int64
+
+	Options
+}
+
+// LogArgs are the arguments of createLogStream.
+type LogArgs struct {
+	// Gt only sends messages that were received after this time, in milliseconds since the epoch
+	Gt int64
+
+	Options
+}
+
+// wireArgs are the arguments as SSB peers expect them
+type wireArgs struct {
+	ID     string `json:"id,omitempty"`
+	Seq    int64  `json:"seq,omitempty"`
+	Gt     int64  `json:"gt,omitempty"`
+	Limit  int64  `json:"limit,omitempty"`
+	Live   bool   `json:"live"`
+	Old    bool   `json:"old"`
+	Keys   bool   `json:"keys"`
+	Values bool   `json:"values"`
+}
+
+func (o Options) wire() wireArgs {
+	return wireArgs{
+		Limit:  o.Limit,
+		Live:   o.Live,
+		Old:    o.Old || !o.Live,
+		Keys:   o.Keys,
+		Values: o.Values || !o.Keys,
+	}
+}
+
+// CreateHistoryStream streams the messages of the feed args.ID from edp.
+func CreateHistoryStream[T any](ctx context.Context, edp muxrpc.Endpoint, args HistoryArgs) (*muxrpc.TypedSource[Message[T]], error) {
+	wa := args.Options.wire()
+	wa.ID, wa.Seq = args.ID, args.Seq
+	return open[T](ctx, edp, HistoryMethod, wa)
+}
+
+// CreateLogStream streams the messages of all feeds that edp has.
+func CreateLogStream[T any](ctx context.Context, edp muxrpc.Endpoint, args LogArgs) (*muxrpc.TypedSource[Message[T]], error) {
+	wa := args.Options.wire()
+	wa.Gt = args.Gt
+	return open[T](ctx, edp, LogMethod, wa)
+}
+
+func open[T any](ctx context.Context, edp muxrpc.Endpoint, method muxrpc.Method, wa wireArgs) (*muxrpc.TypedSource[Message[T]], error) {
+	src, err := edp.Source(ctx, muxrpc.TypeJSON, method, wa)
+	if err != nil {
+		return nil, err
+	}
+	return muxrpc.NewTypedSourceFunc(src, decoder[T](wa.Keys, wa.Values)), nil
+}
+
+// decoder returns how the frames of a stream with the passed options are turned into messages
+func decoder[T any](keys, values bool) func([]byte) (Message[T], error) {
+	return func(b []byte) (Message[T], error) {
+		var msg Message[T]
+		var err error
+		switch {
+		case keys && values:
+			err = json.Unmarshal(b, &msg)
+		case keys:
+			err = json.Unmarshal(b, &msg.Key)
+		default:
+			err = json.Unmarshal(b, &msg.Value)
+		}
+		return msg, err
+	}
+}
@@ -0,0 +1,95 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+//go:build go1.18
+// +build go1.18
+
+package feeds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ssbc/go-muxrpc/v2"
+)
+
+type post struct {
+	Author   string `json:"author"`
+	Sequence int64  `json:"sequence"`
+}
+
+// history answers createHistoryStream with three messages of the feed, in the form the arguments asked for
+func history(ctx context.Context, req *muxrpc.Request) {
+	var args []wireArgs
+	if err := json.Unmarshal(req.RawArgs, &args); err != nil || len(args) != 1 {
+		req.CloseWithError(fmt.Errorf("invalid arguments: %s", req.RawArgs))
+		return
+	}
+	a := args[0]
+
+	snk, _ := req.ResponseSink()
+	snk.SetEncoding(muxrpc.TypeJSON)
+	for seq := a.Seq; seq < a.Seq+3; seq++ {
+		value := post{Author: a.ID, Sequence: seq}
+		key := fmt.Sprintf("%%msg%d.sha256", seq)
+
+		var v interface{} = value
+		switch {
+		case a.Keys && a.Values:
+			v = map[string]interface{}{"key": key, "value": value, "timestamp": 1000 + seq}
+		case a.Keys:
+			v = key
+		}
+		b, _ := json.Marshal(v)
+		snk.Write(b)
+	}
+	snk.Close()
+}
+
+func TestCreateHistoryStream(t *testing.T) {
+	r := require.New(t)
+
+	var srv muxrpc.FakeHandler
+	srv.HandledCalls(func(m muxrpc.Method) bool { return m.String() == HistoryMethod.String() })
+	srv.HandleCallCalls(history)
+
+	opts := []muxrpc.HandleOption{muxrpc.WithoutManifest(), muxrpc.WithLogger(muxrpc.NopLogger())}
+	client, _ := muxrpc.NewPipe(&muxrpc.FakeHandler{}, &srv, muxrpc.WithPipeHandleOptions(opts, opts))
+	defer client.Terminate()
+
+	ctx := context.Background()
+	for _, tc := range []struct {
+		opts      Options
+		key       bool
+		value     bool
+		timestamp bool
+	}{
+		{Options{}, false, true, false},
+		{Options{Values: true}, false, true, false},
+		{Options{Keys: true}, true, false, false},
+		{Options{Keys: true, Values: true}, true, true, true},
+	} {
+		src, err := CreateHistoryStream[post](ctx, client, HistoryArgs{ID: "@feed.ed25519", Seq: 5, Options: tc.opts})
+		r.NoError(err)
+
+		var seq int64 = 5
+		for src.Next(ctx) {
+			msg := src.Value()
+			r.Equal(tc.key, msg.Key != "", "%+v", tc.opts)
+			r.Equal(tc.timestamp, msg.Timestamp != 0, "%+v", tc.opts)
+			if tc.value {
+				r.Equal(post{Author: "@feed.ed25519", Sequence: seq}, msg.Value)
+			} else {
+				r.Zero(msg.Value)
+			}
+			seq++
+		}
+		r.NoError(src.Err())
+		r.EqualValues(8, seq)
+	}
+}
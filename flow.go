@@ -0,0 +1,130 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+// FlowMethod is the call Go peers use to pause and resume each other's streams (see FeatureFlowControl).
+// Every endpoint answers it and typemux lists it in the manifest.
+var FlowMethod = Method{"muxrpc", "flow"}
+
+// flowArgs is the argument of flow calls. Req is the id of the stream on the side that is paused.
+type flowArgs struct {
+	Req   int32 `json:"req"`
+	Pause bool  `json:"pause"`
+}
+
+// watchFlow lets the source of req pause the remote once it went over its high-water mark (see HighWaterPause)
+func (r *rpc) watchFlow(req *Request) {
+	if r.srcHighWater <= 0 || r.srcHighWaterFail {
+		return
+	}
+
+	// the remote knows the call by the negated id
+	id := -req.id
+	sig := &flowSignal{send: func(pause bool) bool {
+		if !r.negotiated(FeatureFlowControl) {
+			return false
+		}
+
+		ctx, cancel := context.WithTimeout(r.serveCtx, manifestTimeout)
+		defer cancel()
+
+		var ok bool
+		if err := r.Async(ctx, &ok, TypeJSON, FlowMethod, flowArgs{Req: id, Pause: pause}); err != nil {
+			logDebug(r.logger).Log("event", "flow control failed", "reqID", req.id, "pause", pause, "err", err)
+			return false
+		}
+		return true
+	}}
+
+	req.source.buf.mu.Lock()
+	defer req.source.buf.mu.Unlock()
+	req.source.buf.flow = sig.set
+}
+
+// flowSignal tells the remote whether a stream should be paused, one call at a time so that they arrive in order.
+// Changes that happen while a call is out are folded into the next one.
+type flowSignal struct {
+	send func(pause bool) bool
+
+	mu      sync.Mutex
+	want    bool
+	told    bool
+	sending bool
+}
+
+// set doesn't block, since it is called while the buffer of the stream is locked
+func (fs *flowSignal) set(pause bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.want = pause
+	if !fs.sending {
+		fs.sending = true
+		go fs.run()
+	}
+}
+
+func (fs *flowSignal) run() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for fs.want != fs.told {
+		pause := fs.want
+		fs.mu.Unlock()
+		sent := fs.send(pause)
+		fs.mu.Lock()
+		if !sent {
+			// a remote that wasn't paused doesn't need to be resumed either
+			break
+		}
+		fs.told = pause
+	}
+	fs.sending = false
+}
+
+// answerFlow handles flow calls, the handler doesn't see them.
+func answerFlow(root Handler, r *rpc) Handler {
+	return flowAnswerer{Handler: root, r: r}
+}
+
+type flowAnswerer struct {
+	Handler
+	r *rpc
+}
+
+func (fa flowAnswerer) Handled(m Method) bool {
+	return m.String() == FlowMethod.String() || fa.Handler.Handled(m)
+}
+
+func (fa flowAnswerer) HandleCall(ctx context.Context, req *Request) {
+	if req.Method.String() != FlowMethod.String() {
+		fa.Handler.HandleCall(ctx, req)
+		return
+	}
+
+	var args []flowArgs
+	if err := json.Unmarshal(req.RawArgs, &args); err != nil || len(args) != 1 {
+		req.CloseWithError(errors.New("muxrpc: invalid flow arguments"))
+		return
+	}
+
+	fa.r.rLock.RLock()
+	paused, ok := fa.r.reqs[args[0].Req]
+	fa.r.rLock.RUnlock()
+	// the stream might have ended in the meantime
+	if ok {
+		if args[0].Pause {
+			paused.sink.pause()
+		} else {
+			paused.sink.resume()
+		}
+	}
+	req.Return(ctx, true)
+}
@@ -0,0 +1,34 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+//go:build go1.18
+// +build go1.18
+
+package muxrpc
+
+import "testing"
+
+// FuzzEndpoint feeds arbitrary bytes into a complete session. Run it with
+//
+//	go test -run XXX -fuzz FuzzEndpoint
+//
+// The fuzzer minimizes crashers and stores them in testdata/fuzz/FuzzEndpoint, from where go test replays them.
+func FuzzEndpoint(f *testing.F) {
+	for _, seed := range endpointSeeds() {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		replayEndpoint(t, data)
+	})
+}
+
+// FuzzPacker feeds arbitrary bytes into the read loop of the packer, see replayPacker.
+func FuzzPacker(f *testing.F) {
+	for _, seed := range endpointSeeds() {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		replayPacker(t, data)
+	})
+}
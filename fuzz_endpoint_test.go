@@ -0,0 +1,190 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+
+	"github.com/ssbc/go-muxrpc/v2/codec"
+)
+
+// endpointCorpus holds inputs that once broke the endpoint. Crashers found by FuzzEndpoint land in testdata/fuzz/FuzzEndpoint,
+// which go test replays as well. Copy the interesting ones here, so they are also replayed by toolchains without fuzzing.
+const endpointCorpus = "testdata/endpoint-corpus"
+
+// replayBudget is how long a session on a finished input may take to end
+const replayBudget = 5 * time.Second
+
+// replayAllocs is how many bytes a session may allocate, on top of a multiple of the input size
+const replayAllocs = 64 << 20
+
+// fuzzConn plays back the input and discards everything the endpoint writes
+type fuzzConn struct {
+	io.Reader
+}
+
+func (fuzzConn) Write(b []byte) (int, error) { return len(b), nil }
+func (fuzzConn) Close() error                { return nil }
+
+// replayEndpoint feeds data into a session with a handler that rejects all calls
+// and fails if the session doesn't end within replayBudget or allocates too much.
+func replayEndpoint(t testing.TB, data []byte) {
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	var h FakeHandler
+	h.HandledCalls(func(m Method) bool { return len(m) > 0 && m[0] != "ignored" })
+	h.HandleCallCalls(func(ctx context.Context, req *Request) {
+		req.CloseWithError(ErrNoSuchMethod{req.Method})
+	})
+
+	edp := Handle(NewPacker(fuzzConn{bytes.NewReader(data)}), &h,
+		WithoutManifest(),
+		WithLogger(NopLogger()),
+		WithMemoryBudget(1<<20, BudgetFailStream),
+	)
+
+	done := make(chan struct{})
+	go func() {
+		edp.(Server).Serve()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(replayBudget):
+		t.Fatalf("session didn't end after the input was consumed (%d bytes)", len(data))
+	}
+	edp.Terminate()
+
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > replayAllocs+uint64(64*len(data)) {
+		t.Fatalf("session allocated %d bytes for %d bytes of input", allocated, len(data))
+	}
+}
+
+// endpointSeeds are well-formed sessions the fuzzer starts from
+func endpointSeeds() [][]byte {
+	session := func(pkts ...codec.Packet) []byte {
+		var buf bytes.Buffer
+		w := codec.NewWriter(fuzzConn{&buf})
+		w.WritePackets(pkts...)
+		w.Goodbye()
+		return buf.Bytes()
+	}
+	call := func(req int32, flag codec.Flag, body string) codec.Packet {
+		return codec.Packet{Req: req, Flag: flag | codec.FlagJSON, Body: []byte(body)}
+	}
+	return [][]byte{
+		session(call(1, 0, `{"name":["whoami"],"args":[],"type":"async"}`)),
+		session(
+			call(2, codec.FlagStream, `{"name":["blobs","add"],"args":[],"type":"sink"}`),
+			codec.Packet{Req: 2, Flag: codec.FlagStream, Body: []byte("data")},
+			call(2, codec.FlagStream|codec.FlagEndErr, `true`),
+		),
+		session(
+			call(3, codec.FlagStream, `{"name":["ignored"],"args":[{"live":true}],"type":"duplex"}`),
+			codec.Packet{Req: 3, Flag: codec.FlagStream, Body: []byte("dropped")},
+		),
+		session(call(-4, codec.FlagEndErr, `{"name":"Error","message":"unknown request"}`)),
+	}
+}
+
+func TestEndpointCorpus(t *testing.T) {
+	for i, seed := range endpointSeeds() {
+		replayEndpoint(t, seed)
+		t.Logf("seed %d ok", i)
+	}
+
+	files, err := filepath.Glob(filepath.Join(endpointCorpus, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatalf("no sessions in %s", endpointCorpus)
+	}
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Run(filepath.Base(f), func(t *testing.T) {
+			replayEndpoint(t, data)
+		})
+	}
+}
+
+// replayPacker runs the read loop of a session on data, without a session around it.
+// The loop has to end with io.EOF or one of the errors for broken input, and the body reads must not allocate for absent bytes.
+func replayPacker(t testing.TB, data []byte) {
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	pkr := NewPacker(fuzzConn{bytes.NewReader(data)})
+	ctx := context.Background()
+	var (
+		hdr  codec.Header
+		body bytes.Buffer
+		n    int
+	)
+	for ; ; n++ {
+		err := pkr.NextHeader(ctx, &hdr)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			if !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, codec.ErrInvalidFlags) {
+				t.Fatalf("unexpected error reading header %d: %v", n, err)
+			}
+			break
+		}
+
+		body.Reset()
+		if err := pkr.r.ReadBodyInto(&body, hdr.Len); err != nil {
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Fatalf("unexpected error reading body %d: %v", n, err)
+			}
+			break
+		}
+	}
+	if stats := pkr.Stats(); stats.Read < uint64(n) {
+		t.Fatalf("read %d packets but counted %d", n, stats.Read)
+	}
+
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > replayAllocs+uint64(64*len(data)) {
+		t.Fatalf("packer allocated %d bytes for %d bytes of input", allocated, len(data))
+	}
+}
+
+func TestPackerCorpus(t *testing.T) {
+	for _, seed := range endpointSeeds() {
+		replayPacker(t, seed)
+	}
+
+	files, err := filepath.Glob(filepath.Join(endpointCorpus, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Run(filepath.Base(f), func(t *testing.T) {
+			replayPacker(t, data)
+		})
+	}
+}
@@ -10,10 +10,7 @@ require (
 	github.com/dustin/go-humanize v1.0.0
 	github.com/hashicorp/errwrap v1.1.0 // indirect
 	github.com/hashicorp/go-multierror v1.1.0
-	github.com/karrick/bufpool v1.2.0
-	github.com/karrick/gopool v1.2.2 // indirect
 	github.com/pkg/errors v0.9.1
 	github.com/ssbc/go-luigi v0.3.7-0.20221019204020-324065b9a7c6
-	github.com/stretchr/testify v1.4.0
-	go.mindeco.de v1.12.0
+	github.com/stretchr/testify v1.7.0
 )
@@ -28,6 +28,8 @@ type CallHandler interface {
 	HandleCall(ctx context.Context, req *Request)
 }
 
+// ConnectHandler is told about new sessions. HandleConnect runs on a goroutine of its own,
+// edp can be used to call the remote until ctx is done, which happens when the session ends.
 type ConnectHandler interface {
 	HandleConnect(ctx context.Context, edp Endpoint)
 }
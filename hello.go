@@ -0,0 +1,159 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+// HelloMethod is the call Go peers use to tell each other which extensions of the protocol they support (see WithHello).
+// Every endpoint answers it with the features it was started with and typemux lists it in the manifest.
+var HelloMethod = Method{"muxrpc", "hello"}
+
+// Feature is an extension of the protocol that both ends need to know about before it can be used.
+// Applications can advertise their own, for instance a body codec they registered.
+type Feature string
+
+const (
+	// FeatureCompression means that compressed bodies can be read, see ByteSink.SetCompression.
+	FeatureCompression Feature = "gzip"
+
+	// FeatureChunking means that chunked frames are put back together, see ByteSink.SetChunkSize.
+	FeatureChunking Feature = "chunks"
+
+	// FeatureMetadata means that the metadata of incoming calls is read, see Metadata.
+	FeatureMetadata Feature = "meta"
+
+	// FeatureFlowControl means that streams can be paused once they buffered too much, see HighWaterPause.
+	FeatureFlowControl Feature = "flow"
+)
+
+// WithHello advertises the passed features to the remote right after connecting.
+// Handle returns once the remote answered, Features then returns what both ends support.
+// Peers that don't list HelloMethod in their manifest, like JS muxrpc, aren't asked and support nothing.
+func WithHello(features ...Feature) HandleOption {
+	return func(r *rpc) {
+		r.features = features
+	}
+}
+
+// Features returns the features that both ends of the session support, see WithHello.
+func Features(edp Endpoint) []Feature {
+	rpc, ok := asRPC(edp)
+	if !ok {
+		return nil
+	}
+	return rpc.commonFeatures()
+}
+
+// HasFeature is true if both ends of the session support f.
+func HasFeature(edp Endpoint, f Feature) bool {
+	for _, has := range Features(edp) {
+		if has == f {
+			return true
+		}
+	}
+	return false
+}
+
+// helloArgs is the argument of hello calls
+type helloArgs struct {
+	Features []Feature `json:"features"`
+}
+
+// remoteFeatures holds what the remote advertised, either in its answer or in its own hello call
+type remoteFeatures struct {
+	mu  sync.Mutex
+	set map[Feature]struct{}
+}
+
+func (rf *remoteFeatures) add(fs []Feature) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.set == nil {
+		rf.set = make(map[Feature]struct{}, len(fs))
+	}
+	for _, f := range fs {
+		rf.set[f] = struct{}{}
+	}
+}
+
+func (rf *remoteFeatures) has(f Feature) bool {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	_, ok := rf.set[f]
+	return ok
+}
+
+// negotiated is true if both ends support f
+func (r *rpc) negotiated(f Feature) bool {
+	for _, local := range r.features {
+		if local == f {
+			return r.remoteFeatures.has(f)
+		}
+	}
+	return false
+}
+
+func (r *rpc) commonFeatures() []Feature {
+	var common []Feature
+	for _, f := range r.features {
+		if r.remoteFeatures.has(f) {
+			common = append(common, f)
+		}
+	}
+	return common
+}
+
+// hello sends the local features to the remote and stores what it answered.
+func (r *rpc) hello() {
+	ctx, cancel := context.WithTimeout(r.serveCtx, manifestTimeout)
+	defer cancel()
+
+	var remote []Feature
+	err := r.Async(ctx, &remote, TypeJSON, HelloMethod, helloArgs{Features: r.features})
+	if err != nil {
+		logDebug(r.logger).Log("event", "hello failed", "err", err)
+		return
+	}
+	r.remoteFeatures.add(remote)
+}
+
+// answerHello handles hello calls, the handler doesn't see them.
+func answerHello(root Handler, r *rpc) Handler {
+	return helloAnswerer{Handler: root, r: r}
+}
+
+type helloAnswerer struct {
+	Handler
+	r *rpc
+}
+
+func (ha helloAnswerer) Handled(m Method) bool {
+	return m.String() == HelloMethod.String() || ha.Handler.Handled(m)
+}
+
+func (ha helloAnswerer) HandleCall(ctx context.Context, req *Request) {
+	if req.Method.String() != HelloMethod.String() {
+		ha.Handler.HandleCall(ctx, req)
+		return
+	}
+
+	var args []helloArgs
+	if err := json.Unmarshal(req.RawArgs, &args); err != nil || len(args) != 1 {
+		req.CloseWithError(errors.New("muxrpc: invalid hello arguments"))
+		return
+	}
+	ha.r.remoteFeatures.add(args[0].Features)
+
+	features := ha.r.features
+	if features == nil {
+		features = []Feature{}
+	}
+	req.Return(ctx, features)
+}
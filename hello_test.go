@@ -0,0 +1,45 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHello(t *testing.T) {
+	r := require.New(t)
+
+	var srv FakeHandler
+	opts := []HandleOption{WithoutManifest(), WithLogger(NopLogger())}
+	client, server := NewPipe(&FakeHandler{}, &srv, WithPipeHandleOptions(
+		append(opts, WithHello(FeatureCompression, FeatureChunking)),
+		append(opts, WithHello(FeatureCompression, "cbor")),
+	))
+	defer client.Terminate()
+
+	r.Equal([]Feature{FeatureCompression}, Features(client))
+	r.Equal([]Feature{FeatureCompression}, Features(server))
+	r.True(HasFeature(client.WithOptions(CallPriority(PriorityLow)), FeatureCompression))
+	r.False(HasFeature(client, FeatureChunking))
+
+	// the handler doesn't see them
+	r.Equal(0, srv.HandleCallCallCount())
+}
+
+func TestHelloWithoutFeatures(t *testing.T) {
+	r := require.New(t)
+
+	opts := []HandleOption{WithoutManifest(), WithLogger(NopLogger())}
+	client, server := NewPipe(&FakeHandler{}, Echo, WithPipeHandleOptions(
+		append(opts, WithHello(FeatureCompression)),
+		opts,
+	))
+	defer client.Terminate()
+
+	r.Empty(Features(client))
+	r.Empty(Features(server))
+}
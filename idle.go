@@ -0,0 +1,69 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// WithIdleTimeout terminates the session with ErrIdleTimeout once no packet was sent or received for d.
+// Keepalive pings (see WithKeepAlive) and the gossip.ping calls of the remote don't count,
+// so servers can let go of peers that keep their connection alive without using it.
+// Zero (the default) means connections are never reaped.
+func WithIdleTimeout(d time.Duration) HandleOption {
+	return func(r *rpc) {
+		r.idleTimeout = d
+	}
+}
+
+// keepAliveCtxKey marks the context of the calls the keepalive makes, so that they don't count as activity
+type keepAliveCtxKey struct{}
+
+func isKeepAliveCall(ctx context.Context) bool {
+	return ctx.Value(keepAliveCtxKey{}) != nil
+}
+
+// used records that a packet of req was sent or received. req is nil for calls that were refused.
+func (r *rpc) used(req *Request) {
+	if r.idleTimeout <= 0 || (req != nil && req.keepalive) {
+		return
+	}
+	r.touch()
+}
+
+func (r *rpc) touch() {
+	atomic.StoreInt64(&r.lastUsed, r.clock.Now().UnixNano())
+}
+
+// watchUse lets the sink of req record its packets, unless it belongs to a keepalive call
+func (r *rpc) watchUse(req *Request) {
+	if r.idleTimeout > 0 && !req.keepalive {
+		req.sink.used = r.touch
+	}
+}
+
+// reapIdle terminates the session once it wasn't used for the idle timeout.
+func (r *rpc) reapIdle() {
+	timer := r.clock.NewTimer(r.idleTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-r.serveCtx.Done():
+			return
+
+		case now := <-timer.C():
+			idle := now.Sub(time.Unix(0, atomic.LoadInt64(&r.lastUsed)))
+			if idle >= r.idleTimeout {
+				logInfo(r.logger).Log("event", "idle timeout", "idle", idle)
+				r.terminate(ErrIdleTimeout)
+				return
+			}
+			timer.Reset(r.idleTimeout - idle)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdleTimeout(t *testing.T) {
+	r := require.New(t)
+
+	var srv FakeHandler
+	srv.HandledCalls(methodChecker("hello"))
+	srv.HandleCallCalls(func(ctx context.Context, req *Request) {
+		req.Return(ctx, "world")
+	})
+
+	bus := NewEventBus()
+	ended := make(chan error, 1)
+	bus.Subscribe(func(ev ConnEvent) {
+		if ev.Type == ConnTerminated {
+			ended <- ev.Err
+		}
+	})
+
+	clientBus := NewEventBus()
+	clientEnded := make(chan struct{})
+	clientBus.Subscribe(func(ev ConnEvent) {
+		if ev.Type == ConnTerminated {
+			close(clientEnded)
+		}
+	})
+
+	opts := []HandleOption{WithoutManifest(), WithLogger(NopLogger()), WithKeepAlive(10*time.Millisecond, 50*time.Millisecond)}
+	client, _ := connectPair(t, &FakeHandler{}, &srv, append(opts, WithEventBus(clientBus)), append(opts, WithIdleTimeout(100*time.Millisecond), WithEventBus(bus)))
+
+	// calls keep the session alive for longer than the timeout
+	ctx := context.Background()
+	start := time.Now()
+	for time.Since(start) < 300*time.Millisecond {
+		var s string
+		r.NoError(client.Async(ctx, &s, TypeString, Method{"hello"}))
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// the pings alone don't
+	select {
+	case err := <-ended:
+		r.True(errors.Is(err, ErrIdleTimeout), "unexpected cause: %v", err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle session wasn't reaped")
+	}
+	r.Greater(int64(time.Since(start)), int64(350*time.Millisecond))
+
+	// a call that races the end of the connection could be reset by the remote, so wait for the client to notice
+	select {
+	case <-clientEnded:
+	case <-time.After(2 * time.Second):
+		t.Fatal("client didn't see the end of the session")
+	}
+	var s string
+	r.Error(client.Async(ctx, &s, TypeString, Method{"hello"}))
+}
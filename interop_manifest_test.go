@@ -0,0 +1,209 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// the manifests in testdata/manifests are recorded from ssb-server (with the usual plugins) and a rooms2 server.
+// interop_ssb_test.go runs the same checks against live servers.
+
+func loadRecordedManifest(t testing.TB, name string) json.RawMessage {
+	data, err := os.ReadFile(filepath.Join("testdata", "manifests", name+".json"))
+	require.NoError(t, err)
+	return json.RawMessage(data)
+}
+
+// the methods and call types the Go client relies on
+var recordedManifestMethods = map[string]map[string]string{
+	"ssb-server": {
+		"whoami":                   "sync", // secret-stack declares it sync, we call it as async
+		"manifest":                 "sync",
+		"createHistoryStream":      "source",
+		"blobs.add":                "sink",
+		"tunnel.connect":           "duplex",
+		"tunnel.isRoom":            "async",
+		"tunnel.announce":          "sync",
+		"httpAuth.requestSolution": "async",
+		"gossip.ping":              "duplex",
+	},
+	"rooms2": {
+		"whoami":                   "async",
+		"manifest":                 "sync",
+		"tunnel.connect":           "duplex",
+		"tunnel.endpoints":         "source",
+		"tunnel.isRoom":            "async",
+		"tunnel.ping":              "sync",
+		"room.attendants":          "source",
+		"httpAuth.requestSolution": "async",
+		"httpAuth.sendSolution":    "async",
+	},
+}
+
+func TestRecordedManifests(t *testing.T) {
+	for name, want := range recordedManifestMethods {
+		t.Run(name, func(t *testing.T) {
+			r := require.New(t)
+
+			var methods manifestMap
+			err := json.Unmarshal(loadRecordedManifest(t, name), &methods)
+			r.NoError(err)
+
+			ms := manifestStruct{mu: new(sync.Mutex), methods: methods}
+			for m, callType := range want {
+				got, ok := ms.Handled(Method(strings.Split(m, ".")))
+				r.True(ok, "%s not handled", m)
+				r.Equal(callType, got, "wrong type for %s", m)
+			}
+
+			// groups are not methods
+			_, ok := ms.Handled(Method{"tunnel"})
+			r.False(ok)
+			_, ok = ms.Handled(Method{"tunnel", "nope"})
+			r.False(ok)
+		})
+	}
+}
+
+// ssb-server lists plugins without methods as empty groups
+func TestRecordedManifestEmptyGroup(t *testing.T) {
+	r := require.New(t)
+
+	var methods manifestMap
+	err := json.Unmarshal(loadRecordedManifest(t, "ssb-server"), &methods)
+	r.NoError(err)
+
+	for m := range methods {
+		r.NotContains(m, "multiserverNet")
+	}
+}
+
+// TestRecordedManifestCalls serves the rooms2 manifest and does the calls a Go client of a room makes
+func TestRecordedManifestCalls(t *testing.T) {
+	r := require.New(t)
+
+	const feed = "@uOReuhnb9+mPi5RnTbKMKRr3M3FDpjQ+dxiaHPmUgDY=.ed25519"
+
+	var room FakeHandler
+	room.HandledCalls(func(m Method) bool { return true })
+	room.HandleCallCalls(func(ctx context.Context, req *Request) {
+		switch req.Method.String() {
+		case "whoami":
+			req.Return(ctx, map[string]string{"id": feed})
+
+		case "tunnel.isRoom":
+			// rooms2 answers with its metadata instead of true
+			req.Return(ctx, map[string]interface{}{
+				"name":       "test room",
+				"membership": false,
+				"features":   []string{"tunnel", "room1", "room2-alias", "httpAuth"},
+			})
+
+		case "tunnel.ping":
+			// a sync method, answered like an async one
+			req.Return(ctx, 1234)
+
+		case "httpAuth.requestSolution":
+			var args []string
+			if err := json.Unmarshal(req.RawArgs, &args); err != nil || len(args) != 2 {
+				req.CloseWithError(errors.New("requestSolution expects sc and cc"))
+				return
+			}
+			req.Return(ctx, "solution:"+args[0]+":"+args[1])
+
+		case "tunnel.connect":
+			// echo everything back, like an established tunnel to ourselves would
+			src, err := req.ResponseSource()
+			if err != nil {
+				req.CloseWithError(err)
+				return
+			}
+			snk, err := req.ResponseSink()
+			if err != nil {
+				req.CloseWithError(err)
+				return
+			}
+			snk.SetEncoding(TypeBinary)
+			for src.Next(ctx) {
+				b, err := src.Bytes()
+				if err != nil {
+					break
+				}
+				snk.Write(b)
+			}
+			snk.Close()
+
+		default:
+			req.CloseWithError(ErrNoSuchMethod{req.Method})
+		}
+	})
+
+	var client FakeHandler
+	client.HandledCalls(methodChecker("manifest"))
+	client.HandleCallCalls(func(ctx context.Context, req *Request) {
+		req.CloseWithError(ErrNoSuchMethod{req.Method})
+	})
+
+	roomSrv := testManifestWrapper{manifest: loadRecordedManifest(t, "rooms2"), root: &room}
+	edp, _ := connectPair(t, &client, roomSrv, nil, nil)
+
+	ctx := context.Background()
+
+	r.True(HasMethod(edp, Method{"tunnel", "connect"}))
+	r.True(HasMethod(edp, Method{"httpAuth", "requestSolution"}))
+	r.False(HasMethod(edp, Method{"httpAuth", "nope"}))
+
+	var who struct {
+		ID string `json:"id"`
+	}
+	err := edp.Async(ctx, &who, TypeJSON, Method{"whoami"})
+	r.NoError(err)
+	r.Equal(feed, who.ID)
+
+	var meta map[string]interface{}
+	err = edp.Async(ctx, &meta, TypeJSON, Method{"tunnel", "isRoom"})
+	r.NoError(err)
+	r.Equal("test room", meta["name"])
+
+	var ts int
+	err = edp.Async(ctx, &ts, TypeJSON, Method{"tunnel", "ping"})
+	r.NoError(err)
+	r.Equal(1234, ts)
+
+	var solution string
+	err = edp.Async(ctx, &solution, TypeString, Method{"httpAuth", "requestSolution"}, "sc", "cc")
+	r.NoError(err)
+	r.Equal("solution:sc:cc", solution)
+
+	// methods that are not in the manifest fail without a roundtrip
+	err = edp.Async(ctx, &solution, TypeString, Method{"room", "nope"})
+	r.True(errors.As(err, new(ErrNoSuchMethod)), "unexpected error: %v", err)
+	r.Equal(4, room.HandleCallCallCount())
+
+	type tunnelArgs struct {
+		Portal string `json:"portal"`
+		Target string `json:"target"`
+	}
+	src, snk, err := edp.Duplex(ctx, TypeBinary, Method{"tunnel", "connect"}, tunnelArgs{Portal: feed, Target: feed})
+	r.NoError(err)
+
+	_, err = snk.Write([]byte("shs hello"))
+	r.NoError(err)
+	r.True(src.Next(ctx), "no reply: %v", src.Err())
+	b, err := src.Bytes()
+	r.NoError(err)
+	r.Equal("shs hello", string(b))
+	r.NoError(snk.Close())
+}
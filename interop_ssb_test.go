@@ -0,0 +1,118 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+//go:build interop_ssb
+// +build interop_ssb
+
+package muxrpc
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// These tests talk to running servers over their no-auth unix sockets (ssb-unix-socket and ssb-no-auth),
+// which speak plain muxrpc without secret-handshake and box-stream. Point them at the sockets like this:
+//
+//	MUXRPC_SSB_SOCKET=~/.ssb/socket MUXRPC_ROOM_SOCKET=/path/to/room/socket go test -tags interop_ssb -run TestInteropSSB
+//
+// Servers that are not configured are skipped.
+var interopSockets = map[string]string{
+	"ssb-server": "MUXRPC_SSB_SOCKET",
+	"rooms2":     "MUXRPC_ROOM_SOCKET",
+}
+
+func dialInterop(t *testing.T, envName string) Endpoint {
+	path := os.Getenv(envName)
+	if path == "" {
+		t.Skipf("%s not set", envName)
+	}
+
+	conn, err := net.Dial("unix", path)
+	require.NoError(t, err)
+
+	// we don't offer anything to the server, besides a manifest without methods
+	var client FakeHandler
+	client.HandledCalls(methodChecker("manifest"))
+	client.HandleCallCalls(func(ctx context.Context, req *Request) {
+		if req.Method.String() == "manifest" {
+			req.Return(ctx, struct{}{})
+			return
+		}
+		req.CloseWithError(ErrNoSuchMethod{req.Method})
+	})
+
+	edp := Handle(NewPacker(conn), &client)
+
+	errc := make(chan error, 1)
+	done := make(chan struct{})
+	go serve(context.Background(), edp.(Server), errc, done)
+
+	t.Cleanup(func() {
+		edp.Terminate()
+		select {
+		case <-done:
+		case err := <-errc:
+			t.Log("serve failed:", err)
+		case <-time.After(5 * time.Second):
+			t.Error("serve didn't stop")
+		}
+	})
+
+	return edp
+}
+
+func TestInteropSSB(t *testing.T) {
+	for name, envName := range interopSockets {
+		t.Run(name, func(t *testing.T) {
+			r := require.New(t)
+			edp := dialInterop(t, envName)
+
+			// the server should list the same methods and call types as the recorded manifest
+			ms := &edp.(*rpc).manifest
+			r.False(ms.missing, "server didn't send a manifest")
+			for m, callType := range recordedManifestMethods[name] {
+				got, ok := ms.Handled(Method(strings.Split(m, ".")))
+				r.True(ok, "%s not handled", m)
+				r.Equal(callType, got, "wrong type for %s", m)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			// whoami is sync on ssb-server and async on rooms2, both answer an async request
+			var who struct {
+				ID string `json:"id"`
+			}
+			err := edp.Async(ctx, &who, TypeJSON, Method{"whoami"})
+			r.NoError(err)
+			r.True(strings.HasPrefix(who.ID, "@"), "not a feed: %q", who.ID)
+
+			// isRoom answers false or with the metadata of the room
+			var isRoom interface{}
+			err = edp.Async(ctx, &isRoom, TypeJSON, Method{"tunnel", "isRoom"})
+			r.NoError(err)
+			if name == "rooms2" {
+				_, isMeta := isRoom.(map[string]interface{})
+				r.True(isMeta, "expected metadata: %v", isRoom)
+			}
+
+			// a bogus httpAuth solution is refused with an error, not by closing the session
+			var ok bool
+			err = edp.Async(ctx, &ok, TypeJSON, Method{"httpAuth", "sendSolution"}, "sc", "cc", "sol")
+			if name == "rooms2" {
+				var cerr *CallError
+				r.ErrorAs(err, &cerr)
+			}
+
+			r.NoError(edp.Async(ctx, &who, TypeJSON, Method{"whoami"}), "session didn't survive")
+		})
+	}
+}
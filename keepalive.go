@@ -0,0 +1,181 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// pingMethod is the duplex call SSB peers use to check each other, both sides send timestamps in milliseconds.
+var pingMethod = Method{"gossip", "ping"}
+
+// WithKeepAlive pings the remote if nothing was received for interval and terminates the session
+// with ErrKeepAliveTimeout if it stays silent for timeout. Any packet from the remote counts as a sign of life.
+//
+// Pings use the gossip.ping convention of SSB, which the endpoint also answers itself if the handler doesn't.
+// Peers that don't offer gossip.ping, or end the ping stream, are pinged with manifest calls instead.
+func WithKeepAlive(interval, timeout time.Duration) HandleOption {
+	return func(r *rpc) {
+		r.pingInterval = interval
+		r.pingTimeout = timeout
+	}
+}
+
+// keepAlive watches the packet counter of the connection and pings the remote while it is quiet.
+func (r *rpc) keepAlive() {
+	ticker := r.clock.NewTicker(r.pingInterval)
+	defer ticker.Stop()
+
+	var (
+		lastRead = r.pkr.r.PacketsRead()
+		lastSeen = r.clock.Now()
+
+		p = r.newPinger()
+		// holds a token while a ping is in flight, so that pings to a dead connection don't pile up
+		inFlight = make(chan struct{}, 1)
+	)
+	for {
+		select {
+		case <-r.serveCtx.Done():
+			return
+
+		case now := <-ticker.C():
+			if n := r.pkr.r.PacketsRead(); n != lastRead {
+				lastRead = n
+				lastSeen = now
+				continue
+			}
+
+			if now.Sub(lastSeen) >= r.pingTimeout {
+				logWarn(r.logger).Log("event", "keepalive timeout", "silent", now.Sub(lastSeen))
+				r.terminate(ErrKeepAliveTimeout)
+				return
+			}
+
+			// a dead connection can block writes, the timeout needs to fire anyhow
+			select {
+			case inFlight <- struct{}{}:
+				go func() {
+					defer func() { <-inFlight }()
+					p.ping()
+				}()
+			default:
+			}
+		}
+	}
+}
+
+// pinger sends the pings of the keepalive. It uses a gossip.ping stream while the remote keeps it open
+// and manifest calls once it ended, for instance because the remote doesn't know gossip.ping.
+type pinger struct {
+	r   *rpc
+	ctx context.Context
+
+	mu  sync.Mutex
+	snk *ByteSink // nil once the stream ended
+}
+
+func (r *rpc) newPinger() *pinger {
+	p := &pinger{
+		r:   r,
+		ctx: context.WithValue(r.serveCtx, keepAliveCtxKey{}, true),
+	}
+
+	src, snk, err := r.Duplex(p.ctx, TypeJSON, pingMethod, map[string]int64{"timeout": r.pingTimeout.Milliseconds()})
+	if err != nil {
+		logDebug(r.logger).Log("event", "no gossip.ping, using manifest calls", "err", err)
+		return p
+	}
+	p.snk = snk
+
+	// the replies only matter as packets, which the keepalive already counted
+	go func() {
+		for src.Next(p.ctx) {
+			src.Bytes()
+		}
+		p.stopStream("gossip.ping ended", src.Err())
+	}()
+	return p
+}
+
+// stopStream makes the following pings use manifest calls
+func (p *pinger) stopStream(event string, err error) {
+	p.mu.Lock()
+	snk := p.snk
+	p.snk = nil
+	p.mu.Unlock()
+	if snk == nil {
+		return
+	}
+
+	logDebug(p.r.logger).Log("event", event+", using manifest calls", "err", err)
+	snk.Close()
+}
+
+// ping sends a single ping.
+func (p *pinger) ping() {
+	p.mu.Lock()
+	snk := p.snk
+	p.mu.Unlock()
+
+	if snk != nil {
+		_, err := snk.Write([]byte(timestamp()))
+		if err == nil {
+			return
+		}
+		p.stopStream("gossip.ping write failed", err)
+	}
+
+	ctx, cancel := context.WithTimeout(p.ctx, p.r.pingTimeout)
+	defer cancel()
+	var ignored interface{}
+	p.r.Async(ctx, &ignored, TypeJSON, Method{"manifest"})
+}
+
+// timestamp is the body of a ping, the current time in milliseconds as JSON
+func timestamp() string {
+	return strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+}
+
+// answerPings handles gossip.ping calls for handlers that don't.
+func answerPings(root Handler) Handler {
+	return pingAnswerer{root}
+}
+
+type pingAnswerer struct{ Handler }
+
+func (pa pingAnswerer) Handled(m Method) bool {
+	return pa.Handler.Handled(m) || m.String() == pingMethod.String()
+}
+
+func (pa pingAnswerer) HandleCall(ctx context.Context, req *Request) {
+	if req.Method.String() != pingMethod.String() || pa.Handler.Handled(req.Method) {
+		pa.Handler.HandleCall(ctx, req)
+		return
+	}
+
+	src, err := req.ResponseSource()
+	if err != nil {
+		req.CloseWithError(err)
+		return
+	}
+	snk, err := req.ResponseSink()
+	if err != nil {
+		req.CloseWithError(err)
+		return
+	}
+	snk.SetEncoding(TypeJSON)
+
+	for src.Next(ctx) {
+		src.Bytes()
+		if _, err := snk.Write([]byte(timestamp())); err != nil {
+			return
+		}
+	}
+	snk.CloseWithError(src.Err())
+}
@@ -0,0 +1,89 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeepAliveDeadPeer(t *testing.T) {
+	r := require.New(t)
+
+	c1, c2 := loPipe(t)
+	// the remote reads everything but never answers, like a peer behind a dead NAT mapping
+	go io.Copy(ioutil.Discard, c2)
+
+	var client FakeHandler
+	edp := Handle(NewPacker(c1), &client, WithoutManifest(), WithKeepAlive(10*time.Millisecond, 100*time.Millisecond))
+	go edp.(Server).Serve()
+
+	src, err := edp.Source(context.Background(), TypeJSON, Method{"feed"})
+	r.NoError(err)
+
+	start := time.Now()
+	r.False(src.Next(context.Background()))
+	r.Less(int64(time.Since(start)), int64(2*time.Second), "took too long to notice")
+
+	err = src.Err()
+	r.True(errors.Is(err, ErrSessionTerminated), "unexpected error: %v", err)
+	r.True(errors.Is(err, ErrKeepAliveTimeout), "unexpected error: %v", err)
+}
+
+func TestKeepAliveHealthy(t *testing.T) {
+	r := require.New(t)
+
+	var srv FakeHandler
+	srv.HandledCalls(methodChecker("hello"))
+	srv.HandleCallCalls(func(ctx context.Context, req *Request) {
+		req.Return(ctx, "world")
+	})
+
+	var client FakeHandler
+	opts := []HandleOption{WithoutManifest(), WithKeepAlive(10*time.Millisecond, 50*time.Millisecond)}
+	edp, _ := connectPair(t, &client, &srv, opts, opts)
+
+	// a few timeouts worth of silence, only pings go over the wire
+	time.Sleep(250 * time.Millisecond)
+
+	var s string
+	r.NoError(edp.Async(context.Background(), &s, TypeString, Method{"hello"}))
+	r.Equal("world", s)
+
+	// the pings were answered by the endpoint, not the handler
+	r.Equal(1, srv.HandleCallCallCount())
+}
+
+func TestKeepAliveWithoutPing(t *testing.T) {
+	r := require.New(t)
+
+	// the remote doesn't use a keepalive, so it doesn't know gossip.ping either
+	var srv FakeHandler
+	srv.HandledCalls(methodChecker("hello"))
+	srv.HandleCallCalls(func(ctx context.Context, req *Request) {
+		if req.Method.String() != "hello" {
+			req.CloseWithError(ErrNoSuchMethod{req.Method})
+			return
+		}
+		req.Return(ctx, "world")
+	})
+
+	var client FakeHandler
+	opts := []HandleOption{WithoutManifest(), WithKeepAlive(10*time.Millisecond, 50*time.Millisecond)}
+	edp, _ := connectPair(t, &client, &srv, opts, []HandleOption{WithoutManifest()})
+
+	// the refused ping stream doesn't end the session, the manifest calls keep it alive
+	time.Sleep(250 * time.Millisecond)
+
+	var s string
+	r.NoError(edp.Async(context.Background(), &s, TypeString, Method{"hello"}))
+	r.Equal("world", s)
+}
@@ -0,0 +1,239 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// HandlerFactory returns the handler for a new connection.
+// If it returns an error the connection is closed without starting a session.
+type HandlerFactory func(conn net.Conn) (Handler, error)
+
+// ServeOption configures Serve.
+type ServeOption func(*acceptLoop)
+
+// WithHandleOptions sets the options that every session of Serve is started with.
+func WithHandleOptions(opts ...HandleOption) ServeOption {
+	return func(al *acceptLoop) {
+		al.handleOpts = append(al.handleOpts, opts...)
+	}
+}
+
+// WithMaxConns limits the number of sessions Serve runs at the same time. Connections beyond that are closed right away.
+// Zero (the default) means no limit.
+func WithMaxConns(n int) ServeOption {
+	return func(al *acceptLoop) {
+		al.maxConns = n
+	}
+}
+
+// WithMaxConnsPerIP limits the number of sessions Serve runs at the same time for connections from the same IP address.
+// Zero (the default) means no limit.
+func WithMaxConnsPerIP(n int) ServeOption {
+	return func(al *acceptLoop) {
+		al.maxPerIP = n
+	}
+}
+
+// WithServeLogger sets the logger for the connections Serve accepts or refuses, the sessions log to the one set with WithLogger.
+func WithServeLogger(l Logger) ServeOption {
+	return func(al *acceptLoop) {
+		al.logger = l
+	}
+}
+
+// WithServeClock sets the clock of the backoff after failed accepts. The default is RealClock.
+func WithServeClock(c Clock) ServeOption {
+	return func(al *acceptLoop) {
+		al.clock = c
+	}
+}
+
+// Serve accepts connections from lis and runs a session in the server role on each, with a handler from hf.
+// It returns once ctx is canceled or lis failed. Before it does it closes lis and terminates all the sessions it started.
+// The returned error is nil if ctx was canceled.
+func Serve(ctx context.Context, lis net.Listener, hf HandlerFactory, opts ...ServeOption) error {
+	al := &acceptLoop{
+		hf:    hf,
+		live:  make(map[Endpoint]struct{}),
+		perIP: make(map[string]int),
+	}
+	for _, o := range opts {
+		o(al)
+	}
+	if al.logger == nil {
+		al.logger = defaultLogger()
+	}
+	if al.clock == nil {
+		al.clock = RealClock()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		lis.Close()
+	}()
+
+	err := al.accept(ctx, lis)
+	if ctx.Err() != nil {
+		err = nil
+	}
+	cancel()
+
+	al.shutdown()
+	return err
+}
+
+type acceptLoop struct {
+	hf         HandlerFactory
+	handleOpts []HandleOption
+	logger     Logger
+	clock      Clock
+
+	maxConns, maxPerIP int
+
+	mu       sync.Mutex
+	live     map[Endpoint]struct{}
+	conns    int
+	perIP    map[string]int
+	closing  bool
+	sessions sync.WaitGroup
+}
+
+func (al *acceptLoop) accept(ctx context.Context, lis net.Listener) error {
+	var backoff time.Duration
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Temporary() {
+				// like running out of file descriptors, which might get better
+				if backoff == 0 {
+					backoff = 5 * time.Millisecond
+				} else if backoff *= 2; backoff > time.Second {
+					backoff = time.Second
+				}
+				logWarn(al.logger).Log("event", "accept failed", "err", err, "retry", backoff)
+				wait := al.clock.NewTimer(backoff)
+				select {
+				case <-wait.C():
+					continue
+				case <-ctx.Done():
+					wait.Stop()
+					return ctx.Err()
+				}
+			}
+			return err
+		}
+		backoff = 0
+
+		ip := remoteIP(conn.RemoteAddr())
+		if reason := al.reserve(ip); reason != "" {
+			logInfo(al.logger).Log("event", "connection refused", "remote", conn.RemoteAddr(), "reason", reason)
+			conn.Close()
+			continue
+		}
+
+		al.sessions.Add(1)
+		go al.handle(ctx, conn, ip)
+	}
+}
+
+// reserve counts a new connection from ip, unless a limit is reached. Then it returns why.
+func (al *acceptLoop) reserve(ip string) string {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if al.maxConns > 0 && al.conns >= al.maxConns {
+		return "too many connections"
+	}
+	if al.maxPerIP > 0 && al.perIP[ip] >= al.maxPerIP {
+		return "too many connections from this address"
+	}
+	al.conns++
+	al.perIP[ip]++
+	return ""
+}
+
+func (al *acceptLoop) release(ip string) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	al.conns--
+	if al.perIP[ip]--; al.perIP[ip] <= 0 {
+		delete(al.perIP, ip)
+	}
+}
+
+func (al *acceptLoop) handle(ctx context.Context, conn net.Conn, ip string) {
+	defer al.sessions.Done()
+	defer al.release(ip)
+
+	h, err := al.hf(conn)
+	if err != nil {
+		logInfo(al.logger).Log("event", "connection refused", "remote", conn.RemoteAddr(), "err", err)
+		conn.Close()
+		return
+	}
+
+	opts := append([]HandleOption{WithContext(ctx), WithIsServer(true)}, al.handleOpts...)
+	edp := Handle(NewPacker(conn), h, opts...)
+
+	al.mu.Lock()
+	if al.closing {
+		// Serve returned while the session was set up
+		al.mu.Unlock()
+		edp.Terminate()
+		return
+	}
+	al.live[edp] = struct{}{}
+	al.mu.Unlock()
+
+	err = edp.(Server).Serve()
+	if err != nil {
+		logDebug(al.logger).Log("event", "session ended", "remote", conn.RemoteAddr(), "err", err)
+	}
+
+	al.mu.Lock()
+	delete(al.live, edp)
+	al.mu.Unlock()
+}
+
+// shutdown terminates the live sessions and waits for all of them
+func (al *acceptLoop) shutdown() {
+	al.mu.Lock()
+	al.closing = true
+	live := make([]Endpoint, 0, len(al.live))
+	for edp := range al.live {
+		live = append(live, edp)
+	}
+	al.mu.Unlock()
+
+	for _, edp := range live {
+		edp.Terminate()
+	}
+	al.sessions.Wait()
+}
+
+func remoteIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,85 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// accepted returns true if conn is held open by the server, rejected connections are closed right away
+func accepted(t *testing.T, conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	var b [1]byte
+	_, err := conn.Read(b[:])
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+func TestServeLimits(t *testing.T) {
+	r := require.New(t)
+
+	lis, err := net.Listen("tcp4", "127.0.0.1:0")
+	r.NoError(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(ctx, lis, func(net.Conn) (Handler, error) { return &FakeHandler{}, nil },
+			WithMaxConnsPerIP(2),
+			WithServeLogger(NopLogger()),
+			WithHandleOptions(WithoutManifest(), WithLogger(NopLogger())),
+		)
+	}()
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp4", lis.Addr().String())
+		r.NoError(err)
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	c1, c2, c3 := dial(), dial(), dial()
+	r.True(accepted(t, c1))
+	r.True(accepted(t, c2))
+	r.False(accepted(t, c3), "over the per IP limit")
+
+	// a slot frees up once a session ended
+	c1.Close()
+	r.Eventually(func() bool {
+		return accepted(t, dial())
+	}, 2*time.Second, 10*time.Millisecond)
+
+	cancel()
+	r.NoError(<-served)
+
+	// the sessions were terminated
+	c2.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = ioutil.ReadAll(c2)
+	var ne net.Error
+	r.False(errors.As(err, &ne) && ne.Timeout(), "session should be closed, got %v", err)
+}
+
+func TestServeHandlerFactoryError(t *testing.T) {
+	r := require.New(t)
+
+	lis, err := net.Listen("tcp4", "127.0.0.1:0")
+	r.NoError(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go Serve(ctx, lis, func(net.Conn) (Handler, error) { return nil, errors.New("not today") }, WithServeLogger(NopLogger()))
+
+	conn, err := net.Dial("tcp4", lis.Addr().String())
+	r.NoError(err)
+	defer conn.Close()
+	r.False(accepted(t, conn))
+}
@@ -0,0 +1,166 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logger receives the events of an endpoint as alternating keys and values.
+// It has the shape of the go-kit logger, so those can be passed as they are.
+// Their level filters don't know about Level though and treat the events of muxrpc as if they had none, use FilterLevel instead.
+// For log/slog use NewSlogLogger.
+type Logger interface {
+	Log(keyvals ...interface{}) error
+}
+
+// LevelKey is the key of the Level that every event logged by muxrpc starts with.
+const LevelKey = "level"
+
+// Level is the severity of an event.
+type Level int
+
+// The levels that muxrpc logs with.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+// NopLogger returns a Logger that drops everything.
+func NopLogger() Logger { return nopLogger{} }
+
+type nopLogger struct{}
+
+func (nopLogger) Log(...interface{}) error { return nil }
+
+// LoggerWith returns a Logger that prepends keyvals to every event, for instance to add the fields of a connection.
+func LoggerWith(l Logger, keyvals ...interface{}) Logger {
+	if len(keyvals) == 0 {
+		return l
+	}
+	if cl, ok := l.(*contextLogger); ok {
+		// flatten, so that deeply nested loggers don't copy over and over
+		kvs := make([]interface{}, 0, len(cl.keyvals)+len(keyvals))
+		kvs = append(kvs, cl.keyvals...)
+		return &contextLogger{next: cl.next, keyvals: append(kvs, keyvals...)}
+	}
+	return &contextLogger{next: l, keyvals: keyvals}
+}
+
+type contextLogger struct {
+	next    Logger
+	keyvals []interface{}
+}
+
+func (cl *contextLogger) Log(keyvals ...interface{}) error {
+	kvs := make([]interface{}, 0, len(cl.keyvals)+len(keyvals))
+	kvs = append(kvs, cl.keyvals...)
+	return cl.next.Log(append(kvs, keyvals...)...)
+}
+
+// FilterLevel returns a Logger that drops events below min.
+// Events without a Level are passed on.
+func FilterLevel(l Logger, min Level) Logger {
+	return levelFilter{next: l, min: min}
+}
+
+type levelFilter struct {
+	next Logger
+	min  Level
+}
+
+func (lf levelFilter) Log(keyvals ...interface{}) error {
+	for i := 0; i < len(keyvals)-1; i += 2 {
+		if lvl, ok := keyvals[i+1].(Level); ok && keyvals[i] == LevelKey && lvl < lf.min {
+			return nil
+		}
+	}
+	return lf.next.Log(keyvals...)
+}
+
+func logDebug(l Logger) Logger { return LoggerWith(l, LevelKey, LevelDebug) }
+func logInfo(l Logger) Logger  { return LoggerWith(l, LevelKey, LevelInfo) }
+func logWarn(l Logger) Logger  { return LoggerWith(l, LevelKey, LevelWarn) }
+func logError(l Logger) Logger { return LoggerWith(l, LevelKey, LevelError) }
+
+// defaultLogger is used if no logger was set, it only logs info and above to stderr
+func defaultLogger() Logger {
+	return LoggerWith(FilterLevel(NewLogfmtLogger(os.Stderr), LevelInfo), "unit", "muxrpc")
+}
+
+// NewLogfmtLogger returns a Logger that writes each event as a line of logfmt to w, starting with a UTC timestamp.
+// It is what endpoints log to, filtered to LevelInfo, if WithLogger isn't used.
+func NewLogfmtLogger(w io.Writer) Logger {
+	return &logfmtLogger{w: w}
+}
+
+type logfmtLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (ll *logfmtLogger) Log(keyvals ...interface{}) error {
+	var sb strings.Builder
+	sb.WriteString("ts=")
+	sb.WriteString(time.Now().UTC().Format(time.RFC3339Nano))
+	for i := 0; i < len(keyvals); i += 2 {
+		sb.WriteByte(' ')
+		sb.WriteString(logfmtValue(keyvals[i]))
+		sb.WriteByte('=')
+		if i+1 < len(keyvals) {
+			sb.WriteString(logfmtValue(keyvals[i+1]))
+		} else {
+			sb.WriteString("(MISSING)")
+		}
+	}
+	sb.WriteByte('\n')
+
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	// a plain Write, so that writers which only lock Write can be shared by several loggers
+	_, err := ll.w.Write([]byte(sb.String()))
+	return err
+}
+
+func logfmtValue(v interface{}) string {
+	var s string
+	switch tv := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		s = tv
+	case error:
+		s = tv.Error()
+	case fmt.Stringer:
+		s = tv.String()
+	default:
+		s = fmt.Sprint(v)
+	}
+	if s == "" || strings.ContainsAny(s, " =\"\\\n\t") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
@@ -0,0 +1,67 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+//go:build go1.21
+// +build go1.21
+
+package muxrpc
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// NewSlogLogger returns a Logger that passes events on to sl.
+// The Level of an event becomes the slog level and its "event" becomes the message.
+func NewSlogLogger(sl *slog.Logger) Logger {
+	return slogLogger{sl: sl}
+}
+
+type slogLogger struct {
+	sl *slog.Logger
+}
+
+func (l slogLogger) Log(keyvals ...interface{}) error {
+	lvl := slog.LevelInfo
+	msg := "muxrpc"
+	attrs := make([]slog.Attr, 0, len(keyvals)/2)
+	for i := 0; i < len(keyvals); i += 2 {
+		key := fmt.Sprint(keyvals[i])
+		var val interface{} = "(MISSING)"
+		if i+1 < len(keyvals) {
+			val = keyvals[i+1]
+		}
+
+		switch v := val.(type) {
+		case Level:
+			if key == LevelKey {
+				lvl = slogLevel(v)
+				continue
+			}
+		case string:
+			if key == "event" || key == "evt" {
+				msg = v
+				continue
+			}
+		case error:
+			val = v.Error()
+		}
+		attrs = append(attrs, slog.Any(key, val))
+	}
+	l.sl.LogAttrs(context.Background(), lvl, msg, attrs...)
+	return nil
+}
+
+func slogLevel(l Level) slog.Level {
+	switch l {
+	case LevelDebug:
+		return slog.LevelDebug
+	case LevelWarn:
+		return slog.LevelWarn
+	case LevelError:
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
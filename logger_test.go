@@ -0,0 +1,33 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogfmtLogger(t *testing.T) {
+	r := require.New(t)
+
+	var buf bytes.Buffer
+	l := FilterLevel(NewLogfmtLogger(&buf), LevelInfo)
+	l = LoggerWith(l, "unit", "muxrpc")
+	l = LoggerWith(l, "remote", "1.2.3.4:8008")
+
+	logDebug(l).Log("event", "hidden")
+	logWarn(l).Log("event", "keepalive timeout", "err", errors.New("no pong"), "reqID", 3)
+	l.Log("event", "no level")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	r.Len(lines, 2)
+	r.True(strings.HasPrefix(lines[0], "ts="))
+	r.Contains(lines[0], ` unit=muxrpc remote=1.2.3.4:8008 level=warn event="keepalive timeout" err="no pong" reqID=3`)
+	r.Contains(lines[1], "event=\"no level\"")
+}
@@ -0,0 +1,92 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// Metadata is sent along with a call, next to its name and arguments, for instance to propagate a trace context.
+// JS muxrpc ignores it, it is only sent if both ends negotiated FeatureMetadata (see WithHello).
+type Metadata map[string]string
+
+// MetadataTimeout is the key of the metadata that tells the remote how many milliseconds the caller is going to wait for the call.
+// It is sent along if the context of the call has a deadline, and the context that the remote passes to its handler ends after that time.
+// The time that is left is sent instead of the deadline itself, so that the clocks of the peers don't need to agree.
+const MetadataTimeout = "muxrpc.timeout"
+
+type (
+	metadataCtxKeyType         struct{}
+	incomingMetadataCtxKeyType struct{}
+)
+
+var (
+	metadataCtxKey         metadataCtxKeyType
+	incomingMetadataCtxKey incomingMetadataCtxKeyType
+)
+
+// ContextWithMetadata returns a context whose calls send md along, if the remote supports it.
+// Keys that are already set on ctx are kept unless md overwrites them.
+func ContextWithMetadata(ctx context.Context, md Metadata) context.Context {
+	if prev, ok := MetadataFromContext(ctx); ok {
+		merged := make(Metadata, len(prev)+len(md))
+		for k, v := range prev {
+			merged[k] = v
+		}
+		for k, v := range md {
+			merged[k] = v
+		}
+		md = merged
+	}
+	return context.WithValue(ctx, metadataCtxKey, md)
+}
+
+// MetadataFromContext returns the metadata that was set with ContextWithMetadata.
+// The metadata of an incoming call isn't part of it, see IncomingMetadata.
+func MetadataFromContext(ctx context.Context) (Metadata, bool) {
+	md, ok := ctx.Value(metadataCtxKey).(Metadata)
+	return md, ok && len(md) > 0
+}
+
+// IncomingMetadata returns the metadata that the caller sent along with the call whose handler got ctx.
+// It is kept apart from the metadata of ContextWithMetadata, so that calls the handler makes don't pass on what the remote sent.
+// Handlers that want to forward some of it set it with ContextWithMetadata.
+func IncomingMetadata(ctx context.Context) (Metadata, bool) {
+	md, ok := ctx.Value(incomingMetadataCtxKey).(Metadata)
+	return md, ok && len(md) > 0
+}
+
+// outgoingMetadata returns what is sent along with a call that is started with ctx: its metadata and the time left until its deadline,
+// as seen by the clock of the session
+func (r *rpc) outgoingMetadata(ctx context.Context) Metadata {
+	md, _ := MetadataFromContext(ctx)
+	dl, ok := ctx.Deadline()
+	if !ok {
+		return md
+	}
+
+	// round up, a call with less than a millisecond left should still time out on the other end
+	ms := (dl.Sub(r.clock.Now()) + time.Millisecond - 1) / time.Millisecond
+	if ms < 1 {
+		ms = 1
+	}
+	withTimeout := make(Metadata, len(md)+1)
+	for k, v := range md {
+		withTimeout[k] = v
+	}
+	withTimeout[MetadataTimeout] = strconv.FormatInt(int64(ms), 10)
+	return withTimeout
+}
+
+// timeout returns the time the caller is going to wait for the call, see MetadataTimeout
+func (md Metadata) timeout() (time.Duration, bool) {
+	ms, err := strconv.ParseInt(md[MetadataTimeout], 10, 64)
+	if err != nil || ms <= 0 {
+		return 0, false
+	}
+	return time.Duration(ms) * time.Millisecond, true
+}
@@ -0,0 +1,148 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadata(t *testing.T) {
+	ctx := ContextWithMetadata(context.Background(), Metadata{"origin": "cli", "trace": "1"})
+	ctx = ContextWithMetadata(ctx, Metadata{"trace": "2"})
+
+	hello := []HandleOption{WithHello(FeatureMetadata)}
+	for _, tc := range []struct {
+		name    string
+		srvOpts []HandleOption
+		want    Metadata
+	}{
+		{"negotiated", hello, Metadata{"origin": "cli", "trace": "2"}},
+		{"not negotiated", nil, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := require.New(t)
+
+			var srv FakeHandler
+			srv.HandledCalls(func(m Method) bool { return true })
+			srv.HandleCallCalls(func(ctx context.Context, req *Request) {
+				if _, forwarded := MetadataFromContext(ctx); forwarded {
+					req.CloseWithError(errors.New("calls of the handler would pass on the incoming metadata"))
+					return
+				}
+				md, _ := IncomingMetadata(ctx)
+				req.Return(ctx, md)
+			})
+
+			var client FakeHandler
+			client.HandledCalls(methodChecker("manifest"))
+			client.HandleCallCalls(func(ctx context.Context, req *Request) {
+				req.CloseWithError(ErrNoSuchMethod{req.Method})
+			})
+
+			manifest := json.RawMessage(`{"whoami":"async"}`)
+			edp, _ := connectPair(t, &client, testManifestWrapper{manifest: manifest, root: &srv}, hello, tc.srvOpts)
+
+			var got Metadata
+			r.NoError(edp.Async(ctx, &got, TypeJSON, Method{"whoami"}))
+			r.Equal(tc.want, got)
+		})
+	}
+}
+
+func TestDeadlinePropagation(t *testing.T) {
+	r := require.New(t)
+
+	type ended struct {
+		hadDeadline bool
+		err         error
+	}
+	endedc := make(chan ended, 2)
+
+	var srv FakeHandler
+	srv.HandledCalls(func(m Method) bool { return true })
+	srv.HandleCallCalls(func(ctx context.Context, req *Request) {
+		if req.Type == "async" {
+			_, hasDeadline := ctx.Deadline()
+			req.Return(ctx, hasDeadline)
+			return
+		}
+		// an expensive source that only stops when it has to
+		_, hadDeadline := ctx.Deadline()
+		<-ctx.Done()
+		endedc <- ended{hadDeadline, ctx.Err()}
+		req.CloseWithError(ctx.Err())
+	})
+
+	var client FakeHandler
+	client.HandledCalls(methodChecker("manifest"))
+	client.HandleCallCalls(func(ctx context.Context, req *Request) {
+		req.CloseWithError(ErrNoSuchMethod{req.Method})
+	})
+
+	manifest := json.RawMessage(`{"ping":"async","feed":"source"}`)
+	hello := []HandleOption{WithHello(FeatureMetadata)}
+	edp, _ := connectPair(t, &client, testManifestWrapper{manifest: manifest, root: &srv}, hello, hello)
+
+	// the consumer gives up without cancelling the call
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	src, err := edp.Source(ctx, TypeJSON, Method{"feed"})
+	r.NoError(err)
+	r.False(src.Next(ctx))
+
+	select {
+	case e := <-endedc:
+		r.True(e.hadDeadline)
+		r.True(errors.Is(e.err, context.DeadlineExceeded), "unexpected error: %v", e.err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handler didn't time out")
+	}
+
+	// calls without a deadline don't get one
+	var hasDeadline bool
+	r.NoError(edp.Async(context.Background(), &hasDeadline, TypeJSON, Method{"ping"}))
+	r.False(hasDeadline)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	r.NoError(edp.Async(ctx, &hasDeadline, TypeJSON, Method{"ping"}))
+	r.True(hasDeadline)
+}
+
+func TestMetadataTimeout(t *testing.T) {
+	r := require.New(t)
+
+	edp := &rpc{clock: RealClock()}
+	r.Nil(edp.outgoingMetadata(context.Background()))
+
+	parent := ContextWithMetadata(context.Background(), Metadata{"origin": "cli"})
+	ctx, cancel := context.WithTimeout(parent, 2*time.Second)
+	defer cancel()
+	md := edp.outgoingMetadata(ctx)
+	r.Equal("cli", md["origin"])
+	d, ok := md.timeout()
+	r.True(ok)
+	r.True(d > time.Second && d <= 2*time.Second, "unexpected timeout: %v", d)
+
+	// the time that is left is measured with the clock of the session
+	later := &rpc{clock: &laterClock{Clock: RealClock(), offset: time.Second}}
+	d, ok = later.outgoingMetadata(ctx).timeout()
+	r.True(ok)
+	r.True(d <= time.Second, "unexpected timeout: %v", d)
+
+	// the metadata of the context is left alone
+	prev, _ := MetadataFromContext(ctx)
+	r.NotContains(prev, MetadataTimeout)
+
+	for _, bad := range []string{"", "-5", "0", "soon"} {
+		_, ok := Metadata{MetadataTimeout: bad}.timeout()
+		r.False(ok, bad)
+	}
+}
@@ -0,0 +1,72 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"fmt"
+)
+
+// CallInterceptor runs instead of HandleCall of the handler it wraps and decides if and when the call is passed on to next.
+// Much like gRPC interceptors they are useful for logging, auth, metrics or rate limiting.
+type CallInterceptor func(ctx context.Context, req *Request, next CallHandler)
+
+// ConnectInterceptor is the same as CallInterceptor, but for HandleConnect.
+type ConnectInterceptor func(ctx context.Context, edp Endpoint, next ConnectHandler)
+
+// InterceptCalls returns a HandlerWrapper that passes all calls through the interceptors.
+// The first one is the outermost, it sees the call first.
+func InterceptCalls(ics ...CallInterceptor) HandlerWrapper {
+	return func(h Handler) Handler {
+		for i := len(ics) - 1; i >= 0; i-- {
+			h = callInterceptor{Handler: h, ic: ics[i]}
+		}
+		return h
+	}
+}
+
+type callInterceptor struct {
+	Handler
+	ic CallInterceptor
+}
+
+func (ci callInterceptor) HandleCall(ctx context.Context, req *Request) {
+	ci.ic(ctx, req, ci.Handler)
+}
+
+// InterceptConnects returns a HandlerWrapper that passes all new connections through the interceptors.
+// The first one is the outermost, like with InterceptCalls.
+func InterceptConnects(ics ...ConnectInterceptor) HandlerWrapper {
+	return func(h Handler) Handler {
+		for i := len(ics) - 1; i >= 0; i-- {
+			h = connectInterceptor{Handler: h, ic: ics[i]}
+		}
+		return h
+	}
+}
+
+type connectInterceptor struct {
+	Handler
+	ic ConnectInterceptor
+}
+
+func (ci connectInterceptor) HandleConnect(ctx context.Context, edp Endpoint) {
+	ci.ic(ctx, edp, ci.Handler)
+}
+
+// RecoverPanics is a CallInterceptor that closes the call with an error if the handler panics, instead of crashing the whole program.
+// It only sees panics of the goroutine that runs HandleCall.
+func RecoverPanics(ctx context.Context, req *Request, next CallHandler) {
+	defer func() {
+		p := recover()
+		if p == nil {
+			return
+		}
+		logError(LoggerFromContext(ctx)).Log("event", "handler panicked", "panic", p)
+		req.CloseWithError(fmt.Errorf("muxrpc: handler panicked: %v", p))
+	}()
+
+	next.HandleCall(ctx, req)
+}
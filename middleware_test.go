@@ -0,0 +1,123 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInterceptors(t *testing.T) {
+	r := require.New(t)
+
+	var (
+		mu    sync.Mutex
+		trace []string
+	)
+	record := func(s string) {
+		mu.Lock()
+		trace = append(trace, s)
+		mu.Unlock()
+	}
+
+	named := func(name string) CallInterceptor {
+		return func(ctx context.Context, req *Request, next CallHandler) {
+			if req.Method.String() == "manifest" {
+				next.HandleCall(ctx, req)
+				return
+			}
+			record(name + " in")
+			next.HandleCall(ctx, req)
+			record(name + " out")
+		}
+	}
+
+	denyAll := func(ctx context.Context, req *Request, next CallHandler) {
+		if req.Method.String() == "secret" {
+			req.CloseWithError(errors.New("access denied"))
+			return
+		}
+		next.HandleCall(ctx, req)
+	}
+
+	connected := make(chan struct{})
+	onConnect := func(ctx context.Context, edp Endpoint, next ConnectHandler) {
+		next.HandleConnect(ctx, edp)
+		close(connected)
+	}
+
+	var fh FakeHandler
+	fh.HandledReturns(true)
+	fh.HandleCallStub = func(ctx context.Context, req *Request) {
+		switch req.Method.String() {
+		case "boom":
+			panic("handler exploded")
+		case "manifest":
+			req.CloseWithError(ErrNoSuchMethod{req.Method})
+		default:
+			record("handler")
+			req.Return(ctx, "ok")
+		}
+	}
+
+	client, _ := connectPair(t, &FakeHandler{}, &fh, nil, []HandleOption{
+		WithHandlerWrappers(
+			InterceptCalls(named("outer"), named("inner"), denyAll, RecoverPanics),
+			InterceptConnects(onConnect),
+		),
+	})
+
+	select {
+	case <-connected:
+	case <-time.After(2 * time.Second):
+		t.Fatal("connect interceptor not called")
+	}
+	r.Equal(1, fh.HandleConnectCallCount())
+
+	ctx := context.Background()
+
+	var s string
+	r.NoError(client.Async(ctx, &s, TypeString, Method{"hello"}))
+	r.Equal("ok", s)
+
+	// the interceptors return after the reply was sent
+	want := []string{"outer in", "inner in", "handler", "inner out", "outer out"}
+	var got []string
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		mu.Lock()
+		got = append(got[:0], trace...)
+		mu.Unlock()
+		if len(got) == len(want) {
+			break
+		}
+	}
+	r.Equal(want, got)
+
+	err := client.Async(ctx, &s, TypeString, Method{"secret"})
+	r.Error(err)
+	r.True(strings.Contains(err.Error(), "access denied"), "wrong error: %s", err)
+	r.Equal(0, countCalls(&fh, "secret"), "denied call reached the handler")
+
+	err = client.Async(ctx, &s, TypeString, Method{"boom"})
+	r.Error(err)
+	r.True(strings.Contains(err.Error(), "handler exploded"), "wrong error: %s", err)
+}
+
+func countCalls(fh *FakeHandler, method string) int {
+	n := 0
+	for i := 0; i < fh.HandleCallCallCount(); i++ {
+		_, req := fh.HandleCallArgsForCall(i)
+		if req.Method.String() == method {
+			n++
+		}
+	}
+	return n
+}
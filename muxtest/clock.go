@@ -0,0 +1,193 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+// Package muxtest has helpers for testing code that uses muxrpc.
+package muxtest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ssbc/go-muxrpc/v2"
+)
+
+// Clock is a muxrpc.Clock that only moves forward when Advance is called,
+// so that tests can trigger timeouts and backoffs without sleeping.
+//
+// Since the timers are set up by other goroutines, tests usually wait with BlockUntil
+// for the code under test to start its timers before they advance the clock.
+type Clock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*timer
+
+	// changed is closed and replaced whenever a timer is added or removed
+	changed chan struct{}
+}
+
+var _ muxrpc.Clock = (*Clock)(nil)
+
+// NewClock returns a clock that starts at start.
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start, changed: make(chan struct{})}
+}
+
+// Now returns the time of the clock.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTimer returns a timer that fires once the clock was advanced by d.
+func (c *Clock) NewTimer(d time.Duration) muxrpc.Timer {
+	t := &timer{c: c, ch: make(chan time.Time, 1)}
+	c.start(t, d, 0)
+	return t
+}
+
+// NewTicker returns a ticker that fires every time the clock was advanced by d.
+// Like a time.Ticker it drops ticks if the receiver doesn't keep up.
+func (c *Clock) NewTicker(d time.Duration) muxrpc.Ticker {
+	if d <= 0 {
+		panic("muxtest: non-positive interval for NewTicker")
+	}
+	t := &timer{c: c, ch: make(chan time.Time, 1)}
+	c.start(t, d, d)
+	return ticker{t}
+}
+
+// AfterFunc calls f in its own goroutine once the clock was advanced by d.
+func (c *Clock) AfterFunc(d time.Duration, f func()) muxrpc.Timer {
+	t := &timer{c: c, f: f}
+	c.start(t, d, 0)
+	return t
+}
+
+// Advance moves the clock forward by d and fires the timers that are due, in order.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	end := c.now.Add(d)
+	for {
+		next := -1
+		for i, t := range c.timers {
+			if !t.at.After(end) && (next == -1 || t.at.Before(c.timers[next].at)) {
+				next = i
+			}
+		}
+		if next == -1 {
+			break
+		}
+
+		t := c.timers[next]
+		c.now = t.at
+		if t.period > 0 {
+			t.at = t.at.Add(t.period)
+		} else {
+			c.remove(t)
+		}
+		t.fire(c.now)
+	}
+	c.now = end
+}
+
+// Pending returns the number of timers and tickers that weren't stopped and didn't fire yet.
+func (c *Clock) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// BlockUntil waits until n timers and tickers are pending or ctx is done.
+func (c *Clock) BlockUntil(ctx context.Context, n int) error {
+	for {
+		c.mu.Lock()
+		pending, changed := len(c.timers), c.changed
+		c.mu.Unlock()
+		if pending == n {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *Clock) start(t *timer, d, period time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t.at = c.now.Add(d)
+	t.period = period
+	c.timers = append(c.timers, t)
+	c.notify()
+}
+
+// remove has to be called with c.mu held. It returns false if t wasn't pending.
+func (c *Clock) remove(t *timer) bool {
+	for i, pending := range c.timers {
+		if pending == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			c.notify()
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Clock) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+type timer struct {
+	c *Clock
+
+	ch chan time.Time
+	f  func()
+
+	at     time.Time
+	period time.Duration
+}
+
+func (t *timer) C() <-chan time.Time { return t.ch }
+
+func (t *timer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	return t.c.remove(t)
+}
+
+func (t *timer) Reset(d time.Duration) bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	wasPending := t.c.remove(t)
+	t.at = t.c.now.Add(d)
+	t.c.timers = append(t.c.timers, t)
+	t.c.notify()
+	return wasPending
+}
+
+// fire is called with the lock of the clock held
+func (t *timer) fire(now time.Time) {
+	if t.f != nil {
+		go t.f()
+		return
+	}
+	select {
+	case t.ch <- now:
+	default:
+	}
+}
+
+// ticker hides the result of Stop, like time.Ticker does
+type ticker struct{ t *timer }
+
+func (tk ticker) C() <-chan time.Time { return tk.t.ch }
+func (tk ticker) Stop()               { tk.t.Stop() }
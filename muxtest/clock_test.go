@@ -0,0 +1,86 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxtest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ssbc/go-muxrpc/v2"
+)
+
+func TestClock(t *testing.T) {
+	r := require.New(t)
+
+	start := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	c := NewClock(start)
+
+	timer := c.NewTimer(time.Second)
+	tick := c.NewTicker(300 * time.Millisecond)
+	called := make(chan time.Time, 1)
+	c.AfterFunc(500*time.Millisecond, func() { called <- c.Now() })
+	r.Equal(3, c.Pending())
+
+	c.Advance(400 * time.Millisecond)
+	r.Equal(start.Add(300*time.Millisecond), <-tick.C())
+	r.Equal(start.Add(400*time.Millisecond), c.Now())
+	select {
+	case <-timer.C():
+		t.Fatal("timer fired early")
+	default:
+	}
+
+	c.Advance(time.Second)
+	r.Equal(start.Add(time.Second), <-timer.C())
+	r.Equal(start.Add(1400*time.Millisecond), <-called)
+	r.Equal(1, c.Pending(), "only the ticker is left")
+
+	// the ticks that weren't received were dropped
+	r.Equal(start.Add(600*time.Millisecond), <-tick.C())
+	tick.Stop()
+	r.Equal(0, c.Pending())
+
+	r.False(timer.Reset(time.Minute))
+	r.True(timer.Stop())
+}
+
+func TestClockResponseTimeout(t *testing.T) {
+	r := require.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	clock := NewClock(time.Now())
+
+	var silent muxrpc.FakeHandler
+	silent.HandledCalls(func(muxrpc.Method) bool { return true })
+	opts := []muxrpc.HandleOption{muxrpc.WithoutManifest(), muxrpc.WithLogger(muxrpc.NopLogger())}
+	client, server := muxrpc.NewPipe(&muxrpc.FakeHandler{}, &silent, muxrpc.WithPipeHandleOptions(
+		append(opts, muxrpc.WithClock(clock), muxrpc.WithResponseTimeout(time.Minute)),
+		opts,
+	))
+	defer server.Terminate()
+	defer client.Terminate()
+
+	errc := make(chan error, 1)
+	go func() {
+		var v interface{}
+		errc <- client.Async(ctx, &v, muxrpc.TypeJSON, muxrpc.Method{"silent"})
+	}()
+
+	r.NoError(clock.BlockUntil(ctx, 1))
+	clock.Advance(59 * time.Second)
+	select {
+	case err := <-errc:
+		t.Fatal("call returned early:", err)
+	default:
+	}
+
+	clock.Advance(time.Second)
+	r.True(errors.Is(<-errc, muxrpc.ErrNoResponse))
+}
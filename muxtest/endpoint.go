@@ -0,0 +1,200 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxtest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/ssbc/go-muxrpc/v2"
+)
+
+// Endpoint is a muxrpc.Endpoint that talks to a scripted peer, for testing code that makes calls.
+// The calls go through a real session over an in-memory pipe, so the code under test gets
+// the same sources, sinks and errors as with a real peer. Methods that weren't scripted fail like unknown methods do.
+//
+//	edp := muxtest.NewEndpoint()
+//	defer edp.Terminate()
+//	edp.OnAsync(muxrpc.Method{"whoami"}, map[string]string{"id": "@alice"})
+//	edp.OnSource(muxrpc.Method{"createHistoryStream"}, msg1, msg2)
+//
+// The calls the code made can be checked with Calls and WaitForCalls.
+type Endpoint struct {
+	muxrpc.Endpoint
+
+	*script
+}
+
+// NewEndpoint starts a session with a peer that has nothing scripted yet.
+// The sessions don't exchange manifests and don't log, the options of the pipe can change that.
+func NewEndpoint(opts ...muxrpc.PipeOption) *Endpoint {
+	sh := &script{replies: make(map[string]reply)}
+	quiet := []muxrpc.HandleOption{muxrpc.WithoutManifest(), muxrpc.WithLogger(muxrpc.NopLogger())}
+	opts = append([]muxrpc.PipeOption{muxrpc.WithPipeHandleOptions(quiet, quiet)}, opts...)
+
+	client, _ := muxrpc.NewPipe(&RecordingHandler{}, sh, opts...)
+	return &Endpoint{Endpoint: client, script: sh}
+}
+
+// OnAsync makes async calls of method return v.
+func (e *Endpoint) OnAsync(method muxrpc.Method, v interface{}) {
+	e.set(method, reply{tipe: "async", value: v})
+}
+
+// OnSource makes source calls of method send items, encoded as JSON, and end.
+func (e *Endpoint) OnSource(method muxrpc.Method, items ...interface{}) {
+	e.set(method, reply{tipe: "source", items: items})
+}
+
+// OnSink makes sink calls of method read everything the caller sends and end the stream after the caller did.
+// The frames show up as Received of the call.
+func (e *Endpoint) OnSink(method muxrpc.Method) {
+	e.set(method, reply{tipe: "sink"})
+}
+
+// OnDuplex makes duplex calls of method send items, encoded as JSON, and then read everything the caller sends,
+// which shows up as Received of the call. The stream ends when the caller ends it.
+func (e *Endpoint) OnDuplex(method muxrpc.Method, items ...interface{}) {
+	e.set(method, reply{tipe: "duplex", items: items})
+}
+
+// OnError makes calls of method fail with err, whatever their type is.
+func (e *Endpoint) OnError(method muxrpc.Method, err error) {
+	e.set(method, reply{err: err})
+}
+
+// OnCall handles calls of method with fn, for everything the other helpers don't cover.
+func (e *Endpoint) OnCall(method muxrpc.Method, fn func(ctx context.Context, req *muxrpc.Request)) {
+	e.set(method, reply{fn: fn})
+}
+
+// script is the handler of the peer of an Endpoint
+type script struct {
+	recorder
+
+	mu      sync.Mutex
+	replies map[string]reply
+}
+
+type reply struct {
+	// tipe is the call type the reply is for, empty for errors and functions
+	tipe muxrpc.CallType
+
+	value interface{}
+	items []interface{}
+	err   error
+	fn    func(context.Context, *muxrpc.Request)
+}
+
+func (s *script) set(method muxrpc.Method, r reply) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replies[method.String()] = r
+}
+
+func (s *script) reply(method muxrpc.Method) (reply, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.replies[method.String()]
+	return r, ok
+}
+
+func (s *script) Handled(m muxrpc.Method) bool {
+	_, ok := s.reply(m)
+	return ok
+}
+
+func (s *script) HandleConnect(context.Context, muxrpc.Endpoint) {}
+
+func (s *script) HandleCall(ctx context.Context, req *muxrpc.Request) {
+	call := s.record(req)
+
+	r, ok := s.reply(req.Method)
+	switch {
+	case !ok:
+		// the script changed since Handled was asked
+		req.CloseWithError(muxrpc.ErrNoSuchMethod{Method: req.Method})
+		return
+	case r.fn != nil:
+		r.fn(ctx, req)
+		return
+	case r.err != nil:
+		req.CloseWithError(r.err)
+		return
+	case r.tipe != req.Type && !(r.tipe == "async" && req.Type == "sync"):
+		req.CloseWithError(muxrpc.ErrWrongCallType{Method: req.Method, Called: string(req.Type), Declared: string(r.tipe)})
+		return
+	}
+
+	switch req.Type {
+	case "async", "sync":
+		req.Return(ctx, r.value)
+
+	case "source":
+		snk, err := req.ResponseSink()
+		if err != nil {
+			req.CloseWithError(err)
+			return
+		}
+		if err := writeItems(snk, r.items); err != nil {
+			req.CloseWithError(err)
+			return
+		}
+		snk.Close()
+
+	case "sink":
+		src, err := req.ResponseSource()
+		if err != nil {
+			req.CloseWithError(err)
+			return
+		}
+		req.CloseWithError(s.drain(ctx, call, src))
+
+	case "duplex":
+		src, err := req.ResponseSource()
+		if err != nil {
+			req.CloseWithError(err)
+			return
+		}
+		snk, err := req.ResponseSink()
+		if err != nil {
+			req.CloseWithError(err)
+			return
+		}
+		if err := writeItems(snk, r.items); err != nil {
+			req.CloseWithError(err)
+			return
+		}
+		req.CloseWithError(s.drain(ctx, call, src))
+	}
+}
+
+// drain records the frames of src for the call at index call and returns the error of src
+func (s *script) drain(ctx context.Context, call int, src *muxrpc.ByteSource) error {
+	for src.Next(ctx) {
+		b, err := src.Bytes()
+		if err != nil {
+			return err
+		}
+		s.received(call, b)
+	}
+	return src.Err()
+}
+
+func writeItems(snk *muxrpc.ByteSink, items []interface{}) error {
+	snk.SetEncoding(muxrpc.TypeJSON)
+	for _, item := range items {
+		b, err := json.Marshal(item)
+		if err != nil {
+			return fmt.Errorf("muxtest: failed to encode item: %w", err)
+		}
+		if _, err := snk.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
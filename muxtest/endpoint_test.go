@@ -0,0 +1,133 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxtest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ssbc/go-muxrpc/v2"
+)
+
+func readAll(ctx context.Context, t *testing.T, src *muxrpc.ByteSource) []string {
+	var items []string
+	for src.Next(ctx) {
+		b, err := src.Bytes()
+		require.NoError(t, err)
+		items = append(items, string(b))
+	}
+	require.NoError(t, src.Err())
+	return items
+}
+
+// findCall returns the call of method, the calls run concurrently so their order isn't fixed
+func findCall(t *testing.T, calls []Call, method string) Call {
+	for _, c := range calls {
+		if c.Method.String() == method {
+			return c
+		}
+	}
+	t.Fatalf("no call of %s", method)
+	return Call{}
+}
+
+func TestEndpoint(t *testing.T) {
+	r := require.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	edp := NewEndpoint()
+	defer edp.Terminate()
+
+	edp.OnAsync(muxrpc.Method{"whoami"}, map[string]string{"id": "@alice"})
+	edp.OnSource(muxrpc.Method{"feed"}, 1, 2, 3)
+	edp.OnSink(muxrpc.Method{"upload"})
+	edp.OnDuplex(muxrpc.Method{"chat"}, "hi")
+	edp.OnError(muxrpc.Method{"broken"}, errors.New("out of order"))
+
+	var who map[string]string
+	r.NoError(edp.Async(ctx, &who, muxrpc.TypeJSON, muxrpc.Method{"whoami"}))
+	r.Equal("@alice", who["id"])
+
+	src, err := edp.Source(ctx, muxrpc.TypeJSON, muxrpc.Method{"feed"}, map[string]int{"seq": 1})
+	r.NoError(err)
+	r.Equal([]string{"1", "2", "3"}, readAll(ctx, t, src))
+
+	snk, err := edp.Sink(ctx, muxrpc.TypeBinary, muxrpc.Method{"upload"})
+	r.NoError(err)
+	snk.Write([]byte("part1"))
+	snk.Write([]byte("part2"))
+	r.NoError(snk.Close())
+
+	src, snk, err = edp.Duplex(ctx, muxrpc.TypeJSON, muxrpc.Method{"chat"})
+	r.NoError(err)
+	r.True(src.Next(ctx))
+	greeting, err := src.Bytes()
+	r.NoError(err)
+	r.Equal(`"hi"`, string(greeting))
+	snk.Write([]byte(`"hello"`))
+	r.NoError(snk.Close())
+	r.False(src.Next(ctx))
+
+	var ignored interface{}
+	err = edp.Async(ctx, &ignored, muxrpc.TypeJSON, muxrpc.Method{"broken"})
+	r.Error(err)
+	r.Contains(err.Error(), "out of order")
+
+	err = edp.Async(ctx, &ignored, muxrpc.TypeJSON, muxrpc.Method{"unknown"})
+	r.True(errors.Is(err, muxrpc.ErrMethodNotFound), "got %v", err)
+
+	_, err = edp.Source(ctx, muxrpc.TypeJSON, muxrpc.Method{"whoami"})
+	r.NoError(err, "the error arrives on the stream")
+
+	calls, err := edp.WaitForCalls(ctx, 6)
+	r.NoError(err)
+	feed := findCall(t, calls, "feed")
+	r.Equal(muxrpc.CallType("source"), feed.Type)
+	r.JSONEq(`[{"seq":1}]`, string(feed.Args))
+
+	// the frames of the sink and duplex calls arrive while the calls go on
+	r.Eventually(func() bool {
+		calls := edp.Calls()
+		return len(findCall(t, calls, "upload").Received) == 2 && len(findCall(t, calls, "chat").Received) == 1
+	}, time.Second, 5*time.Millisecond)
+	calls = edp.Calls()
+	r.Equal([][]byte{[]byte("part1"), []byte("part2")}, findCall(t, calls, "upload").Received)
+	r.Equal([][]byte{[]byte(`"hello"`)}, findCall(t, calls, "chat").Received)
+}
+
+func TestRecordingHandler(t *testing.T) {
+	r := require.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	echo := &RecordingHandler{Handler: muxrpc.Echo}
+	var dropAll RecordingHandler
+
+	opts := []muxrpc.HandleOption{muxrpc.WithoutManifest(), muxrpc.WithLogger(muxrpc.NopLogger())}
+	a, b := muxrpc.NewPipe(&dropAll, echo, muxrpc.WithPipeHandleOptions(opts, opts))
+	defer a.Terminate()
+
+	var v []int
+	r.NoError(a.Async(ctx, &v, muxrpc.TypeJSON, muxrpc.Method{"echo"}, []int{1, 2}))
+	r.Equal([]int{1, 2}, v)
+
+	err := b.Async(ctx, &v, muxrpc.TypeJSON, muxrpc.Method{"anything"}, "x")
+	r.Error(err)
+	r.Contains(err.Error(), ErrNotHandled.Error())
+
+	calls := echo.Calls()
+	r.Len(calls, 1)
+	r.Equal("echo", calls[0].Method.String())
+	r.JSONEq(`[[1,2]]`, string(calls[0].Args))
+
+	calls, err = dropAll.WaitForCalls(ctx, 1)
+	r.NoError(err)
+	r.Equal("anything", calls[0].Method.String())
+}
@@ -0,0 +1,135 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxtest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/ssbc/go-muxrpc/v2"
+)
+
+// Call is an incoming call that was recorded.
+type Call struct {
+	Method muxrpc.Method
+	Type   muxrpc.CallType
+	Args   json.RawMessage
+
+	// Received holds the frames the caller sent on sink and duplex calls, as far as they were read.
+	Received [][]byte
+}
+
+// recorder keeps the calls of a handler
+type recorder struct {
+	mu    sync.Mutex
+	calls []Call
+
+	// changed is closed and replaced whenever a call or frame was recorded
+	changed chan struct{}
+}
+
+// record adds a call for req and returns its index
+func (rec *recorder) record(req *muxrpc.Request) int {
+	args := make(json.RawMessage, len(req.RawArgs))
+	copy(args, req.RawArgs)
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.calls = append(rec.calls, Call{Method: req.Method, Type: req.Type, Args: args})
+	rec.notify()
+	return len(rec.calls) - 1
+}
+
+// received adds a frame to the call at index i
+func (rec *recorder) received(i int, body []byte) {
+	frame := make([]byte, len(body))
+	copy(frame, body)
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.calls[i].Received = append(rec.calls[i].Received, frame)
+	rec.notify()
+}
+
+// notify has to be called with rec.mu held
+func (rec *recorder) notify() {
+	if rec.changed != nil {
+		close(rec.changed)
+		rec.changed = nil
+	}
+}
+
+// Calls returns the calls that were recorded so far, in the order the handler got them.
+// Calls are handled concurrently, so that can differ from the order they were made in.
+func (rec *recorder) Calls() []Call {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	calls := make([]Call, len(rec.calls))
+	for i, c := range rec.calls {
+		c.Received = append([][]byte(nil), c.Received...)
+		calls[i] = c
+	}
+	return calls
+}
+
+// WaitForCalls waits until n calls were recorded and returns them, or the error of ctx.
+func (rec *recorder) WaitForCalls(ctx context.Context, n int) ([]Call, error) {
+	for {
+		rec.mu.Lock()
+		if len(rec.calls) >= n {
+			rec.mu.Unlock()
+			return rec.Calls(), nil
+		}
+		if rec.changed == nil {
+			rec.changed = make(chan struct{})
+		}
+		changed := rec.changed
+		rec.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// ErrNotHandled is the error a RecordingHandler without a Handler closes calls with.
+var ErrNotHandled = errors.New("muxtest: call recorded but not handled")
+
+// RecordingHandler is a muxrpc.Handler that records the calls it gets and passes them on to Handler.
+// If Handler is nil it takes all calls and closes them with ErrNotHandled after recording them.
+// The zero value is ready to use.
+type RecordingHandler struct {
+	Handler muxrpc.Handler
+
+	recorder
+}
+
+var _ muxrpc.Handler = (*RecordingHandler)(nil)
+
+func (rh *RecordingHandler) Handled(m muxrpc.Method) bool {
+	if rh.Handler == nil {
+		return true
+	}
+	return rh.Handler.Handled(m)
+}
+
+func (rh *RecordingHandler) HandleConnect(ctx context.Context, edp muxrpc.Endpoint) {
+	if rh.Handler != nil {
+		rh.Handler.HandleConnect(ctx, edp)
+	}
+}
+
+func (rh *RecordingHandler) HandleCall(ctx context.Context, req *muxrpc.Request) {
+	rh.record(req)
+	if rh.Handler == nil {
+		req.CloseWithError(ErrNotHandled)
+		return
+	}
+	rh.Handler.HandleCall(ctx, req)
+}
@@ -14,6 +14,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"testing"
 	"time"
@@ -21,13 +22,45 @@ import (
 	"github.com/pkg/errors"
 	"github.com/ssbc/go-luigi"
 	"github.com/stretchr/testify/require"
-	"go.mindeco.de/log"
-	"go.mindeco.de/log/level"
-	"go.mindeco.de/proc"
 
 	"github.com/ssbc/go-muxrpc/v2/debug"
 )
 
+// startNode runs script with node, what it reads and writes on stdio is the connection
+func startNode(script string) (io.ReadWriteCloser, error) {
+	cmd := exec.Command("node", script)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &nodeConn{ReadCloser: stdout, WriteCloser: stdin, cmd: cmd}, nil
+}
+
+type nodeConn struct {
+	io.ReadCloser
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+// Close closes stdio and waits for node to exit
+func (nc *nodeConn) Close() error {
+	if err := nc.ReadCloser.Close(); err != nil {
+		return err
+	}
+	if err := nc.WriteCloser.Close(); err != nil {
+		return err
+	}
+	return nc.cmd.Wait()
+}
+
 // This wrapper supplies the manifest for the javascript side
 type jsManifestWrapper struct {
 	root Handler
@@ -67,7 +100,7 @@ func (w jsManifestWrapper) HandleCall(ctx context.Context, req *Request) {
 func TestJSGettingCalledSource(t *testing.T) {
 	r := require.New(t)
 
-	serv, err := proc.StartStdioProcess("node", os.Stderr, "nodejs_test.js")
+	serv, err := startNode("nodejs_test.js")
 	r.NoError(err, "nodejs startup")
 
 	gotCall := make(chan struct{})
@@ -153,7 +186,7 @@ func TestJSGettingCalledAsync(t *testing.T) {
 		close(errc)
 	}()
 
-	serv, err := proc.StartStdioProcess("node", os.Stderr, "nodejs_test.js")
+	serv, err := startNode("nodejs_test.js")
 	r.NoError(err, "nodejs startup")
 
 	var fh FakeHandler
@@ -213,7 +246,7 @@ sbot.whoami((err, who) => {
 func TestJSSyncString(t *testing.T) {
 	r := require.New(t)
 
-	serv, err := proc.StartStdioProcess("node", os.Stderr, "nodejs_test.js")
+	serv, err := startNode("nodejs_test.js")
 	r.NoError(err, "nodejs startup")
 
 	muxdbgPath := filepath.Join("testrun", t.Name())
@@ -264,7 +297,7 @@ func TestJSSyncString(t *testing.T) {
 func TestJSAsyncString(t *testing.T) {
 	r := require.New(t)
 
-	serv, err := proc.StartStdioProcess("node", os.Stderr, "nodejs_test.js")
+	serv, err := startNode("nodejs_test.js")
 	r.NoError(err, "nodejs startup")
 
 	muxdbgPath := filepath.Join("testrun", t.Name())
@@ -311,7 +344,7 @@ func TestJSAsyncString(t *testing.T) {
 func TestJSAsyncObject(t *testing.T) {
 	r := require.New(t)
 
-	serv, err := proc.StartStdioProcess("node", os.Stderr, "nodejs_test.js")
+	serv, err := startNode("nodejs_test.js")
 	r.NoError(err, "nodejs startup")
 
 	muxdbgPath := filepath.Join("testrun", t.Name())
@@ -362,7 +395,7 @@ func TestJSAsyncObject(t *testing.T) {
 func TestJSSource(t *testing.T) {
 	r := require.New(t)
 
-	serv, err := proc.StartStdioProcess("node", os.Stderr, "nodejs_test.js")
+	serv, err := startNode("nodejs_test.js")
 	r.NoError(err, "nodejs startup")
 
 	muxdbgPath := filepath.Join("testrun", t.Name())
@@ -427,10 +460,59 @@ func TestJSSource(t *testing.T) {
 	r.Equal(0, fh.HandleCallCallCount(), "peer did call unexpectedly")
 }
 
+// canceling the context of a source has to abort it on the JS side, too
+func TestJSCancelSource(t *testing.T) {
+	r := require.New(t)
+
+	serv, err := startNode("nodejs_test.js")
+	r.NoError(err, "nodejs startup")
+
+	muxdbgPath := filepath.Join("testrun", t.Name())
+	os.RemoveAll(muxdbgPath)
+	os.MkdirAll(muxdbgPath, 0700)
+	packer := NewPacker(debug.Dump(muxdbgPath, serv))
+
+	var fh FakeHandler
+	rpc1 := Handle(packer, jsManifestWrapper{root: &fh})
+
+	errc := make(chan error)
+	go serve(context.Background(), rpc1.(Server), errc)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	src, err := rpc1.Source(ctx, TypeJSON, Method{"ticker"})
+	r.NoError(err)
+	for i := 0; i < 3; i++ {
+		r.True(src.Next(ctx), "src.Next %d", i)
+		_, err = src.Bytes()
+		r.NoError(err)
+	}
+	cancel()
+
+	bg := context.Background()
+	var aborted bool
+	for i := 0; i < 50 && !aborted; i++ {
+		time.Sleep(20 * time.Millisecond)
+		err = rpc1.Async(bg, &aborted, TypeJSON, Method{"tickerAborted"})
+		r.NoError(err)
+	}
+	r.True(aborted, "ticker wasn't aborted on the JS side")
+
+	var str string
+	err = rpc1.Async(bg, &str, TypeString, Method{"finalCall"}, 1000)
+	r.NoError(err, "rcp shutdown call")
+	r.Equal("ty", str, "expected call result")
+
+	rpc1.Terminate()
+	close(errc)
+	for err := range errc {
+		r.NoError(err)
+	}
+}
+
 func TestJSDuplex(t *testing.T) {
 	r := require.New(t)
 
-	serv, err := proc.StartStdioProcess("node", os.Stderr, "nodejs_test.js")
+	serv, err := startNode("nodejs_test.js")
 	r.NoError(err, "nodejs startup")
 
 	muxdbgPath := filepath.Join("testrun", t.Name())
@@ -505,16 +587,16 @@ func TestJSDuplex(t *testing.T) {
 
 func TestJSDuplexToUs(t *testing.T) {
 	r := require.New(t)
-	jsLog := log.NewLogfmtLogger(os.Stderr)
+	jsLog := NewLogfmtLogger(os.Stderr)
 
-	serv, err := proc.StartStdioProcess("node", os.Stderr, "nodejs_test.js")
+	serv, err := startNode("nodejs_test.js")
 	r.NoError(err, "nodejs startup")
 
 	var h hDuplex
 	h.encoding = TypeJSON
 	h.failed = make(chan error)
 
-	muxdbg := log.With(jsLog, "u", "pkts")
+	muxdbg := LoggerWith(jsLog, "u", "pkts")
 	h.logger = muxdbg
 
 	h.txvals = []interface{}{"a", "b", "c", "d", "e", struct{ RXJS int }{9}}
@@ -554,7 +636,7 @@ func TestJSDuplexToUs(t *testing.T) {
 func TestJSNoSuchMethod(t *testing.T) {
 	r := require.New(t)
 
-	serv, err := proc.StartStdioProcess("node", os.Stderr, "nodejs_test.js")
+	serv, err := startNode("nodejs_test.js")
 	r.NoError(err, "nodejs startup")
 
 	muxdbgPath := filepath.Join("testrun", t.Name())
@@ -625,9 +707,9 @@ func TestJSSupportAbort(t *testing.T) {
 	}
 
 	r := require.New(t)
-	jsLog := log.NewLogfmtLogger(os.Stderr)
+	jsLog := NewLogfmtLogger(os.Stderr)
 
-	serv, err := proc.StartStdioProcess("node", os.Stderr, "nodejs_test.js")
+	serv, err := startNode("nodejs_test.js")
 	r.NoError(err, "nodejs startup")
 
 	var h hAbortMe
@@ -667,7 +749,7 @@ func TestJSSupportAbort(t *testing.T) {
 
 type hAbortMe struct {
 	want   int
-	logger log.Logger
+	logger Logger
 	t      *testing.T
 }
 
@@ -706,7 +788,7 @@ func (h *hAbortMe) HandleCall(ctx context.Context, req *Request) {
 	}
 	if i != h.want {
 		err := fmt.Errorf("expected %d but sent %d packets", h.want, i)
-		level.Error(h.logger).Log("evt", "sent too much?", "err", err)
+		LoggerWith(h.logger, LevelKey, LevelError).Log("evt", "sent too much?", "err", err)
 		require.NoError(h.t, err)
 	}
 }
@@ -22,9 +22,14 @@ var api = {
   object: 'async',
   stuff: 'source',
   magic: 'duplex',
-  takeSome: 'source'
+  takeSome: 'source',
+  ticker: 'source',
+  tickerAborted: 'async'
 }
 
+// set once a caller aborted the ticker source
+var tickerAborted = false
+
 var bootstrap = (err, rpc, manifst) => {
   if (err) {
     console.error(err)
@@ -135,6 +140,20 @@ var server = MRPC(bootstrap, api)({
     console.error('object:ok')
     cb(null, { with: 'fields!' })
   },
+  ticker: function () {
+    // an endless source, only the caller can stop it
+    var i = 0
+    return function (abort, cb) {
+      if (abort) {
+        tickerAborted = true
+        return cb(abort)
+      }
+      setTimeout(() => cb(null, { i: i++ }), 10)
+    }
+  },
+  tickerAborted: function (cb) {
+    cb(null, tickerAborted)
+  },
   stuff: function () {
     console.error('stuff called')
     return pull.values([{ a: 1 }, { a: 2 }, { a: 3 }, { a: 4 }])
@@ -0,0 +1,18 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: Unlicense
+
+go 1.15
+
+module github.com/ssbc/go-muxrpc/v2/oteltrace
+
+require (
+	github.com/ssbc/go-muxrpc/v2 v2.0.0
+	github.com/stretchr/testify v1.7.0
+	go.opentelemetry.io/otel v1.0.1
+	go.opentelemetry.io/otel/sdk v1.0.1
+	go.opentelemetry.io/otel/trace v1.0.1
+)
+
+// the tracer is developed together with the muxrpc module
+replace github.com/ssbc/go-muxrpc/v2 => ../
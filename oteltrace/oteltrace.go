@@ -0,0 +1,150 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+// Package oteltrace traces muxrpc calls with OpenTelemetry.
+//
+// Every call gets a span, client spans for the calls that are made and server spans for the ones that are handled.
+// The trace context is sent along with the calls as metadata (see muxrpc.Metadata), so that server spans continue the trace of the caller.
+// Both ends need to negotiate muxrpc.FeatureMetadata for that, otherwise server spans start new traces.
+// Packets that are sent and received for a call are recorded as events of its span.
+//
+//	edp := muxrpc.Handle(pkr, handler, muxrpc.WithTracer(oteltrace.New()), muxrpc.WithHello(muxrpc.FeatureMetadata))
+package oteltrace
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/ssbc/go-muxrpc/v2"
+	"github.com/ssbc/go-muxrpc/v2/codec"
+)
+
+// instrumentationName identifies this package as the creator of the spans
+const instrumentationName = "github.com/ssbc/go-muxrpc/v2/oteltrace"
+
+// Tracer is a muxrpc.Tracer that creates OpenTelemetry spans.
+type Tracer struct {
+	provider   trace.TracerProvider
+	propagator propagation.TextMapPropagator
+
+	tracer trace.Tracer
+}
+
+var _ muxrpc.Tracer = (*Tracer)(nil)
+
+// Option configures a Tracer.
+type Option func(*Tracer)
+
+// WithTracerProvider sets the provider of the tracer. The global one is used by default.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(t *Tracer) {
+		t.provider = tp
+	}
+}
+
+// WithPropagator sets how the trace context is put into the metadata of calls. The global propagator is used by default.
+func WithPropagator(p propagation.TextMapPropagator) Option {
+	return func(t *Tracer) {
+		t.propagator = p
+	}
+}
+
+// New returns a Tracer. Pass it to muxrpc.WithTracer.
+func New(opts ...Option) *Tracer {
+	t := &Tracer{}
+	for _, o := range opts {
+		o(t)
+	}
+
+	// defaults
+	if t.provider == nil {
+		t.provider = otel.GetTracerProvider()
+	}
+	if t.propagator == nil {
+		t.propagator = otel.GetTextMapPropagator()
+	}
+
+	t.tracer = t.provider.Tracer(instrumentationName)
+	return t
+}
+
+// StartCall starts the span of the call. Outgoing calls are children of the span in ctx,
+// incoming calls continue the trace that the caller sent along.
+func (t *Tracer) StartCall(ctx context.Context, call muxrpc.TracedCall) (context.Context, muxrpc.CallTrace) {
+	name := call.Method.String()
+	attrs := []attribute.KeyValue{
+		attribute.String("rpc.system", "muxrpc"),
+		attribute.String("rpc.method", name),
+		attribute.String("muxrpc.type", string(call.Type)),
+	}
+	if call.Remote != nil {
+		attrs = append(attrs, attribute.String("net.peer.name", call.Remote.String()))
+	}
+
+	var span trace.Span
+	if call.Incoming {
+		ctx = t.propagator.Extract(ctx, metadataCarrier(call.Meta))
+		ctx, span = t.tracer.Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attrs...))
+	} else {
+		ctx, span = t.tracer.Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(attrs...))
+
+		md := make(muxrpc.Metadata)
+		t.propagator.Inject(ctx, metadataCarrier(md))
+		if len(md) > 0 {
+			ctx = muxrpc.ContextWithMetadata(ctx, md)
+		}
+	}
+	return ctx, callTrace{span: span}
+}
+
+// callTrace records what happens to a call on its span
+type callTrace struct {
+	span trace.Span
+}
+
+func (ct callTrace) PacketSent(flag codec.Flag, size int) {
+	ct.span.AddEvent("packet sent", trace.WithAttributes(
+		attribute.String("muxrpc.flag", flag.String()),
+		attribute.Int("muxrpc.size", size),
+	))
+}
+
+func (ct callTrace) PacketReceived(flag codec.Flag, size int) {
+	ct.span.AddEvent("packet received", trace.WithAttributes(
+		attribute.String("muxrpc.flag", flag.String()),
+		attribute.Int("muxrpc.size", size),
+	))
+}
+
+func (ct callTrace) End(err error) {
+	if err != nil {
+		ct.span.RecordError(err)
+		ct.span.SetStatus(codes.Error, err.Error())
+	}
+	ct.span.End()
+}
+
+// metadataCarrier lets propagators read and write the metadata of a call
+type metadataCarrier muxrpc.Metadata
+
+func (mc metadataCarrier) Get(key string) string { return mc[key] }
+
+func (mc metadataCarrier) Set(key, value string) { mc[key] = value }
+
+func (mc metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(mc))
+	for k := range mc {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -0,0 +1,115 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package oteltrace
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/ssbc/go-muxrpc/v2"
+	"github.com/ssbc/go-muxrpc/v2/typemux"
+)
+
+type nopHandler struct{}
+
+func (nopHandler) Handled(muxrpc.Method) bool                        { return false }
+func (nopHandler) HandleCall(_ context.Context, req *muxrpc.Request) { req.CloseWithError(nil) }
+func (nopHandler) HandleConnect(context.Context, muxrpc.Endpoint)    {}
+
+func TestTracer(t *testing.T) {
+	r := require.New(t)
+
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	tracer := New(WithTracerProvider(tp), WithPropagator(propagation.TraceContext{}))
+
+	var handlerSpan trace.SpanContext
+	mux := typemux.New(muxrpc.NopLogger())
+	mux.RegisterAsync(muxrpc.Method{"whoami"}, typemux.AsyncFunc(func(ctx context.Context, req *muxrpc.Request) (interface{}, error) {
+		handlerSpan = trace.SpanContextFromContext(ctx)
+		return "me", nil
+	}))
+	mux.RegisterSource(muxrpc.Method{"feed"}, typemux.SourceFunc(func(ctx context.Context, req *muxrpc.Request, snk *muxrpc.ByteSink) error {
+		snk.Write([]byte("one"))
+		return errors.New("feed broke")
+	}))
+
+	lis, err := net.Listen("tcp4", "localhost:0")
+	r.NoError(err)
+	defer lis.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		c, _ := lis.Accept()
+		accepted <- c
+	}()
+	c1, err := net.Dial("tcp", lis.Addr().String())
+	r.NoError(err)
+	c2 := <-accepted
+
+	srvc := make(chan muxrpc.Endpoint)
+	go func() {
+		srvc <- muxrpc.Handle(muxrpc.NewPacker(c2), &mux, muxrpc.WithTracer(tracer), muxrpc.WithHello(muxrpc.FeatureMetadata), muxrpc.WithLogger(muxrpc.NopLogger()))
+	}()
+	client := muxrpc.Handle(muxrpc.NewPacker(c1), nopHandler{}, muxrpc.WithTracer(tracer), muxrpc.WithHello(muxrpc.FeatureMetadata), muxrpc.WithLogger(muxrpc.NopLogger()))
+	server := <-srvc
+	t.Cleanup(func() {
+		client.Terminate()
+		server.Terminate()
+	})
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "parent")
+
+	var v string
+	r.NoError(client.Async(ctx, &v, muxrpc.TypeString, muxrpc.Method{"whoami"}))
+	r.Equal("me", v)
+
+	src, err := client.Source(ctx, muxrpc.TypeString, muxrpc.Method{"feed"})
+	r.NoError(err)
+	r.True(src.Next(ctx))
+	_, err = src.Bytes()
+	r.NoError(err)
+	r.False(src.Next(ctx))
+	r.Error(src.Err())
+	parent.End()
+
+	var spans map[string]sdktrace.ReadOnlySpan
+	r.Eventually(func() bool {
+		spans = make(map[string]sdktrace.ReadOnlySpan)
+		for _, s := range rec.Ended() {
+			spans[s.SpanKind().String()+" "+s.Name()] = s
+		}
+		// the manifest call of the client is traced as well
+		return len(spans) == 6
+	}, time.Second, 10*time.Millisecond)
+
+	// the server continues the trace of the client
+	cliAsync, srvAsync := spans["client whoami"], spans["server whoami"]
+	r.Equal(parent.SpanContext().SpanID(), cliAsync.Parent().SpanID())
+	r.Equal(cliAsync.SpanContext().SpanID(), srvAsync.Parent().SpanID())
+	r.True(srvAsync.Parent().IsRemote())
+	r.Equal(srvAsync.SpanContext(), handlerSpan)
+
+	r.Len(cliAsync.Events(), 1)
+	r.Equal("packet received", cliAsync.Events()[0].Name)
+	r.Len(srvAsync.Events(), 1)
+	r.Equal("packet sent", srvAsync.Events()[0].Name)
+
+	// the failure shows up on both sides
+	cliFeed, srvFeed := spans["client feed"], spans["server feed"]
+	r.Equal(cliFeed.SpanContext().TraceID(), srvFeed.SpanContext().TraceID())
+	r.Equal(codes.Error, cliFeed.Status().Code)
+	r.Equal(codes.Error, srvFeed.Status().Code)
+	r.Contains(srvFeed.Status().Description, "feed broke")
+}
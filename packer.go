@@ -15,6 +15,7 @@ import (
 )
 
 // NewPacker takes an io.ReadWriteCloser and returns a Packer.
+// Connections from a Transport keep their ConnInfo, see RemoteInfo.
 func NewPacker(rwc io.ReadWriteCloser) *Packer {
 	return &Packer{
 		r: codec.NewReader(rwc),
@@ -25,6 +26,15 @@ func NewPacker(rwc io.ReadWriteCloser) *Packer {
 	}
 }
 
+// NewBufferedPacker is like NewPacker but collects outgoing packets in a buffer of the passed size (see codec.NewBufferedWriter).
+// Endpoints flush it once they have nothing more to send and after packets that end a call or stream,
+// so busy connections need less writes without calls waiting on the buffer.
+func NewBufferedPacker(rwc io.ReadWriteCloser, size int) *Packer {
+	pkr := NewPacker(rwc)
+	pkr.w = codec.NewBufferedWriter(rwc, size)
+	return pkr
+}
+
 // Packer is a duplex stream that sends and receives *codec.Packet values.
 // Usually wraps a network connection or stdio.
 type Packer struct {
@@ -74,6 +84,21 @@ func (pkr *Packer) NextHeader(ctx context.Context, hdr *codec.Header) error {
 	return nil
 }
 
+// PacketStats counts the packets that went over a connection in each direction.
+// They help to line up errors with the logs and packet dumps of the other side.
+type PacketStats struct {
+	Read    uint64
+	Written uint64
+}
+
+// Stats returns the current packet counters. It is safe to call at any time.
+func (pkr *Packer) Stats() PacketStats {
+	return PacketStats{
+		Read:    pkr.r.PacketsRead(),
+		Written: pkr.w.PacketsWritten(),
+	}
+}
+
 // Close closes the packer.
 func (pkr *Packer) Close() error {
 	pkr.cl.Lock()
@@ -10,10 +10,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"reflect"
+	"sync/atomic"
 	"testing"
 
 	"github.com/ssbc/go-muxrpc/v2/codec"
+	"github.com/stretchr/testify/require"
 )
 
 // TestPacker is a crappy golden path test
@@ -89,4 +92,105 @@ func TestPacker(t *testing.T) {
 	}
 
 	t.Log("this error should be about pouring to a closed sink:", err)
+
+	if got := pkr1.Stats(); got != (PacketStats{Written: 1}) {
+		t.Errorf("unexpected stats for the sender: %+v", got)
+	}
+	if got := pkr2.Stats(); got != (PacketStats{Read: 1}) {
+		t.Errorf("unexpected stats for the receiver: %+v", got)
+	}
+}
+
+// writeCountingConn counts the calls to Write of the connection it wraps
+type writeCountingConn struct {
+	net.Conn
+	writes int64
+}
+
+func (c *writeCountingConn) Write(b []byte) (int, error) {
+	atomic.AddInt64(&c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+func TestBufferedPacker(t *testing.T) {
+	r := require.New(t)
+
+	const frames = 200
+	var srv FakeHandler
+	srv.HandledCalls(func(m Method) bool { return true })
+	srv.HandleCallCalls(func(ctx context.Context, req *Request) {
+		switch req.Method.String() {
+		case "whoami":
+			req.Return(ctx, "me")
+		case "feed":
+			snk, err := req.ResponseSink()
+			if err != nil {
+				req.CloseWithError(err)
+				return
+			}
+			for i := 0; i < frames; i++ {
+				fmt.Fprintf(snk, "frame %d", i)
+			}
+			snk.Close()
+		}
+	})
+
+	c1, c2 := loPipe(t)
+	counted := &writeCountingConn{Conn: c2}
+	opts := []HandleOption{WithoutManifest(), WithLogger(NopLogger())}
+	client := Handle(NewPacker(c1), &FakeHandler{}, opts...)
+	server := Handle(NewBufferedPacker(counted, 64*1024), &srv, append(opts, WithIsServer(true))...)
+	errc := make(chan error, 2)
+	ctx := context.Background()
+	go serve(ctx, client.(Server), errc)
+	go serve(ctx, server.(Server), errc)
+	t.Cleanup(func() {
+		client.Terminate()
+		server.Terminate()
+	})
+
+	// a single reply isn't held back by the buffer
+	var s string
+	r.NoError(client.Async(ctx, &s, TypeString, Method{"whoami"}))
+	r.Equal("me", s)
+
+	// the queue flushes once it has nothing more to write, so the packets pile up in the buffer while streams take turns
+	const streams = 10
+	errs := make(chan error, streams)
+	for j := 0; j < streams; j++ {
+		go func() {
+			src, err := client.Source(ctx, TypeString, Method{"feed"})
+			if err != nil {
+				errs <- err
+				return
+			}
+			for i := 0; i < frames; i++ {
+				if !src.Next(ctx) {
+					errs <- fmt.Errorf("frame %d missing: %v", i, src.Err())
+					return
+				}
+				b, err := src.Bytes()
+				if err != nil {
+					errs <- err
+					return
+				}
+				if want := fmt.Sprintf("frame %d", i); string(b) != want {
+					errs <- fmt.Errorf("expected %q, got %q", want, b)
+					return
+				}
+			}
+			if src.Next(ctx) {
+				errs <- errors.New("too many frames")
+				return
+			}
+			errs <- src.Err()
+		}()
+	}
+	for j := 0; j < streams; j++ {
+		r.NoError(<-errs)
+	}
+
+	written := ConnStats(server).PacketsWritten
+	writes := uint64(atomic.LoadInt64(&counted.writes))
+	r.True(writes < written/2, "%d packets needed %d writes", written, writes)
 }
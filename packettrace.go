@@ -0,0 +1,200 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ssbc/go-muxrpc/v2/codec"
+)
+
+// WithPacketTracer writes a line for every packet that is sent or received to w.
+// The line holds the direction, the request ID as it is on the wire, the flags, the size and the start of the body.
+// JSON bodies are pretty-printed on the lines that follow it, indented by four spaces.
+// This is meant for debugging the protocol against other implementations, it slows down the connection considerably.
+func WithPacketTracer(w io.Writer) HandleOption {
+	return func(r *rpc) {
+		r.packetTrace = &packetTracer{w: w}
+	}
+}
+
+// WithJSONPacketTracer is like WithPacketTracer but writes one JSON object per packet, for instance to be filtered with jq.
+// The objects have the fields ts, dir, req, flags, len and body. JSON bodies are embedded as they are, others as strings.
+// Bodies that were cut short have truncated set to true and are always strings.
+func WithJSONPacketTracer(w io.Writer) HandleOption {
+	return func(r *rpc) {
+		r.packetTrace = &packetTracer{w: w, json: true}
+	}
+}
+
+// traceBodyLimit is how much of a body is traced
+const traceBodyLimit = 512
+
+type packetTracer struct {
+	mu   sync.Mutex
+	w    io.Writer
+	json bool
+}
+
+// tap starts tracing the packets of pkr. It has to be called before the packer is used.
+func (pt *packetTracer) tap(pkr *Packer) {
+	pkr.rl.Lock()
+	pkr.r.Tap(&packetSplitter{limit: traceBodyLimit, packet: func(hdr codec.Header, body []byte) {
+		pt.trace("in", hdr, body)
+	}})
+	pkr.rl.Unlock()
+
+	pkr.w.Tap(&packetSplitter{limit: traceBodyLimit, packet: func(hdr codec.Header, body []byte) {
+		pt.trace("out", hdr, body)
+	}})
+}
+
+// packetSplitter splits the bytes of one direction back into packets
+type packetSplitter struct {
+	// limit is how much of a body is kept, negative means all of it
+	limit int
+	// packet is called for every packet, the goodbye packet included. body is only valid until it returns.
+	packet func(hdr codec.Header, body []byte)
+
+	hdrBuf [codec.HeaderLength]byte
+	hdrN   int
+
+	hdr      codec.Header
+	bodyLeft uint32
+	body     []byte
+}
+
+func (ps *packetSplitter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if ps.hdrN < codec.HeaderLength {
+			c := copy(ps.hdrBuf[ps.hdrN:], p)
+			ps.hdrN += c
+			p = p[c:]
+			if ps.hdrN < codec.HeaderLength {
+				break
+			}
+
+			ps.hdr = codec.Header{
+				Flag: codec.Flag(ps.hdrBuf[0]),
+				Len:  binary.BigEndian.Uint32(ps.hdrBuf[1:5]),
+				Req:  int32(binary.BigEndian.Uint32(ps.hdrBuf[5:9])),
+			}
+			ps.bodyLeft = ps.hdr.Len
+			ps.body = ps.body[:0]
+		}
+
+		c := len(p)
+		if uint32(c) > ps.bodyLeft {
+			c = int(ps.bodyLeft)
+		}
+		keep := c
+		if ps.limit >= 0 && keep > ps.limit-len(ps.body) {
+			keep = ps.limit - len(ps.body)
+		}
+		ps.body = append(ps.body, p[:keep]...)
+		ps.bodyLeft -= uint32(c)
+		p = p[c:]
+
+		if ps.bodyLeft == 0 {
+			ps.packet(ps.hdr, ps.body)
+			ps.hdrN = 0
+		}
+	}
+	// splitting never fails the connection
+	return n, nil
+}
+
+func (pt *packetTracer) trace(dir string, hdr codec.Header, body []byte) {
+	var line []byte
+	if pt.json {
+		line = pt.jsonLine(dir, hdr, body)
+	} else {
+		line = pt.textLine(dir, hdr, body)
+	}
+
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.w.Write(line)
+}
+
+func (pt *packetTracer) textLine(dir string, hdr codec.Header, body []byte) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %-3s ", time.Now().UTC().Format(time.RFC3339Nano), dir)
+	if hdr == (codec.Header{}) {
+		buf.WriteString("goodbye\n")
+		return buf.Bytes()
+	}
+	fmt.Fprintf(&buf, "req=%d flags=%s len=%d", hdr.Req, hdr.Flag, hdr.Len)
+
+	truncated := uint32(len(body)) < hdr.Len
+	switch {
+	case len(body) == 0:
+	case hdr.Flag.Get(codec.FlagJSON) && !truncated:
+		var pretty bytes.Buffer
+		if json.Indent(&pretty, body, "    ", "  ") == nil {
+			buf.WriteString("\n    ")
+			buf.Write(pretty.Bytes())
+			break
+		}
+		fallthrough
+	case hdr.Flag.Get(codec.FlagString), hdr.Flag.Get(codec.FlagJSON):
+		fmt.Fprintf(&buf, " body=%q", body)
+	default:
+		fmt.Fprintf(&buf, " body=%x", body)
+	}
+	if truncated {
+		fmt.Fprintf(&buf, " (%d bytes more)", hdr.Len-uint32(len(body)))
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+type tracedPacket struct {
+	Time      time.Time   `json:"ts"`
+	Dir       string      `json:"dir"`
+	Req       int32       `json:"req"`
+	Flags     []string    `json:"flags"`
+	Len       uint32      `json:"len"`
+	Body      interface{} `json:"body,omitempty"`
+	Truncated bool        `json:"truncated,omitempty"`
+	Goodbye   bool        `json:"goodbye,omitempty"`
+}
+
+func (pt *packetTracer) jsonLine(dir string, hdr codec.Header, body []byte) []byte {
+	tp := tracedPacket{
+		Time:    time.Now().UTC(),
+		Dir:     dir,
+		Req:     hdr.Req,
+		Flags:   []string{},
+		Len:     hdr.Len,
+		Goodbye: hdr == (codec.Header{}),
+	}
+	if names := strings.Trim(hdr.Flag.String(), "{}"); names != "" {
+		tp.Flags = strings.Split(names, ", ")
+	}
+
+	tp.Truncated = uint32(len(body)) < hdr.Len
+	switch {
+	case len(body) == 0:
+	case hdr.Flag.Get(codec.FlagJSON) && !tp.Truncated && json.Valid(body):
+		tp.Body = json.RawMessage(body)
+	default:
+		tp.Body = string(body)
+	}
+
+	line, err := json.Marshal(tp)
+	if err != nil {
+		line, _ = json.Marshal(map[string]string{"dir": dir, "err": err.Error()})
+	}
+	return append(line, '\n')
+}
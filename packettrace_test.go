@@ -0,0 +1,91 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ssbc/go-muxrpc/v2/codec"
+)
+
+func TestPacketTracerText(t *testing.T) {
+	r := require.New(t)
+
+	var wire bytes.Buffer
+	w := codec.NewWriter(&wire)
+	r.NoError(w.WritePacket(codec.Packet{Req: 1, Flag: codec.FlagJSON, Body: []byte(`{"name":["whoami"],"args":[],"type":"async"}`)}))
+	r.NoError(w.WritePacket(codec.Packet{Req: -1, Flag: codec.FlagString | codec.FlagEndErr, Body: []byte("me")}))
+	r.NoError(w.WritePacket(codec.Packet{Req: 2, Flag: codec.FlagStream, Body: bytes.Repeat([]byte{0xff}, traceBodyLimit+10)}))
+	r.NoError(w.Goodbye())
+
+	var out bytes.Buffer
+	pt := &packetTracer{w: &out}
+	tap := &packetSplitter{limit: traceBodyLimit, packet: func(hdr codec.Header, body []byte) {
+		pt.trace("in", hdr, body)
+	}}
+	// the packets are split up at odd places, like they arrive from a connection
+	raw := wire.Bytes()
+	for len(raw) > 0 {
+		n := 5
+		if n > len(raw) {
+			n = len(raw)
+		}
+		tap.Write(raw[:n])
+		raw = raw[n:]
+	}
+
+	lines := strings.Split(out.String(), "\n")
+	r.Contains(lines[0], " in  req=1 flags={FlagJSON} len=44")
+	r.Equal(`    {`, lines[1])
+	r.Equal(`      "name": [`, lines[2])
+	r.Contains(out.String(), `req=-1 flags={FlagString, FlagEndErr} len=2 body="me"`)
+	r.Contains(out.String(), "req=2 flags={FlagStream} len=522 body=ffff")
+	r.Contains(out.String(), "(10 bytes more)")
+	r.True(strings.HasSuffix(out.String(), "in  goodbye\n"))
+}
+
+func TestJSONPacketTracer(t *testing.T) {
+	r := require.New(t)
+
+	var out lockedBuffer
+	var srvh FakeHandler
+	srvh.HandledCalls(methodChecker("whoami"))
+	srvh.HandleCallCalls(func(ctx context.Context, req *Request) {
+		req.Return(ctx, map[string]string{"id": "me"})
+	})
+	client, _ := connectPair(t, &FakeHandler{}, &srvh, []HandleOption{WithJSONPacketTracer(&out)}, nil)
+
+	var v map[string]string
+	r.NoError(client.Async(context.TODO(), &v, TypeJSON, Method{"whoami"}))
+
+	var pkts []tracedPacket
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var tp tracedPacket
+		r.NoError(json.Unmarshal([]byte(line), &tp), line)
+		pkts = append(pkts, tp)
+	}
+
+	var call, resp *tracedPacket
+	for i, tp := range pkts {
+		body, _ := json.Marshal(tp.Body)
+		switch {
+		case tp.Dir == "out" && strings.Contains(string(body), "whoami"):
+			call = &pkts[i]
+		case tp.Dir == "in" && strings.Contains(string(body), `"id":"me"`):
+			resp = &pkts[i]
+		}
+	}
+	r.NotNil(call)
+	r.NotNil(resp)
+	r.Equal(call.Req, -resp.Req)
+	r.Equal([]string{"FlagJSON"}, call.Flags)
+	r.Contains(resp.Flags, "FlagJSON")
+}
@@ -0,0 +1,171 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// PipeOption configures the in-memory connection of NewPipe.
+type PipeOption func(*pipeConfig)
+
+type pipeConfig struct {
+	latency   time.Duration
+	chunkSize int
+
+	opts1, opts2 []HandleOption
+}
+
+// WithPipeLatency delays every write by d before the other end can read it.
+func WithPipeLatency(d time.Duration) PipeOption {
+	return func(pc *pipeConfig) {
+		pc.latency = d
+	}
+}
+
+// WithPipeChunkSize splits writes into chunks of at most n bytes that arrive one by one,
+// like a socket that only takes part of a write at a time. Reads never return more than one chunk.
+func WithPipeChunkSize(n int) PipeOption {
+	return func(pc *pipeConfig) {
+		pc.chunkSize = n
+	}
+}
+
+// WithPipeHandleOptions sets the options the first (client) and second (server) endpoint of NewPipe are started with.
+func WithPipeHandleOptions(opts1, opts2 []HandleOption) PipeOption {
+	return func(pc *pipeConfig) {
+		pc.opts1, pc.opts2 = opts1, opts2
+	}
+}
+
+// NewPipe returns two endpoints that are connected in memory, for testing handlers and the code that calls them without sockets.
+// h1 is served by the first endpoint, which is in the client role, and h2 by the second one.
+// Terminating one of them ends the other one, too.
+func NewPipe(h1, h2 Handler, opts ...PipeOption) (Endpoint, Endpoint) {
+	var pc pipeConfig
+	for _, o := range opts {
+		o(&pc)
+	}
+
+	c1, c2 := newPipeConns(pc.latency, pc.chunkSize)
+
+	// Handle blocks until the manifests were exchanged, which needs both ends running
+	edp2 := make(chan Endpoint, 1)
+	go func() {
+		edp2 <- Handle(NewPacker(c2), h2, append([]HandleOption{WithIsServer(true)}, pc.opts2...)...)
+	}()
+	edp1 := Handle(NewPacker(c1), h1, append([]HandleOption{WithIsServer(false)}, pc.opts1...)...)
+	return edp1, <-edp2
+}
+
+// pipeAddr is the remote address of both ends of a pipe
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+func newPipeConns(latency time.Duration, chunkSize int) (TransportConn, TransportConn) {
+	ab := newPipeLane(latency, chunkSize)
+	ba := newPipeLane(latency, chunkSize)
+	info := ConnInfo{Remote: pipeAddr{}, Local: pipeAddr{}}
+	return NewTransportConn(&pipeConn{r: ba, w: ab}, info), NewTransportConn(&pipeConn{r: ab, w: ba}, info)
+}
+
+type pipeConn struct {
+	r, w *pipeLane
+}
+
+func (pc *pipeConn) Read(b []byte) (int, error)  { return pc.r.read(b) }
+func (pc *pipeConn) Write(b []byte) (int, error) { return pc.w.write(b) }
+
+// Close ends both directions. The other end can still read what was written before.
+func (pc *pipeConn) Close() error {
+	pc.w.close(false)
+	pc.r.close(true)
+	return nil
+}
+
+// pipeLane carries the bytes of one direction. Writes don't block, the chunks queue up until they are read.
+type pipeLane struct {
+	latency   time.Duration
+	chunkSize int
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	chunks []pipeChunk
+	closed bool
+}
+
+type pipeChunk struct {
+	data []byte
+	at   time.Time
+}
+
+func newPipeLane(latency time.Duration, chunkSize int) *pipeLane {
+	pl := &pipeLane{latency: latency, chunkSize: chunkSize}
+	pl.cond = sync.NewCond(&pl.mu)
+	return pl
+}
+
+func (pl *pipeLane) write(b []byte) (int, error) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if pl.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	at := time.Now().Add(pl.latency)
+	data := make([]byte, len(b))
+	copy(data, b)
+	for len(data) > 0 {
+		n := len(data)
+		if pl.chunkSize > 0 && n > pl.chunkSize {
+			n = pl.chunkSize
+		}
+		pl.chunks = append(pl.chunks, pipeChunk{data: data[:n], at: at})
+		data = data[n:]
+	}
+	pl.cond.Broadcast()
+	return len(b), nil
+}
+
+func (pl *pipeLane) read(b []byte) (int, error) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	for {
+		if len(pl.chunks) > 0 {
+			if wait := time.Until(pl.chunks[0].at); wait > 0 {
+				pl.mu.Unlock()
+				time.Sleep(wait)
+				pl.mu.Lock()
+				continue
+			}
+
+			head := &pl.chunks[0]
+			n := copy(b, head.data)
+			if head.data = head.data[n:]; len(head.data) == 0 {
+				pl.chunks = pl.chunks[1:]
+			}
+			return n, nil
+		}
+		if pl.closed {
+			return 0, io.EOF
+		}
+		pl.cond.Wait()
+	}
+}
+
+// close stops writes to the lane. If drop is set, what wasn't read yet is thrown away.
+func (pl *pipeLane) close(drop bool) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	pl.closed = true
+	if drop {
+		pl.chunks = nil
+	}
+	pl.cond.Broadcast()
+}
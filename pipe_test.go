@@ -0,0 +1,69 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipe(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+
+	const latency = 20 * time.Millisecond
+	client, server := NewPipe(&FakeHandler{}, Echo,
+		WithPipeLatency(latency),
+		WithPipeChunkSize(3),
+		WithPipeHandleOptions(
+			[]HandleOption{WithoutManifest(), WithLogger(NopLogger())},
+			[]HandleOption{WithoutManifest(), WithLogger(NopLogger())},
+		),
+	)
+	r.False(IsServer(client))
+	r.True(IsServer(server))
+
+	info, ok := RemoteInfo(client)
+	r.True(ok)
+	r.Equal("pipe", info.Remote.String())
+
+	start := time.Now()
+	var v map[string]string
+	r.NoError(client.Async(ctx, &v, TypeJSON, Method{"echo"}, map[string]string{"long": strings.Repeat("x", 100)}))
+	r.Equal(strings.Repeat("x", 100), v["long"])
+	r.True(time.Since(start) >= 2*latency, "call took %s", time.Since(start))
+
+	client.Terminate()
+	r.NoError(server.(Server).Serve())
+}
+
+func TestPipeConn(t *testing.T) {
+	r := require.New(t)
+
+	a, b := newPipeConns(0, 2)
+	n, err := a.Write([]byte("hello"))
+	r.NoError(err)
+	r.Equal(5, n)
+
+	buf := make([]byte, 10)
+	n, err = b.Read(buf)
+	r.NoError(err)
+	r.Equal("he", string(buf[:n]), "reads are limited to a chunk")
+
+	// what was written before close can still be read
+	r.NoError(a.Close())
+	rest, err := ioutil.ReadAll(b)
+	r.NoError(err)
+	r.Equal("llo", string(rest))
+
+	_, err = b.Write([]byte("too late"))
+	r.ErrorIs(err, io.ErrClosedPipe)
+}
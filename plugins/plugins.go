@@ -0,0 +1,165 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+// Package plugins composes features that each own a namespace of methods into one muxrpc.Handler, like the plugins of ssb-server.
+// A plugin named "blobs" handles blobs.get and blobs.add, another one named "ebt" handles ebt.replicate,
+// and the manifest of the registry lists all of them.
+//
+//	var reg plugins.Registry
+//	if err := reg.Register(blobsPlugin); err != nil {
+//		...
+//	}
+//	edp := muxrpc.Handle(pkr, reg.Handler())
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/ssbc/go-muxrpc/v2"
+	"github.com/ssbc/go-muxrpc/v2/typemux"
+)
+
+// Plugin is a feature that handles the methods below its name.
+type Plugin interface {
+	// Name is the namespace of the plugin, the first element of all of its methods.
+	Name() string
+
+	// Methods lists the methods of the plugin, without its name, and their call type. Methods of sub-groups are joined with dots.
+	//
+	//	{"get": "source", "add": "sink", "ws.ping": "async"}
+	Methods() map[string]muxrpc.CallType
+
+	// Handler gets the calls to the methods of the plugin, with their full method. It is asked for once, by Register.
+	Handler() muxrpc.Handler
+}
+
+// Initializer is implemented by plugins that need to know about new sessions.
+// Init is called for every session before HandleConnect of the handler of the plugin.
+type Initializer interface {
+	Init(edp muxrpc.Endpoint)
+}
+
+// Registry collects plugins. The zero value is ready to use.
+type Registry struct {
+	mu      sync.RWMutex
+	plugins []registered
+	byName  map[string]registered
+}
+
+// registered is a plugin with its handler
+type registered struct {
+	Plugin
+	h muxrpc.Handler
+}
+
+// Register adds p. It fails if another plugin already has the same name.
+// A plugin that is registered later gets the calls of running sessions as well, but is only initialized for new ones.
+func (reg *Registry) Register(p Plugin) error {
+	name := p.Name()
+	if name == "" || strings.Contains(name, ".") || name == "manifest" {
+		return fmt.Errorf("plugins: invalid name %q", name)
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if _, taken := reg.byName[name]; taken {
+		return fmt.Errorf("plugins: %q is already registered", name)
+	}
+	if reg.byName == nil {
+		reg.byName = make(map[string]registered)
+	}
+	rp := registered{Plugin: p, h: p.Handler()}
+	reg.byName[name] = rp
+	reg.plugins = append(reg.plugins, rp)
+	return nil
+}
+
+// Manifest merges the methods of all plugins, each under its name.
+func (reg *Registry) Manifest() typemux.Manifest {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	m := typemux.Manifest{"manifest": "sync"}
+	for _, p := range reg.plugins {
+		group := make(typemux.Manifest)
+		for method, ct := range p.Methods() {
+			path := strings.Split(method, ".")
+			sub := group
+			for _, elem := range path[:len(path)-1] {
+				next, ok := sub[elem].(typemux.Manifest)
+				if !ok {
+					next = make(typemux.Manifest)
+					sub[elem] = next
+				}
+				sub = next
+			}
+			sub[path[len(path)-1]] = string(ct)
+		}
+		m[p.Name()] = group
+	}
+	return m
+}
+
+// Handler returns the handler that passes calls to the plugin of their namespace and answers manifest calls with Manifest.
+func (reg *Registry) Handler() muxrpc.Handler {
+	return registryHandler{reg}
+}
+
+func (reg *Registry) lookup(m muxrpc.Method) (registered, bool) {
+	if len(m) < 2 {
+		return registered{}, false
+	}
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	p, ok := reg.byName[m[0]]
+	return p, ok
+}
+
+type registryHandler struct {
+	reg *Registry
+}
+
+var _ muxrpc.Handler = registryHandler{}
+
+func (h registryHandler) Handled(m muxrpc.Method) bool {
+	if isManifestCall(m) {
+		return true
+	}
+	p, ok := h.reg.lookup(m)
+	return ok && p.h.Handled(m)
+}
+
+func (h registryHandler) HandleCall(ctx context.Context, req *muxrpc.Request) {
+	if isManifestCall(req.Method) {
+		req.Return(ctx, h.reg.Manifest())
+		return
+	}
+
+	p, ok := h.reg.lookup(req.Method)
+	if !ok {
+		req.CloseWithError(muxrpc.ErrNoSuchMethod{Method: req.Method})
+		return
+	}
+	p.h.HandleCall(ctx, req)
+}
+
+func (h registryHandler) HandleConnect(ctx context.Context, edp muxrpc.Endpoint) {
+	h.reg.mu.RLock()
+	plugins := append([]registered(nil), h.reg.plugins...)
+	h.reg.mu.RUnlock()
+
+	for _, p := range plugins {
+		if init, ok := p.Plugin.(Initializer); ok {
+			init.Init(edp)
+		}
+		go p.h.HandleConnect(ctx, edp)
+	}
+}
+
+func isManifestCall(m muxrpc.Method) bool {
+	return len(m) == 1 && m[0] == "manifest"
+}
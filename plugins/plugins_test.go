@@ -0,0 +1,90 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package plugins
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ssbc/go-muxrpc/v2"
+	"github.com/ssbc/go-muxrpc/v2/typemux"
+)
+
+// echoPlugin answers its async methods with their name
+type echoPlugin struct {
+	name    string
+	methods []string
+
+	inits chan muxrpc.Endpoint
+}
+
+func (p echoPlugin) Name() string { return p.name }
+
+func (p echoPlugin) Methods() map[string]muxrpc.CallType {
+	ms := make(map[string]muxrpc.CallType)
+	for _, m := range p.methods {
+		ms[m] = "async"
+	}
+	return ms
+}
+
+func (p echoPlugin) Handler() muxrpc.Handler {
+	mux := typemux.New(muxrpc.NopLogger())
+	for name := range p.Methods() {
+		method := append(muxrpc.Method{p.name}, strings.Split(name, ".")...)
+		mux.RegisterAsync(method, typemux.AsyncFunc(func(ctx context.Context, req *muxrpc.Request) (interface{}, error) {
+			return req.Method.String(), nil
+		}))
+	}
+	return &mux
+}
+
+func (p echoPlugin) Init(edp muxrpc.Endpoint) {
+	if p.inits != nil {
+		p.inits <- edp
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	r := require.New(t)
+
+	var reg Registry
+	inits := make(chan muxrpc.Endpoint, 1)
+	r.NoError(reg.Register(echoPlugin{name: "blobs", methods: []string{"get", "has"}, inits: inits}))
+	r.NoError(reg.Register(echoPlugin{name: "conn", methods: []string{"ping", "ws.ping"}}))
+
+	r.Error(reg.Register(echoPlugin{name: "blobs"}), "names are unique")
+	r.Error(reg.Register(echoPlugin{name: "a.b"}))
+	r.Error(reg.Register(echoPlugin{name: "manifest"}))
+
+	r.Equal(typemux.Manifest{
+		"manifest": "sync",
+		"blobs":    typemux.Manifest{"get": "async", "has": "async"},
+		"conn":     typemux.Manifest{"ping": "async", "ws": typemux.Manifest{"ping": "async"}},
+	}, reg.Manifest())
+
+	client, _ := muxrpc.NewPipe(&muxrpc.FakeHandler{}, reg.Handler(), muxrpc.WithPipeHandleOptions(
+		[]muxrpc.HandleOption{muxrpc.WithLogger(muxrpc.NopLogger())},
+		[]muxrpc.HandleOption{muxrpc.WithLogger(muxrpc.NopLogger())},
+	))
+	defer client.Terminate()
+	<-inits
+
+	ctx := context.Background()
+	for _, m := range []muxrpc.Method{{"blobs", "get"}, {"conn", "ws", "ping"}} {
+		var got string
+		r.NoError(client.Async(ctx, &got, muxrpc.TypeString, m))
+		r.Equal(m.String(), got)
+	}
+
+	// the client checks the merged manifest
+	var got string
+	err := client.Async(ctx, &got, muxrpc.TypeString, muxrpc.Method{"ebt", "replicate"})
+	r.True(errors.Is(err, muxrpc.ErrMethodNotFound), "unexpected error: %v", err)
+}
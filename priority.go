@@ -0,0 +1,91 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+)
+
+// Priority decides which of the streams that wait to write to the connection goes first.
+// It only changes the order of packets that are waiting at the same time, a packet that is being written is never interrupted.
+type Priority int
+
+const (
+	// PriorityLow is for bulk transfers that may wait, like replicating whole feeds.
+	PriorityLow Priority = -1
+
+	// PriorityNormal is what streams use by default.
+	PriorityNormal Priority = 0
+
+	// PriorityHigh is what async calls and their replies use by default, so they aren't stuck behind a busy stream.
+	PriorityHigh Priority = 1
+)
+
+// priorityLevels is the number of distinct priorities
+const priorityLevels = 3
+
+// level maps p to one of the queues of writeQueue.jobs, priorities outside of the constants are clamped
+func (p Priority) level() int {
+	switch {
+	case p < PriorityLow:
+		return 0
+	case p > PriorityHigh:
+		return priorityLevels - 1
+	}
+	return int(p - PriorityLow)
+}
+
+// defaultPriority is the priority of new sinks of calls of type t
+func defaultPriority(t CallType) Priority {
+	if t == "" || t == "async" || t == "sync" {
+		return PriorityHigh
+	}
+	return PriorityNormal
+}
+
+// CallPriority sets the priority of the packets of the calls of the view, see Priority.
+func CallPriority(p Priority) CallOption {
+	return func(o *callOptions) {
+		o.priority = p
+		o.hasPriority = true
+	}
+}
+
+type priorityCtxKeyType struct{}
+
+var priorityCtxKey priorityCtxKeyType
+
+func withPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityCtxKey, p)
+}
+
+func priorityFromContext(ctx context.Context) (Priority, bool) {
+	p, ok := ctx.Value(priorityCtxKey).(Priority)
+	return p, ok
+}
+
+// SetPriority changes the priority of the packets the handler sends for the request.
+func (req *Request) SetPriority(p Priority) {
+	req.sink.SetPriority(p)
+}
+
+// SetPriority changes the priority of the following writes to the sink.
+func (bs *ByteSink) SetPriority(p Priority) {
+	bs.closedMu.Lock()
+	defer bs.closedMu.Unlock()
+	bs.prio = p
+}
+
+// defaultWriteQuantum is the WithWriteQuantum of new sessions
+const defaultWriteQuantum = 64 * 1024
+
+// WithWriteQuantum sets how many bytes a sink writes of a batch (see ByteSink.WriteBatch and ByteSink.Uncork)
+// before it lets other streams of the same priority write, so that one stream with a lot to send doesn't hold up the others.
+// Single packets are never split, no matter how large they are. Zero writes every batch in one go, the default is 64KiB.
+func WithWriteQuantum(n int) HandleOption {
+	return func(r *rpc) {
+		r.writeQuantum = n
+	}
+}
@@ -0,0 +1,213 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ssbc/go-muxrpc/v2/codec"
+)
+
+// stuckWriter blocks the first write until release is closed, like a connection to a remote that doesn't read
+type stuckWriter struct {
+	entered, release chan struct{}
+	once             sync.Once
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func newStuckWriter() *stuckWriter {
+	return &stuckWriter{entered: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (sw *stuckWriter) Write(b []byte) (int, error) {
+	sw.once.Do(func() {
+		close(sw.entered)
+		<-sw.release
+	})
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.buf.Write(b)
+}
+
+// reqs returns the request ids of the packets that were written
+func (sw *stuckWriter) reqs(t *testing.T) []int32 {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	pkts, err := codec.ReadAllPackets(codec.NewReader(bytes.NewReader(sw.buf.Bytes())))
+	require.NoError(t, err)
+	var reqs []int32
+	for _, pkt := range pkts {
+		reqs = append(reqs, pkt.Req)
+	}
+	return reqs
+}
+
+func startWriteQueue(t *testing.T, w io.Writer) *writeQueue {
+	q := newWriteQueue(codec.NewWriter(w), defaultWriteQueue, RealClock())
+	go q.run()
+	t.Cleanup(func() { q.close() })
+	return q
+}
+
+func TestWriteQueueOrder(t *testing.T) {
+	r := require.New(t)
+
+	out := newStuckWriter()
+	q := startWriteQueue(t, out)
+
+	pkt := func(req int32) codec.Packet {
+		return codec.Packet{Req: req, Flag: codec.FlagJSON, Body: []byte("{}")}
+	}
+	r.NoError(q.write(PriorityNormal, pkt(1)))
+	<-out.entered
+
+	// queued while the writer is stuck
+	r.NoError(q.write(PriorityLow, pkt(2)))
+	r.NoError(q.write(PriorityNormal, pkt(3)))
+	r.NoError(q.write(PriorityHigh, pkt(4)))
+	r.NoError(q.write(PriorityHigh+5, pkt(5)))
+	r.NoError(q.write(PriorityNormal, pkt(6)))
+
+	close(out.release)
+	r.NoError(q.flush(false, time.Second))
+	r.Equal([]int32{1, 4, 5, 3, 6, 2}, out.reqs(t))
+
+	// nothing is lost if the queue is closed once it was written
+	r.Equal(0, q.close())
+	r.ErrorIs(q.write(PriorityNormal, pkt(7)), ErrSessionTerminated)
+}
+
+// expiredClock is a real clock whose timers fire right away
+type expiredClock struct{ Clock }
+
+func (expiredClock) NewTimer(time.Duration) Timer { return RealClock().NewTimer(0) }
+
+func TestWriteQueueFlushClock(t *testing.T) {
+	r := require.New(t)
+
+	out := newStuckWriter()
+	q := newWriteQueue(codec.NewWriter(out), defaultWriteQueue, expiredClock{RealClock()})
+	go q.run()
+	defer func() {
+		close(out.release)
+		q.close()
+	}()
+
+	r.NoError(q.write(PriorityNormal, codec.Packet{Req: 1, Flag: codec.FlagJSON, Body: []byte("{}")}))
+	<-out.entered
+
+	// the timeout comes from the clock of the session
+	r.ErrorIs(q.flush(false, time.Hour), ErrWriteTimeout)
+}
+
+func TestWriteQuantumRoundRobin(t *testing.T) {
+	r := require.New(t)
+
+	out := newStuckWriter()
+	q := startWriteQueue(t, out)
+
+	newSink := func(req int32) *ByteSink {
+		snk := NewTestSink(nil)
+		snk.pkt.Req = req
+		snk.queue = q
+		snk.quantum = 2 * (codec.HeaderLength + 2)
+		return snk
+	}
+	a, b := newSink(1), newSink(2)
+
+	queued := func(n int) func() bool {
+		return func() bool { return len(q.jobs[PriorityNormal.level()]) == n }
+	}
+
+	// both sinks wait with a batch of four packets, two of them fit into a turn
+	r.NoError(q.write(PriorityNormal, codec.Packet{Req: 9, Body: []byte("x")}))
+	<-out.entered
+	errc := make(chan error, 2)
+	batch := [][]byte{[]byte("p1"), []byte("p2"), []byte("p3"), []byte("p4")}
+	go func() { errc <- a.WriteBatch(batch) }()
+	r.Eventually(queued(1), time.Second, time.Millisecond)
+	go func() { errc <- b.WriteBatch(batch) }()
+	r.Eventually(queued(2), time.Second, time.Millisecond)
+	close(out.release)
+	r.NoError(<-errc)
+	r.NoError(<-errc)
+
+	// b doesn't wait for all of a, after that it depends on who is quicker to queue the next turn
+	r.NoError(q.flush(false, time.Second))
+	reqs := out.reqs(t)
+	r.Len(reqs, 9)
+	r.Equal([]int32{9, 1, 1, 2, 2}, reqs[:5])
+}
+
+func TestCallPriority(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+
+	opts := []HandleOption{WithoutManifest(), WithLogger(NopLogger())}
+	client, _ := NewPipe(&FakeHandler{}, Echo, WithPipeHandleOptions(opts, opts))
+	defer client.Terminate()
+
+	_, snk, err := client.Duplex(ctx, TypeJSON, Method{"echo"})
+	r.NoError(err)
+	r.Equal(PriorityNormal, snk.prio)
+	snk.Close()
+
+	bulk := client.WithOptions(CallPriority(PriorityLow))
+	_, snk, err = bulk.Duplex(ctx, TypeJSON, Method{"echo"})
+	r.NoError(err)
+	r.Equal(PriorityLow, snk.prio)
+
+	snk.SetPriority(PriorityHigh)
+	r.Equal(PriorityHigh, snk.prio)
+	r.NoError(snk.Close())
+
+	var v int
+	r.NoError(bulk.Async(ctx, &v, TypeJSON, Method{"echo"}, 1))
+	r.Equal(1, v)
+}
+
+func TestRefusalWithFullQueue(t *testing.T) {
+	// nobody reads what the endpoint writes, so its queue fills up with refusals
+	c1, c2 := net.Pipe()
+	edp := Handle(NewPacker(c2), &FakeHandler{}, WithoutManifest(), WithLogger(NopLogger()), WithWriteQueue(1))
+	t.Cleanup(func() {
+		// the remote goes away, otherwise terminating would wait for the stuck writes to time out
+		c1.Close()
+		edp.Terminate()
+	})
+
+	go func() {
+		w := codec.NewWriter(c1)
+		body := []byte(`{"name":["nope"],"args":[],"type":"async"}`)
+		for i := int32(1); i <= 10; i++ {
+			if err := w.WritePacket(codec.Packet{Req: i, Flag: codec.FlagJSON, Body: body}); err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// waiting for room doesn't keep the requests locked
+	done := make(chan struct{})
+	go func() {
+		edp.Stats()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("requests stayed locked while the refusal waited for the queue")
+	}
+}
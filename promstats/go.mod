@@ -0,0 +1,16 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: Unlicense
+
+go 1.15
+
+module github.com/ssbc/go-muxrpc/v2/promstats
+
+require (
+	github.com/prometheus/client_golang v1.11.1
+	github.com/ssbc/go-muxrpc/v2 v2.0.0
+	github.com/stretchr/testify v1.7.0
+)
+
+// the exporter is developed together with the muxrpc module
+replace github.com/ssbc/go-muxrpc/v2 => ../
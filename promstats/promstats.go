@@ -0,0 +1,269 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+// Package promstats exports the stats of muxrpc connections to Prometheus.
+//
+// A Handler is a muxrpc.StatsHandler and a prometheus.Collector at the same time:
+//
+//	h := promstats.New("ssb", promstats.Methods(mux.Manifest())...)
+//	prometheus.MustRegister(h)
+//	edp := muxrpc.Handle(pkr, mux, muxrpc.WithStatsHandler(h))
+//
+// Incoming calls are only labeled with their method if it was passed to New, the rest share the "<unknown>" label,
+// so that remotes can't blow up the number of series by calling made up methods.
+// This includes calls that were refused and calls that were matched by a wildcard.
+//
+// The package is a module of its own, so that only its importers depend on the Prometheus client.
+package promstats
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/ssbc/go-muxrpc/v2"
+	"github.com/ssbc/go-muxrpc/v2/typemux"
+)
+
+// unknownMethod is the method label of incoming calls to methods that aren't known to the handler
+const unknownMethod = "<unknown>"
+
+// ErrorRateBuckets are the buckets of the per connection error rate histogram.
+var ErrorRateBuckets = []float64{0, 0.01, 0.05, 0.1, 0.25, 0.5, 1}
+
+// Handler collects the stats of all the connections it was passed to with muxrpc.WithStatsHandler.
+type Handler struct {
+	calls      *prometheus.CounterVec
+	callErrors *prometheus.CounterVec
+	inFlight   *prometheus.GaugeVec
+	conns      prometheus.Gauge
+	errorRate  prometheus.Histogram
+
+	// methods are the names of the methods that incoming calls are labeled with
+	methods map[string]struct{}
+
+	packets  *prometheus.Desc
+	bytes    *prometheus.Desc
+	buffered *prometheus.Desc
+
+	mu   sync.Mutex
+	live map[*connState]struct{}
+	// closed holds the counters of the connections that ended, so that the totals don't go down
+	closed muxrpc.ConnCounters
+}
+
+var (
+	_ muxrpc.StatsHandler  = (*Handler)(nil)
+	_ prometheus.Collector = (*Handler)(nil)
+)
+
+// New returns a Handler whose metrics are prefixed with namespace, which can be empty.
+// methods are the ones that are served locally, usually those of the manifest (see Methods).
+// Incoming calls of other methods are labeled as unknown.
+func New(namespace string, methods ...muxrpc.Method) *Handler {
+	known := make(map[string]struct{}, len(methods))
+	for _, m := range methods {
+		known[m.String()] = struct{}{}
+	}
+
+	callLabels := []string{"method", "type", "direction"}
+	return &Handler{
+		methods: known,
+
+		calls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "muxrpc",
+			Name:      "calls_total",
+			Help:      "Number of calls, counted when they end.",
+		}, callLabels),
+		callErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "muxrpc",
+			Name:      "call_errors_total",
+			Help:      "Number of calls that ended with an error.",
+		}, callLabels),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "muxrpc",
+			Name:      "calls_in_flight",
+			Help:      "Number of calls and streams that are open.",
+		}, []string{"type", "direction"}),
+		conns: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "muxrpc",
+			Name:      "connections",
+			Help:      "Number of open connections.",
+		}),
+		errorRate: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "muxrpc",
+			Name:      "connection_error_rate",
+			Help:      "Share of the calls of a connection that failed, observed when it ends.",
+			Buckets:   ErrorRateBuckets,
+		}),
+
+		packets: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "muxrpc", "packets_total"),
+			"Number of packets sent and received.",
+			[]string{"direction"}, nil),
+		bytes: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "muxrpc", "bytes_total"),
+			"Number of bytes sent and received, packet headers included.",
+			[]string{"direction"}, nil),
+		buffered: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "muxrpc", "buffered_bytes"),
+			"Number of received bytes that are buffered until they are read.",
+			nil, nil),
+
+		live: make(map[*connState]struct{}),
+	}
+}
+
+// connState is what the handler tracks for each connection
+type connState struct {
+	edp muxrpc.Endpoint
+
+	// accessed atomically
+	calls, failed uint64
+}
+
+type connCtxKeyType struct{}
+
+var connCtxKey connCtxKeyType
+
+// TagConn starts tracking the connection of edp.
+func (h *Handler) TagConn(ctx context.Context, edp muxrpc.Endpoint) context.Context {
+	cs := &connState{edp: edp}
+
+	h.mu.Lock()
+	h.live[cs] = struct{}{}
+	h.mu.Unlock()
+
+	h.conns.Inc()
+	return context.WithValue(ctx, connCtxKey, cs)
+}
+
+// HandleStats updates the metrics.
+func (h *Handler) HandleStats(ctx context.Context, s muxrpc.Stats) {
+	cs, ok := ctx.Value(connCtxKey).(*connState)
+	if !ok {
+		return
+	}
+
+	switch s := s.(type) {
+	case muxrpc.CallBegin:
+		h.inFlight.WithLabelValues(string(s.Type), direction(s.Incoming)).Inc()
+
+	case muxrpc.CallEnd:
+		h.inFlight.WithLabelValues(string(s.Type), direction(s.Incoming)).Dec()
+
+		method := s.Method.String()
+		if _, known := h.methods[method]; s.Incoming && !known {
+			method = unknownMethod
+		}
+		labels := []string{method, string(s.Type), direction(s.Incoming)}
+
+		// counted at the end, so that both counters have the same labels
+		h.calls.WithLabelValues(labels...).Inc()
+		atomic.AddUint64(&cs.calls, 1)
+		if s.Err != nil {
+			h.callErrors.WithLabelValues(labels...).Inc()
+			atomic.AddUint64(&cs.failed, 1)
+		}
+
+	case muxrpc.ConnEnd:
+		counters := muxrpc.ConnStats(cs.edp)
+
+		h.mu.Lock()
+		if _, live := h.live[cs]; live {
+			delete(h.live, cs)
+			h.closed.PacketsRead += counters.PacketsRead
+			h.closed.PacketsWritten += counters.PacketsWritten
+			h.closed.BytesRead += counters.BytesRead
+			h.closed.BytesWritten += counters.BytesWritten
+		}
+		h.mu.Unlock()
+
+		h.conns.Dec()
+		if calls := atomic.LoadUint64(&cs.calls); calls > 0 {
+			h.errorRate.Observe(float64(atomic.LoadUint64(&cs.failed)) / float64(calls))
+		}
+	}
+}
+
+// Methods returns the methods listed in a manifest, in the nested format of typemux.Manifest.
+// Wildcard entries are left out, calls they match are labeled as unknown.
+func Methods(manifest map[string]interface{}) []muxrpc.Method {
+	var methods []muxrpc.Method
+	var walk func(prefix muxrpc.Method, group map[string]interface{})
+	walk = func(prefix muxrpc.Method, group map[string]interface{}) {
+		for name, v := range group {
+			if name == "*" {
+				continue
+			}
+			m := append(append(muxrpc.Method(nil), prefix...), name)
+			switch v := v.(type) {
+			case string:
+				methods = append(methods, m)
+			case map[string]interface{}:
+				walk(m, v)
+			case typemux.Manifest:
+				walk(m, v)
+			}
+		}
+	}
+	walk(nil, manifest)
+
+	sort.Slice(methods, func(i, j int) bool { return methods[i].String() < methods[j].String() })
+	return methods
+}
+
+func direction(incoming bool) string {
+	if incoming {
+		return "in"
+	}
+	return "out"
+}
+
+// Describe implements prometheus.Collector.
+func (h *Handler) Describe(ch chan<- *prometheus.Desc) {
+	h.calls.Describe(ch)
+	h.callErrors.Describe(ch)
+	h.inFlight.Describe(ch)
+	h.conns.Describe(ch)
+	h.errorRate.Describe(ch)
+	ch <- h.packets
+	ch <- h.bytes
+	ch <- h.buffered
+}
+
+// Collect implements prometheus.Collector. The packet and byte counters and the buffer occupancy are polled from the open connections.
+func (h *Handler) Collect(ch chan<- prometheus.Metric) {
+	h.calls.Collect(ch)
+	h.callErrors.Collect(ch)
+	h.inFlight.Collect(ch)
+	h.conns.Collect(ch)
+	h.errorRate.Collect(ch)
+
+	h.mu.Lock()
+	total := h.closed
+	for cs := range h.live {
+		counters := muxrpc.ConnStats(cs.edp)
+		total.PacketsRead += counters.PacketsRead
+		total.PacketsWritten += counters.PacketsWritten
+		total.BytesRead += counters.BytesRead
+		total.BytesWritten += counters.BytesWritten
+		total.Buffered += counters.Buffered
+	}
+	h.mu.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(h.packets, prometheus.CounterValue, float64(total.PacketsRead), "in")
+	ch <- prometheus.MustNewConstMetric(h.packets, prometheus.CounterValue, float64(total.PacketsWritten), "out")
+	ch <- prometheus.MustNewConstMetric(h.bytes, prometheus.CounterValue, float64(total.BytesRead), "in")
+	ch <- prometheus.MustNewConstMetric(h.bytes, prometheus.CounterValue, float64(total.BytesWritten), "out")
+	ch <- prometheus.MustNewConstMetric(h.buffered, prometheus.GaugeValue, float64(total.Buffered))
+}
@@ -0,0 +1,128 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package promstats
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ssbc/go-muxrpc/v2"
+	"github.com/ssbc/go-muxrpc/v2/typemux"
+)
+
+type onlyEcho struct{}
+
+func (onlyEcho) Handled(m muxrpc.Method) bool { return m.String() == "echo" }
+func (onlyEcho) HandleCall(ctx context.Context, req *muxrpc.Request) {
+	muxrpc.Echo.HandleCall(ctx, req)
+}
+func (onlyEcho) HandleConnect(context.Context, muxrpc.Endpoint) {}
+
+func TestHandler(t *testing.T) {
+	r := require.New(t)
+
+	h := New("test", muxrpc.Method{"echo"})
+	reg := prometheus.NewPedanticRegistry()
+	r.NoError(reg.Register(h))
+
+	c1, c2 := net.Pipe()
+	opts := []muxrpc.HandleOption{
+		muxrpc.WithoutManifest(),
+		muxrpc.WithLogger(muxrpc.NopLogger()),
+		muxrpc.WithStatsHandler(h),
+	}
+	srvc := make(chan muxrpc.Endpoint)
+	go func() {
+		srv := muxrpc.Handle(muxrpc.NewPacker(c2), onlyEcho{}, opts...)
+		srvc <- srv
+		srv.(muxrpc.Server).Serve()
+	}()
+	client := muxrpc.Handle(muxrpc.NewPacker(c1), onlyEcho{}, opts...)
+	go client.(muxrpc.Server).Serve()
+	server := <-srvc
+
+	ctx := context.Background()
+
+	var v map[string]int
+	r.NoError(client.Async(ctx, &v, muxrpc.TypeJSON, muxrpc.Method{"echo"}, map[string]int{"a": 1}))
+	r.Equal(1, v["a"])
+	r.Error(client.Async(ctx, &v, muxrpc.TypeJSON, muxrpc.Method{"made", "up"}))
+
+	src, err := client.Source(ctx, muxrpc.TypeJSON, muxrpc.Method{"echo"}, 1, 2)
+	r.NoError(err)
+	for i := 0; i < 2; i++ {
+		r.True(src.Next(ctx))
+		_, err := src.Bytes()
+		r.NoError(err)
+	}
+	r.False(src.Next(ctx))
+	r.NoError(src.Err())
+
+	r.Equal(2.0, testutil.ToFloat64(h.conns))
+	r.Equal(1.0, testutil.ToFloat64(h.calls.WithLabelValues("echo", "async", "out")))
+	r.Equal(1.0, testutil.ToFloat64(h.calls.WithLabelValues("echo", "source", "out")))
+	r.Equal(1.0, testutil.ToFloat64(h.callErrors.WithLabelValues("made.up", "async", "out")))
+	r.Eventually(func() bool {
+		return testutil.ToFloat64(h.callErrors.WithLabelValues(unknownMethod, "async", "in")) == 1
+	}, time.Second, 10*time.Millisecond, "the server should hide made up methods")
+
+	r.NoError(client.Terminate())
+	r.NoError(server.Terminate())
+	r.Equal(0.0, testutil.ToFloat64(h.conns))
+	r.Equal(0.0, testutil.ToFloat64(h.inFlight.WithLabelValues("source", "out")))
+
+	// the counters of the ended connections are kept, as they were when the connections ended
+	r.Equal(1, testutil.CollectAndCount(h, "test_muxrpc_buffered_bytes"))
+	families, err := reg.Gather()
+	r.NoError(err)
+	totals := make(map[string]float64)
+	for _, mf := range families {
+		if mf.GetName() != "test_muxrpc_bytes_total" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			totals[m.GetLabel()[0].GetValue()] = m.GetCounter().GetValue()
+		}
+	}
+	cc, sc := muxrpc.ConnStats(client), muxrpc.ConnStats(server)
+	r.NotZero(totals["in"])
+	r.NotZero(totals["out"])
+	r.LessOrEqual(totals["in"], float64(cc.BytesRead+sc.BytesRead))
+	r.LessOrEqual(totals["out"], float64(cc.BytesWritten+sc.BytesWritten))
+
+	lint, err := testutil.CollectAndLint(h)
+	r.NoError(err)
+	r.Empty(lint)
+}
+
+func TestMethods(t *testing.T) {
+	r := require.New(t)
+
+	m := typemux.Manifest{
+		"whoami": "async",
+		"blobs":  typemux.Manifest{"get": "source", "add": "sink"},
+		"tunnel": typemux.Manifest{"*": "async", "connect": "duplex"},
+	}
+	r.Equal([]muxrpc.Method{
+		{"blobs", "add"},
+		{"blobs", "get"},
+		{"tunnel", "connect"},
+		{"whoami"},
+	}, Methods(m))
+
+	// calls matched by the wildcard are unknown
+	h := New("test", Methods(m)...)
+	ctx := h.TagConn(context.Background(), nil)
+	h.HandleStats(ctx, muxrpc.CallEnd{Method: muxrpc.Method{"tunnel", "anything"}, Type: "async", Incoming: true})
+	h.HandleStats(ctx, muxrpc.CallEnd{Method: muxrpc.Method{"tunnel", "connect"}, Type: "duplex", Incoming: true})
+	r.Equal(1.0, testutil.ToFloat64(h.calls.WithLabelValues(unknownMethod, "async", "in")))
+	r.Equal(1.0, testutil.ToFloat64(h.calls.WithLabelValues("tunnel.connect", "duplex", "in")))
+}
@@ -0,0 +1,113 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/ssbc/go-muxrpc/v2/codec"
+)
+
+// ProtocolViolation is the kind of a ProtocolError.
+type ProtocolViolation uint
+
+// The ways in which a remote can mix up request numbers.
+const (
+	// ViolationUnknownID is a packet for a call that was never made, like an answer to a request number this end didn't use yet.
+	ViolationUnknownID ProtocolViolation = iota + 1
+
+	// ViolationReusedID is a second call packet with the number of a call that is still open.
+	ViolationReusedID
+
+	// ViolationWrongDirection is data that flows against the type of its call,
+	// like the caller of a source or the callee of a sink sending more than the end of the stream.
+	ViolationWrongDirection
+
+	// ViolationDataAfterEnd is data for a call that the remote already ended.
+	ViolationDataAfterEnd
+
+	// ViolationDuplicateEnd is a second end of a call from the remote.
+	ViolationDuplicateEnd
+)
+
+func (v ProtocolViolation) String() string {
+	switch v {
+	case ViolationUnknownID:
+		return "unknown request id"
+	case ViolationReusedID:
+		return "request id in use"
+	case ViolationWrongDirection:
+		return "data against the call type"
+	case ViolationDataAfterEnd:
+		return "data after the end of the call"
+	case ViolationDuplicateEnd:
+		return "duplicate end of the call"
+	default:
+		return "unknown violation"
+	}
+}
+
+// ProtocolError describes a packet of the remote that doesn't fit the calls of the session.
+// Such packets are dropped and logged, or end the session if it was started WithStrictProtocol.
+// Serve then returns an error that wraps the ProtocolError, use errors.As to get it.
+type ProtocolError struct {
+	Violation ProtocolViolation
+
+	// Req is the request number of the packet as this end sees it. Calls that the remote made have negative numbers.
+	Req  int32
+	Flag codec.Flag
+}
+
+func (e ProtocolError) Error() string {
+	return fmt.Sprintf("muxrpc: protocol error: %s (req:%d flags:%s)", e.Violation, e.Req, e.Flag)
+}
+
+// WithStrictProtocol terminates the session with a ProtocolError when the remote sends a packet that doesn't fit its calls.
+// Without it, such packets are logged and skipped.
+func WithStrictProtocol() HandleOption {
+	return func(r *rpc) {
+		r.strictProtocol = true
+	}
+}
+
+// checkPacket looks for a ProtocolError in a packet that isn't the end of a call.
+// It returns errSkip if the packet was dropped.
+func (r *rpc) checkPacket(hdr codec.Header) error {
+	r.rLock.RLock()
+	req, ok := r.reqs[hdr.Req]
+	r.rLock.RUnlock()
+
+	switch {
+	case !ok && hdr.Req >= 0:
+		// the calls of the remote have negative numbers, anything else has to be one of ours
+		return r.violation(hdr, ViolationUnknownID)
+
+	case !ok:
+		return nil
+
+	case req.id < 0 && (req.Type == "async" || req.Type == "sync" || req.Type == ""):
+		return r.violation(hdr, ViolationReusedID)
+
+	case req.id < 0 && req.Type == "source", req.id > 0 && req.Type == "sink":
+		return r.violation(hdr, ViolationWrongDirection)
+	}
+	return nil
+}
+
+// violation ends the session with a ProtocolError if it is strict, otherwise it logs it and skips the body of the packet.
+func (r *rpc) violation(hdr codec.Header, v ProtocolViolation) error {
+	perr := ProtocolError{Violation: v, Req: hdr.Req, Flag: hdr.Flag}
+	if r.strictProtocol {
+		return perr
+	}
+
+	logWarn(r.logger).Log("event", "dropped packet", "err", perr, "len", hdr.Len)
+	if _, err := io.Copy(ioutil.Discard, r.pkr.r.NextBodyReader(hdr.Len)); err != nil {
+		return fmt.Errorf("muxrpc: failed to skip body of req %d: %w", hdr.Req, err)
+	}
+	return errSkip
+}
@@ -0,0 +1,137 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ssbc/go-muxrpc/v2/codec"
+)
+
+func TestProtocolErrorLenient(t *testing.T) {
+	r := require.New(t)
+
+	var srv FakeHandler
+	srv.HandledCalls(methodChecker("hello"))
+	srv.HandleCallCalls(func(ctx context.Context, req *Request) {
+		req.Return(ctx, "world")
+	})
+
+	c1, c2 := loPipe(t)
+	edp := Handle(NewPacker(c1), &srv, WithoutManifest(), WithLogger(NopLogger()))
+	go edp.(Server).Serve()
+	t.Cleanup(func() { edp.Terminate() })
+
+	remoteR, remoteW := codec.NewReader(c2), codec.NewWriter(c2)
+
+	// an answer and an end for calls that were never made are skipped
+	r.NoError(remoteW.WritePacket(codec.Packet{Req: -5, Flag: codec.FlagJSON, Body: []byte(`"surprise"`)}))
+	r.NoError(remoteW.WritePacket(codec.Packet{Req: -6, Flag: codec.FlagJSON | codec.FlagStream | codec.FlagEndErr, Body: []byte("true")}))
+
+	// the session goes on
+	r.NoError(remoteW.WritePacket(codec.Packet{Req: 1, Flag: codec.FlagJSON, Body: []byte(`{"name":["hello"],"args":[],"type":"async"}`)}))
+	answer, err := remoteR.ReadPacket()
+	r.NoError(err)
+	r.Equal(int32(-1), answer.Req)
+	r.Equal(`world`, string(answer.Body))
+}
+
+func TestProtocolErrorStrict(t *testing.T) {
+	type testCase struct {
+		name string
+		pkts []codec.Packet
+
+		violation ProtocolViolation
+		req       int32
+	}
+
+	tcs := []testCase{
+		{
+			name:      "unknown id",
+			pkts:      []codec.Packet{{Req: -5, Flag: codec.FlagJSON, Body: []byte(`"surprise"`)}},
+			violation: ViolationUnknownID,
+			req:       5,
+		},
+		{
+			name:      "unknown end",
+			pkts:      []codec.Packet{{Req: -6, Flag: codec.FlagJSON | codec.FlagEndErr, Body: []byte("true")}},
+			violation: ViolationUnknownID,
+			req:       6,
+		},
+		{
+			name: "reused id",
+			pkts: []codec.Packet{
+				{Req: 1, Flag: codec.FlagJSON, Body: []byte(`{"name":["block"],"args":[],"type":"async"}`)},
+				{Req: 1, Flag: codec.FlagJSON, Body: []byte(`{"name":["block"],"args":[],"type":"async"}`)},
+			},
+			violation: ViolationReusedID,
+			req:       -1,
+		},
+		{
+			name: "data from the caller of a source",
+			pkts: []codec.Packet{
+				{Req: 1, Flag: codec.FlagJSON | codec.FlagStream, Body: []byte(`{"name":["block"],"args":[],"type":"source"}`)},
+				{Req: 1, Flag: codec.FlagJSON | codec.FlagStream, Body: []byte(`{}`)},
+			},
+			violation: ViolationWrongDirection,
+			req:       -1,
+		},
+		{
+			name: "data after end",
+			pkts: []codec.Packet{
+				{Req: 1, Flag: codec.FlagJSON | codec.FlagStream, Body: []byte(`{"name":["block"],"args":[],"type":"sink"}`)},
+				{Req: 1, Flag: codec.FlagJSON | codec.FlagStream | codec.FlagEndErr, Body: []byte("true")},
+				{Req: 1, Flag: codec.FlagJSON | codec.FlagStream, Body: []byte(`{}`)},
+			},
+			violation: ViolationDataAfterEnd,
+			req:       -1,
+		},
+		{
+			name: "duplicate end",
+			pkts: []codec.Packet{
+				{Req: 1, Flag: codec.FlagJSON | codec.FlagStream, Body: []byte(`{"name":["block"],"args":[],"type":"sink"}`)},
+				{Req: 1, Flag: codec.FlagJSON | codec.FlagStream | codec.FlagEndErr, Body: []byte("true")},
+				{Req: 1, Flag: codec.FlagJSON | codec.FlagStream | codec.FlagEndErr, Body: []byte("true")},
+			},
+			violation: ViolationDuplicateEnd,
+			req:       -1,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			r := require.New(t)
+
+			var srv FakeHandler
+			srv.HandledReturns(true)
+			srv.HandleCallCalls(func(ctx context.Context, req *Request) { <-ctx.Done() })
+
+			c1, c2 := loPipe(t)
+			edp := Handle(NewPacker(c1), &srv, WithoutManifest(), WithLogger(NopLogger()), WithStrictProtocol())
+			served := make(chan error, 1)
+			go func() { served <- edp.(Server).Serve() }()
+
+			remoteW := codec.NewWriter(c2)
+			for _, pkt := range tc.pkts {
+				r.NoError(remoteW.WritePacket(pkt))
+			}
+
+			select {
+			case err := <-served:
+				var perr ProtocolError
+				r.True(errors.As(err, &perr), "unexpected error: %v", err)
+				r.Equal(tc.violation, perr.Violation)
+				r.Equal(tc.req, perr.Req)
+			case <-time.After(5 * time.Second):
+				t.Fatal("session didn't end")
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// ProxyTo returns a Handler that forwards every call it gets to method on edp, using the same call type and arguments.
+// Data is passed along in both directions until one of the sides ends the stream.
+// Responses to async calls are forwarded as JSON.
+// The manifest call isn't forwarded, since the manifest of the far side doesn't list what the proxy handles.
+//
+// Each forwarded call gets a correlation id (see WithCorrelation) that shows up in the log lines
+// of both the incoming and the forwarded call, so failures on the far side can be traced back to the caller.
+func ProxyTo(edp Endpoint, method Method) Handler {
+	return proxyHandler{edp: edp, method: method}
+}
+
+type proxyHandler struct {
+	edp    Endpoint
+	method Method
+}
+
+func (proxyHandler) Handled(m Method) bool { return m.String() != "manifest" }
+
+func (proxyHandler) HandleConnect(context.Context, Endpoint) {}
+
+func (ph proxyHandler) HandleCall(ctx context.Context, req *Request) {
+	var rawArgs []json.RawMessage
+	if err := json.Unmarshal(req.RawArgs, &rawArgs); err != nil {
+		req.CloseWithError(fmt.Errorf("proxy: invalid arguments: %w", err))
+		return
+	}
+	args := make([]interface{}, len(rawArgs))
+	for i, a := range rawArgs {
+		args[i] = a
+	}
+
+	// keep the id if the call was already forwarded to us from within the process
+	id, ok := CorrelationFromContext(ctx)
+	if !ok {
+		id = newCorrelationID()
+		ctx = WithCorrelation(ctx, id)
+	}
+	req.correlation = id
+	dbg := LoggerWith(logDebug(LoggerFromContext(ctx)), "correlation", id, "upstreamReqID", req.id)
+	dbg.Log("event", "forwarding call", "to", ph.method.String())
+	fail := func(err error) {
+		if err != nil {
+			dbg.Log("event", "forwarded call failed", "err", err)
+		}
+		req.CloseWithError(err)
+	}
+
+	switch req.Type {
+	case "async", "sync":
+		var v json.RawMessage
+		err := ph.edp.Async(ctx, &v, TypeJSON, ph.method, args...)
+		if err != nil {
+			fail(err)
+			return
+		}
+		req.Return(ctx, v)
+
+	case "source":
+		snk, err := req.ResponseSink()
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		upstream, err := ph.edp.Source(ctx, TypeJSON, ph.method, args...)
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		if err := pumpFrames(ctx, snk, upstream); err != nil {
+			fail(err)
+			return
+		}
+		snk.Close()
+
+	case "sink":
+		src, err := req.ResponseSource()
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		upstream, err := ph.edp.Sink(ctx, TypeJSON, ph.method, args...)
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		err = pumpFrames(ctx, upstream, src)
+		upstream.CloseWithError(err)
+		fail(err)
+
+	case "duplex":
+		src, err := req.ResponseSource()
+		if err != nil {
+			fail(err)
+			return
+		}
+		snk, err := req.ResponseSink()
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		upSrc, upSnk, err := ph.edp.Duplex(ctx, TypeJSON, ph.method, args...)
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		// from the caller to the upstream
+		go func() {
+			err := pumpFrames(ctx, upSnk, src)
+			upSnk.CloseWithError(err)
+		}()
+
+		// and back
+		if err := pumpFrames(ctx, snk, upSrc); err != nil {
+			fail(err)
+			return
+		}
+		snk.Close()
+
+	default:
+		req.CloseWithError(ErrWrongStreamType{req.Type})
+	}
+}
@@ -0,0 +1,122 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// a -> b -> c, where b proxies everything to the Echo handler of c
+func setupProxy(t *testing.T) Endpoint {
+	bToC, _ := connectPair(t, &FakeHandler{}, Echo, nil, nil)
+	aToB, _ := connectPair(t, &FakeHandler{}, ProxyTo(bToC, Method{"echo"}), nil, nil)
+	return aToB
+}
+
+func TestProxyEcho(t *testing.T) {
+	a := setupProxy(t)
+	ctx := context.Background()
+
+	t.Run("async", func(t *testing.T) {
+		r := require.New(t)
+
+		var v map[string]int
+		err := a.Async(ctx, &v, TypeJSON, Method{"whatever"}, map[string]int{"a": 1})
+		r.NoError(err)
+		r.Equal(1, v["a"])
+	})
+
+	t.Run("source", func(t *testing.T) {
+		r := require.New(t)
+
+		src, err := a.Source(ctx, TypeJSON, Method{"whatever"}, 1, 2, 3)
+		r.NoError(err)
+
+		var got []int
+		for src.Next(ctx) {
+			b, err := src.Bytes()
+			r.NoError(err)
+			var i int
+			r.NoError(json.Unmarshal(b, &i))
+			got = append(got, i)
+		}
+		r.NoError(src.Err())
+		r.Equal([]int{1, 2, 3}, got)
+	})
+
+	t.Run("duplex", func(t *testing.T) {
+		r := require.New(t)
+
+		src, snk, err := a.Duplex(ctx, TypeString, Method{"whatever"})
+		r.NoError(err)
+
+		for _, msg := range []string{"hello", "world"} {
+			_, err = snk.Write([]byte(msg))
+			r.NoError(err)
+
+			r.True(src.Next(ctx))
+			b, err := src.Bytes()
+			r.NoError(err)
+			r.Equal(msg, string(b))
+			r.Equal(TypeString, src.Encoding())
+		}
+		r.NoError(snk.Close())
+	})
+
+	t.Run("mixed encodings", func(t *testing.T) {
+		r := require.New(t)
+
+		src, snk, err := a.Duplex(ctx, TypeString, Method{"whatever"})
+		r.NoError(err)
+
+		// all frames are sent before any is read, so that they are buffered together on the way
+		encs := []RequestEncoding{TypeJSON, TypeString, TypeString, TypeBinary, TypeJSON}
+		for i, enc := range encs {
+			snk.SetEncoding(enc)
+			_, err = fmt.Fprint(snk, i)
+			r.NoError(err)
+		}
+
+		for i, enc := range encs {
+			r.True(src.Next(ctx))
+			r.Equal(enc, src.Encoding(), "frame %d", i)
+			b, err := src.Bytes()
+			r.NoError(err)
+			r.Equal(fmt.Sprint(i), string(b))
+		}
+		r.NoError(snk.Close())
+	})
+}
+
+func TestProxyCorrelation(t *testing.T) {
+	r := require.New(t)
+
+	var logs lockedBuffer
+	bToC, _ := connectPair(t, &FakeHandler{}, &FakeHandler{}, []HandleOption{WithoutManifest()}, nil)
+	aToB, _ := connectPair(t, &FakeHandler{}, ProxyTo(bToC, Method{"nope"}), nil, []HandleOption{WithLogger(NewLogfmtLogger(&logs))})
+
+	var v string
+	err := aToB.Async(context.Background(), &v, TypeString, Method{"whatever"})
+	r.True(IsNoSuchMethod(err), "unexpected error: %v", err)
+
+	// the forwarded call is logged with the logger of the incoming one, both lines carry the same id
+	out := logs.String()
+	id := regexp.MustCompile(`correlation=([0-9a-f]+) upstreamReqID=(-[0-9]+) event="forwarding call"`).FindStringSubmatch(out)
+	r.Len(id, 3, "no correlation in:\n%s", out)
+	r.Regexp(`method=nope correlation=`+id[1]+` reqID=1 event="request sent"`, out)
+	r.Regexp(`correlation=`+id[1]+` upstreamReqID=`+id[2]+` event="forwarded call failed"`, out)
+
+	// set by the caller, it is kept
+	ctx := WithCorrelation(context.Background(), "caller")
+	got, ok := CorrelationFromContext(ctx)
+	r.True(ok)
+	r.Equal("caller", got)
+}
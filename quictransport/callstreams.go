@@ -0,0 +1,273 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package quictransport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ssbc/go-muxrpc/v2"
+)
+
+// CallStreams runs a session on a QUIC connection where every duplex call gets a stream of its own,
+// so that a big transfer, like that of a blob, doesn't hold up the packets of the other calls.
+//
+// The session itself runs on the first stream of the connection. A duplex call opens a new stream
+// and runs a muxrpc session with just that call on it, which ends together with the call.
+// Since each stream carries plain muxrpc, both ends need to use CallStreams, but nothing else changes on the wire.
+// QUIC hands out the streams of a connection in the order they were opened, so the first one is always the session.
+type CallStreams struct {
+	// Handler serves the incoming calls of the session and of the streams of duplex calls.
+	Handler muxrpc.Handler
+
+	// Options are used for the session and for the sessions of duplex calls, the latter don't ask for the manifest.
+	// Don't pass WithStatsHandler here, use StatsHandler instead.
+	Options []muxrpc.HandleOption
+
+	// StatsHandler sees the calls of the session and those of the duplex streams, each of which is a connection of its own to it.
+	StatsHandler muxrpc.StatsHandler
+}
+
+// Dial opens the first stream of qc and runs the session on it in the client role.
+// Closing the endpoint closes qc.
+func (cs CallStreams) Dial(ctx context.Context, qc Conn) (muxrpc.Endpoint, error) {
+	s, err := qc.OpenStreamSync(ctx)
+	if err != nil {
+		qc.CloseWithError(0, "")
+		return nil, fmt.Errorf("quictransport: failed to open stream: %w", err)
+	}
+	return cs.start(qc, s, false), nil
+}
+
+// Accept waits for the first stream of qc and runs the session on it in the server role.
+// Closing the endpoint closes qc.
+func (cs CallStreams) Accept(ctx context.Context, qc Conn) (muxrpc.Endpoint, error) {
+	s, err := qc.AcceptStream(ctx)
+	if err != nil {
+		qc.CloseWithError(0, "")
+		return nil, fmt.Errorf("quictransport: failed to accept stream: %w", err)
+	}
+	return cs.start(qc, s, true), nil
+}
+
+func (cs CallStreams) start(qc Conn, s Stream, isServer bool) muxrpc.Endpoint {
+	sess := &callSession{
+		cs:    cs,
+		qc:    qc,
+		calls: make(map[muxrpc.Endpoint]struct{}),
+		ended: make(map[muxrpc.Endpoint]struct{}),
+	}
+	sess.acceptCtx, sess.stopAccept = context.WithCancel(context.Background())
+
+	opts := append([]muxrpc.HandleOption{muxrpc.WithIsServer(isServer)}, cs.Options...)
+	opts = append(opts, muxrpc.WithStatsHandler(callStreamStats{next: cs.StatsHandler, sess: sess, main: true}))
+	sess.main = muxrpc.Handle(muxrpc.NewPacker(newConn(qc, s, true)), cs.Handler, opts...)
+
+	go sess.acceptCalls()
+	return &callStreamEndpoint{Endpoint: sess.main, sess: sess}
+}
+
+// callSession holds the session and the sessions of the duplex calls of a connection
+type callSession struct {
+	cs   CallStreams
+	qc   Conn
+	main muxrpc.Endpoint
+
+	acceptCtx  context.Context
+	stopAccept context.CancelFunc
+
+	// calls are the sessions of duplex calls that are still running.
+	// ended holds those that ended before they were tracked, which can happen for short calls.
+	mu     sync.Mutex
+	calls  map[muxrpc.Endpoint]struct{}
+	ended  map[muxrpc.Endpoint]struct{}
+	closed bool
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+var errSessionClosed = errors.New("quictransport: session closed")
+
+// callOptions returns the options for the session of a duplex call
+func (sess *callSession) callOptions(isServer bool) []muxrpc.HandleOption {
+	opts := append([]muxrpc.HandleOption{muxrpc.WithIsServer(isServer)}, sess.cs.Options...)
+	return append(opts,
+		muxrpc.WithoutManifest(),
+		muxrpc.WithStatsHandler(callStreamStats{next: sess.cs.StatsHandler, sess: sess}),
+	)
+}
+
+// openCall opens a stream and starts the session for an outgoing duplex call on it
+func (sess *callSession) openCall(ctx context.Context) (muxrpc.Endpoint, error) {
+	sess.mu.Lock()
+	closed := sess.closed
+	sess.mu.Unlock()
+	if closed {
+		return nil, errSessionClosed
+	}
+
+	s, err := sess.qc.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("quictransport: failed to open stream for call: %w", err)
+	}
+	edp := muxrpc.Handle(muxrpc.NewPacker(newConn(sess.qc, s, false)), sess.cs.Handler, sess.callOptions(false)...)
+	if !sess.track(edp) {
+		edp.Terminate()
+		return nil, errSessionClosed
+	}
+	return edp, nil
+}
+
+// acceptCalls starts sessions for the streams the remote opens for its duplex calls, until the connection is closed
+func (sess *callSession) acceptCalls() {
+	for {
+		s, err := sess.qc.AcceptStream(sess.acceptCtx)
+		if err != nil {
+			sess.close()
+			return
+		}
+		go func() {
+			edp := muxrpc.Handle(muxrpc.NewPacker(newConn(sess.qc, s, false)), sess.cs.Handler, sess.callOptions(true)...)
+			if !sess.track(edp) {
+				edp.Terminate()
+			}
+		}()
+	}
+}
+
+// track adds the session of a call, unless the connection was closed already
+func (sess *callSession) track(edp muxrpc.Endpoint) bool {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.closed {
+		return false
+	}
+	if _, ok := sess.ended[edp]; ok {
+		delete(sess.ended, edp)
+		return true
+	}
+	sess.calls[edp] = struct{}{}
+	return true
+}
+
+func (sess *callSession) untrack(edp muxrpc.Endpoint) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.closed {
+		return
+	}
+	if _, ok := sess.calls[edp]; ok {
+		delete(sess.calls, edp)
+	} else {
+		sess.ended[edp] = struct{}{}
+	}
+}
+
+// open returns the number of duplex calls that still have a session
+func (sess *callSession) open() int {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return len(sess.calls)
+}
+
+// close ends the sessions of all calls and the session itself, which closes the connection
+func (sess *callSession) close() error {
+	sess.closeOnce.Do(func() {
+		sess.stopAccept()
+
+		sess.mu.Lock()
+		sess.closed = true
+		calls := sess.calls
+		sess.calls = make(map[muxrpc.Endpoint]struct{})
+		sess.mu.Unlock()
+
+		for edp := range calls {
+			edp.Terminate()
+		}
+		sess.closeErr = sess.main.Terminate()
+	})
+	return sess.closeErr
+}
+
+// callStreamEndpoint makes duplex calls on streams of their own and the rest on the session
+type callStreamEndpoint struct {
+	muxrpc.Endpoint
+
+	sess *callSession
+
+	// callOpts are the options of the view, they are applied to duplex calls as well
+	callOpts []muxrpc.CallOption
+}
+
+func (e *callStreamEndpoint) Duplex(ctx context.Context, tipe muxrpc.RequestEncoding, method muxrpc.Method, args ...interface{}) (*muxrpc.ByteSource, *muxrpc.ByteSink, error) {
+	edp, err := e.sess.openCall(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	caller := edp
+	if len(e.callOpts) > 0 {
+		caller = edp.WithOptions(e.callOpts...)
+	}
+	src, snk, err := caller.Duplex(ctx, tipe, method, args...)
+	if err != nil {
+		edp.Terminate()
+		return nil, nil, err
+	}
+	return src, snk, nil
+}
+
+func (e *callStreamEndpoint) Terminate() error {
+	return e.sess.close()
+}
+
+func (e *callStreamEndpoint) WithOptions(opts ...muxrpc.CallOption) muxrpc.Endpoint {
+	return &callStreamEndpoint{
+		Endpoint: e.Endpoint.WithOptions(opts...),
+		sess:     e.sess,
+		callOpts: append(append([]muxrpc.CallOption(nil), e.callOpts...), opts...),
+	}
+}
+
+// callStreamStats passes the stats on and ends the session of a duplex call once the call ended.
+// Once the session of the connection ended, it closes the rest as well.
+type callStreamStats struct {
+	next muxrpc.StatsHandler
+	sess *callSession
+	main bool
+}
+
+type statsEndpointKey struct{}
+
+func (css callStreamStats) TagConn(ctx context.Context, edp muxrpc.Endpoint) context.Context {
+	if css.next != nil {
+		ctx = css.next.TagConn(ctx, edp)
+	}
+	return context.WithValue(ctx, statsEndpointKey{}, edp)
+}
+
+func (css callStreamStats) HandleStats(ctx context.Context, s muxrpc.Stats) {
+	if css.next != nil {
+		css.next.HandleStats(ctx, s)
+	}
+
+	edp, _ := ctx.Value(statsEndpointKey{}).(muxrpc.Endpoint)
+	switch s := s.(type) {
+	case muxrpc.CallEnd:
+		// other calls, like hello, can come before the duplex call
+		if !css.main && s.Type == "duplex" && edp != nil {
+			go edp.Terminate()
+		}
+	case muxrpc.ConnEnd:
+		if css.main {
+			go css.sess.close()
+		} else if edp != nil {
+			css.sess.untrack(edp)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+// Package quictransport carries muxrpc over QUIC streams.
+//
+// It doesn't depend on a QUIC implementation. Conn and Listener describe the few methods it needs,
+// a small adapter hands in the connections of quic-go or any other library:
+//
+//	type conn struct{ quic.Connection }
+//
+//	func (c conn) OpenStreamSync(ctx context.Context) (quictransport.Stream, error) {
+//		return c.Connection.OpenStreamSync(ctx)
+//	}
+//
+//	func (c conn) AcceptStream(ctx context.Context) (quictransport.Stream, error) {
+//		return c.Connection.AcceptStream(ctx)
+//	}
+//
+//	func (c conn) CloseWithError(code uint64, reason string) error {
+//		return c.Connection.CloseWithError(quic.ApplicationErrorCode(code), reason)
+//	}
+//
+// Transport runs every muxrpc session on the first stream of its own QUIC connection.
+// NewStreamTransport runs many sessions over one QUIC connection, one stream each,
+// so that a big transfer on one session doesn't hold up the packets of the others.
+// CallStreams does the same for the duplex calls of a single session.
+package quictransport
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/ssbc/go-muxrpc/v2"
+)
+
+// Stream is a bidirectional QUIC stream.
+type Stream interface {
+	io.ReadWriteCloser
+}
+
+// Conn is a QUIC connection.
+type Conn interface {
+	// OpenStreamSync opens a new bidirectional stream, waiting if the peer doesn't allow more streams yet.
+	OpenStreamSync(ctx context.Context) (Stream, error)
+
+	// AcceptStream waits for the next bidirectional stream opened by the peer.
+	AcceptStream(ctx context.Context) (Stream, error)
+
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+
+	// CloseWithError closes the connection and all its streams.
+	CloseWithError(code uint64, reason string) error
+}
+
+// Listener accepts QUIC connections.
+type Listener interface {
+	Accept(ctx context.Context) (Conn, error)
+}
+
+// Transport is a muxrpc.Transport where each session has a QUIC connection of its own and runs on its first stream.
+// Closing the muxrpc connection closes the QUIC connection.
+//
+// Some implementations, like quic-go, only tell the peer about a new stream once something is written on it.
+// The side that dials has to send the first packet then, otherwise Accept doesn't return.
+type Transport struct {
+	// DialQUIC is used by Dial to connect to addr.
+	DialQUIC func(ctx context.Context, addr string) (Conn, error)
+
+	// Listener is used by Accept, it can be nil if the transport is only used for dialing.
+	Listener Listener
+}
+
+var _ muxrpc.Transport = Transport{}
+
+// Dial connects to addr and opens the stream for the session.
+func (t Transport) Dial(ctx context.Context, addr string) (muxrpc.TransportConn, error) {
+	if t.DialQUIC == nil {
+		return nil, fmt.Errorf("quictransport: no DialQUIC function to dial %s", addr)
+	}
+	qc, err := t.DialQUIC(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	s, err := qc.OpenStreamSync(ctx)
+	if err != nil {
+		qc.CloseWithError(0, "")
+		return nil, fmt.Errorf("quictransport: failed to open stream: %w", err)
+	}
+	return newConn(qc, s, true), nil
+}
+
+// Accept waits for the next connection and its first stream.
+func (t Transport) Accept(ctx context.Context) (muxrpc.TransportConn, error) {
+	if t.Listener == nil {
+		return nil, fmt.Errorf("quictransport: no listener to accept connections")
+	}
+	qc, err := t.Listener.Accept(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s, err := qc.AcceptStream(ctx)
+	if err != nil {
+		qc.CloseWithError(0, "")
+		return nil, fmt.Errorf("quictransport: failed to accept stream: %w", err)
+	}
+	return newConn(qc, s, true), nil
+}
+
+// NewStreamTransport returns a muxrpc.Transport for sessions on the streams of qc.
+// Dial opens a new stream and ignores the address, Accept waits for the next stream opened by the peer.
+// Closing a muxrpc connection only closes its stream, the caller closes qc once all sessions are done.
+func NewStreamTransport(qc Conn) muxrpc.Transport {
+	return streamTransport{qc: qc}
+}
+
+type streamTransport struct {
+	qc Conn
+}
+
+func (st streamTransport) Dial(ctx context.Context, _ string) (muxrpc.TransportConn, error) {
+	s, err := st.qc.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("quictransport: failed to open stream: %w", err)
+	}
+	return newConn(st.qc, s, false), nil
+}
+
+func (st streamTransport) Accept(ctx context.Context) (muxrpc.TransportConn, error) {
+	s, err := st.qc.AcceptStream(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("quictransport: failed to accept stream: %w", err)
+	}
+	return newConn(st.qc, s, false), nil
+}
+
+func newConn(qc Conn, s Stream, ownsConn bool) muxrpc.TransportConn {
+	c := &conn{Stream: s, qc: qc, ownsConn: ownsConn}
+	return muxrpc.NewTransportConn(c, muxrpc.ConnInfo{
+		Remote: qc.RemoteAddr(),
+		Local:  qc.LocalAddr(),
+	})
+}
+
+// conn closes the stream and, if the session had the connection to itself, the QUIC connection
+type conn struct {
+	Stream
+
+	qc       Conn
+	ownsConn bool
+
+	once sync.Once
+	err  error
+}
+
+func (c *conn) Close() error {
+	c.once.Do(func() {
+		c.err = c.Stream.Close()
+		if c.ownsConn {
+			if err := c.qc.CloseWithError(0, ""); c.err == nil {
+				c.err = err
+			}
+		}
+	})
+	return c.err
+}
@@ -0,0 +1,224 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package quictransport
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ssbc/go-muxrpc/v2"
+)
+
+// fakeConn is one side of a QUIC connection, streams are pipes that show up at the peer right away
+type fakeConn struct {
+	peer     *fakeConn
+	incoming chan Stream
+
+	mu     sync.Mutex
+	closed bool
+	done   chan struct{}
+}
+
+func newFakeConns() (*fakeConn, *fakeConn) {
+	a := &fakeConn{incoming: make(chan Stream, 4), done: make(chan struct{})}
+	b := &fakeConn{incoming: make(chan Stream, 4), done: make(chan struct{})}
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+func (fc *fakeConn) OpenStreamSync(ctx context.Context) (Stream, error) {
+	local, remote := net.Pipe()
+	select {
+	case fc.peer.incoming <- remote:
+		return local, nil
+	case <-fc.done:
+		return nil, errors.New("connection closed")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (fc *fakeConn) AcceptStream(ctx context.Context) (Stream, error) {
+	select {
+	case s := <-fc.incoming:
+		return s, nil
+	case <-fc.done:
+		return nil, errors.New("connection closed")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (fc *fakeConn) LocalAddr() net.Addr  { return &net.UDPAddr{Port: 1} }
+func (fc *fakeConn) RemoteAddr() net.Addr { return &net.UDPAddr{Port: 2} }
+
+func (fc *fakeConn) CloseWithError(uint64, string) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if !fc.closed {
+		fc.closed = true
+		close(fc.done)
+	}
+	return nil
+}
+
+func (fc *fakeConn) isClosed() bool {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.closed
+}
+
+type fakeListener chan Conn
+
+func (fl fakeListener) Accept(ctx context.Context) (Conn, error) {
+	select {
+	case c := <-fl:
+		return c, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+var testOpts = []muxrpc.HandleOption{muxrpc.WithLogger(muxrpc.NopLogger()), muxrpc.WithoutManifest()}
+
+func TestTransport(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+
+	clientConn, serverConn := newFakeConns()
+	lis := make(fakeListener, 1)
+	lis <- serverConn
+
+	dialer := Transport{DialQUIC: func(ctx context.Context, addr string) (Conn, error) {
+		r.Equal("example.com:8008", addr)
+		return clientConn, nil
+	}}
+	client, err := muxrpc.DialEndpoint(ctx, dialer, "example.com:8008", muxrpc.Echo, testOpts...)
+	r.NoError(err)
+	server, err := muxrpc.AcceptEndpoint(ctx, Transport{Listener: lis}, muxrpc.Echo, testOpts...)
+	r.NoError(err)
+	defer server.Terminate()
+
+	info, ok := muxrpc.RemoteInfo(server)
+	r.True(ok)
+	r.Equal(&net.UDPAddr{Port: 2}, info.Remote)
+
+	var v map[string]string
+	r.NoError(client.Async(ctx, &v, muxrpc.TypeJSON, muxrpc.Method{"echo"}, map[string]string{"msg": "hello"}))
+	r.Equal("hello", v["msg"])
+
+	r.NoError(client.Terminate())
+	r.True(clientConn.isClosed(), "the session owns the connection")
+}
+
+func TestStreamTransport(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+
+	clientConn, serverConn := newFakeConns()
+	dialer, acceptor := NewStreamTransport(clientConn), NewStreamTransport(serverConn)
+
+	// two sessions over the same connection
+	var clients, servers []muxrpc.Endpoint
+	for i := 0; i < 2; i++ {
+		client, err := muxrpc.DialEndpoint(ctx, dialer, "", muxrpc.Echo, testOpts...)
+		r.NoError(err)
+		clients = append(clients, client)
+		server, err := muxrpc.AcceptEndpoint(ctx, acceptor, muxrpc.Echo, testOpts...)
+		r.NoError(err)
+		servers = append(servers, server)
+	}
+	defer func() {
+		for _, s := range servers {
+			s.Terminate()
+		}
+	}()
+
+	for i, client := range clients {
+		var v map[string]string
+		r.NoError(client.Async(ctx, &v, muxrpc.TypeJSON, muxrpc.Method{"echo"}, map[string]string{"msg": "hello"}), "session %d", i)
+		r.Equal("hello", v["msg"])
+	}
+
+	r.NoError(clients[0].Terminate())
+	r.False(clientConn.isClosed(), "closing a session only closes its stream")
+
+	var v map[string]string
+	r.NoError(clients[1].Async(ctx, &v, muxrpc.TypeJSON, muxrpc.Method{"echo"}, map[string]string{"msg": "still there"}))
+	r.Equal("still there", v["msg"])
+	r.NoError(clients[1].Terminate())
+}
+
+func TestCallStreams(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+
+	clientConn, serverConn := newFakeConns()
+	cs := CallStreams{Handler: muxrpc.Echo, Options: testOpts}
+
+	accepted := make(chan muxrpc.Endpoint, 1)
+	go func() {
+		edp, err := cs.Accept(ctx, serverConn)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		accepted <- edp
+	}()
+	client, err := cs.Dial(ctx, clientConn)
+	r.NoError(err)
+	server := <-accepted
+	defer server.Terminate()
+	sess := client.(*callStreamEndpoint).sess
+
+	// async calls stay on the session
+	var v map[string]string
+	r.NoError(client.Async(ctx, &v, muxrpc.TypeJSON, muxrpc.Method{"echo"}, map[string]string{"msg": "hello"}))
+	r.Equal("hello", v["msg"])
+	r.Equal(0, sess.open())
+
+	// two duplex calls at once, each on a stream of its own
+	type call struct {
+		src *muxrpc.ByteSource
+		snk *muxrpc.ByteSink
+	}
+	var calls []call
+	for i := 0; i < 2; i++ {
+		src, snk, err := client.WithOptions(muxrpc.CallPriority(muxrpc.PriorityLow)).Duplex(ctx, muxrpc.TypeBinary, muxrpc.Method{"echo"})
+		r.NoError(err)
+		calls = append(calls, call{src, snk})
+	}
+	r.Equal(2, sess.open())
+
+	for i, c := range calls {
+		_, err := c.snk.Write([]byte{byte(i)})
+		r.NoError(err)
+		r.True(c.src.Next(ctx))
+		b, err := c.src.Bytes()
+		r.NoError(err)
+		r.Equal([]byte{byte(i)}, b)
+	}
+
+	// the sessions of the calls end with them, the connection stays
+	for _, c := range calls {
+		r.NoError(c.snk.Close())
+		r.False(c.src.Next(ctx))
+	}
+	srvSess := server.(*callStreamEndpoint).sess
+	r.Eventually(func() bool { return sess.open() == 0 && srvSess.open() == 0 }, time.Second, 10*time.Millisecond)
+	r.False(clientConn.isClosed())
+
+	r.NoError(client.Terminate())
+	r.True(clientConn.isClosed())
+
+	// the server notices that the connection is gone
+	r.Eventually(serverConn.isClosed, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,111 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"time"
+
+	"github.com/ssbc/go-muxrpc/v2/codec"
+)
+
+// RateLimit configures a token bucket for incoming packets. Zero rates mean no limit.
+type RateLimit struct {
+	// Packets is how many packets per second may arrive, Bytes how many bytes (headers included).
+	Packets, Bytes float64
+
+	// PacketBurst and ByteBurst are how many packets and bytes may arrive at once after a quiet period.
+	// Zero means one second worth of the rate.
+	PacketBurst, ByteBurst float64
+}
+
+// WithRateLimit limits the incoming packets of the connection. Once the peer sends faster than that,
+// the endpoint stops reading until the bucket filled up again, which slows the peer down through the transport
+// and keeps it from starving other connections of the process.
+func WithRateLimit(l RateLimit) HandleOption {
+	return func(r *rpc) {
+		r.connRate = l
+	}
+}
+
+// WithStreamRateLimit limits the incoming packets of every stream separately, in addition to WithRateLimit.
+// Since muxrpc has no flow control of it's own, throttling one stream stalls the other streams of the connection as well.
+func WithStreamRateLimit(l RateLimit) HandleOption {
+	return func(r *rpc) {
+		r.streamRate = l
+	}
+}
+
+func (l RateLimit) enabled() bool { return l.Packets > 0 || l.Bytes > 0 }
+
+// rateLimiter holds the buckets of a RateLimit
+type rateLimiter struct {
+	packets, bytes tokenBucket
+}
+
+func newRateLimiter(l RateLimit, now time.Time) *rateLimiter {
+	return &rateLimiter{
+		packets: newTokenBucket(l.Packets, l.PacketBurst, now),
+		bytes:   newTokenBucket(l.Bytes, l.ByteBurst, now),
+	}
+}
+
+// wait takes the tokens for a packet with a body of n bytes and waits until the buckets cover them.
+// It returns the error of ctx if it is done before that.
+func (rl *rateLimiter) wait(ctx context.Context, clock Clock, n uint32) error {
+	now := clock.Now()
+	d := rl.packets.take(now, 1)
+	if bd := rl.bytes.take(now, float64(codec.HeaderLength+uint64(n))); bd > d {
+		d = bd
+	}
+	if d <= 0 {
+		return nil
+	}
+
+	t := clock.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// tokenBucket goes into debt for packets larger than what it holds, the debt is paid off by waiting
+type tokenBucket struct {
+	rate, burst float64
+
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) tokenBucket {
+	if burst <= 0 {
+		burst = rate
+	}
+	return tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+// take removes n tokens and returns how long it takes until the bucket is out of debt again
+func (tb *tokenBucket) take(now time.Time, n float64) time.Duration {
+	if tb.rate <= 0 {
+		return 0
+	}
+
+	if elapsed := now.Sub(tb.last); elapsed > 0 {
+		tb.tokens += elapsed.Seconds() * tb.rate
+		if tb.tokens > tb.burst {
+			tb.tokens = tb.burst
+		}
+		tb.last = now
+	}
+
+	tb.tokens -= n
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
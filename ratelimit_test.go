@@ -0,0 +1,74 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBucket(t *testing.T) {
+	r := require.New(t)
+
+	start := time.Now()
+	tb := newTokenBucket(10, 2, start)
+
+	// the burst goes through right away
+	r.Zero(tb.take(start, 1))
+	r.Zero(tb.take(start, 1))
+
+	// then it's one token every 100ms
+	r.Equal(100*time.Millisecond, tb.take(start, 1))
+	r.Equal(150*time.Millisecond, tb.take(start.Add(50*time.Millisecond), 1))
+
+	// large packets go into debt
+	r.Equal(800*time.Millisecond, tb.take(start.Add(200*time.Millisecond), 8))
+
+	// a long pause only fills up the burst
+	r.Zero(tb.take(start.Add(time.Hour), 2))
+	r.Equal(100*time.Millisecond, tb.take(start.Add(time.Hour), 1))
+
+	unlimited := newTokenBucket(0, 0, start)
+	r.Zero(unlimited.take(start, 1e9))
+}
+
+func TestStreamRateLimit(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+
+	opts := []HandleOption{WithoutManifest(), WithLogger(NopLogger())}
+	client, _ := NewPipe(&FakeHandler{}, Echo, WithPipeHandleOptions(
+		append(opts,
+			WithRateLimit(RateLimit{Bytes: 1 << 20}),
+			WithStreamRateLimit(RateLimit{Packets: 20, PacketBurst: 1}),
+		),
+		opts,
+	))
+	defer client.Terminate()
+
+	start := time.Now()
+	src, err := client.Source(ctx, TypeJSON, Method{"echo"}, 1, 2, 3, 4, 5)
+	r.NoError(err)
+	var n int
+	for src.Next(ctx) {
+		_, err := src.Bytes()
+		r.NoError(err)
+		n++
+	}
+	r.NoError(src.Err())
+	r.Equal(5, n)
+
+	// the first frame is the burst, the other four come every 50ms
+	r.True(time.Since(start) >= 190*time.Millisecond, "took %s", time.Since(start))
+
+	// every stream has its own bucket
+	start = time.Now()
+	var v int
+	r.NoError(client.Async(ctx, &v, TypeJSON, Method{"echo"}, 1))
+	r.True(time.Since(start) < 50*time.Millisecond, "took %s", time.Since(start))
+}
@@ -0,0 +1,310 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ConnState is the state of the connection of a Client.
+type ConnState int
+
+// The states a Client goes through. It starts in StateConnecting and goes back and forth until Close moves it to StateClosed.
+const (
+	StateConnecting ConnState = iota
+	StateConnected
+	StateDisconnected
+	StateClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("ConnState(%d)", int(s))
+}
+
+// ConnStateChange tells the application about a new state of a Client.
+type ConnStateChange struct {
+	State ConnState
+
+	// Err is why dialing failed or the connection ended, for StateDisconnected. It is nil if the peer hung up.
+	Err error
+
+	// Endpoint is the new session, for StateConnected
+	Endpoint Endpoint
+
+	// Retry is how long the client waits before it dials again, for StateDisconnected
+	Retry time.Duration
+}
+
+// ClientOption configures a Client.
+type ClientOption func(*Client)
+
+// WithClientHandleOptions sets the options that every session of the client is started with.
+func WithClientHandleOptions(opts ...HandleOption) ClientOption {
+	return func(c *Client) {
+		c.handleOpts = append(c.handleOpts, opts...)
+	}
+}
+
+// WithReconnectBackoff sets how long the client waits before it dials again.
+// The wait starts at min and doubles with every failed attempt, up to max. The defaults are 100ms and 30s.
+func WithReconnectBackoff(min, max time.Duration) ClientOption {
+	return func(c *Client) {
+		c.minBackoff, c.maxBackoff = min, max
+	}
+}
+
+// WithClientClock sets the clock of the reconnect backoff. The default is RealClock.
+// Use WithClientHandleOptions and WithClock for the sessions.
+func WithClientClock(clock Clock) ClientOption {
+	return func(c *Client) {
+		c.clock = clock
+	}
+}
+
+// WithStateHandler sets a function that is called with every state change, in order.
+// It is called from the goroutine that maintains the connection, so it must not block.
+func WithStateHandler(fn func(ConnStateChange)) ClientOption {
+	return func(c *Client) {
+		c.onState = fn
+	}
+}
+
+// ErrClientClosed is returned by Client methods after Close was called.
+var ErrClientClosed = errors.New("muxrpc: client closed")
+
+// Client keeps a session with the peer at an address. It dials again whenever the connection ends,
+// until it is closed, and makes the subscribed source calls again on every new session.
+type Client struct {
+	tr      Transport
+	addr    string
+	handler Handler
+
+	handleOpts             []HandleOption
+	minBackoff, maxBackoff time.Duration
+	onState                func(ConnStateChange)
+	clock                  Clock
+	retry                  RetryPolicy
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	subsWg sync.WaitGroup
+
+	mu  sync.Mutex
+	edp Endpoint
+	// changed is closed and replaced whenever edp changes
+	changed chan struct{}
+	subs    map[*subscription]struct{}
+}
+
+// NewClient starts to connect to addr using the transport. The sessions use handler for the calls the peer makes.
+// The client stops when ctx is canceled or Close is called.
+func NewClient(ctx context.Context, tr Transport, addr string, handler Handler, opts ...ClientOption) *Client {
+	c := &Client{
+		tr:      tr,
+		addr:    addr,
+		handler: handler,
+
+		minBackoff: 100 * time.Millisecond,
+		maxBackoff: 30 * time.Second,
+		clock:      RealClock(),
+
+		done:    make(chan struct{}),
+		changed: make(chan struct{}),
+		subs:    make(map[*subscription]struct{}),
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	c.ctx, c.cancel = context.WithCancel(ctx)
+
+	go c.run()
+	return c
+}
+
+func (c *Client) notify(change ConnStateChange) {
+	if c.onState != nil {
+		c.onState(change)
+	}
+}
+
+func (c *Client) run() {
+	defer close(c.done)
+
+	backoff := c.minBackoff
+	for {
+		c.notify(ConnStateChange{State: StateConnecting})
+
+		edp, err := DialEndpoint(c.ctx, c.tr, c.addr, c.handler, c.handleOpts...)
+		if err == nil {
+			backoff = c.minBackoff
+			c.setEndpoint(edp)
+			c.notify(ConnStateChange{State: StateConnected, Endpoint: edp})
+
+			err = edp.(Server).Serve()
+			c.setEndpoint(nil)
+		}
+
+		if c.ctx.Err() != nil {
+			c.subsWg.Wait()
+			c.notify(ConnStateChange{State: StateClosed})
+			return
+		}
+
+		c.notify(ConnStateChange{State: StateDisconnected, Err: err, Retry: backoff})
+		wait := c.clock.NewTimer(backoff)
+		select {
+		case <-wait.C():
+		case <-c.ctx.Done():
+			wait.Stop()
+		}
+		if backoff *= 2; backoff > c.maxBackoff {
+			backoff = c.maxBackoff
+		}
+	}
+}
+
+// setEndpoint switches to a new session and starts the subscriptions on it
+func (c *Client) setEndpoint(edp Endpoint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.edp = edp
+	close(c.changed)
+	c.changed = make(chan struct{})
+
+	if edp == nil {
+		return
+	}
+	for sub := range c.subs {
+		c.startSubscription(edp, sub)
+	}
+}
+
+// Endpoint returns the current session. If there is none it waits for the next one until ctx is done.
+// The session can end at any time, calls that fail because of that should get a new one.
+func (c *Client) Endpoint(ctx context.Context) (Endpoint, error) {
+	for {
+		c.mu.Lock()
+		edp, changed := c.edp, c.changed
+		c.mu.Unlock()
+		if edp != nil {
+			return edp, nil
+		}
+
+		select {
+		case <-changed:
+		case <-c.done:
+			return nil, ErrClientClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Close stops the client, ends the current session and waits for the subscriptions to return.
+func (c *Client) Close() error {
+	c.cancel()
+	c.mu.Lock()
+	edp := c.edp
+	c.mu.Unlock()
+	if edp != nil {
+		edp.Terminate()
+	}
+	<-c.done
+	return nil
+}
+
+// SourceSubscription is a source call that a Client makes on every session until the subscription is canceled.
+type SourceSubscription struct {
+	Method   Method
+	Encoding RequestEncoding
+
+	// Args returns the arguments of the next call, so that a subscription can continue where the last session stopped.
+	// It can be nil for calls without arguments.
+	Args func() []interface{}
+
+	// Handle is called with the body of every item. If it returns an error the subscription is canceled.
+	Handle func(body []byte) error
+}
+
+type subscription struct {
+	SourceSubscription
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Subscribe makes the source call now, if the client is connected, and again on every new session.
+// A call that fails or ends is only made again on the next session. The returned function cancels the subscription.
+func (c *Client) Subscribe(ss SourceSubscription) (cancel func()) {
+	sub := &subscription{SourceSubscription: ss}
+	sub.ctx, sub.cancel = context.WithCancel(c.ctx)
+
+	c.mu.Lock()
+	c.subs[sub] = struct{}{}
+	if c.edp != nil {
+		c.startSubscription(c.edp, sub)
+	}
+	c.mu.Unlock()
+
+	return func() {
+		c.mu.Lock()
+		delete(c.subs, sub)
+		c.mu.Unlock()
+		sub.cancel()
+	}
+}
+
+// startSubscription has to be called with c.mu held
+func (c *Client) startSubscription(edp Endpoint, sub *subscription) {
+	c.subsWg.Add(1)
+	go func() {
+		defer c.subsWg.Done()
+		if err := c.runSubscription(edp, sub); err != nil {
+			c.mu.Lock()
+			delete(c.subs, sub)
+			c.mu.Unlock()
+			sub.cancel()
+		}
+	}()
+}
+
+// runSubscription returns the error of the Handle function of the subscription
+func (c *Client) runSubscription(edp Endpoint, sub *subscription) error {
+	var args []interface{}
+	if sub.Args != nil {
+		args = sub.Args()
+	}
+	src, err := edp.Source(sub.ctx, sub.Encoding, sub.Method, args...)
+	if err != nil {
+		return nil
+	}
+	defer src.Cancel(nil)
+
+	for src.Next(sub.ctx) {
+		body, err := src.Bytes()
+		if err != nil {
+			return nil
+		}
+		if err := sub.Handle(body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
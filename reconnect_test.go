@@ -0,0 +1,191 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientReconnect(t *testing.T) {
+	r := require.New(t)
+
+	lis, err := net.Listen("tcp4", "127.0.0.1:0")
+	r.NoError(err)
+
+	// the server counts up from the number that is passed, three items per session
+	var (
+		mu       sync.Mutex
+		sessions []Endpoint
+	)
+	var srvh FakeHandler
+	srvh.HandledCalls(methodChecker("count"))
+	srvh.HandleConnectCalls(func(_ context.Context, edp Endpoint) {
+		mu.Lock()
+		sessions = append(sessions, edp)
+		mu.Unlock()
+	})
+	srvh.HandleCallCalls(func(ctx context.Context, req *Request) {
+		var args []map[string]int
+		json.Unmarshal(req.RawArgs, &args)
+		snk, _ := req.ResponseSink()
+		for i := 0; i < 3; i++ {
+			snk.Write([]byte(strconv.Itoa(args[0]["from"] + i)))
+		}
+		// live, until the session ends
+		<-ctx.Done()
+	})
+
+	srvCtx, stopServer := context.WithCancel(context.Background())
+	defer stopServer()
+	go Serve(srvCtx, lis, func(net.Conn) (Handler, error) { return &srvh, nil },
+		WithServeLogger(NopLogger()),
+		WithHandleOptions(WithLogger(NopLogger())),
+	)
+
+	states := make(chan ConnStateChange, 100)
+	c := NewClient(context.Background(), NetTransport{Network: "tcp4"}, lis.Addr().String(), &FakeHandler{},
+		WithReconnectBackoff(10*time.Millisecond, 50*time.Millisecond),
+		WithStateHandler(func(csc ConnStateChange) { states <- csc }),
+		WithClientHandleOptions(WithLogger(NopLogger())),
+	)
+
+	expectState := func(want ConnState) ConnStateChange {
+		for {
+			select {
+			case csc := <-states:
+				if csc.State == want {
+					return csc
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("no %s state", want)
+			}
+		}
+	}
+	expectState(StateConnected)
+
+	items := make(chan int, 10)
+	var next int
+	c.Subscribe(SourceSubscription{
+		Method:   Method{"count"},
+		Encoding: TypeJSON,
+		Args: func() []interface{} {
+			return []interface{}{map[string]int{"from": next}}
+		},
+		Handle: func(body []byte) error {
+			n, err := strconv.Atoi(string(body))
+			if err != nil {
+				return err
+			}
+			next = n + 1
+			items <- n
+			return nil
+		},
+	})
+
+	for i := 0; i < 3; i++ {
+		r.Equal(i, <-items)
+	}
+
+	// the server drops the session, the client comes back and continues where it stopped
+	mu.Lock()
+	sessions[0].Terminate()
+	mu.Unlock()
+	expectState(StateDisconnected)
+	expectState(StateConnected)
+	for i := 3; i < 6; i++ {
+		r.Equal(i, <-items)
+	}
+
+	edp, err := c.Endpoint(context.Background())
+	r.NoError(err)
+	r.NotNil(edp)
+
+	r.NoError(c.Close())
+	expectState(StateClosed)
+	_, err = c.Endpoint(context.Background())
+	r.ErrorIs(err, ErrClientClosed)
+}
+
+func TestClientRetry(t *testing.T) {
+	r := require.New(t)
+
+	lis, err := net.Listen("tcp4", "127.0.0.1:0")
+	r.NoError(err)
+
+	// each method fails the first two times it is called, in its own way
+	var (
+		mu    sync.Mutex
+		calls = make(map[string]int)
+	)
+	var srvh FakeHandler
+	srvh.HandledReturns(true)
+	srvh.HandleCallCalls(func(ctx context.Context, req *Request) {
+		m := req.Method.String()
+		mu.Lock()
+		calls[m]++
+		n := calls[m]
+		mu.Unlock()
+		if n > 2 {
+			req.Return(ctx, "ok")
+			return
+		}
+
+		switch m {
+		case "busy", "busy2":
+			req.CloseWithError(ErrTooManyCalls)
+		case "drop":
+			edp, _ := EndpointFromContext(ctx)
+			edp.Terminate()
+		default:
+			req.CloseWithError(fmt.Errorf("broken"))
+		}
+	})
+
+	srvCtx, stopServer := context.WithCancel(context.Background())
+	defer stopServer()
+	go Serve(srvCtx, lis, func(net.Conn) (Handler, error) { return &srvh, nil },
+		WithServeLogger(NopLogger()),
+		WithHandleOptions(WithoutManifest(), WithLogger(NopLogger())),
+	)
+
+	c := NewClient(context.Background(), NetTransport{Network: "tcp4"}, lis.Addr().String(), &FakeHandler{},
+		WithReconnectBackoff(time.Millisecond, 10*time.Millisecond),
+		WithClientRetry(RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}),
+		WithClientHandleOptions(WithoutManifest(), WithLogger(NopLogger())),
+	)
+	defer c.Close()
+
+	ctx := context.Background()
+	var s string
+	r.NoError(c.Async(ctx, &s, TypeString, Method{"busy"}))
+	r.Equal("ok", s)
+
+	// also on the next session
+	s = ""
+	r.NoError(c.Async(ctx, &s, TypeString, Method{"drop"}))
+	r.Equal("ok", s)
+
+	// errors of the handler are not transient
+	err = c.Async(ctx, &s, TypeString, Method{"broken"})
+	r.Error(err)
+	r.False(IsTransient(err))
+
+	// the policy of a call takes precedence
+	err = c.Async(WithRetry(ctx, RetryPolicy{MaxAttempts: 1}), &s, TypeString, Method{"busy2"})
+	r.ErrorIs(err, ErrTooManyCalls)
+
+	mu.Lock()
+	defer mu.Unlock()
+	r.Equal(map[string]int{"busy": 3, "drop": 3, "broken": 1, "busy2": 1}, calls)
+}
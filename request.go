@@ -11,7 +11,6 @@ import (
 	"fmt"
 	"io"
 	"net"
-	"runtime/debug"
 	"strings"
 
 	"github.com/ssbc/go-luigi"
@@ -21,7 +20,7 @@ import (
 // RequestEncoding hides the specifics of codec.Flag
 type RequestEncoding uint
 
-// binary, string and JSON are the three supported format types.
+// binary, string and JSON are the three format types of the wire. More can be added with RegisterBodyCodec.
 // Don't ask me why we have string and binary, this just copies the javascript secifics.
 const (
 	TypeBinary RequestEncoding = iota
@@ -31,29 +30,16 @@ const (
 
 // IsValid returns false if the type is not known.
 func (rt RequestEncoding) IsValid() bool {
-	if rt < 0 {
-		return false
-	}
-	if rt > TypeJSON {
-		return false
-	}
-	return true
+	_, has := LookupBodyCodec(rt)
+	return has
 }
 
 func (rt RequestEncoding) asCodecFlag() (codec.Flag, error) {
-	if !rt.IsValid() {
-		return 0, fmt.Errorf("muxrpc: invalid request encoding %d", rt)
-	}
-	switch rt {
-	case TypeBinary:
-		return 0, nil
-	case TypeString:
-		return codec.FlagString, nil
-	case TypeJSON:
-		return codec.FlagJSON, nil
-	default:
+	c, has := LookupBodyCodec(rt)
+	if !has {
 		return 0, fmt.Errorf("muxrpc: invalid request encoding %d", rt)
 	}
+	return c.Flag(), nil
 }
 
 // Method defines the name of the endpoint.
@@ -95,6 +81,12 @@ type Request struct {
 	// Type is the type of the call, i.e. async, sink, source or duplex
 	Type CallType `json:"type"`
 
+	// Meta is what the caller sent along with the call, see Metadata
+	Meta Metadata `json:"meta,omitempty"`
+
+	// args are the parsed RawArgs, see WithArgParser
+	args interface{}
+
 	// luigi-less iterators
 	sink   *ByteSink
 	source *ByteSource
@@ -102,12 +94,28 @@ type Request struct {
 	// same as packet.Req - the numerical identifier for the stream
 	id int32
 
+	// keepalive is set on the pings of the keepalive and incoming gossip.ping calls, which don't count as using the session (see WithIdleTimeout)
+	keepalive bool
+
+	// links forwarded calls to the call that caused them, see WithCorrelation
+	correlation string
+
+	// stats is what the StatsHandler of the endpoint was told about the call, nil until it began
+	stats *callStats
+	trace CallTrace
+
+	// responseTimer closes the call if nothing arrived for it in time (see WithResponseTimeout), it is stopped once the call ended
+	responseTimer Timer
+
 	// used to stop producing more data on this request
 	// the calling sight might tell us they had enough of this stream
 	abort context.CancelFunc
 
 	remoteAddr net.Addr
 	endpoint   *rpc
+
+	// rate holds the buckets of the stream rate limit, only used by the serve loop
+	rate *rateLimiter
 }
 
 // Endpoint returns the client instance to start new calls. Mostly usefull inside handlers.
@@ -134,8 +142,9 @@ func (req *Request) ResponseSource() (*ByteSource, error) {
 
 // Args is a legacy stub to get the unmarshaled json arguments
 func (req *Request) Args() []interface{} {
-	fmt.Println("[muxrpc/deprecation] warning: please use RawArgs where ever possible")
-	debug.PrintStack()
+	if req.endpoint != nil {
+		logWarn(req.endpoint.logger).Log("event", "deprecated", "func", "Request.Args", "use", "RawArgs")
+	}
 	var v []interface{}
 	json.Unmarshal(req.RawArgs, &v)
 	return v
@@ -143,32 +152,36 @@ func (req *Request) Args() []interface{} {
 
 // Return is a helper that returns on an async call
 func (req *Request) Return(ctx context.Context, v interface{}) error {
+	if _, ok := v.(string); ok {
+		return req.ReturnEncoded(ctx, TypeString, v)
+	}
+	return req.ReturnEncoded(ctx, TypeJSON, v)
+}
+
+// ReturnEncoded is like Return but uses the BodyCodec that is registered for re to encode v.
+func (req *Request) ReturnEncoded(ctx context.Context, re RequestEncoding, v interface{}) error {
 	if req.Type != "async" && req.Type != "sync" {
 		return fmt.Errorf("cannot return value on %q stream", req.Type)
 	}
 
-	var b []byte
-	switch tv := v.(type) {
-
-	case string:
-		req.sink.SetEncoding(TypeString)
-
-		b = []byte(tv)
-
-	default:
-		req.sink.SetEncoding(TypeJSON)
+	bodyCodec, ok := LookupBodyCodec(re)
+	if !ok {
+		return fmt.Errorf("muxrpc: invalid request encoding %d", re)
+	}
 
-		var err error
-		b, err = json.Marshal(v)
-		if err != nil {
-			return fmt.Errorf("muxrpc: error marshaling return value: %w", err)
-		}
+	b, err := bodyCodec.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("muxrpc: error marshaling return value: %w", err)
 	}
 
+	req.sink.SetEncoding(re)
 	if _, err := req.sink.Write(b); err != nil {
 		return fmt.Errorf("muxrpc: error writing return value: %w", err)
 	}
 
+	if req.endpoint != nil {
+		req.endpoint.endCall(req, nil)
+	}
 	return nil
 }
 
@@ -177,13 +190,15 @@ func (req *Request) Return(ctx context.Context, v interface{}) error {
 func (req *Request) CloseWithError(cerr error) error {
 	if cerr == nil || errors.Is(cerr, io.EOF) || errors.Is(cerr, luigi.EOS{}) {
 		req.source.Cancel(nil)
-		req.sink.Close()
+		req.sink.end(io.EOF, false)
 	} else {
 		req.source.Cancel(cerr)
-		req.sink.CloseWithError(cerr)
+		req.sink.end(cerr, false)
 	}
 	// this is a bit ugly but CloseWithError() is the function that HandlerMux uses when replying with "no such command"
-	req.endpoint.closeStream(req, cerr)
+	if req.endpoint != nil {
+		req.endpoint.closeStream(req, cerr)
+	}
 	return nil
 }
 
@@ -0,0 +1,131 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// RetryPolicy says if and when a Client makes a failed async call again, see Client.Async.
+// Only calls that failed before anything of the answer arrived are made again, so that no answer is handled twice.
+type RetryPolicy struct {
+	// MaxAttempts is how often a call is made at most, including the first time. One or less means it isn't retried.
+	MaxAttempts int
+
+	// The wait before the next attempt starts at MinBackoff and doubles with every attempt, up to MaxBackoff.
+	MinBackoff, MaxBackoff time.Duration
+
+	// Retryable says if a call that failed with err should be made again. If it is nil, IsTransient is used.
+	Retryable func(err error) bool
+}
+
+// IsTransient returns true for errors that might go away if the call is made again:
+// the end of the session (ErrSessionTerminated), also if the remote ended it or is shutting down,
+// a remote that didn't answer in time (ErrNoResponse) and one that was busy (ErrTooManyCalls).
+func IsTransient(err error) bool {
+	if errors.Is(err, ErrSessionTerminated) ||
+		errors.Is(err, ErrNoResponse) ||
+		errors.Is(err, ErrTooManyCalls) {
+		return true
+	}
+
+	var ce *CallError
+	if errors.As(err, &ce) {
+		// the remote ends its open calls like this when its session ends
+		return ce.Code == CodeShuttingDown || ce.Message == ErrSessionTerminated.Error()
+	}
+	return false
+}
+
+func (p RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return IsTransient(err)
+}
+
+// backoff returns how long to wait after the attempt-th attempt failed, counting from one
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.MinBackoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+type retryCtxKeyType struct{}
+
+var retryCtxKey retryCtxKeyType
+
+// WithRetry returns a context that makes Client.Async use p for the calls started with it, instead of the policy of the client.
+func WithRetry(ctx context.Context, p RetryPolicy) context.Context {
+	return context.WithValue(ctx, retryCtxKey, p)
+}
+
+// WithClientRetry sets the RetryPolicy of the async calls of the client. By default calls aren't retried.
+func WithClientRetry(p RetryPolicy) ClientOption {
+	return func(c *Client) {
+		c.retry = p
+	}
+}
+
+// Async makes an async call on the current session, waiting for one if the client isn't connected.
+// A call that failed before anything of the answer arrived is made again according to the RetryPolicy of ctx (see WithRetry) or of the client,
+// also on the next session if the connection ended.
+func (c *Client) Async(ctx context.Context, ret interface{}, re RequestEncoding, method Method, args ...interface{}) error {
+	p, ok := ctx.Value(retryCtxKey).(RetryPolicy)
+	if !ok {
+		p = c.retry
+	}
+
+	for attempt := 1; ; attempt++ {
+		received, err := c.tryAsync(ctx, ret, re, method, args)
+		if err == nil {
+			return nil
+		}
+		if received || attempt >= p.MaxAttempts || !p.retryable(err) || ctx.Err() != nil {
+			return err
+		}
+
+		wait := c.clock.NewTimer(p.backoff(attempt))
+		select {
+		case <-wait.C():
+		case <-ctx.Done():
+			wait.Stop()
+			return fmt.Errorf("muxrpc(%s): gave up after %d attempts: %w", method, attempt, err)
+		}
+	}
+}
+
+// tryAsync makes the call once. received is true if something of the answer arrived.
+func (c *Client) tryAsync(ctx context.Context, ret interface{}, re RequestEncoding, method Method, args []interface{}) (received bool, err error) {
+	edp, err := c.Endpoint(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	starter, ok := edp.(AsyncStarter)
+	if !ok {
+		// there is no telling if something arrived, better not risk making the call twice
+		return true, edp.Async(ctx, ret, re, method, args...)
+	}
+
+	call, err := starter.AsyncStart(ctx, re, method, args...)
+	if err != nil {
+		return false, err
+	}
+	select {
+	case <-call.Done():
+	case <-ctx.Done():
+		return call.received(), ctx.Err()
+	}
+	return call.received(), call.Decode(ret)
+}
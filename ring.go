@@ -0,0 +1,198 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/ssbc/go-muxrpc/v2/codec"
+)
+
+// minRingSize is the size of the buffer of a ringBuffer that gets its first bytes
+const minRingSize = 512
+
+// ringBuffer is a queue of bytes for the frameBuffer. Unlike bytes.Buffer it reuses the space of what was read
+// right away, instead of moving the unread bytes to the front once it runs out of room.
+// It only grows if more bytes are buffered at once than fit, and gets its memory from pool if that isn't nil.
+type ringBuffer struct {
+	pool codec.BufferPool
+
+	buf  []byte
+	head int // where the next read starts
+	n    int // number of unread bytes
+
+	// retain is how large buf can stay once all bytes were read, larger ones go back to the pool. Zero keeps it.
+	retain int
+}
+
+func newRingBuffer(pool codec.BufferPool) *ringBuffer {
+	return &ringBuffer{pool: pool}
+}
+
+// Len returns the number of unread bytes
+func (rb *ringBuffer) Len() int { return rb.n }
+
+// Cap returns the number of bytes that fit into the buffer without growing it
+func (rb *ringBuffer) Cap() int { return len(rb.buf) }
+
+// tail returns the free space after the unread bytes, in up to two pieces
+func (rb *ringBuffer) tail() ([]byte, []byte) {
+	end := rb.head + rb.n
+	if end >= len(rb.buf) {
+		end -= len(rb.buf)
+		return rb.buf[end:rb.head], nil
+	}
+	return rb.buf[end:], rb.buf[:rb.head]
+}
+
+// Grow makes sure that another n bytes fit without growing the buffer again
+func (rb *ringBuffer) Grow(n int) {
+	if rb.n+n <= len(rb.buf) {
+		return
+	}
+
+	size := 2 * len(rb.buf)
+	if size < rb.n+n {
+		size = rb.n + n
+	}
+	if size < minRingSize {
+		size = minRingSize
+	}
+
+	var next []byte
+	if rb.pool != nil {
+		b := rb.pool.Get(size)
+		next = b.Bytes()[:b.Cap()]
+	} else {
+		next = make([]byte, size)
+	}
+
+	// move the unread bytes to the front of the new buffer
+	if rb.n > 0 {
+		end := rb.head + rb.n
+		if end > len(rb.buf) {
+			end = len(rb.buf)
+		}
+		c := copy(next, rb.buf[rb.head:end])
+		copy(next[c:], rb.buf[:rb.n-c])
+	}
+	rb.put()
+	rb.buf = next
+	rb.head = 0
+}
+
+// Write appends b to the unread bytes, growing the buffer if needed
+func (rb *ringBuffer) Write(b []byte) (int, error) {
+	rb.Grow(len(b))
+	first, second := rb.tail()
+	c := copy(first, b)
+	copy(second, b[c:])
+	rb.n += len(b)
+	return len(b), nil
+}
+
+// readFull appends exactly n bytes from r.
+// It returns io.ErrUnexpectedEOF if r ends before that and doesn't keep what was read then.
+func (rb *ringBuffer) readFull(r io.Reader, n int) error {
+	rb.Grow(n)
+	first, second := rb.tail()
+	if len(first) > n {
+		first, second = first[:n], nil
+	} else {
+		second = second[:n-len(first)]
+	}
+
+	if _, err := io.ReadFull(r, first); err != nil {
+		return noEOF(err)
+	}
+	if _, err := io.ReadFull(r, second); err != nil {
+		return noEOF(err)
+	}
+	rb.n += n
+	return nil
+}
+
+// truncate drops the last n unread bytes
+func (rb *ringBuffer) truncate(n int) {
+	rb.n -= n
+}
+
+// noEOF turns io.EOF into io.ErrUnexpectedEOF, for reads that expected more
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Read reads the oldest unread bytes into b
+func (rb *ringBuffer) Read(b []byte) (int, error) {
+	if rb.n == 0 {
+		if len(b) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+
+	end := rb.head + rb.n
+	if end > len(rb.buf) {
+		end = len(rb.buf)
+	}
+	c := copy(b, rb.buf[rb.head:end])
+	if c < len(b) && c < rb.n {
+		c += copy(b[c:], rb.buf[:rb.n-c])
+	}
+
+	rb.head += c
+	if rb.head >= len(rb.buf) {
+		rb.head -= len(rb.buf)
+	}
+	rb.n -= c
+
+	if rb.n == 0 {
+		// start over at the front, so that the next frames are in one piece
+		rb.head = 0
+		if rb.retain > 0 && len(rb.buf) > rb.retain {
+			rb.put()
+			rb.buf = nil
+		}
+	}
+	return c, nil
+}
+
+// peekAt copies the unread bytes that start off bytes in into b, without reading them.
+// It returns how many bytes were copied.
+func (rb *ringBuffer) peekAt(b []byte, off int) int {
+	if off >= rb.n {
+		return 0
+	}
+	if len(b) > rb.n-off {
+		b = b[:rb.n-off]
+	}
+
+	start := rb.head + off
+	if start >= len(rb.buf) {
+		start -= len(rb.buf)
+	}
+	c := copy(b, rb.buf[start:])
+	copy(b[c:], rb.buf)
+	return len(b)
+}
+
+// release gives the memory of the buffer back to the pool, the buffer is empty afterwards
+func (rb *ringBuffer) release() {
+	rb.put()
+	rb.buf = nil
+	rb.head, rb.n = 0, 0
+}
+
+// put returns buf to the pool, if there is one
+func (rb *ringBuffer) put() {
+	if rb.pool == nil || rb.buf == nil {
+		return
+	}
+	rb.pool.Put(bytes.NewBuffer(rb.buf[:0]))
+}
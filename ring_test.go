@@ -0,0 +1,166 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/ssbc/go-muxrpc/v2/codec"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRingBuffer(t *testing.T) {
+	r := require.New(t)
+
+	// write and read random amounts and compare with a plain buffer
+	rnd := rand.New(rand.NewSource(42))
+	rb := newRingBuffer(codec.NewTieredPool())
+	var want bytes.Buffer
+	var next byte
+	for i := 0; i < 5000; i++ {
+		if rnd.Intn(2) == 0 {
+			b := make([]byte, rnd.Intn(300))
+			for j := range b {
+				b[j] = next
+				next++
+			}
+			if rnd.Intn(2) == 0 {
+				rb.Write(b)
+			} else {
+				r.NoError(rb.readFull(bytes.NewReader(b), len(b)))
+			}
+			want.Write(b)
+		} else {
+			// peeking sees the same bytes, wherever they wrap around
+			off := rnd.Intn(50)
+			peeked := make([]byte, rnd.Intn(300))
+			pn := rb.peekAt(peeked, off)
+			if off < want.Len() {
+				r.Equal(want.Bytes()[off:off+pn], peeked[:pn])
+			} else {
+				r.Zero(pn)
+			}
+
+			got := make([]byte, rnd.Intn(300))
+			n, _ := rb.Read(got)
+			exp := make([]byte, len(got))
+			m, _ := want.Read(exp)
+			r.Equal(exp[:m], got[:n], "read %d", i)
+		}
+		r.Equal(want.Len(), rb.Len())
+	}
+
+	// a short read doesn't keep anything
+	n := rb.Len()
+	r.Equal(io.ErrUnexpectedEOF, rb.readFull(strings.NewReader("abc"), 4))
+	r.Equal(n, rb.Len())
+}
+
+func TestRingBufferReuse(t *testing.T) {
+	r := require.New(t)
+
+	// a consumer that keeps up doesn't need more space than a couple of frames, no matter how many went through
+	rb := newRingBuffer(nil)
+	frame := bytes.Repeat([]byte("a"), 100)
+	buf := make([]byte, 100)
+	for i := 0; i < 10000; i++ {
+		rb.Write(frame)
+		if i%3 == 2 {
+			for rb.Len() > 100 {
+				rb.Read(buf)
+			}
+		}
+	}
+	r.Equal(minRingSize, rb.Cap())
+}
+
+func TestSourceBufferRetain(t *testing.T) {
+	ctx := context.Background()
+
+	for _, retain := range []int{0, 4096} {
+		t.Run(fmt.Sprint(retain), func(t *testing.T) {
+			r := require.New(t)
+
+			var e rpc
+			e.bpool = codec.NewTieredPool()
+			WithSourceBufferRetain(retain)(&e)
+			bs := e.newSource(ctx)
+
+			// a burst
+			body := bytes.Repeat([]byte("a"), 1024)
+			for i := 0; i < 64; i++ {
+				r.NoError(bs.consume(uint32(len(body)), codec.FlagStream, bytes.NewReader(body)))
+			}
+			r.GreaterOrEqual(bs.buf.store.Cap(), 64*1024)
+
+			for i := 0; i < 64; i++ {
+				r.True(bs.Next(ctx))
+				_, err := bs.Bytes()
+				r.NoError(err)
+			}
+
+			if retain == 0 {
+				r.GreaterOrEqual(bs.buf.store.Cap(), 64*1024, "the buffer should be kept")
+			} else {
+				r.Equal(0, bs.buf.store.Cap(), "the buffer should be returned after the burst")
+			}
+		})
+	}
+}
+
+// BenchmarkSourceSteadyState feeds a long-lived source with bursts and a consumer that lags behind by a few frames.
+// The buf-bytes metric is the memory the buffer of the source holds in the end, the B/op the memory that was allocated for it.
+func BenchmarkSourceSteadyState(b *testing.B) {
+	ctx := context.Background()
+	body := bytes.Repeat([]byte("a"), 700)
+
+	for _, retain := range []int{0, 8 * 1024} {
+		b.Run(fmt.Sprintf("retain=%d", retain), func(b *testing.B) {
+			var e rpc
+			e.bpool = codec.NewTieredPool()
+			WithSourceBufferRetain(retain)(&e)
+			bs := e.newSource(ctx)
+
+			rd := bytes.NewReader(body)
+			consume := func() {
+				rd.Reset(body)
+				if err := bs.consume(uint32(len(body)), codec.FlagStream, rd); err != nil {
+					b.Fatal(err)
+				}
+			}
+			drain := func(keep uint32) {
+				for bs.buf.Frames() > keep {
+					bs.Next(ctx)
+					if _, err := bs.Bytes(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(body)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				consume()
+				if i%1000 == 999 {
+					// a burst of a hundred frames, and the consumer catches up completely
+					for j := 0; j < 100; j++ {
+						consume()
+					}
+					drain(0)
+				}
+				drain(4)
+			}
+			drain(0)
+			b.ReportMetric(float64(bs.buf.store.Cap()), "buf-bytes")
+		})
+	}
+}
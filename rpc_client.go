@@ -5,28 +5,63 @@
 package muxrpc
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-
-	"go.mindeco.de/log"
-	"go.mindeco.de/log/level"
+	"time"
 
 	"github.com/ssbc/go-muxrpc/v2/codec"
 )
 
 // Async does an aync call on the remote.
 func (r *rpc) Async(ctx context.Context, ret interface{}, re RequestEncoding, method Method, args ...interface{}) error {
-	_, ok := r.manifest.Handled(method)
-	if !ok {
-		return ErrNoSuchMethod{Method: method}
+	ctx, req, err := r.startAsync(ctx, re, method, args)
+	if err != nil {
+		return err
+	}
+
+	if !req.source.Next(ctx) {
+		err := req.source.Err()
+		if err == nil {
+			return fmt.Errorf("muxrpc(%s): did not receive data for request", method)
+		}
+		return fmt.Errorf("muxrpc(%s): data source errored: %w", method, err)
 	}
 
-	argData, err := marshalCallArgs(args)
+	bodyCodec, _ := LookupBodyCodec(re) // checked by asCodecFlag above
+	processEntry := func(rd io.Reader) error {
+		body, err := ioutil.ReadAll(rd)
+		if err != nil {
+			return fmt.Errorf("error reading body from request source: %w", err)
+		}
+		err = bodyCodec.Unmarshal(body, ret)
+		if err != nil {
+			return fmt.Errorf("error decoding body from request source: %w", err)
+		}
+		return nil
+	}
+
+	if err := req.source.Reader(processEntry); err != nil {
+		srcErr := req.source.Err()
+		return fmt.Errorf("muxrpc(%s): async call failed: %s (%w)", method, err, srcErr)
+	}
+
+	return nil
+}
+
+// startAsync sends an async call to the remote, the answer arrives on the source of the returned request.
+func (r *rpc) startAsync(ctx context.Context, re RequestEncoding, method Method, args []interface{}) (context.Context, *Request, error) {
+	if err := r.manifest.check(method, "async"); err != nil {
+		return nil, nil, err
+	}
+
+	argData, err := r.marshalCallArgs(args)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	ctx, cancel := context.WithCancel(ctx)
@@ -36,8 +71,8 @@ func (r *rpc) Async(ctx context.Context, ret interface{}, re RequestEncoding, me
 
 		abort: cancel,
 
-		source: newByteSource(ctx, r.bpool),
-		sink:   newByteSink(ctx, r.pkr.w),
+		source: r.newSource(ctx),
+		sink:   r.newSink(ctx, "async"),
 
 		Method:  method,
 		RawArgs: argData,
@@ -46,72 +81,21 @@ func (r *rpc) Async(ctx context.Context, ret interface{}, re RequestEncoding, me
 
 	req.sink.pkt.Flag, err = re.asCodecFlag()
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	if err := r.start(ctx, req); err != nil {
-		return fmt.Errorf("muxrpc(%s): error sending request: %w", method, err)
-	}
-
-	if !req.source.Next(ctx) {
-		err := req.source.Err()
-		if err == nil {
-			return fmt.Errorf("muxrpc(%s): did not receive data for request", method)
-		}
-		return fmt.Errorf("muxrpc(%s): data source errored: %w", method, err)
+		return nil, nil, fmt.Errorf("muxrpc(%s): error sending request: %w", method, err)
 	}
-
-	processEntry := func(rd io.Reader) error {
-		switch tv := ret.(type) {
-		case *[]byte:
-			if re != TypeBinary {
-				return fmt.Errorf("unexpected requst encoding, need TypeBinary got %v", re)
-			}
-			var bs []byte
-			bs, err = ioutil.ReadAll(rd)
-			if err != nil {
-				return fmt.Errorf("error decoding json from request source: %w", err)
-			}
-			*tv = bs
-
-		case *string:
-			if re != TypeString {
-				return fmt.Errorf("unexpected requst encoding, need TypeString got %v", re)
-			}
-			var bs []byte
-			bs, err = ioutil.ReadAll(rd)
-			if err != nil {
-				return fmt.Errorf("error decoding json from request source: %w", err)
-			}
-			*tv = string(bs)
-
-		default:
-			if re != TypeJSON {
-				return fmt.Errorf("unexpected requst encoding, need TypeJSON got %v for %T", re, tv)
-			}
-			err = json.NewDecoder(rd).Decode(ret)
-			if err != nil {
-				return fmt.Errorf("error decoding json from request source: %w", err)
-			}
-		}
-		return nil
-	}
-
-	if err := req.source.Reader(processEntry); err != nil {
-		srcErr := req.source.Err()
-		return fmt.Errorf("muxrpc(%s): async call failed: %s (%w)", method, err, srcErr)
-	}
-
-	return nil
+	return ctx, req, nil
 }
 
 func (r *rpc) Source(ctx context.Context, re RequestEncoding, method Method, args ...interface{}) (*ByteSource, error) {
-	_, ok := r.manifest.Handled(method)
-	if !ok {
-		return nil, ErrNoSuchMethod{Method: method}
+	if err := r.manifest.check(method, "source"); err != nil {
+		return nil, err
 	}
 
-	argData, err := marshalCallArgs(args)
+	argData, err := r.marshalCallArgs(args)
 	if err != nil {
 		return nil, err
 	}
@@ -128,13 +112,14 @@ func (r *rpc) Source(ctx context.Context, re RequestEncoding, method Method, arg
 
 		abort: cancel,
 
-		source: newByteSource(ctx, r.bpool),
-		sink:   newByteSink(ctx, r.pkr.w),
+		source: r.newSource(ctx),
+		sink:   r.newSink(ctx, "source"),
 
 		Method:  method,
 		RawArgs: argData,
 	}
-	req.sink.pkt.Flag = req.sink.pkt.Flag.Set(encFlag)
+	// the end of the stream, when it is canceled, is sent through the sink
+	req.sink.pkt.Flag = req.sink.pkt.Flag.Set(encFlag).Set(codec.FlagStream)
 
 	req.Stream = req.source.AsStream()
 
@@ -147,12 +132,11 @@ func (r *rpc) Source(ctx context.Context, re RequestEncoding, method Method, arg
 
 // Sink does a sink call on the remote.
 func (r *rpc) Sink(ctx context.Context, re RequestEncoding, method Method, args ...interface{}) (*ByteSink, error) {
-	_, ok := r.manifest.Handled(method)
-	if !ok {
-		return nil, ErrNoSuchMethod{Method: method}
+	if err := r.manifest.check(method, "sink"); err != nil {
+		return nil, err
 	}
 
-	argData, err := marshalCallArgs(args)
+	argData, err := r.marshalCallArgs(args)
 	if err != nil {
 		return nil, err
 	}
@@ -168,8 +152,8 @@ func (r *rpc) Sink(ctx context.Context, re RequestEncoding, method Method, args
 		Type: "sink",
 
 		abort:  cancel,
-		sink:   newByteSink(ctx, r.pkr.w),
-		source: newByteSource(ctx, r.bpool),
+		sink:   r.newSink(ctx, "sink"),
+		source: r.newSource(ctx),
 
 		Method:  method,
 		RawArgs: argData,
@@ -186,12 +170,11 @@ func (r *rpc) Sink(ctx context.Context, re RequestEncoding, method Method, args
 
 // Duplex does a duplex call on the remote.
 func (r *rpc) Duplex(ctx context.Context, re RequestEncoding, method Method, args ...interface{}) (*ByteSource, *ByteSink, error) {
-	_, ok := r.manifest.Handled(method)
-	if !ok {
-		return nil, nil, ErrNoSuchMethod{Method: method}
+	if err := r.manifest.check(method, "duplex"); err != nil {
+		return nil, nil, err
 	}
 
-	argData, err := marshalCallArgs(args)
+	argData, err := r.marshalCallArgs(args)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -203,8 +186,8 @@ func (r *rpc) Duplex(ctx context.Context, re RequestEncoding, method Method, arg
 
 	ctx, cancel := context.WithCancel(ctx)
 
-	bSrc := newByteSource(ctx, r.bpool)
-	bSink := newByteSink(ctx, r.pkr.w)
+	bSrc := r.newSource(ctx)
+	bSink := r.newSink(ctx, "duplex")
 	bSink.pkt.Flag = bSink.pkt.Flag.Set(encFlag).Set(codec.FlagStream)
 
 	req := &Request{
@@ -238,43 +221,190 @@ func (r *rpc) start(ctx context.Context, req *Request) error {
 		req.RawArgs = []byte("[]")
 	}
 
+	req.keepalive = isKeepAliveCall(ctx)
+	r.watchUse(req)
+
 	var (
 		first codec.Packet
 		err   error
 
-		dbg = log.With(level.Debug(r.logger),
+		dbg = LoggerWith(logDebug(r.callLogger(ctx)),
 			"call", req.Type,
 			"method", req.Method.String())
 	)
+	if id, ok := CorrelationFromContext(ctx); ok {
+		req.correlation = id
+		dbg = LoggerWith(dbg, "correlation", id)
+	}
+
+	// the tracer might want to send metadata along
+	traceCtx := r.beginCall(ctx, req, false)
+	if r.negotiated(FeatureMetadata) {
+		req.Meta = r.outgoingMetadata(traceCtx)
+	}
+
+	s := r.getScratch()
+	defer r.putScratch(s)
 
 	func() { // localize locking
 		r.rLock.Lock()
 		defer r.rLock.Unlock()
 
+		// nobody would close the request once the session is gone
+		if r.closeErr != nil {
+			err = r.closeErr
+			return
+		}
+		if r.tooManyOpen() {
+			err = ErrTooManyCalls
+			return
+		}
+
 		first.Flag = first.Flag.Set(codec.FlagJSON)
 		first.Flag = first.Flag.Set(req.Type.Flags())
-		first.Body, err = json.Marshal(req)
+		err = s.encodeRequest(req)
+		first.Body = s.buf.Bytes()
 
 		r.highest++
 		first.Req = r.highest
 		r.reqs[first.Req] = req
+		r.watchStall(req)
 
 		req.id = first.Req
 		req.sink.pkt.Req = first.Req
+		r.watchFlow(req)
+
+		// set up while the request is registered, so that endCall sees the timer no matter who ends the call
+		if r.responseTimeout > 0 && (req.Type == "async" || req.Type == "source") {
+			req.responseTimer = r.watchResponse(req, r.responseTimeout)
+		}
 	}()
 	if err != nil {
 		dbg.Log("event", "request create failed", "err", err)
+		r.endCall(req, err)
 		return err
 	}
 
-	dbg = log.With(dbg, "reqID", req.id)
+	dbg = LoggerWith(dbg, "reqID", req.id)
 
-	err = r.pkr.w.WritePacket(first)
+	err = req.sink.sendFirst(first)
 	if err != nil {
+		r.endCall(req, err)
 		return err
 	}
+	r.used(req)
 
 	dbg.Log("event", "request sent", "flag", first.Flag.String())
 
+	if req.Type.Flags().Get(codec.FlagStream) {
+		go r.watchCancel(ctx, req)
+	}
+
+	return nil
+}
+
+// watchCancel ends the stream towards the remote if ctx is canceled before the stream ended,
+// so that the remote stops producing. Like js-muxrpc it sends an okay end if the caller just lost interest.
+// There is nothing like that for async calls, their answer is dropped when it arrives.
+func (r *rpc) watchCancel(ctx context.Context, req *Request) {
+	select {
+	case <-ctx.Done():
+	case <-req.source.closed:
+		return
+	}
+
+	r.rLock.RLock()
+	active := r.reqs[req.id] == req
+	r.rLock.RUnlock()
+	if !active || req.source.ended() {
+		return
+	}
+
+	err := ctx.Err()
+	logDebug(r.logger).Log("event", "call canceled", "reqID", req.id, "method", req.Method.String(), "err", err)
+
+	// the consumer sees why, the remote only needs to know if it was an error
+	req.source.Cancel(err)
+	if errors.Is(err, context.Canceled) {
+		err = nil
+	}
+	r.markAborted(req)
+	r.closeStream(req, err)
+}
+
+// watchResponse closes the request with ErrNoResponse if nothing arrived for it after d.
+// The returned timer should be stopped once the call ended, so that it doesn't hold on to the request.
+func (r *rpc) watchResponse(req *Request, d time.Duration) Timer {
+	return r.clock.AfterFunc(d, func() {
+		if req.source.hasReceived() {
+			return
+		}
+
+		r.rLock.RLock()
+		active := r.reqs[req.id] == req
+		r.rLock.RUnlock()
+		if !active {
+			return
+		}
+
+		logWarn(r.logger).Log("event", "no response", "reqID", req.id, "method", req.Method.String(), "timeout", d)
+		r.closeStream(req, ErrNoResponse)
+	})
+}
+
+// jsonScratch is a reusable buffer and encoder for marshaling outgoing calls
+type jsonScratch struct {
+	buf bytes.Buffer
+	enc *json.Encoder
+}
+
+// don't hold on to buffers that grew because of a few very large calls
+const maxScratchSize = 64 * 1024
+
+func (r *rpc) getScratch() *jsonScratch {
+	if s, ok := r.scratch.Get().(*jsonScratch); ok {
+		s.buf.Reset()
+		return s
+	}
+	s := new(jsonScratch)
+	s.enc = json.NewEncoder(&s.buf)
+	return s
+}
+
+func (r *rpc) putScratch(s *jsonScratch) {
+	if s.buf.Cap() > maxScratchSize {
+		return
+	}
+	r.scratch.Put(s)
+}
+
+// encode appends the JSON encoding of v to the buffer, without the newline json.Encoder adds
+func (s *jsonScratch) encode(v interface{}) error {
+	if err := s.enc.Encode(v); err != nil {
+		return err
+	}
+	s.buf.Truncate(s.buf.Len() - 1)
+	return nil
+}
+
+// encodeRequest writes the same body as json.Marshal(req) would, but without copying RawArgs through the encoder
+func (s *jsonScratch) encodeRequest(req *Request) error {
+	s.buf.WriteString(`{"name":`)
+	if err := s.encode(&req.Method); err != nil {
+		return err
+	}
+	s.buf.WriteString(`,"args":`)
+	s.buf.Write(req.RawArgs)
+	s.buf.WriteString(`,"type":`)
+	if err := s.encode(&req.Type); err != nil {
+		return err
+	}
+	if len(req.Meta) > 0 {
+		s.buf.WriteString(`,"meta":`)
+		if err := s.encode(&req.Meta); err != nil {
+			return err
+		}
+	}
+	s.buf.WriteByte('}')
 	return nil
 }
@@ -0,0 +1,352 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ssbc/go-muxrpc/v2/codec"
+)
+
+var testCallArgs = []interface{}{
+	map[string]interface{}{"id": "@feed.ed25519", "seq": 23, "live": true},
+	"<script>",
+}
+
+func TestScratchMatchesMarshal(t *testing.T) {
+	r := require.New(t)
+
+	var e rpc
+
+	args, err := e.marshalCallArgs(testCallArgs)
+	r.NoError(err)
+
+	expArgs, err := json.Marshal(testCallArgs)
+	r.NoError(err)
+	r.Equal(string(expArgs), string(args))
+
+	req := &Request{
+		Type:    "source",
+		Method:  Method{"createHistoryStream"},
+		RawArgs: args,
+	}
+
+	expBody, err := json.Marshal(req)
+	r.NoError(err)
+
+	s := e.getScratch()
+	r.NoError(s.encodeRequest(req))
+	r.Equal(string(expBody), s.buf.String())
+	e.putScratch(s)
+
+	// reused buffers start empty
+	s = e.getScratch()
+	r.Equal(0, s.buf.Len())
+}
+
+func BenchmarkMarshalCall(b *testing.B) {
+	b.Run("json.Marshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			args, err := json.Marshal(testCallArgs)
+			if err != nil {
+				b.Fatal(err)
+			}
+			req := &Request{Type: "async", Method: Method{"whoami"}, RawArgs: args}
+			if _, err := json.Marshal(req); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("scratch", func(b *testing.B) {
+		var e rpc
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			args, err := e.marshalCallArgs(testCallArgs)
+			if err != nil {
+				b.Fatal(err)
+			}
+			req := &Request{Type: "async", Method: Method{"whoami"}, RawArgs: args}
+			s := e.getScratch()
+			if err := s.encodeRequest(req); err != nil {
+				b.Fatal(err)
+			}
+			e.putScratch(s)
+		}
+	})
+}
+
+func TestResponseTimeout(t *testing.T) {
+	r := require.New(t)
+
+	// the server accepts the call but never answers
+	var srvH FakeHandler
+	srvH.HandledCalls(func(m Method) bool { return m.String() != "manifest" })
+	srvH.HandleCallCalls(func(ctx context.Context, req *Request) {
+		<-ctx.Done()
+	})
+
+	client, _ := connectPair(t, &FakeHandler{}, &srvH, []HandleOption{
+		WithResponseTimeout(50 * time.Millisecond),
+	}, nil)
+
+	ctx := context.Background()
+
+	var v string
+	start := time.Now()
+	err := client.Async(ctx, &v, TypeString, Method{"silent"})
+	r.Error(err)
+	r.True(errors.Is(err, ErrNoResponse), "wrong error: %s", err)
+	r.True(time.Since(start) < 5*time.Second)
+
+	src, err := client.Source(ctx, TypeJSON, Method{"silent"})
+	r.NoError(err)
+	r.False(src.Next(ctx))
+	r.True(errors.Is(src.Err(), ErrNoResponse), "wrong error: %s", src.Err())
+}
+
+// afterFuncClock records the timers of AfterFunc
+type afterFuncClock struct {
+	Clock
+
+	mu     sync.Mutex
+	timers []*stopTimer
+}
+
+func (c *afterFuncClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &stopTimer{Timer: c.Clock.AfterFunc(d, f)}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// running returns how many of the timers weren't stopped
+func (c *afterFuncClock) running() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, t := range c.timers {
+		if atomic.LoadInt32(&t.stopped) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+type stopTimer struct {
+	Timer
+	stopped int32
+}
+
+func (t *stopTimer) Stop() bool {
+	atomic.StoreInt32(&t.stopped, 1)
+	return t.Timer.Stop()
+}
+
+func TestResponseTimerStopped(t *testing.T) {
+	r := require.New(t)
+
+	var srvH FakeHandler
+	srvH.HandledCalls(func(m Method) bool { return true })
+	srvH.HandleCallCalls(func(ctx context.Context, req *Request) {
+		if req.Type == "async" {
+			req.Return(ctx, "pong")
+			return
+		}
+		snk, err := req.ResponseSink()
+		if err != nil {
+			req.CloseWithError(err)
+			return
+		}
+		snk.Write([]byte("pong"))
+		snk.Close()
+	})
+
+	clock := &afterFuncClock{Clock: RealClock()}
+	client, _ := connectPair(t, &FakeHandler{}, &srvH, []HandleOption{
+		WithoutManifest(), WithClock(clock), WithResponseTimeout(time.Hour),
+	}, []HandleOption{WithoutManifest()})
+
+	ctx := context.Background()
+	var v string
+	r.NoError(client.Async(ctx, &v, TypeString, Method{"ping"}))
+	r.Equal("pong", v)
+
+	src, err := client.Source(ctx, TypeString, Method{"ping"})
+	r.NoError(err)
+	r.True(src.Next(ctx))
+	_, err = src.Bytes()
+	r.NoError(err)
+	r.False(src.Next(ctx))
+	r.NoError(src.Err())
+
+	// the timers of answered calls don't keep their requests around until they would have fired
+	r.Eventually(func() bool { return clock.running() == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestCancelEndsRemoteStream(t *testing.T) {
+	r := require.New(t)
+
+	stopped := make(chan struct{})
+
+	var srvH FakeHandler
+	srvH.HandledCalls(func(m Method) bool { return true })
+	srvH.HandleCallCalls(func(ctx context.Context, req *Request) {
+		defer close(stopped)
+		snk, err := req.ResponseSink()
+		if err != nil {
+			req.CloseWithError(err)
+			return
+		}
+		// produce until the caller isn't interested anymore
+		for {
+			if _, err := snk.Write([]byte(`{"i":1}`)); err != nil {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	})
+
+	client, _ := connectPair(t, &FakeHandler{}, &srvH, []HandleOption{WithoutManifest()}, []HandleOption{WithoutManifest()})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	src, err := client.Source(ctx, TypeJSON, Method{"live"})
+	r.NoError(err)
+	r.True(src.Next(ctx))
+
+	cancel()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("remote didn't stop producing")
+	}
+
+	// frames that arrived before are still handed out
+	for src.Next(context.Background()) {
+		_, err = src.Bytes()
+		r.NoError(err)
+	}
+	// canceling is a regular end for the consumer
+	r.NoError(src.Err())
+}
+
+// js-muxrpc aborts a source by ending the stream with true, the remote shouldn't see an error
+func TestCancelSendsStreamEnd(t *testing.T) {
+	r := require.New(t)
+
+	c1, c2 := loPipe(t)
+	client := Handle(NewPacker(c1), &FakeHandler{}, WithoutManifest())
+	go client.(Server).Serve()
+	t.Cleanup(func() { client.Terminate() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err := client.Source(ctx, TypeJSON, Method{"live"})
+	r.NoError(err)
+
+	remote := codec.NewReader(c2)
+	call, err := remote.ReadPacket()
+	r.NoError(err)
+	r.True(call.Flag.Get(codec.FlagStream))
+
+	cancel()
+
+	end, err := remote.ReadPacket()
+	r.NoError(err)
+	r.Equal(call.Req, end.Req)
+	r.Equal(codec.FlagJSON|codec.FlagStream|codec.FlagEndErr, end.Flag)
+	r.Equal("true", string(end.Body))
+}
+
+func TestAbortLatency(t *testing.T) {
+	r := require.New(t)
+
+	type slowAbort struct {
+		m    Method
+		took time.Duration
+	}
+	slow := make(chan slowAbort, 1)
+	var client Endpoint
+	hook := func(m Method, took time.Duration) {
+		// the hook can use the endpoint, it doesn't run on the read loop
+		client.Terminate()
+		slow <- slowAbort{m, took}
+	}
+
+	c1, c2 := loPipe(t)
+	client = Handle(NewPacker(c1), &FakeHandler{}, WithoutManifest(), WithSlowAbortHook(10*time.Millisecond, hook))
+	go client.(Server).Serve()
+	t.Cleanup(func() { client.Terminate() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err := client.Source(ctx, TypeJSON, Method{"live"})
+	r.NoError(err)
+
+	remoteR, remoteW := codec.NewReader(c2), codec.NewWriter(c2)
+	call, err := remoteR.ReadPacket()
+	r.NoError(err)
+
+	cancel()
+	_, err = remoteR.ReadPacket()
+	r.NoError(err)
+
+	// a sluggish remote that sends one more frame before it ends the stream
+	time.Sleep(30 * time.Millisecond)
+	r.NoError(remoteW.WritePacket(codec.Packet{Req: -call.Req, Flag: codec.FlagJSON | codec.FlagStream, Body: []byte(`{}`)}))
+	r.NoError(remoteW.WritePacket(codec.Packet{Req: -call.Req, Flag: codec.FlagJSON | codec.FlagStream | codec.FlagEndErr, Body: []byte("true")}))
+
+	select {
+	case s := <-slow:
+		r.Equal("live", s.m.String())
+		r.True(s.took >= 30*time.Millisecond, "took only %s", s.took)
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow abort hook wasn't called")
+	}
+
+	h := client.Stats().AbortLatencies
+	r.EqualValues(1, h.Count)
+	r.Len(h.Counts, len(AbortLatencyBuckets)+1)
+	r.True(h.Sum >= 30*time.Millisecond)
+}
+
+// laterClock is a real clock that is ahead by offset
+type laterClock struct {
+	Clock
+	offset time.Duration
+}
+
+func (c *laterClock) Now() time.Time { return c.Clock.Now().Add(c.offset) }
+
+func TestAbortExpiry(t *testing.T) {
+	r := require.New(t)
+
+	clk := &laterClock{Clock: RealClock()}
+	rpc := &rpc{clock: clk}
+	rpc.markAborted(&Request{id: 1, Method: Method{"ignored"}})
+
+	// the remote never ends the first stream
+	clk.offset = abortExpiry + time.Second
+	rpc.markAborted(&Request{id: 2, Method: Method{"answered"}})
+	rpc.abortAcknowledged(codec.Header{Req: 2, Flag: codec.FlagStream | codec.FlagEndErr})
+
+	h, unanswered := rpc.abortStats()
+	r.EqualValues(1, unanswered)
+	r.EqualValues(1, h.Count)
+	r.Len(rpc.aborted, 0)
+}
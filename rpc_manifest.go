@@ -13,8 +13,6 @@ import (
 	"time"
 
 	"github.com/ssbc/go-muxrpc/v2/codec"
-	"go.mindeco.de/log"
-	"go.mindeco.de/log/level"
 )
 
 const manifestTimeout = 1 * time.Minute
@@ -27,8 +25,8 @@ func (r *rpc) retreiveManifest() {
 	var req = Request{
 		Type: "sync",
 
-		sink:   newByteSink(ctx, r.pkr.w),
-		source: newByteSource(ctx, r.bpool),
+		sink:   r.newSink(ctx, "sync"),
+		source: r.newSource(ctx),
 
 		Method:  Method{"manifest"},
 		RawArgs: json.RawMessage(`[]`),
@@ -40,7 +38,7 @@ func (r *rpc) retreiveManifest() {
 		pkt codec.Packet
 		err error
 
-		dbg = log.With(level.Debug(r.logger), "call", "manifest-init")
+		dbg = LoggerWith(logDebug(r.logger), "call", "manifest-init")
 	)
 
 	func() {
@@ -62,9 +60,9 @@ func (r *rpc) retreiveManifest() {
 		return
 	}
 
-	dbg = log.With(dbg, "reqID", req.id)
+	dbg = LoggerWith(dbg, "reqID", req.id)
 
-	err = r.pkr.w.WritePacket(pkt)
+	err = r.writes.write(PriorityHigh, pkt)
 	if err != nil {
 		dbg.Log("event", "manifest request failed to send", "err", err)
 		return
@@ -103,8 +101,66 @@ func (ms *manifestStruct) Handled(m Method) (string, bool) {
 	if ms.missing {
 		return "", true
 	}
-	callType, yes := ms.methods[m.String()]
-	return callType, yes
+	if callType, yes := ms.methods[m.String()]; yes {
+		return callType, true
+	}
+
+	// Go peers list patterns that handle everything under a prefix (see typemux.Wildcard)
+	for i := len(m) - 1; i >= 0; i-- {
+		pattern := append(m[:i:i], "*")
+		if callType, yes := ms.methods[pattern.String()]; yes {
+			return callType, true
+		}
+	}
+	return "", false
+}
+
+// check returns ErrNoSuchMethod if the remote doesn't list the method
+// and ErrWrongCallType if it lists it with a type that doesn't fit how it is called.
+func (ms *manifestStruct) check(m Method, callType string) error {
+	declared, ok := ms.Handled(m)
+	if !ok {
+		return ErrNoSuchMethod{Method: m}
+	}
+
+	switch declared {
+	case callType:
+	case "sync":
+		// sync methods are called as async, JS muxrpc answers both the same way
+		if callType != "async" {
+			return ErrWrongCallType{Method: m, Called: callType, Declared: declared}
+		}
+	case "async", "source", "sink", "duplex":
+		return ErrWrongCallType{Method: m, Called: callType, Declared: declared}
+	default:
+		// a missing manifest or a type we don't know about, let the remote decide
+	}
+	return nil
+}
+
+// Manifest returns a copy of the flattened manifest of the remote, like "blobs.get": "source".
+// If the remote didn't send one, it returns false.
+func (r *rpc) Manifest() (map[string]string, bool) {
+	r.manifest.mu.Lock()
+	defer r.manifest.mu.Unlock()
+	if r.manifest.missing {
+		return nil, false
+	}
+
+	methods := make(map[string]string, len(r.manifest.methods))
+	for m, callType := range r.manifest.methods {
+		methods[m] = callType
+	}
+	return methods, true
+}
+
+// RemoteManifest returns the manifest the remote of the endpoint sent when the session started, see WithoutManifest.
+func RemoteManifest(edp Endpoint) (map[string]string, bool) {
+	rpc, ok := asRPC(edp)
+	if !ok {
+		return nil, false
+	}
+	return rpc.Manifest()
 }
 
 func (ms *manifestMap) UnmarshalJSON(bin []byte) error {
@@ -125,13 +181,13 @@ func (ms *manifestMap) UnmarshalJSON(bin []byte) error {
 	return nil
 }
 
-/* recurseMap iterates over and decends into a muxrpc manifest and creates a flat structure ala
+/*
+	recurseMap iterates over and decends into a muxrpc manifest and creates a flat structure ala
 
 "plugin.method1": "async",
 "plugin.method2": "source",
 "plugin.method3": "sink",
 ...
-
 */
 func recurseMap(methods manifestMap, jsonMap map[string]interface{}, prefix Method) error {
 	for k, iv := range jsonMap {
@@ -0,0 +1,93 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifestCallTypes(t *testing.T) {
+	r := require.New(t)
+
+	var srv FakeHandler
+	srv.HandledCalls(func(m Method) bool { return true })
+	srv.HandleCallCalls(func(ctx context.Context, req *Request) {
+		req.Return(ctx, "hello")
+	})
+
+	var client FakeHandler
+	client.HandledCalls(methodChecker("manifest"))
+	client.HandleCallCalls(func(ctx context.Context, req *Request) {
+		req.CloseWithError(ErrNoSuchMethod{req.Method})
+	})
+
+	manifest := json.RawMessage(`{"whoami":"sync","feed":"source","blobs":{"add":"sink"},"odd":"weird"}`)
+	edp, _ := connectPair(t, &client, testManifestWrapper{manifest: manifest, root: &srv}, nil, nil)
+
+	methods, ok := RemoteManifest(edp)
+	r.True(ok)
+	r.Equal(map[string]string{
+		"whoami":    "sync",
+		"feed":      "source",
+		"blobs.add": "sink",
+		"odd":       "weird",
+	}, methods)
+
+	// views see the same manifest
+	methods, ok = RemoteManifest(edp.WithOptions(CallEncoding(TypeJSON)))
+	r.True(ok)
+	r.Len(methods, 4)
+
+	ctx := context.Background()
+
+	var s string
+	r.NoError(edp.Async(ctx, &s, TypeString, Method{"whoami"}))
+	r.Equal("hello", s)
+
+	// types we don't know are left to the remote
+	r.NoError(edp.Async(ctx, &s, TypeString, Method{"odd"}))
+
+	var wrongType ErrWrongCallType
+	err := edp.Async(ctx, &s, TypeString, Method{"feed"})
+	r.True(errors.As(err, &wrongType), "unexpected error: %v", err)
+	r.Equal("source", wrongType.Declared)
+	r.Equal("async", wrongType.Called)
+
+	_, err = edp.Source(ctx, TypeString, Method{"whoami"})
+	r.True(errors.As(err, &wrongType), "unexpected error: %v", err)
+
+	_, _, err = edp.Duplex(ctx, TypeString, Method{"blobs", "add"})
+	r.True(errors.As(err, &wrongType), "unexpected error: %v", err)
+
+	// none of those made it to the remote
+	r.Equal(2, srv.HandleCallCallCount())
+}
+
+func TestWithoutManifest(t *testing.T) {
+	r := require.New(t)
+
+	var srv FakeHandler
+	srv.HandledCalls(func(m Method) bool { return true })
+	srv.HandleCallCalls(func(ctx context.Context, req *Request) {
+		req.Return(ctx, "hello")
+	})
+
+	var client FakeHandler
+	edp, _ := connectPair(t, &client, &srv, []HandleOption{WithoutManifest()}, nil)
+
+	_, ok := RemoteManifest(edp)
+	r.False(ok)
+
+	// no manifest means no checks
+	var s string
+	r.NoError(edp.Async(context.Background(), &s, TypeString, Method{"anything"}))
+	r.Equal("hello", s)
+	r.Equal(1, srv.HandleCallCallCount())
+}
@@ -11,14 +11,12 @@ import (
 	"io"
 	"io/ioutil"
 	"net"
-	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/karrick/bufpool"
 	"github.com/pkg/errors"
-	"go.mindeco.de/log"
-	"go.mindeco.de/log/level"
 
 	"github.com/ssbc/go-muxrpc/v2/codec"
 )
@@ -42,12 +40,101 @@ func WithRemoteAddr(addr net.Addr) HandleOption {
 }
 
 // WithLogger let's you overwrite the stderr logger
-func WithLogger(l log.Logger) HandleOption {
+func WithLogger(l Logger) HandleOption {
 	return func(r *rpc) {
 		r.logger = l
 	}
 }
 
+// LoggerProvider derives the logger for an incoming call from the context that is passed to HandleCall.
+// The base logger already carries the connection fields and the reqID and method of the call.
+type LoggerProvider func(ctx context.Context, base Logger) Logger
+
+// WithLoggerProvider sets a hook that is consulted for every incoming call.
+// The returned logger can be retrieved inside the handler using LoggerFromContext.
+func WithLoggerProvider(lp LoggerProvider) HandleOption {
+	return func(r *rpc) {
+		r.loggerProvider = lp
+	}
+}
+
+// HighWaterPolicy decides what happens to an incoming stream that buffered more than its high-water mark.
+type HighWaterPolicy uint
+
+const (
+	// HighWaterPause asks the remote to stop sending on the stream until the consumer read it down to half of the mark.
+	// The other streams on the connection keep going. What the remote sent before it got the message is still buffered,
+	// so the mark can be exceeded by what the connection had in flight.
+	// Only peers that negotiated FeatureFlowControl can be paused, the streams of other peers keep buffering, use WithMemoryBudget to bound those.
+	HighWaterPause HighWaterPolicy = iota
+
+	// HighWaterFailStream closes the stream with ErrSourceHighWater.
+	HighWaterFailStream
+)
+
+// WithSourceHighWaterMark limits how many bytes are buffered for a single incoming stream.
+// Once a stream holds n bytes that weren't read yet, the policy decides what happens to it.
+// Zero (the default) means no limit.
+func WithSourceHighWaterMark(n int, policy HighWaterPolicy) HandleOption {
+	return func(r *rpc) {
+		r.srcHighWater = n
+		r.srcHighWaterFail = policy == HighWaterFailStream
+	}
+}
+
+// WithSourceBufferRetain makes incoming streams give the memory of their buffer back to the pool once it is drained,
+// if it grew past n bytes. That way a burst on a long-lived stream doesn't pin the memory it needed until the stream ends.
+// Zero (the default) keeps the buffer, which saves growing it again for the next burst.
+func WithSourceBufferRetain(n int) HandleOption {
+	return func(r *rpc) {
+		r.srcRetain = n
+	}
+}
+
+// WithMaxPacketSize ends the session with an error that matches ErrPacketTooLarge
+// as soon as the remote announces a packet with a body larger than n bytes, before any of it is read.
+// Compressed bodies (see WithCompression) that inflate to more than n bytes and chunked frames (see ByteSink.SetChunkSize)
+// that add up to more than n bytes fail their stream instead.
+// Zero (the default) means no limit for single packets, inflated and chunked frames are still limited to 64MiB.
+func WithMaxPacketSize(n uint32) HandleOption {
+	return func(r *rpc) {
+		r.maxPacket = n
+	}
+}
+
+// WithResponseTimeout sets how long async and source calls wait for the first packet from the remote.
+// If nothing arrived by then, the call is closed and fails with ErrNoResponse.
+// This is independent of the deadline of the context passed to the call, which limits the whole call.
+// Sink and duplex calls are not affected since the remote might legitimately stay silent on those.
+func WithResponseTimeout(d time.Duration) HandleOption {
+	return func(r *rpc) {
+		r.responseTimeout = d
+	}
+}
+
+// WithStreamIdleTimeout sets the idle timeout of all incoming streams, see ByteSource.SetIdleTimeout.
+// It also applies to the response of async calls.
+func WithStreamIdleTimeout(d time.Duration) HandleOption {
+	return func(r *rpc) {
+		r.streamIdle = d
+	}
+}
+
+// WithHandlerWrappers wraps the handler that is passed to Handle, see ApplyHandlerWrappers.
+func WithHandlerWrappers(hws ...HandlerWrapper) HandleOption {
+	return func(r *rpc) {
+		r.root = ApplyHandlerWrappers(r.root, hws...)
+	}
+}
+
+// WithoutManifest skips asking the remote for its manifest when the session starts.
+// The endpoint then assumes that the remote handles every method and doesn't check call types.
+func WithoutManifest() HandleOption {
+	return func(r *rpc) {
+		r.skipManifest = true
+	}
+}
+
 // WithIsServer sets wether the Handle should be in the server (true) or client (false) role
 func WithIsServer(yes bool) HandleOption {
 	return func(r *rpc) {
@@ -58,11 +145,12 @@ func WithIsServer(yes bool) HandleOption {
 // IsServer tells you if the passed endpoint is in the server-role or not.
 // i.e.: Did I call the remote: yes.
 // Was I called by the remote: no.
+// It is false for endpoints that were not returned by Handle, like fakes.
 // Q: don't want to extend Endpoint interface?
 func IsServer(edp Endpoint) bool {
-	rpc, ok := edp.(*rpc)
+	rpc, ok := asRPC(edp)
 	if !ok {
-		panic(fmt.Sprintf("not an *rpc: %T", edp))
+		return false
 	}
 
 	return rpc.isServer
@@ -73,8 +161,13 @@ func Handle(pkr *Packer, handler Handler, opts ...HandleOption) Endpoint {
 	r := &rpc{
 		pkr:        pkr,
 		reqs:       make(map[int32]*Request),
-		reqsClosed: make(map[int32]struct{}),
+		reqsClosed: make(map[int32]bool),
 		root:       handler,
+		callDone:   make(chan struct{}, 1),
+
+		bpool:         defaultBufferPool,
+		writeQuantum:  defaultWriteQuantum,
+		writeQueueLen: defaultWriteQueue,
 	}
 
 	// apply options
@@ -84,41 +177,93 @@ func Handle(pkr *Packer, handler Handler, opts ...HandleOption) Endpoint {
 
 	// defaults
 	if r.logger == nil {
-		logger := log.NewLogfmtLogger(os.Stderr)
-		logger = level.NewFilter(logger, level.AllowInfo()) // only log info and above
-		r.logger = log.With(logger, "ts", log.DefaultTimestampUTC, "unit", "muxrpc")
+		r.logger = defaultLogger()
+	}
+	if r.clock == nil {
+		r.clock = RealClock()
 	}
 
-	if r.remote == nil {
-		if ra, ok := pkr.c.(interface{ RemoteAddr() net.Addr }); ok {
-			r.remote = ra.RemoteAddr()
+	switch c := pkr.c.(type) {
+	case TransportConn:
+		info := c.Info()
+		if r.remote == nil {
+			r.remote = info.Remote
+		}
+		r.local = info.Local
+		r.identity = info.Identity
+		r.meta.fromConnInfo(info)
+	case net.Conn:
+		if r.remote == nil {
+			r.remote = c.RemoteAddr()
+		}
+		r.local = c.LocalAddr()
+	case interface{ RemoteAddr() net.Addr }:
+		if r.remote == nil {
+			r.remote = c.RemoteAddr()
 		}
 	}
+	connectedAt := r.clock.Now()
+	r.meta.Set(MetaConnectedAt, connectedAt)
 
 	if r.remote != nil {
 		// TODO: retract remote address
-		r.logger = log.With(r.logger, "remote", r.remote.String())
+		r.logger = LoggerWith(r.logger, "remote", r.remote.String())
 	}
 
 	if r.serveCtx == nil {
 		r.serveCtx = context.Background()
 	}
 
-	bp, err := bufpool.NewChanPool()
-	if err != nil {
-		panic(err)
+	if r.maxPacket > 0 {
+		pkr.r.SetMaxBodySize(r.maxPacket)
+	}
+	if r.connRate.enabled() {
+		r.connLimiter = newRateLimiter(r.connRate, r.clock.Now())
+	}
+	if r.packetTrace != nil {
+		r.packetTrace.tap(pkr)
+	}
+	if r.capture != nil {
+		tapCapture(pkr, r.capture)
 	}
-	r.bpool = bp
+	r.lastActivity = connectedAt.UnixNano()
+	r.lastUsed = connectedAt.UnixNano()
+	pkr.r.Tap(activityTap{clock: r.clock, last: &r.lastActivity})
+	pkr.w.Tap(activityTap{clock: r.clock, last: &r.lastActivity})
+	r.writes = newWriteQueue(pkr.w, r.writeQueueLen, r.clock)
+	go r.writes.run()
+
+	keepAlive := r.pingInterval > 0 && r.pingTimeout > 0
+	if keepAlive {
+		r.root = answerPings(r.root)
+	}
+	r.root = answerHello(r.root, r)
+	r.root = answerFlow(r.root, r)
 
 	// we need to be able to cancel in any case
 	r.serveCtx, r.cancel = context.WithCancel(r.serveCtx)
 
+	// handlers can get to the endpoint through their context
+	r.serveCtx = withEndpoint(r.serveCtx, r)
+
+	if r.statsHandler != nil {
+		r.statsCtx = r.statsHandler.TagConn(r.serveCtx, r)
+	}
+
+	r.publishEvent(ConnEvent{Type: ConnEstablished})
+
 	// assume we dont have a manifest
 	r.manifest.mu = new(sync.Mutex)
 	r.manifest.missing = true
 	manifestDone := make(chan struct{})
 	go func() {
-		r.retreiveManifest()
+		if !r.skipManifest {
+			r.retreiveManifest()
+		}
+		if len(r.features) > 0 {
+			r.hello()
+			r.meta.Set(MetaFeatures, r.commonFeatures())
+		}
 		close(manifestDone)
 	}()
 
@@ -130,23 +275,41 @@ func Handle(pkr *Packer, handler Handler, opts ...HandleOption) Endpoint {
 
 	<-manifestDone
 
-	go handler.HandleConnect(r.serveCtx, r)
+	if keepAlive {
+		go r.keepAlive()
+	}
+	if r.idleTimeout > 0 {
+		go r.reapIdle()
+	}
+
+	if r.serveCtx.Err() == nil {
+		r.publishEvent(ConnEvent{Type: ConnHandshakeDone})
+	}
+
+	go r.root.HandleConnect(r.serveCtx, r)
+	for _, ch := range r.connectHooks {
+		go r.runConnectHook(ch)
+	}
 
 	return r
 }
 
 // no args should be handled as empty array not args: null
-func marshalCallArgs(args []interface{}) ([]byte, error) {
-	var argData []byte
+func (r *rpc) marshalCallArgs(args []interface{}) ([]byte, error) {
 	if len(args) == 0 {
-		argData = []byte("[]")
-	} else {
-		var err error
-		argData, err = json.Marshal(args)
-		if err != nil {
-			return nil, fmt.Errorf("error marshaling request arguments: %w", err)
-		}
+		return []byte("[]"), nil
 	}
+
+	s := r.getScratch()
+	defer r.putScratch(s)
+
+	if err := s.encode(&args); err != nil {
+		return nil, fmt.Errorf("error marshaling request arguments: %w", err)
+	}
+
+	// the request keeps the arguments, the scratch buffer is reused
+	argData := make([]byte, s.buf.Len())
+	copy(argData, s.buf.Bytes())
 	return argData, nil
 }
 
@@ -157,24 +320,163 @@ var (
 
 // rpc implements an Endpoint, but also implements Server
 type rpc struct {
-	logger log.Logger
+	// lastActivity is when the connection was last read from or written to in unix nanoseconds, accessed atomically (see Stats)
+	lastActivity int64
+
+	// lastUsed is like lastActivity but leaves out keepalive calls, it is only kept with an idle timeout (see WithIdleTimeout)
+	lastUsed    int64
+	idleTimeout time.Duration
+
+	logger Logger
+
+	loggerProvider LoggerProvider
 
 	remote net.Addr
+	local  net.Addr
+
+	// identity is the authenticated key of the remote, if the transport has one
+	identity []byte
+
+	// authorizer is asked before incoming calls reach the handler (see WithAuthorizer)
+	authorizer Authorizer
+
+	// argParsers parse the arguments of incoming calls by method (see WithArgParser)
+	argParsers map[string]ArgParser
+
+	// connectHooks run once the session started (see WithConnectHook)
+	connectHooks []connectHook
+
+	// events is told about the lifecycle of the connection (see WithEventBus)
+	events *EventBus
+
+	// meta is filled with what is known about the connection when the session starts (see Endpoint.Meta)
+	meta ConnMeta
 
 	isServer bool // is this rpc endpoint in the server role?
 
 	// pkr (un)marshales codec.Packets
 	pkr *Packer
 
-	bpool bufpool.FreeList
+	bpool codec.BufferPool
+
+	// scratch holds *jsonScratch values for marshaling outgoing calls
+	scratch sync.Pool
+
+	// responseTimeout is how long calls wait for the first response packet (see WithResponseTimeout)
+	responseTimeout time.Duration
+
+	// streamIdle is the idle timeout of new sources (see WithStreamIdleTimeout)
+	// stalledStreams counts the ones that failed with ErrStreamStalled, accessed atomically
+	streamIdle     time.Duration
+	stalledStreams uint64
+
+	// budget limits the memory of all incoming streams (see WithMemoryBudget)
+	budget *memoryBudget
+
+	// spill lets incoming streams buffer frames on disk (see WithDiskSpill)
+	spill *spillConfig
+
+	// pingInterval and pingTimeout configure the keepalive (see WithKeepAlive)
+	pingInterval, pingTimeout time.Duration
+
+	// clock runs the timers of the session (see WithClock)
+	clock Clock
+
+	// skipManifest disables the manifest exchange on connect (see WithoutManifest)
+	skipManifest bool
+
+	// maxPacket is the largest body the remote may send (see WithMaxPacketSize)
+	maxPacket uint32
+
+	// compressAbove is the compression threshold for replies to compressMethods (see WithCompression)
+	compressAbove   int
+	compressMethods map[string]struct{}
+
+	// connRate and streamRate limit incoming packets (see WithRateLimit and WithStreamRateLimit).
+	// connLimiter holds the buckets of connRate, it is only used by the serve loop like the ones of the streams.
+	connRate, streamRate RateLimit
+	connLimiter          *rateLimiter
+
+	// writes takes the packets of all sinks to the connection, ordered by their priority (see Priority).
+	// writeQueueLen is how many writes of each priority it holds (see WithWriteQueue).
+	writes        *writeQueue
+	writeQueueLen int
+
+	// writeQuantum is how many bytes of a batch a sink writes before the next stream gets a turn (see WithWriteQuantum)
+	writeQuantum int
+
+	// srcHighWater is the number of bytes a ByteSource buffers before it pauses the remote or fails (see WithSourceHighWaterMark)
+	srcHighWater     int
+	srcHighWaterFail bool
+
+	// srcRetain is the largest buffer a drained ByteSource keeps (see WithSourceBufferRetain)
+	srcRetain int
 
 	// reqs is the map we keep, tracking all requests
 	reqs map[int32]*Request
 	// reqs we didnt accept still might send data
-	// like duplex or sink, the remote might send early data before we even get a chance to send an EndErr
-	reqsClosed map[int32]struct{}
+	// like duplex or sink, the remote might send early data before we even get a chance to send an EndErr.
+	// The value is true for calls the remote ended itself, it must not send anything for those anymore.
+	reqsClosed map[int32]bool
 	rLock      sync.RWMutex
 
+	// features are the ones advertised to the remote and remoteFeatures what it answered (see WithHello)
+	features       []Feature
+	remoteFeatures remoteFeatures
+
+	// callLimits limits the concurrent incoming calls per method (see WithMethodConcurrency)
+	callLimits map[string]*callLimiter
+
+	// maxOpen limits the number of reqs (see WithMaxOpenCalls)
+	maxOpen int
+
+	// batchParallel is how many calls of a batch are open at once (see WithBatchParallelism)
+	batchParallel int
+
+	// strictProtocol ends the session on the first ProtocolError (see WithStrictProtocol)
+	strictProtocol bool
+
+	// panicOnBug makes states that are bugs panic instead of failing their stream (see WithPanicOnBug)
+	panicOnBug bool
+
+	// acceptHook can reject incoming calls before they are set up (see WithAcceptHook)
+	acceptHook AcceptHook
+
+	// statsHandler is told about calls and the end of the session (see WithStatsHandler)
+	statsHandler StatsHandler
+	statsCtx     context.Context
+
+	// tracer follows every call (see WithTracer)
+	tracer Tracer
+
+	// packetTrace writes out the packets of the connection (see WithPacketTracer)
+	packetTrace *packetTracer
+
+	// capture records the connection (see WithCapture)
+	capture *codec.CaptureWriter
+
+	// aborted tracks streams that were canceled locally until the remote ended them or they expired.
+	// abortLatencies and unansweredAborts are what came of them (see EndpointStats), all are guarded by abortMu.
+	aborted          map[int32]abortedCall
+	abortLatencies   LatencyHistogram
+	unansweredAborts uint64
+	abortMu          sync.Mutex
+
+	slowAbort     time.Duration
+	slowAbortHook SlowAbortHook
+
+	// draining is set (under rLock) by Shutdown, new incoming calls are refused from then on
+	draining   bool
+	drainStart time.Time
+	// callDone wakes up Shutdown whenever a call ended, so that it can check if all are done
+	callDone chan struct{}
+
+	// shutdown is the report of the first terminate call (under tLock)
+	shutdown *ShutdownReport
+
+	// closeErr is set (under rLock) once the session ended and passed to all pending and new requests
+	closeErr error
+
 	// highest is the highest request id we already allocated
 	highest int32
 
@@ -196,16 +498,24 @@ var errSkip = errors.New("mxurpc: skip packet")
 // we might receive data for requests we chose to not handle
 func (r *rpc) maybeDiscardPacket(hdr codec.Header) error {
 	r.rLock.RLock()
-	defer r.rLock.RUnlock()
-	if _, ignore := r.reqsClosed[hdr.Req]; ignore {
-		rd := r.pkr.r.NextBodyReader(hdr.Len)
-		_, err := io.Copy(ioutil.Discard, rd)
-		if err != nil {
-			return err
+	remoteEnded, ignore := r.reqsClosed[hdr.Req]
+	r.rLock.RUnlock()
+	if !ignore {
+		return nil
+	}
+	if remoteEnded {
+		if hdr.Flag.Get(codec.FlagEndErr) {
+			return r.violation(hdr, ViolationDuplicateEnd)
 		}
-		return errSkip
+		return r.violation(hdr, ViolationDataAfterEnd)
 	}
-	return nil
+	r.abortAcknowledged(hdr)
+	rd := r.pkr.r.NextBodyReader(hdr.Len)
+	_, err := io.Copy(ioutil.Discard, rd)
+	if err != nil {
+		return err
+	}
+	return errSkip
 }
 
 // fetchRequest returns the request from the reqs map or, if it's not there yet, builds a new one.
@@ -223,40 +533,102 @@ func (r *rpc) fetchRequest(ctx context.Context, hdr *codec.Header) (*Request, bo
 
 	r.rLock.RUnlock()
 	r.rLock.Lock()
-	defer r.rLock.Unlock()
 
+	// check if we handle the method and if not, mark the request as closed for potentially incoming data for that request
+	var refuse error
 	ctx, req, err = r.parseNewRequest(hdr, ctx)
-	if err != nil {
+	var rejected callRejected
+	if errors.As(err, &rejected) {
+		refuse = rejected.err
+	} else if err != nil {
+		r.rLock.Unlock()
 		return nil, false, err
+	} else if r.draining {
+		refuse = ErrShuttingDown
+	} else if r.tooManyOpen() {
+		refuse = ErrTooManyCalls
+	} else if !r.root.Handled(req.Method) {
+		refuse = ErrNoSuchMethod{req.Method}
 	}
 
-	// check if we handle the method and if not, mark the request as closed for potentially incoming data for that request
-	if !r.root.Handled(req.Method) {
-		errPkt, err := newEndErrPacket(hdr.Req, hdr.Flag.Get(codec.FlagStream), ErrNoSuchMethod{req.Method})
+	// take a slot of the method's concurrency limit, or a place in its queue
+	var (
+		limit  *callLimiter
+		queued bool
+	)
+	if refuse == nil {
+		limit = r.callLimits[req.Method.String()]
+	}
+	if limit != nil {
+		var ok bool
+		if queued, ok = limit.reserve(); !ok {
+			refuse = ErrTooManyCalls
+		}
+	}
+	if refuse != nil {
+		if req != nil {
+			r.beginCall(ctx, req, true)
+			r.endCall(req, refuse)
+		}
+		errPkt, err := newEndErrPacket(hdr.Req, hdr.Flag.Get(codec.FlagStream), refuse)
 		if err != nil {
+			r.rLock.Unlock()
 			return nil, false, err
 		}
-		err = r.pkr.w.WritePacket(errPkt)
+		r.reqsClosed[hdr.Req] = false
+		r.rLock.Unlock()
+
+		// the queue might be full, waiting for it mustn't keep the other streams from starting or closing
+		err = r.writes.write(PriorityHigh, errPkt)
 		if err != nil {
 			return nil, false, err
 		}
-		r.reqsClosed[hdr.Req] = struct{}{}
 		// it is a new call in that there is nothing else to do
 		return nil, true, nil
 	}
 
 	// add the request to the map of active requests
 	r.reqs[hdr.Req] = req
+	r.watchStall(req)
+	r.watchFlow(req)
+	if len(req.Meta) > 0 {
+		ctx = context.WithValue(ctx, incomingMetadataCtxKey, req.Meta)
+	}
+	ctx = r.beginCall(ctx, req, true)
+
+	reqLogger := LoggerWith(r.logger, "reqID", req.id, "method", req.Method.String())
+	if r.loggerProvider != nil {
+		reqLogger = r.loggerProvider(ctx, reqLogger)
+	}
+	ctx = withLogger(ctx, reqLogger)
 
 	// TODO:
 	// buffer new requests to not mindlessly spawn goroutines
 	// and prioritize exisitng requests to unblock the connection time
 	// maybe use two maps
 	go func() {
+		if limit != nil {
+			if queued {
+				if err := limit.wait(ctx); err != nil {
+					// the call was ended while it waited
+					return
+				}
+			}
+			defer limit.release()
+		}
+		if err := r.authorize(ctx, req); err != nil {
+			req.CloseWithError(err)
+			return
+		}
+		if err := r.parseArgs(req); err != nil {
+			req.CloseWithError(err)
+			return
+		}
 		r.root.HandleCall(ctx, req)
-		level.Debug(r.logger).Log("call", "returned", "method", req.Method, "reqID", req.id)
+		logDebug(reqLogger).Log("call", "returned")
 	}()
 
+	r.rLock.Unlock()
 	return req, true, nil
 }
 
@@ -281,6 +653,26 @@ func (r *rpc) parseNewRequest(pkt *codec.Header, sessionCtx context.Context) (co
 		return nil, nil, fmt.Errorf("new request %d: error decoding packet: %w", pkt.Req, err)
 	}
 
+	info := CallInfo{
+		Method:   req.Method,
+		Type:     req.Type,
+		ID:       pkt.Req,
+		Encoding: TypeJSON,
+		ArgsSize: len(req.RawArgs),
+		Remote:   r.remote,
+		Identity: r.identity,
+	}
+	if info.Type == "" {
+		info.Type = "async"
+	}
+
+	// the accept hook sees the call before anything is allocated for it
+	if r.acceptHook != nil {
+		if err := r.acceptHook(info); err != nil {
+			return nil, nil, callRejected{err}
+		}
+	}
+
 	// initialize the other fields of the request
 	req.remoteAddr = r.remote
 	req.endpoint = r
@@ -288,14 +680,27 @@ func (r *rpc) parseNewRequest(pkt *codec.Header, sessionCtx context.Context) (co
 	req.id = pkt.Req // copy the request id
 
 	// prepare for shutting it down
-	reqCtx, reqCancel := context.WithCancel(sessionCtx)
+	// the handler doesn't need to go on once the caller gave up (see MetadataTimeout)
+	var (
+		reqCtx    context.Context
+		reqCancel context.CancelFunc
+	)
+	if d, ok := req.Meta.timeout(); ok {
+		reqCtx, reqCancel = context.WithTimeout(sessionCtx, d)
+	} else {
+		reqCtx, reqCancel = context.WithCancel(sessionCtx)
+	}
 	req.abort = reqCancel
+	reqCtx = withCallInfo(reqCtx, info)
 
 	// initialize sending and receiving sides of the stream
-	req.sink = newByteSink(reqCtx, r.pkr.w)
+	req.sink = r.newSink(reqCtx, req.Type)
+	req.keepalive = req.Method.String() == pingMethod.String()
+	r.watchUse(&req)
 	req.sink.pkt.Req = req.id
+	req.sink.compressAbove = r.compressionFor(req.Method)
 
-	req.source = newByteSource(reqCtx, r.bpool)
+	req.source = r.newSource(reqCtx)
 
 	// legacy streams (TODO: remove these)
 	if pkt.Flag.Get(codec.FlagStream) {
@@ -320,11 +725,45 @@ func (r *rpc) parseNewRequest(pkt *codec.Header, sessionCtx context.Context) (co
 		req.Stream = req.sink.AsStream()
 	}
 
-	level.Debug(r.logger).Log("event", "got request", "reqID", req.id, "method", req.Method, "type", req.Type)
+	logDebug(r.logger).Log("event", "got request", "reqID", req.id, "method", req.Method, "type", req.Type)
 
 	return reqCtx, &req, nil
 }
 
+// newSource returns a new ByteSource configured with the options of this session
+func (r *rpc) newSource(ctx context.Context) *ByteSource {
+	bs := newByteSource(ctx, r.bpool)
+	bs.buf.highWater = r.srcHighWater
+	bs.buf.highWaterFail = r.srcHighWaterFail
+	bs.buf.store.retain = r.srcRetain
+	bs.buf.budget = r.budget
+	if r.spill != nil {
+		bs.buf.spill = &spillFile{cfg: r.spill}
+	}
+	bs.idle = r.streamIdle
+	bs.maxFrame = r.maxPacket
+	bs.features = r.negotiated
+	if r.clock != nil {
+		bs.useClock(r.clock)
+	}
+	return bs
+}
+
+// newSink returns a new ByteSink that writes through the queue of this session.
+// Its priority is the one of the CallPriority option the call was made with, otherwise the one for calls of type t.
+func (r *rpc) newSink(ctx context.Context, t CallType) *ByteSink {
+	bs := newByteSink(ctx, r.pkr.w)
+	bs.queue = r.writes
+	bs.clock = r.clock
+	bs.quantum = r.writeQuantum
+	bs.panicOnBug = r.panicOnBug
+	bs.prio = defaultPriority(t)
+	if p, ok := priorityFromContext(ctx); ok {
+		bs.prio = p
+	}
+	return bs
+}
+
 // Server can handle packets to and from a remote party
 type Server interface {
 	Remote() net.Addr
@@ -337,14 +776,32 @@ func (r *rpc) Serve() error {
 }
 
 func (r *rpc) serve() (err error) {
-	level.Debug(r.logger).Log("event", "serving")
+	logDebug(r.logger).Log("event", "serving")
+
+	// cause is why the connection ended, even if that isn't an error worth returning (like EOF)
+	var cause error
 	defer func() {
+		if cause == nil {
+			cause = err
+		}
 		if isAlreadyClosed(err) {
 			err = nil
 		}
-		cerr := r.Terminate()
+		if err != nil {
+			// like the headers, the rest of a packet can't be read once Terminate closed the connection
+			r.tLock.Lock()
+			if r.terminated {
+				err = nil
+			}
+			r.tLock.Unlock()
+		}
+		if err != nil {
+			stats := r.pkr.Stats()
+			err = fmt.Errorf("%w (after %d packets read, %d written)", err, stats.Read, stats.Written)
+		}
+		cerr := r.terminate(cause)
 		if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
-			level.Error(r.logger).Log(
+			logError(r.logger).Log(
 				"event", "closed",
 				"handleErr", err,
 				"closeErr", cerr)
@@ -358,6 +815,7 @@ func (r *rpc) serve() (err error) {
 		doRet := func() bool {
 			err = r.pkr.NextHeader(r.serveCtx, &hdr)
 			if isAlreadyClosed(err) {
+				cause = err
 				err = nil
 				return true
 			}
@@ -380,6 +838,13 @@ func (r *rpc) serve() (err error) {
 			return
 		}
 
+		if r.connLimiter != nil {
+			if r.connLimiter.wait(r.serveCtx, r.clock, hdr.Len) != nil {
+				// terminated while throttled
+				return nil
+			}
+		}
+
 		// error/endstream handling and cleanup
 		if hdr.Flag.Get(codec.FlagEndErr) {
 			getReq := func(req int32) (*Request, bool) {
@@ -400,34 +865,47 @@ func (r *rpc) serve() (err error) {
 					}
 					return err
 				}
-				level.Warn(r.logger).Log("event", "unhandled packet", "reqID", hdr.Req, "len", hdr.Len, "flags", hdr.Flag)
-				continue
+				// the remote ended a call that was never made
+				err = r.violation(hdr, ViolationUnknownID)
+				if err == errSkip {
+					continue
+				}
+				return err
 			}
 
-			buf := r.bpool.Get()
+			if req.trace != nil {
+				req.trace.PacketReceived(hdr.Flag, int(hdr.Len))
+			}
+			r.used(req)
 
-			err = r.pkr.r.ReadBodyInto(buf, hdr.Len)
+			var pkt *codec.PooledPacket
+			pkt, err = r.pkr.r.ReadPooledBody(r.bpool, hdr)
 			if err != nil {
 				return fmt.Errorf("muxrpc: failed to get error body for closing of req: %d (len:%d): %w", hdr.Req, hdr.Len, err)
 			}
 
-			body := buf.Bytes()
-			r.bpool.Put(buf)
-
+			// the body is only valid until the packet is released
 			var streamErr error
-			if !isTrue(body) {
-				streamErr, err = parseError(body)
-				if err != nil {
-					return fmt.Errorf("error parsing error packet: %w", err)
-				}
+			if !isTrue(pkt.Body) {
+				streamErr, err = parseError(pkt.Body)
+			}
+			pkt.Release()
+			if err != nil {
+				return fmt.Errorf("error parsing error packet: %w", err)
 			}
 
 			r.closeStream(req, streamErr)
+			r.rLock.Lock()
+			r.reqsClosed[req.id] = true
+			r.rLock.Unlock()
 			continue
 		}
 
 		// data muxing
 		err = r.maybeDiscardPacket(hdr)
+		if err == nil {
+			err = r.checkPacket(hdr)
+		}
 		if err != nil {
 			if err == errSkip {
 				continue
@@ -444,21 +922,46 @@ func (r *rpc) serve() (err error) {
 		if err != nil {
 			return fmt.Errorf("muxrpc: error unpacking request: %w", err)
 		}
+		r.used(req)
 
 		if isNew { // the first packet is just the request data, nothing else to do
 			continue
 		}
 
-		err = req.source.consume(hdr.Len, hdr.Flag, r.pkr.r.NextBodyReader(hdr.Len))
+		if r.streamRate.enabled() {
+			if req.rate == nil {
+				req.rate = newRateLimiter(r.streamRate, r.clock.Now())
+			}
+			if req.rate.wait(r.serveCtx, r.clock, hdr.Len) != nil {
+				return nil
+			}
+		}
+
+		if req.trace != nil {
+			req.trace.PacketReceived(hdr.Flag, int(hdr.Len))
+		}
+
+		body := r.pkr.r.NextBodyReader(hdr.Len)
+		err = req.source.consume(hdr.Len, hdr.Flag, body)
 		if err != nil {
-			level.Warn(r.logger).Log(
+			logWarn(r.logger).Log(
 				"event", "consume failed",
 				"req", hdr.Req,
 				"method", req.Method.String(),
 				"err", err)
 			r.closeStream(req, err)
+
+			// skip what wasn't consumed to stay in sync with the packet stream
+			if _, err = io.Copy(ioutil.Discard, body); err != nil {
+				return fmt.Errorf("muxrpc: failed to skip body of req %d: %w", hdr.Req, err)
+			}
 			continue
 		}
+
+		// the answer to an async call is all there is, once all of its chunks arrived
+		if !hdr.Flag.Get(codec.FlagStream) && !hdr.Flag.Get(codec.FlagMore) {
+			r.endCall(req, nil)
+		}
 	}
 }
 
@@ -470,37 +973,135 @@ func isTrue(data []byte) bool {
 		data[3] == 'e'
 }
 
+// watchStall closes req once its source stalled (see WithStreamIdleTimeout), so that the remote learns about it as well
+func (r *rpc) watchStall(req *Request) {
+	req.source.mu.Lock()
+	defer req.source.mu.Unlock()
+	req.source.stalled = func(err error) {
+		atomic.AddUint64(&r.stalledStreams, 1)
+		r.closeStream(req, err)
+	}
+}
+
 func (r *rpc) closeStream(req *Request, streamErr error) {
-	req.source.Cancel(streamErr)
-	req.sink.CloseWithError(streamErr)
+	req.source.end(streamErr)
+	req.sink.end(streamErr, false)
 	req.abort()
+	r.endCall(req, streamErr)
 
 	r.rLock.Lock()
 	defer r.rLock.Unlock()
 	delete(r.reqs, req.id)
-	r.reqsClosed[req.id] = struct{}{}
+	r.reqsClosed[req.id] = false
 	return
 }
 
 // Terminate ends the RPC session
 func (r *rpc) Terminate() error {
-	r.cancel()
+	return r.terminate(nil)
+}
+
+// terminate ends the session and fails all pending requests with an error that wraps cause.
+// Only the first cause is kept if it is called more than once.
+func (r *rpc) terminate(cause error) error {
+	_, err := r.terminateWithReport(cause)
+	return err
+}
+
+// terminateWithReport does the work of terminate and logs and returns what was cut short.
+// Later calls return the report of the first one.
+func (r *rpc) terminateWithReport(cause error) (ShutdownReport, error) {
+	// subscribers might terminate the session themselves, so the event is published without holding tLock
+	var ended *ConnEvent
+	defer func() {
+		if ended != nil {
+			r.publishEvent(*ended)
+		}
+	}()
+
 	r.tLock.Lock()
 	defer r.tLock.Unlock()
 	r.terminated = true
 
-	// close active requests
+	if r.shutdown != nil {
+		return *r.shutdown, r.pkr.Close()
+	}
+
+	start := r.clock.Now()
+	report := ShutdownReport{Cause: cause}
+
+	// close active requests before canceling their contexts,
+	// so that they see why the session ended and not just context.Canceled
 	r.rLock.Lock()
-	defer r.rLock.Unlock()
+	if r.closeErr == nil {
+		r.closeErr = newSessionTerminated(cause)
+	}
+	ended = &ConnEvent{Type: ConnTerminated, Err: cause, Streams: len(r.reqs)}
 	for _, req := range r.reqs {
-		req.source.Cancel(ErrSessionTerminated)
-		req.sink.CloseWithError(ErrSessionTerminated)
+		if req.inFlight() {
+			report.StreamsAborted++
+		}
+		report.FramesDropped += req.source.buf.Frames()
+
+		pending := req.sink.pendingBytes()
+
+		req.source.end(r.closeErr)
+		if err := req.sink.end(r.closeErr, false); err != nil {
+			report.BytesUnflushed += pending
+		}
+		r.endCall(req, r.closeErr)
 		delete(r.reqs, req.id)
-		r.reqsClosed[req.id] = struct{}{}
+		r.reqsClosed[req.id] = false
+	}
+	graceful := r.draining
+	if graceful {
+		start = r.drainStart
+	}
+	r.rLock.Unlock()
+
+	// what was queued, like the ends of the streams above, goes out before the connection is closed.
+	// A shutdown tells the remote that nothing follows.
+	if err := r.writes.flush(graceful, closeTimeout); err != nil {
+		logDebug(r.logger).Log("event", "flush failed", "goodbye", graceful, "err", err)
+	}
+
+	r.cancel()
+	err := r.pkr.Close()
+
+	report.BytesUnflushed += r.writes.close() + r.pkr.w.Buffered()
+	report.Drain = r.clock.Now().Sub(start)
+	r.shutdown = &report
+
+	logger := logDebug(r.logger)
+	if !report.lossless() {
+		logger = logInfo(r.logger)
 	}
-	return r.pkr.Close()
+	logger.Log("event", "shutdown",
+		"streams", report.StreamsAborted,
+		"frames", report.FramesDropped,
+		"unflushed", report.BytesUnflushed,
+		"drain", report.Drain,
+		"cause", cause)
+
+	if r.statsHandler != nil {
+		r.statsHandler.HandleStats(r.statsCtx, ConnEnd{Err: cause})
+	}
+
+	return report, err
 }
 
 func (r *rpc) Remote() net.Addr {
 	return r.remote
 }
+
+func (r *rpc) RemoteAddr() net.Addr {
+	return r.remote
+}
+
+func (r *rpc) LocalAddr() net.Addr {
+	return r.local
+}
+
+func (r *rpc) Meta() *ConnMeta {
+	return &r.meta
+}
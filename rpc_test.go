@@ -13,13 +13,13 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/ssbc/go-luigi"
 	"github.com/stretchr/testify/require"
-	"go.mindeco.de/log"
 
 	"github.com/ssbc/go-muxrpc/v2/codec"
 	"github.com/ssbc/go-muxrpc/v2/debug"
@@ -881,7 +881,7 @@ type testStruct struct {
 	Str string
 }
 type hDuplex struct {
-	logger         log.Logger
+	logger         Logger
 	txvals, rxvals []interface{}
 
 	encoding RequestEncoding
@@ -1000,7 +1000,7 @@ func (h *hDuplex) HandleCall(ctx context.Context, req *Request) {
 }
 
 func XTestDuplexHandlerStr(t *testing.T) {
-	dbg := log.NewLogfmtLogger(os.Stderr)
+	dbg := NewLogfmtLogger(os.Stderr)
 	r := require.New(t)
 	expRx := []string{
 		"you are a test",
@@ -1103,7 +1103,7 @@ func XTestDuplexHandlerStr(t *testing.T) {
 }
 
 func TestDuplexHandlerJSON(t *testing.T) {
-	dbg := log.NewLogfmtLogger(os.Stderr)
+	dbg := NewLogfmtLogger(os.Stderr)
 	r := require.New(t)
 	expRx := []string{
 		"you are a test",
@@ -1216,3 +1216,116 @@ func TestDuplexHandlerJSON(t *testing.T) {
 
 	r.Equal(0, fh1.HandleCallCallCount(), "peer h1 did call unexpectedly")
 }
+
+// TestTerminatePendingCalls checks that calls which are in flight when the connection dies fail with the reason and not just a canceled context
+func TestTerminatePendingCalls(t *testing.T) {
+	r := require.New(t)
+
+	const n = 200
+
+	var (
+		mu      sync.Mutex
+		pending int
+		allIn   = make(chan struct{})
+	)
+	var fh FakeHandler
+	fh.HandledReturns(true)
+	fh.HandleCallStub = func(ctx context.Context, req *Request) {
+		if req.Method.String() != "block" {
+			req.CloseWithError(ErrNoSuchMethod{req.Method})
+			return
+		}
+		mu.Lock()
+		pending++
+		if pending == n {
+			close(allIn)
+		}
+		mu.Unlock()
+		<-ctx.Done()
+	}
+
+	c1, c2 := loPipe(t)
+
+	srvc := make(chan Endpoint)
+	go func() {
+		srvc <- Handle(NewPacker(c2), &fh)
+	}()
+	client := Handle(NewPacker(c1), &FakeHandler{})
+	server := <-srvc
+	t.Cleanup(func() {
+		client.Terminate()
+		server.Terminate()
+	})
+
+	ctx := context.Background()
+	errc := make(chan error, n)
+	for i := 0; i < n; i++ {
+		if i%2 == 0 {
+			go func() {
+				var v interface{}
+				errc <- client.Async(ctx, &v, TypeJSON, Method{"block"})
+			}()
+			continue
+		}
+		go func() {
+			src, err := client.Source(ctx, TypeJSON, Method{"block"})
+			if err != nil {
+				errc <- err
+				return
+			}
+			if src.Next(ctx) {
+				errc <- errors.New("unexpected frame")
+				return
+			}
+			errc <- src.Err()
+		}()
+	}
+
+	select {
+	case <-allIn:
+	case <-time.After(10 * time.Second):
+		t.Fatal("calls didn't arrive")
+	}
+
+	// kill the connection without any goodbyes
+	r.NoError(c2.Close())
+
+	timeout := time.After(10 * time.Second)
+	for i := 0; i < n; i++ {
+		select {
+		case err := <-errc:
+			r.True(errors.Is(err, ErrSessionTerminated), "call %d: %v", i, err)
+			r.False(errors.Is(err, context.Canceled), "call %d: %v", i, err)
+
+			var ste sessionTerminatedError
+			r.True(errors.As(err, &ste), "call %d: expected the cause: %v", i, err)
+			r.NotNil(ste.cause)
+		case <-timeout:
+			t.Fatalf("only %d of %d calls returned", i, n)
+		}
+	}
+
+	// new calls fail right away
+	var v interface{}
+	err := client.Async(ctx, &v, TypeJSON, Method{"block"})
+	r.True(errors.Is(err, ErrSessionTerminated), "new call: %v", err)
+}
+
+func TestMaxPacketSize(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+
+	opts := []HandleOption{WithoutManifest(), WithLogger(NopLogger())}
+	client, server := NewPipe(&FakeHandler{}, Echo, WithPipeHandleOptions(opts, append(opts, WithMaxPacketSize(100))))
+	defer client.Terminate()
+
+	var v string
+	r.NoError(client.Async(ctx, &v, TypeString, Method{"echo"}, "small"))
+	r.Equal(`"small"`, v)
+
+	err := client.Async(ctx, &v, TypeString, Method{"echo"}, strings.Repeat("x", 200))
+	r.True(errors.Is(err, ErrSessionTerminated), "call: %v", err)
+
+	err = server.(Server).Serve()
+	r.True(errors.Is(err, ErrPacketTooLarge), "serve: %v", err)
+}
@@ -57,31 +57,29 @@ func NewSourceReader(src *ByteSource) io.Reader {
 type srcReader struct {
 	src *ByteSource
 
-	buf []byte
+	// inFrame is true while the frame that Next announced wasn't read to its end
+	inFrame bool
 }
 
 func (r *srcReader) Read(data []byte) (int, error) {
-	if len(r.buf) > 0 {
-		n := copy(data, r.buf)
-		r.buf = r.buf[n:]
-		return n, nil
-	}
-
-	more := r.src.Next(r.src.streamCtx)
-	if !more {
-		err := r.src.Err()
-		if err == nil || errors.Is(err, io.EOF) {
-			return 0, io.EOF
+	for {
+		if r.inFrame {
+			n, err := r.src.Read(data)
+			if err != io.EOF {
+				return n, err
+			}
+			r.inFrame = false
 		}
 
-		return 0, fmt.Errorf("muxrpc: error getting next block: %w", err)
-	}
+		more := r.src.Next(r.src.streamCtx)
+		if !more {
+			err := r.src.Err()
+			if err == nil || errors.Is(err, io.EOF) {
+				return 0, io.EOF
+			}
 
-	var err error
-	r.buf, err = r.src.Bytes()
-	if err != nil {
-		return 0, err
+			return 0, fmt.Errorf("muxrpc: error getting next block: %w", err)
+		}
+		r.inFrame = true
 	}
-
-	return r.Read(data)
 }
@@ -0,0 +1,245 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SecretHandshake runs the secret-handshake of SSB on a connection and returns the box-stream that encrypts it.
+// The shs module (github.com/ssbc/go-muxrpc/v2/shs) implements it with go.cryptoscope.co/secretstream,
+// this package doesn't depend on the cryptography itself.
+type SecretHandshake interface {
+	// Client authenticates towards the peer on conn, which has to have the key remote.
+	Client(ctx context.Context, conn io.ReadWriteCloser, remote ed25519.PublicKey) (io.ReadWriteCloser, error)
+
+	// Server waits for a peer to authenticate on conn and returns its key.
+	Server(ctx context.Context, conn io.ReadWriteCloser) (io.ReadWriteCloser, ed25519.PublicKey, error)
+}
+
+// shsHandshakeTimeout limits how long a handshake of ListenSHS may take
+const shsHandshakeTimeout = 10 * time.Second
+
+// SHSAddr is the remote address of connections that were authenticated with the secret-handshake.
+// Remote returns it for endpoints from DialSHS and ListenSHS.
+type SHSAddr struct {
+	net.Addr
+
+	PubKey ed25519.PublicKey
+}
+
+func (a SHSAddr) Network() string { return "shs-bs" }
+
+// String returns the multiserver address of the peer, like net:10.0.0.1:8008~shs:<base64 key>
+func (a SHSAddr) String() string {
+	return fmt.Sprintf("net:%s~shs:%s", a.Addr.String(), base64.StdEncoding.EncodeToString(a.PubKey))
+}
+
+// ParseSHSAddr parses a multiserver address like net:10.0.0.1:8008~shs:<base64 key> into the network address and the key of the peer.
+func ParseSHSAddr(addr string) (hostPort string, key ed25519.PublicKey, err error) {
+	parts := strings.Split(addr, "~")
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "net:") || !strings.HasPrefix(parts[1], "shs:") {
+		return "", nil, fmt.Errorf("muxrpc: %q is not a net:...~shs:... address", addr)
+	}
+
+	key, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(parts[1], "shs:"))
+	if err != nil {
+		return "", nil, fmt.Errorf("muxrpc: invalid key in %q: %w", addr, err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return "", nil, fmt.Errorf("muxrpc: key in %q has %d bytes instead of %d", addr, len(key), ed25519.PublicKeySize)
+	}
+	return strings.TrimPrefix(parts[0], "net:"), key, nil
+}
+
+// DialSHS connects to the multiserver address addr over TCP, runs the client side of the handshake
+// and starts a session on the box-stream in the client role.
+func DialSHS(ctx context.Context, hs SecretHandshake, addr string, handler Handler, opts ...HandleOption) (Endpoint, error) {
+	hostPort, key, err := ParseSHSAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", hostPort)
+	if err != nil {
+		return nil, fmt.Errorf("muxrpc: failed to dial %s: %w", hostPort, err)
+	}
+
+	box, err := shsHandshake(ctx, conn, func() (io.ReadWriteCloser, error) {
+		return hs.Client(ctx, conn, key)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sc := newSHSConn(conn, box, key)
+	return Handle(NewPacker(sc), handler, append([]HandleOption{WithIsServer(false)}, opts...)...), nil
+}
+
+// ListenSHS listens on the network address and runs the server side of the handshake on every connection, before Accept returns it.
+// The handshakes run concurrently, so that a slow peer doesn't hold up the others. Connections that fail it are closed.
+// The accepted connections are box-streams, pass the listener to Serve to run sessions on them.
+func ListenSHS(hs SecretHandshake, network, address string) (net.Listener, error) {
+	lis, err := net.Listen(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("muxrpc: failed to listen on %s: %w", address, err)
+	}
+
+	sl := &shsListener{
+		Listener: lis,
+		hs:       hs,
+		accepted: make(chan acceptedSHS),
+		closing:  make(chan struct{}),
+	}
+	go sl.acceptLoop()
+	return sl, nil
+}
+
+var errSHSListenerClosed = errors.New("muxrpc: shs listener closed")
+
+type acceptedSHS struct {
+	conn net.Conn
+	err  error
+}
+
+type shsListener struct {
+	net.Listener
+	hs SecretHandshake
+
+	accepted chan acceptedSHS
+
+	closeOnce sync.Once
+	closing   chan struct{}
+}
+
+func (sl *shsListener) acceptLoop() {
+	for {
+		conn, err := sl.Listener.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Temporary() {
+				// Serve backs off after these
+				if !sl.deliver(acceptedSHS{err: err}) {
+					return
+				}
+				continue
+			}
+			sl.deliver(acceptedSHS{err: err})
+			return
+		}
+		go sl.handshake(conn)
+	}
+}
+
+func (sl *shsListener) handshake(conn net.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), shsHandshakeTimeout)
+	defer cancel()
+
+	var key ed25519.PublicKey
+	box, err := shsHandshake(ctx, conn, func() (io.ReadWriteCloser, error) {
+		var (
+			box io.ReadWriteCloser
+			err error
+		)
+		box, key, err = sl.hs.Server(ctx, conn)
+		return box, err
+	})
+	if err != nil {
+		return
+	}
+
+	sc := newSHSConn(conn, box, key)
+	if !sl.deliver(acceptedSHS{conn: sc}) {
+		sc.Close()
+	}
+}
+
+// deliver hands a to Accept, it returns false if the listener was closed
+func (sl *shsListener) deliver(a acceptedSHS) bool {
+	select {
+	case sl.accepted <- a:
+		return true
+	case <-sl.closing:
+		return false
+	}
+}
+
+func (sl *shsListener) Accept() (net.Conn, error) {
+	select {
+	case a := <-sl.accepted:
+		return a.conn, a.err
+	case <-sl.closing:
+		return nil, errSHSListenerClosed
+	}
+}
+
+func (sl *shsListener) Close() error {
+	var err error
+	sl.closeOnce.Do(func() {
+		close(sl.closing)
+		err = sl.Listener.Close()
+	})
+	return err
+}
+
+// shsHandshake runs fn with the deadline of ctx on conn. conn is closed if it fails.
+func shsHandshake(ctx context.Context, conn net.Conn, fn func() (io.ReadWriteCloser, error)) (io.ReadWriteCloser, error) {
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
+	box, err := fn()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("muxrpc: secret-handshake with %s failed: %w", conn.RemoteAddr(), err)
+	}
+	conn.SetDeadline(time.Time{})
+	return box, nil
+}
+
+// shsConn is a box-stream that keeps the addresses and deadlines of the connection below it
+type shsConn struct {
+	net.Conn
+	box io.ReadWriteCloser
+
+	remote SHSAddr
+}
+
+var _ TransportConn = (*shsConn)(nil)
+
+func newSHSConn(conn net.Conn, box io.ReadWriteCloser, key ed25519.PublicKey) *shsConn {
+	return &shsConn{
+		Conn:   conn,
+		box:    box,
+		remote: SHSAddr{Addr: conn.RemoteAddr(), PubKey: key},
+	}
+}
+
+func (sc *shsConn) Read(b []byte) (int, error)  { return sc.box.Read(b) }
+func (sc *shsConn) Write(b []byte) (int, error) { return sc.box.Write(b) }
+
+// Close sends the goodbye of the box-stream and closes the connection
+func (sc *shsConn) Close() error {
+	err := sc.box.Close()
+	if cerr := sc.Conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (sc *shsConn) RemoteAddr() net.Addr { return sc.remote }
+
+func (sc *shsConn) Info() ConnInfo {
+	return ConnInfo{Remote: sc.remote, Local: sc.Conn.LocalAddr(), Identity: sc.remote.PubKey}
+}
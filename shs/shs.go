@@ -0,0 +1,124 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+// Package shs runs the secret-handshake of SSB and the box-stream behind it for muxrpc.DialSHS and muxrpc.ListenSHS,
+// using go.cryptoscope.co/secretstream:
+//
+//	hs, err := shs.New(keyPair, appKey)
+//	lis, err := muxrpc.ListenSHS(hs, "tcp", ":8008")
+//	edp, err := muxrpc.DialSHS(ctx, hs, "net:10.0.0.1:8008~shs:<base64 key>", handler)
+//
+// The package is a module of its own, so that only its importers depend on secretstream.
+package shs
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"io"
+
+	"go.cryptoscope.co/secretstream/boxstream"
+	"go.cryptoscope.co/secretstream/secrethandshake"
+
+	"github.com/ssbc/go-muxrpc/v2"
+)
+
+// appKeySize is the length of the app key (caps) that tells SSB networks apart
+const appKeySize = 32
+
+// Handshake authenticates connections with the key pair of the local peer, for the network with the app key.
+type Handshake struct {
+	keyPair secrethandshake.EdKeyPair
+	appKey  []byte
+}
+
+var _ muxrpc.SecretHandshake = (*Handshake)(nil)
+
+// New returns a handshake with the key pair of the local peer and the 32 byte app key of the network.
+func New(keyPair secrethandshake.EdKeyPair, appKey []byte) (*Handshake, error) {
+	if len(appKey) != appKeySize {
+		return nil, fmt.Errorf("shs: app key has %d bytes instead of %d", len(appKey), appKeySize)
+	}
+	return &Handshake{keyPair: keyPair, appKey: appKey}, nil
+}
+
+// Client authenticates towards the peer with the key remote on conn and returns the box-stream on top of it.
+// The handshake doesn't take a context, DialSHS sets the deadline of ctx on the connection instead.
+func (hs *Handshake) Client(ctx context.Context, conn io.ReadWriteCloser, remote ed25519.PublicKey) (io.ReadWriteCloser, error) {
+	state, err := secrethandshake.NewClientState(hs.appKey, hs.keyPair, remote)
+	if err != nil {
+		return nil, fmt.Errorf("shs: failed to set up client: %w", err)
+	}
+	if err := secrethandshake.Client(state, conn); err != nil {
+		return nil, err
+	}
+	return newBoxStream(conn, state), nil
+}
+
+// Server waits for a peer to authenticate on conn and returns the box-stream on top of it and the key of the peer.
+// The handshake doesn't take a context, ListenSHS sets the deadline of ctx on the connection instead.
+func (hs *Handshake) Server(ctx context.Context, conn io.ReadWriteCloser) (io.ReadWriteCloser, ed25519.PublicKey, error) {
+	state, err := secrethandshake.NewServerState(hs.appKey, hs.keyPair)
+	if err != nil {
+		return nil, nil, fmt.Errorf("shs: failed to set up server: %w", err)
+	}
+	if err := secrethandshake.Server(state, conn); err != nil {
+		return nil, nil, err
+	}
+	return newBoxStream(conn, state), ed25519.PublicKey(state.Remote()), nil
+}
+
+// boxStream encrypts a connection with the keys of a finished handshake
+type boxStream struct {
+	boxer   *boxstream.Boxer
+	unboxer *boxstream.Unboxer
+
+	// rest is what the last Read left of the message it got
+	rest []byte
+}
+
+func newBoxStream(conn io.ReadWriter, state *secrethandshake.State) *boxStream {
+	encKey, encNonce := state.GetBoxstreamEncKeys()
+	decKey, decNonce := state.GetBoxstreamDecKeys()
+	return &boxStream{
+		boxer:   boxstream.NewBoxer(conn, &encNonce, &encKey),
+		unboxer: boxstream.NewUnboxer(conn, &decNonce, &decKey),
+	}
+}
+
+// Read returns io.EOF once the peer said goodbye
+func (bs *boxStream) Read(p []byte) (int, error) {
+	for len(bs.rest) == 0 {
+		msg, err := bs.unboxer.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		bs.rest = msg
+	}
+	n := copy(p, bs.rest)
+	bs.rest = bs.rest[n:]
+	return n, nil
+}
+
+// Write splits p into as many messages as it takes
+func (bs *boxStream) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		seg := p
+		if len(seg) > boxstream.MaxSegmentSize {
+			seg = seg[:boxstream.MaxSegmentSize]
+		}
+		if err := bs.boxer.WriteMessage(seg); err != nil {
+			return n, err
+		}
+		n += len(seg)
+		p = p[len(seg):]
+	}
+	return n, nil
+}
+
+// Close only says goodbye, muxrpc closes the connection below it
+func (bs *boxStream) Close() error {
+	return bs.boxer.WriteGoodbye()
+}
@@ -0,0 +1,76 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package shs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.cryptoscope.co/secretstream/secrethandshake"
+
+	"github.com/ssbc/go-muxrpc/v2"
+)
+
+func TestHandshake(t *testing.T) {
+	r := require.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	appKey := bytes.Repeat([]byte{7}, appKeySize)
+	newHandshake := func() (*Handshake, secrethandshake.EdKeyPair) {
+		kp, err := secrethandshake.GenEdKeyPair(rand.Reader)
+		r.NoError(err)
+		hs, err := New(*kp, appKey)
+		r.NoError(err)
+		return hs, *kp
+	}
+	serverHS, serverKP := newHandshake()
+	clientHS, clientKP := newHandshake()
+
+	lis, err := muxrpc.ListenSHS(serverHS, "tcp", "127.0.0.1:0")
+	r.NoError(err)
+
+	remotes := make(chan net.Addr, 1)
+	go muxrpc.Serve(ctx, lis, func(conn net.Conn) (muxrpc.Handler, error) {
+		remotes <- conn.RemoteAddr()
+		return muxrpc.Echo, nil
+	}, muxrpc.WithServeLogger(muxrpc.NopLogger()))
+
+	addr := "net:" + lis.Addr().String() + "~shs:" + base64.StdEncoding.EncodeToString(serverKP.Public)
+	opts := []muxrpc.HandleOption{muxrpc.WithoutManifest(), muxrpc.WithLogger(muxrpc.NopLogger())}
+	client, err := muxrpc.DialSHS(ctx, clientHS, addr, &muxrpc.FakeHandler{}, opts...)
+	r.NoError(err)
+	defer client.Terminate()
+
+	// more than one box-stream message each way
+	big := strings.Repeat("a", 10000)
+	var v interface{}
+	r.NoError(client.Async(ctx, &v, muxrpc.TypeJSON, muxrpc.Method{"echo"}, big))
+	r.Equal(big, v)
+
+	remote := <-remotes
+	shsAddr, ok := remote.(muxrpc.SHSAddr)
+	r.True(ok, "unexpected address: %T", remote)
+	r.Equal(clientKP.Public, shsAddr.PubKey)
+
+	// a different network refuses the handshake
+	otherHS, err := New(clientKP, bytes.Repeat([]byte{8}, appKeySize))
+	r.NoError(err)
+	_, err = muxrpc.DialSHS(ctx, otherHS, addr, &muxrpc.FakeHandler{}, opts...)
+	r.Error(err)
+}
+
+func TestNewAppKeySize(t *testing.T) {
+	kp, err := secrethandshake.GenEdKeyPair(rand.Reader)
+	require.NoError(t, err)
+	_, err = New(*kp, []byte("short"))
+	require.Error(t, err)
+}
@@ -0,0 +1,114 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// plainHandshake swaps the keys in the clear, it only stands in for secretstream
+type plainHandshake struct{ key ed25519.PublicKey }
+
+func (ph plainHandshake) Client(_ context.Context, conn io.ReadWriteCloser, remote ed25519.PublicKey) (io.ReadWriteCloser, error) {
+	if _, err := conn.Write(ph.key); err != nil {
+		return nil, err
+	}
+	got := make([]byte, ed25519.PublicKeySize)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(got, remote) {
+		return nil, errors.New("wrong server key")
+	}
+	return conn, nil
+}
+
+func (ph plainHandshake) Server(_ context.Context, conn io.ReadWriteCloser) (io.ReadWriteCloser, ed25519.PublicKey, error) {
+	got := make([]byte, ed25519.PublicKeySize)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		return nil, nil, err
+	}
+	if _, err := conn.Write(ph.key); err != nil {
+		return nil, nil, err
+	}
+	return conn, got, nil
+}
+
+func TestSHS(t *testing.T) {
+	r := require.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	newKey := func() ed25519.PublicKey {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		r.NoError(err)
+		return pub
+	}
+	serverKey, clientKey := newKey(), newKey()
+
+	lis, err := ListenSHS(plainHandshake{serverKey}, "tcp", "127.0.0.1:0")
+	r.NoError(err)
+
+	remotes := make(chan net.Addr, 1)
+	go Serve(ctx, lis, func(conn net.Conn) (Handler, error) {
+		remotes <- conn.RemoteAddr()
+		return Echo, nil
+	}, WithServeLogger(NopLogger()))
+
+	addr := "net:" + lis.Addr().String() + "~shs:" + base64.StdEncoding.EncodeToString(serverKey)
+	opts := []HandleOption{WithoutManifest(), WithLogger(NopLogger())}
+	client, err := DialSHS(ctx, plainHandshake{clientKey}, addr, &FakeHandler{}, opts...)
+	r.NoError(err)
+	defer client.Terminate()
+
+	var v interface{}
+	r.NoError(client.Async(ctx, &v, TypeJSON, Method{"echo"}, "hi"))
+	r.Equal("hi", v)
+
+	r.Equal(addr, client.Remote().String())
+	info, ok := RemoteInfo(client)
+	r.True(ok)
+	r.Equal([]byte(serverKey), info.Identity)
+
+	remote := <-remotes
+	shsAddr, ok := remote.(SHSAddr)
+	r.True(ok, "unexpected address: %T", remote)
+	r.Equal(clientKey, shsAddr.PubKey)
+
+	// the wrong key fails the handshake
+	wrong := "net:" + lis.Addr().String() + "~shs:" + base64.StdEncoding.EncodeToString(clientKey)
+	_, err = DialSHS(ctx, plainHandshake{clientKey}, wrong, &FakeHandler{}, opts...)
+	r.Error(err)
+}
+
+func TestParseSHSAddr(t *testing.T) {
+	r := require.New(t)
+
+	key := bytes.Repeat([]byte{1}, ed25519.PublicKeySize)
+	hostPort, got, err := ParseSHSAddr("net:10.0.0.1:8008~shs:" + base64.StdEncoding.EncodeToString(key))
+	r.NoError(err)
+	r.Equal("10.0.0.1:8008", hostPort)
+	r.Equal(ed25519.PublicKey(key), got)
+
+	for _, bad := range []string{
+		"10.0.0.1:8008",
+		"net:10.0.0.1:8008",
+		"net:10.0.0.1:8008~shs:nope",
+		"net:10.0.0.1:8008~shs:" + base64.StdEncoding.EncodeToString(key[:5]),
+	} {
+		_, _, err := ParseSHSAddr(bad)
+		r.Error(err, bad)
+	}
+}
@@ -0,0 +1,79 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"fmt"
+)
+
+// ErrShuttingDown is returned to calls that arrive while the session drains (see Shutdown).
+var ErrShuttingDown error = codedError{msg: "muxrpc: shutting down", code: CodeShuttingDown}
+
+// Shutdown ends the session of the endpoint gracefully, see rpc.Shutdown.
+// Endpoints that aren't backed by a session are just terminated.
+func Shutdown(ctx context.Context, edp Endpoint) (ShutdownReport, error) {
+	rpc, ok := asRPC(edp)
+	if !ok {
+		return ShutdownReport{}, edp.Terminate()
+	}
+	return rpc.Shutdown(ctx)
+}
+
+// Shutdown refuses new incoming calls and waits for the open ones to finish, until ctx is done.
+// Calls that are still open then are closed with an error, after that the remote gets the goodbye packet
+// and the connection is closed. Unlike Terminate, calls that finish in time don't lose anything.
+// If ctx ended before the calls finished, the returned error wraps ctx.Err().
+func (r *rpc) Shutdown(ctx context.Context) (ShutdownReport, error) {
+	r.rLock.Lock()
+	r.draining = true
+	if r.drainStart.IsZero() {
+		r.drainStart = r.clock.Now()
+	}
+	r.rLock.Unlock()
+
+	for r.inFlight() > 0 {
+		select {
+		case <-r.callDone:
+		case <-ctx.Done():
+			report, err := r.terminateWithReport(nil)
+			if err != nil {
+				return report, fmt.Errorf("muxrpc: shutdown timed out: %w (terminate failed: %v)", ctx.Err(), err)
+			}
+			return report, fmt.Errorf("muxrpc: shutdown timed out: %w", ctx.Err())
+		case <-r.serveCtx.Done():
+			return r.terminateWithReport(nil)
+		}
+	}
+
+	return r.terminateWithReport(nil)
+}
+
+// inFlight returns the number of calls that didn't finish yet.
+func (r *rpc) inFlight() int {
+	r.rLock.RLock()
+	defer r.rLock.RUnlock()
+	var n int
+	for _, req := range r.reqs {
+		if req.inFlight() {
+			n++
+		}
+	}
+	return n
+}
+
+// inFlight is true until the call is answered or, for streams, until both sides ended it.
+func (req *Request) inFlight() bool {
+	wrote, ended := req.sink.state()
+	switch req.Type {
+	case "async", "sync":
+		if req.id < 0 { // incoming calls are done once they are answered
+			return !wrote && !ended
+		}
+		return !req.source.hasReceived() && !req.source.ended()
+	default:
+		return !ended || !req.source.ended()
+	}
+}
@@ -0,0 +1,49 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"fmt"
+	"time"
+)
+
+// ShutdownReport describes what ending a session cost.
+type ShutdownReport struct {
+	// Cause is why the session ended, nil if it was terminated locally.
+	Cause error
+
+	// StreamsAborted is the number of calls that were still in flight.
+	StreamsAborted int
+
+	// FramesDropped is the number of frames that arrived on those calls but weren't read by their consumers.
+	FramesDropped uint32
+
+	// BytesUnflushed is the number of body bytes that never made it to the connection,
+	// either because corked sinks couldn't send them or because they were left in the write buffer.
+	BytesUnflushed int
+
+	// Drain is how long it took to close the open calls and the connection, including the wait of Shutdown.
+	Drain time.Duration
+}
+
+func (sr ShutdownReport) String() string {
+	return fmt.Sprintf("aborted %d streams, dropped %d frames and %d unflushed bytes, drain took %s",
+		sr.StreamsAborted, sr.FramesDropped, sr.BytesUnflushed, sr.Drain)
+}
+
+// lossless is true if the shutdown didn't cut anything short.
+func (sr ShutdownReport) lossless() bool {
+	return sr.StreamsAborted == 0 && sr.FramesDropped == 0 && sr.BytesUnflushed == 0
+}
+
+// TerminateWithReport ends the session of the endpoint like Terminate and returns what that cost.
+// If the session already ended, it returns the report of that.
+func TerminateWithReport(edp Endpoint) (ShutdownReport, error) {
+	rpc, ok := asRPC(edp)
+	if !ok {
+		return ShutdownReport{}, edp.Terminate()
+	}
+	return rpc.terminateWithReport(nil)
+}
@@ -0,0 +1,76 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShutdownReport(t *testing.T) {
+	r := require.New(t)
+
+	var srv FakeHandler
+	srv.HandledCalls(func(m Method) bool { return true })
+	srv.HandleCallCalls(func(ctx context.Context, req *Request) {
+		snk, err := req.ResponseSink()
+		if err != nil {
+			req.CloseWithError(err)
+			return
+		}
+		snk.SetEncoding(TypeString)
+		for i := 0; i < 3; i++ {
+			snk.Write([]byte("frame"))
+		}
+		// keep the stream open
+		<-ctx.Done()
+	})
+
+	var client FakeHandler
+	client.HandledCalls(methodChecker("manifest"))
+	client.HandleCallCalls(func(ctx context.Context, req *Request) {
+		req.CloseWithError(ErrNoSuchMethod{req.Method})
+	})
+
+	edp, _ := connectPair(t, &client, &srv, nil, nil)
+
+	ctx := context.Background()
+	src, err := edp.Source(ctx, TypeString, Method{"frames"})
+	r.NoError(err)
+
+	// wait for the frames to arrive without reading them
+	deadline := time.Now().Add(5 * time.Second)
+	for src.buf.Frames() < 3 {
+		r.True(time.Now().Before(deadline), "frames didn't arrive")
+		time.Sleep(time.Millisecond)
+	}
+
+	report, err := TerminateWithReport(edp)
+	r.NoError(err)
+	r.Nil(report.Cause)
+	r.Equal(1, report.StreamsAborted)
+	r.EqualValues(3, report.FramesDropped)
+	r.Equal(0, report.BytesUnflushed)
+	r.True(report.Drain > 0)
+
+	// the session only ends once
+	again, err := TerminateWithReport(edp)
+	r.NoError(err)
+	r.Equal(report, again)
+}
+
+func TestShutdownReportIdle(t *testing.T) {
+	r := require.New(t)
+
+	var srv, client FakeHandler
+	edp, _ := connectPair(t, &client, &srv, []HandleOption{WithoutManifest()}, []HandleOption{WithoutManifest()})
+
+	report, err := TerminateWithReport(edp.WithOptions())
+	r.NoError(err)
+	r.True(report.lossless(), "unexpected losses: %s", report)
+}
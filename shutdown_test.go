@@ -0,0 +1,114 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShutdownDrains(t *testing.T) {
+	r := require.New(t)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	var srv FakeHandler
+	srv.HandledCalls(func(m Method) bool { return true })
+	srv.HandleCallCalls(func(ctx context.Context, req *Request) {
+		if req.Method.String() == "slow" {
+			close(started)
+			<-release
+		}
+		req.Return(ctx, "done")
+	})
+
+	var client FakeHandler
+	opts := []HandleOption{WithoutManifest()}
+	edp, srvEdp := connectPair(t, &client, &srv, opts, opts)
+
+	ctx := context.Background()
+
+	slowErr := make(chan error, 1)
+	var slow string
+	go func() {
+		slowErr <- edp.Async(ctx, &slow, TypeString, Method{"slow"})
+	}()
+	<-started
+
+	type result struct {
+		report ShutdownReport
+		err    error
+	}
+	shut := make(chan result, 1)
+	go func() {
+		sctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		report, err := Shutdown(sctx, srvEdp)
+		shut <- result{report, err}
+	}()
+
+	// new calls are refused while draining
+	var s string
+	var err error
+	for i := 0; i < 100; i++ {
+		err = edp.Async(ctx, &s, TypeString, Method{"fast"})
+		if err != nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	r.Error(err)
+	r.True(strings.Contains(err.Error(), ErrShuttingDown.Error()), "unexpected error: %v", err)
+
+	// the call that was already running still finishes
+	close(release)
+	r.NoError(<-slowErr)
+	r.Equal("done", slow)
+
+	res := <-shut
+	r.NoError(res.err)
+	r.Equal(0, res.report.StreamsAborted)
+	r.True(res.report.lossless(), "unexpected losses: %s", res.report)
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	r := require.New(t)
+
+	var srv FakeHandler
+	srv.HandledCalls(func(m Method) bool { return true })
+	srv.HandleCallCalls(func(ctx context.Context, req *Request) {
+		// a stream that never ends by itself
+		<-ctx.Done()
+	})
+
+	var client FakeHandler
+	opts := []HandleOption{WithoutManifest()}
+	edp, srvEdp := connectPair(t, &client, &srv, opts, opts)
+
+	ctx := context.Background()
+	src, err := edp.Source(ctx, TypeJSON, Method{"forever"})
+	r.NoError(err)
+
+	// wait for the call to arrive
+	for srv.HandleCallCallCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	sctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	report, err := Shutdown(sctx, srvEdp)
+	r.ErrorIs(err, context.DeadlineExceeded)
+	r.Equal(1, report.StreamsAborted)
+	r.True(report.Drain >= 50*time.Millisecond, "drain too short: %s", report.Drain)
+
+	// the client got an error for the stream instead of a dead connection
+	r.False(src.Next(ctx))
+	r.Error(src.Err())
+}
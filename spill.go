@@ -0,0 +1,169 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// ErrSpillQuotaExceeded is returned for streams that would write more to disk than the quota of their connection allows (see WithDiskSpill).
+var ErrSpillQuotaExceeded = errors.New("muxrpc: disk spill quota exceeded")
+
+// WithDiskSpill lets incoming streams buffer more than fits into memory, for instance a slow consumer of a large history stream.
+// Once a stream buffers more than threshold bytes, further frames are appended to a temporary file in dir (the default temp dir if empty)
+// and read back from it when the consumer gets to them. quota limits the bytes that all streams of the connection keep on disk together,
+// a stream that would exceed it fails with ErrSpillQuotaExceeded.
+//
+// Spilled bytes don't count against WithSourceHighWaterMark, which then only limits what a stream keeps in memory.
+// The space of a file is given back once its stream drained it or the consumer canceled it,
+// so a consumer that never catches up fills the quota eventually.
+func WithDiskSpill(dir string, threshold int, quota int64) HandleOption {
+	return func(r *rpc) {
+		r.spill = &spillConfig{
+			dir:       dir,
+			threshold: threshold,
+			quota:     quota,
+		}
+	}
+}
+
+// spillConfig is shared by all the frameBuffers of a connection
+type spillConfig struct {
+	dir       string
+	threshold int
+
+	mu    sync.Mutex
+	quota int64
+	used  int64
+}
+
+func (sc *spillConfig) take(n int64) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.used+n > sc.quota {
+		return false
+	}
+	sc.used += n
+	return true
+}
+
+func (sc *spillConfig) give(n int64) {
+	if n == 0 {
+		return
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.used -= n
+}
+
+// Used returns the number of bytes that are currently on disk
+func (sc *spillConfig) Used() int64 {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.used
+}
+
+// spillFile holds the frames of a stream that didn't fit into memory, in the same format as the store of the frameBuffer.
+// Frames are appended at wr and read from rd. Once the reader caught up, the file is truncated and its space given back.
+type spillFile struct {
+	cfg *spillConfig
+
+	f      *os.File
+	rd, wr int64
+}
+
+func (sf *spillFile) Len() int {
+	return int(sf.wr - sf.rd)
+}
+
+// reserve takes n bytes from the quota for the next frame and creates the file if there is none yet
+func (sf *spillFile) reserve(n int64) error {
+	if !sf.cfg.take(n) {
+		return fmt.Errorf("muxrpc: can't spill frame of %d bytes: %w", n, ErrSpillQuotaExceeded)
+	}
+
+	if sf.f == nil {
+		f, err := ioutil.TempFile(sf.cfg.dir, "muxrpc-spill-")
+		if err != nil {
+			sf.cfg.give(n)
+			return fmt.Errorf("muxrpc: failed to create spill file: %w", err)
+		}
+		// where that works, the file is gone once it's closed, even if the process dies
+		os.Remove(f.Name())
+		sf.f = f
+	}
+	return nil
+}
+
+// unwrite drops what was written after wr, if a frame couldn't be written in full, and gives back what was reserved for it
+func (sf *spillFile) unwrite(wr, reserved int64) {
+	sf.wr = wr
+	sf.cfg.give(reserved)
+}
+
+// Write appends b to the end of the file
+func (sf *spillFile) Write(b []byte) (int, error) {
+	n, err := sf.f.WriteAt(b, sf.wr)
+	sf.wr += int64(n)
+	return n, err
+}
+
+// Read reads from the oldest frame that wasn't read yet
+func (sf *spillFile) Read(b []byte) (int, error) {
+	if sf.rd >= sf.wr {
+		return 0, io.EOF
+	}
+	if left := sf.wr - sf.rd; int64(len(b)) > left {
+		b = b[:left]
+	}
+	n, err := sf.f.ReadAt(b, sf.rd)
+	sf.rd += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+
+	if sf.rd == sf.wr {
+		sf.reset()
+	}
+	return n, err
+}
+
+// peekAt copies the unread bytes that start off bytes in into b, without reading them.
+// It returns how many bytes were copied.
+func (sf *spillFile) peekAt(b []byte, off int) int {
+	pos := sf.rd + int64(off)
+	if pos >= sf.wr {
+		return 0
+	}
+	if left := sf.wr - pos; int64(len(b)) > left {
+		b = b[:left]
+	}
+	n, _ := sf.f.ReadAt(b, pos)
+	return n
+}
+
+// reset empties the file and gives its space back to the quota
+func (sf *spillFile) reset() {
+	sf.cfg.give(sf.wr)
+	sf.rd, sf.wr = 0, 0
+	sf.f.Truncate(0)
+}
+
+// close gives the space back and removes the file
+func (sf *spillFile) close() {
+	if sf.f == nil {
+		return
+	}
+	sf.cfg.give(sf.wr)
+	sf.rd, sf.wr = 0, 0
+	sf.f.Close()
+	os.Remove(sf.f.Name())
+	sf.f = nil
+}
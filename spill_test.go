@@ -0,0 +1,158 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/ssbc/go-muxrpc/v2/codec"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSourceDiskSpill(t *testing.T) {
+	ctx := context.Background()
+
+	mkSource := func(threshold int, quota int64) (*rpc, *ByteSource) {
+		var e rpc
+		e.bpool = codec.NewTieredPool()
+		WithMemoryBudget(1000, BudgetFailStream)(&e)
+		WithDiskSpill(t.TempDir(), threshold, quota)(&e)
+		return &e, e.newSource(ctx)
+	}
+
+	frame := func(i int) string { return fmt.Sprintf("frame-%04d", i) }
+
+	t.Run("in order", func(t *testing.T) {
+		r := require.New(t)
+		e, bs := mkSource(30, 1000)
+
+		// two frames fit into memory, the rest goes to disk
+		for i := 0; i < 10; i++ {
+			r.NoError(bs.consume(10, codec.FlagStream, strings.NewReader(frame(i))))
+		}
+		r.EqualValues(28, e.budget.Used(), "spilled frames don't count against the memory budget")
+		r.EqualValues(8*14, e.spill.Used())
+		r.Equal(10*14, bs.buf.Buffered())
+
+		next := 0
+		read := func(n int) {
+			for ; n > 0; n-- {
+				r.True(bs.Next(ctx))
+				b, err := bs.Bytes()
+				r.NoError(err)
+				r.Equal(frame(next), string(b))
+				next++
+			}
+		}
+
+		// the memory drained but new frames still have to go behind the spilled ones
+		read(3)
+		r.EqualValues(0, e.budget.Used())
+		r.NoError(bs.consume(10, codec.FlagStream, strings.NewReader(frame(10))))
+		r.EqualValues(0, e.budget.Used())
+
+		read(8)
+		r.EqualValues(0, e.spill.Used(), "the drained file should give its space back")
+
+		// back to memory
+		r.NoError(bs.consume(10, codec.FlagStream, strings.NewReader(frame(11))))
+		r.EqualValues(14, e.budget.Used())
+		read(1)
+	})
+
+	t.Run("partial reads", func(t *testing.T) {
+		r := require.New(t)
+		_, bs := mkSource(0, 1000)
+
+		for i := 0; i < 3; i++ {
+			r.NoError(bs.consume(10, codec.FlagStream, strings.NewReader(frame(i))))
+		}
+
+		// the rest of a frame that wasn't read is skipped
+		buf := make([]byte, 3)
+		r.True(bs.Next(ctx))
+		r.NoError(bs.Reader(func(rd io.Reader) error {
+			_, err := io.ReadFull(rd, buf)
+			return err
+		}))
+		r.Equal("fra", string(buf))
+
+		for i := 1; i < 3; i++ {
+			r.True(bs.Next(ctx))
+			b, err := bs.Bytes()
+			r.NoError(err)
+			r.Equal(frame(i), string(b))
+		}
+	})
+
+	t.Run("quota", func(t *testing.T) {
+		r := require.New(t)
+		e, bs := mkSource(0, 30)
+
+		r.NoError(bs.consume(10, codec.FlagStream, strings.NewReader(frame(0))))
+		r.NoError(bs.consume(10, codec.FlagStream, strings.NewReader(frame(1))))
+		err := bs.consume(10, codec.FlagStream, strings.NewReader(frame(2)))
+		r.True(errors.Is(err, ErrSpillQuotaExceeded), "wrong error: %v", err)
+		r.EqualValues(28, e.spill.Used())
+	})
+
+	t.Run("release", func(t *testing.T) {
+		r := require.New(t)
+		e, bs := mkSource(0, 1000)
+
+		r.NoError(bs.consume(10, codec.FlagStream, strings.NewReader(frame(0))))
+		r.NoError(bs.consume(10, codec.FlagStream, strings.NewReader(frame(1))))
+
+		// the remote ended the stream, what is on disk can still be read
+		bs.end(nil)
+		for i := 0; i < 2; i++ {
+			r.True(bs.Next(ctx))
+			b, err := bs.Bytes()
+			r.NoError(err)
+			r.Equal(frame(i), string(b))
+		}
+
+		// once the ended stream was drained, the file is closed
+		r.False(bs.Next(ctx))
+		r.EqualValues(0, e.spill.Used())
+		r.Nil(bs.buf.spill.f)
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		r := require.New(t)
+		e, bs := mkSource(0, 1000)
+
+		r.NoError(bs.consume(10, codec.FlagStream, strings.NewReader(frame(0))))
+		r.NoError(bs.consume(10, codec.FlagStream, strings.NewReader(frame(1))))
+		r.True(bs.Next(ctx))
+
+		// a consumer that gives up doesn't need to drain the stream to free the file
+		bs.Cancel(nil)
+		r.EqualValues(0, e.spill.Used())
+		r.Nil(bs.buf.spill.f)
+		r.False(bs.Next(ctx))
+	})
+
+	t.Run("high water", func(t *testing.T) {
+		r := require.New(t)
+		var e rpc
+		e.bpool = codec.NewTieredPool()
+		WithSourceHighWaterMark(30, HighWaterFailStream)(&e)
+		WithDiskSpill(t.TempDir(), 20, 1000)(&e)
+		bs := e.newSource(ctx)
+
+		// past the threshold the frames go to disk, without pausing the connection
+		for i := 0; i < 10; i++ {
+			r.True(bs.buf.hasSpace(), "frame %d", i)
+			r.NoError(bs.consume(10, codec.FlagStream, strings.NewReader(frame(i))))
+		}
+		r.EqualValues(9*14, e.spill.Used())
+	})
+}
@@ -0,0 +1,227 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/ssbc/go-luigi"
+)
+
+// StatsHandler is notified when connections end and calls begin and end, for instance to export metrics.
+// It is called from the read loop and from the goroutines that use the endpoint, so it has to be fast and must not block.
+// Apart from ConnEnd, it might be called while the endpoint holds locks, so it must not call ConnStats or the endpoint from there.
+// Counters that change with every packet are not pushed to it, it can poll them with ConnStats instead.
+type StatsHandler interface {
+	// TagConn is called once per connection, before any call is made on it.
+	// The returned context is passed to HandleStats for everything that happens on the connection.
+	TagConn(ctx context.Context, edp Endpoint) context.Context
+
+	// HandleStats gets one of CallBegin, CallEnd or ConnEnd.
+	HandleStats(ctx context.Context, s Stats)
+}
+
+// WithStatsHandler sets the StatsHandler of the connection.
+func WithStatsHandler(sh StatsHandler) HandleOption {
+	return func(r *rpc) {
+		r.statsHandler = sh
+	}
+}
+
+// Stats is one of CallBegin, CallEnd or ConnEnd.
+type Stats interface {
+	isStats()
+}
+
+// CallBegin is sent when a call is started on the remote or an incoming call is accepted.
+// Incoming calls that are refused, for instance because there is no handler for them, also begin and end right away.
+type CallBegin struct {
+	Method Method
+	Type   CallType
+
+	// Incoming is true for calls that the remote made
+	Incoming bool
+}
+
+// CallEnd is sent once a call is closed by either side or because the connection ended.
+type CallEnd struct {
+	Method   Method
+	Type     CallType
+	Incoming bool
+
+	// Err is nil if the call ended without an error
+	Err error
+
+	Duration time.Duration
+}
+
+// ConnEnd is sent when the session ended.
+type ConnEnd struct {
+	// Err is why the session ended, nil if it was terminated locally
+	Err error
+}
+
+func (CallBegin) isStats() {}
+func (CallEnd) isStats()   {}
+func (ConnEnd) isStats()   {}
+
+// ConnCounters are the running totals of a connection, see ConnStats.
+type ConnCounters struct {
+	PacketsRead, PacketsWritten uint64
+
+	// BytesRead and BytesWritten include the packet headers
+	BytesRead, BytesWritten uint64
+
+	// Buffered is the number of bytes that incoming streams hold and their consumers didn't read yet.
+	Buffered int64
+}
+
+// ConnStats returns the current counters of the connection of edp, like Endpoint.Stats.
+// It is safe to call at any time, also after the session ended.
+func ConnStats(edp Endpoint) ConnCounters {
+	return edp.Stats().ConnCounters
+}
+
+// EndpointStats is a snapshot of the state of a connection, see Endpoint.Stats.
+type EndpointStats struct {
+	ConnCounters
+
+	// ActiveStreams is the number of calls in either direction that weren't closed yet.
+	ActiveStreams int
+
+	// OldestCall is how long the oldest of those calls is open already, zero if there are none.
+	OldestCall time.Duration
+
+	// LastActivity is when something was last read from or written to the connection, or when the session started if nothing was.
+	LastActivity time.Time
+
+	// StalledStreams is the number of incoming streams that failed with ErrStreamStalled so far (see WithStreamIdleTimeout).
+	StalledStreams uint64
+
+	// AbortLatencies is how long the remote took to end its side of streams that were canceled locally.
+	// This quantifies how well the peer respects cancellation, UnansweredAborts counts the streams it didn't end within a minute.
+	AbortLatencies   LatencyHistogram
+	UnansweredAborts uint64
+}
+
+func (r *rpc) Stats() EndpointStats {
+	es := EndpointStats{
+		ConnCounters: ConnCounters{
+			PacketsRead:    r.pkr.r.PacketsRead(),
+			PacketsWritten: r.pkr.w.PacketsWritten(),
+			BytesRead:      r.pkr.r.BytesRead(),
+			BytesWritten:   r.pkr.w.BytesWritten(),
+		},
+		LastActivity:   time.Unix(0, atomic.LoadInt64(&r.lastActivity)),
+		StalledStreams: atomic.LoadUint64(&r.stalledStreams),
+	}
+	es.AbortLatencies, es.UnansweredAborts = r.abortStats()
+
+	now := r.clock.Now()
+	r.rLock.RLock()
+	defer r.rLock.RUnlock()
+	es.ActiveStreams = len(r.reqs)
+	for _, req := range r.reqs {
+		es.Buffered += int64(req.source.buf.Buffered())
+		if req.stats == nil {
+			continue
+		}
+		if age := now.Sub(req.stats.begin); age > es.OldestCall {
+			es.OldestCall = age
+		}
+	}
+	return es
+}
+
+// activityTap records the time of every read or write of the connection in the lastActivity of its endpoint
+type activityTap struct {
+	clock Clock
+	last  *int64
+}
+
+func (at activityTap) Write(p []byte) (int, error) {
+	atomic.StoreInt64(at.last, at.clock.Now().UnixNano())
+	return len(p), nil
+}
+
+// beginCall tells the stats handler and the tracer about a new call. It returns the context of the tracer for it.
+func (r *rpc) beginCall(ctx context.Context, req *Request, incoming bool) context.Context {
+	req.stats = &callStats{begin: r.clock.Now(), incoming: incoming}
+	if r.statsHandler == nil && r.tracer == nil {
+		return ctx
+	}
+	if r.tracer != nil {
+		call := TracedCall{
+			Method:   req.Method,
+			Type:     req.Type,
+			Incoming: incoming,
+			Remote:   r.remote,
+		}
+		if incoming {
+			call.Meta = req.Meta
+		}
+		ctx, req.trace = r.tracer.StartCall(ctx, call)
+		req.sink.trace = req.trace
+	}
+	atomic.StoreUint32(&req.stats.state, callBegun)
+	if r.statsHandler == nil {
+		return ctx
+	}
+	r.statsHandler.HandleStats(r.statsCtx, CallBegin{
+		Method:   req.Method,
+		Type:     req.Type,
+		Incoming: incoming,
+	})
+	return ctx
+}
+
+// endCall stops the response timer of a call and tells the stats handler and the trace that it ended.
+// Only the first call for a begun request counts.
+func (r *rpc) endCall(req *Request, err error) {
+	if req.responseTimer != nil {
+		req.responseTimer.Stop()
+	}
+	select {
+	case r.callDone <- struct{}{}:
+	default:
+	}
+	if req.stats == nil || !atomic.CompareAndSwapUint32(&req.stats.state, callBegun, callEnded) {
+		return
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, luigi.EOS{}) {
+		err = nil
+	}
+	if req.trace != nil {
+		req.trace.End(err)
+	}
+	if r.statsHandler == nil {
+		return
+	}
+	r.statsHandler.HandleStats(r.statsCtx, CallEnd{
+		Method:   req.Method,
+		Type:     req.Type,
+		Incoming: req.stats.incoming,
+		Err:      err,
+		Duration: r.clock.Now().Sub(req.stats.begin),
+	})
+}
+
+// callStats is kept apart from its Request, since the state changes while the handler might still print the request
+type callStats struct {
+	state    uint32 // accessed atomically
+	begin    time.Time
+	incoming bool
+}
+
+// the states of callStats
+const (
+	callUntracked uint32 = iota
+	callBegun
+	callEnded
+)
@@ -0,0 +1,277 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type recordedStats struct {
+	mu     sync.Mutex
+	tagged int
+	stats  []Stats
+	ended  chan struct{}
+}
+
+func newRecordedStats() *recordedStats {
+	return &recordedStats{ended: make(chan struct{})}
+}
+
+func (rs *recordedStats) TagConn(ctx context.Context, edp Endpoint) context.Context {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.tagged++
+	return ctx
+}
+
+func (rs *recordedStats) HandleStats(ctx context.Context, s Stats) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.stats = append(rs.stats, s)
+	if _, ok := s.(ConnEnd); ok {
+		close(rs.ended)
+	}
+}
+
+func (rs *recordedStats) get() []Stats {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return append([]Stats(nil), rs.stats...)
+}
+
+// strip the durations so that the stats can be compared
+func withoutDurations(stats []Stats) []Stats {
+	for i, s := range stats {
+		if ce, ok := s.(CallEnd); ok {
+			ce.Duration = 0
+			stats[i] = ce
+		}
+	}
+	return stats
+}
+
+// callEvents returns the CallBegin and CallEnd of the call of method in stats and checks that the call began before it ended
+func callEvents(t *testing.T, stats []Stats, method string) (CallBegin, CallEnd) {
+	t.Helper()
+	var (
+		begin   CallBegin
+		end     CallEnd
+		begins  int
+		ends    int
+		beganAt = -1
+		endedAt = -1
+	)
+	for i, s := range stats {
+		switch s := s.(type) {
+		case CallBegin:
+			if s.Method.String() == method {
+				begin, beganAt = s, i
+				begins++
+			}
+		case CallEnd:
+			if s.Method.String() == method {
+				end, endedAt = s, i
+				ends++
+			}
+		}
+	}
+	if begins != 1 || ends != 1 {
+		t.Fatalf("%s: expected one CallBegin and one CallEnd, got %d and %d: %#v", method, begins, ends, stats)
+	}
+	if endedAt < beganAt {
+		t.Fatalf("%s: CallEnd came before CallBegin: %#v", method, stats)
+	}
+	return begin, end
+}
+
+func TestStatsHandler(t *testing.T) {
+	r := require.New(t)
+
+	cliStats, srvStats := newRecordedStats(), newRecordedStats()
+
+	var srv FakeHandler
+	srv.HandledCalls(func(m Method) bool { return m.String() == "whoami" || m.String() == "feed" })
+	srv.HandleCallCalls(func(ctx context.Context, req *Request) {
+		switch req.Method.String() {
+		case "whoami":
+			req.Return(ctx, "me")
+		case "feed":
+			snk, err := req.ResponseSink()
+			if err != nil {
+				req.CloseWithError(err)
+				return
+			}
+			snk.Write([]byte("one"))
+			snk.Close()
+		}
+	})
+
+	client, server := connectPair(t, &FakeHandler{}, &srv,
+		[]HandleOption{WithoutManifest(), WithStatsHandler(cliStats)},
+		[]HandleOption{WithoutManifest(), WithStatsHandler(srvStats)},
+	)
+
+	ctx := context.Background()
+
+	var s string
+	r.NoError(client.Async(ctx, &s, TypeString, Method{"whoami"}))
+	r.Equal("me", s)
+
+	err := client.Async(ctx, &s, TypeString, Method{"nope"})
+	r.True(IsNoSuchMethod(err))
+
+	src, err := client.Source(ctx, TypeString, Method{"feed"})
+	r.NoError(err)
+	r.True(src.Next(ctx))
+	b, err := src.Bytes()
+	r.NoError(err)
+	r.Equal("one", string(b))
+	r.False(src.Next(ctx))
+	r.NoError(src.Err())
+
+	// the server saw everything that was sent
+	cc := ConnStats(client)
+	r.Eventually(func() bool {
+		sc := ConnStats(server)
+		return sc.BytesRead >= cc.BytesWritten && sc.PacketsRead >= cc.PacketsWritten
+	}, time.Second, 10*time.Millisecond)
+	r.NotZero(cc.PacketsWritten)
+	r.NotZero(cc.BytesRead)
+
+	r.NoError(client.Terminate())
+	for _, rs := range []*recordedStats{cliStats, srvStats} {
+		select {
+		case <-rs.ended:
+		case <-time.After(time.Second):
+			t.Fatal("no ConnEnd")
+		}
+		r.Equal(1, rs.tagged)
+	}
+
+	// the events of different calls come from different goroutines, so only those of one call are ordered
+	cliGot := withoutDurations(cliStats.get())
+	r.Len(cliGot, 7, "%#v", cliGot)
+	begin, end := callEvents(t, cliGot, "whoami")
+	r.Equal(CallBegin{Method: Method{"whoami"}, Type: "async"}, begin)
+	r.Equal(CallEnd{Method: Method{"whoami"}, Type: "async"}, end)
+	begin, end = callEvents(t, cliGot, "nope")
+	r.Equal(CallBegin{Method: Method{"nope"}, Type: "async"}, begin)
+	r.True(IsNoSuchMethod(end.Err))
+	begin, end = callEvents(t, cliGot, "feed")
+	r.Equal(CallBegin{Method: Method{"feed"}, Type: "source"}, begin)
+	r.Equal(CallEnd{Method: Method{"feed"}, Type: "source"}, end)
+	r.Equal(ConnEnd{}, cliGot[6])
+
+	// the server ends the async call itself, the refused one right away
+	srvGot := withoutDurations(srvStats.get())
+	var begun, ended, failed int
+	for _, s := range srvGot {
+		switch s := s.(type) {
+		case CallBegin:
+			r.True(s.Incoming)
+			begun++
+		case CallEnd:
+			r.True(s.Incoming)
+			ended++
+			if s.Err != nil {
+				r.True(IsNoSuchMethod(s.Err), "unexpected error: %v", s.Err)
+				failed++
+			}
+		}
+	}
+	r.Equal(3, begun)
+	r.Equal(3, ended)
+	r.Equal(1, failed)
+}
+
+func TestEndpointStats(t *testing.T) {
+	r := require.New(t)
+
+	called := make(chan struct{})
+	var srv FakeHandler
+	srv.HandledCalls(func(m Method) bool { return true })
+	srv.HandleCallCalls(func(ctx context.Context, req *Request) {
+		close(called)
+		<-ctx.Done()
+	})
+
+	opts := []HandleOption{WithoutManifest(), WithLogger(NopLogger())}
+	client, server := connectPair(t, &FakeHandler{}, &srv, opts, opts)
+
+	es := client.Stats()
+	r.Zero(es.ActiveStreams)
+	r.Zero(es.OldestCall)
+	r.False(es.LastActivity.IsZero())
+
+	before := time.Now()
+	ctx := context.Background()
+	_, err := client.Source(ctx, TypeJSON, Method{"open"})
+	r.NoError(err)
+	<-called
+	time.Sleep(10 * time.Millisecond)
+
+	for _, edp := range []Endpoint{client, client.WithOptions(), server} {
+		es = edp.Stats()
+		r.Equal(1, es.ActiveStreams)
+		r.GreaterOrEqual(es.OldestCall, 10*time.Millisecond)
+		r.False(es.LastActivity.Before(before))
+		r.NotZero(es.PacketsRead + es.PacketsWritten)
+	}
+
+	r.NoError(client.Terminate())
+	es = client.Stats()
+	r.Zero(es.ActiveStreams)
+	r.NotZero(es.PacketsWritten)
+}
+
+func TestEndpointStatsStalled(t *testing.T) {
+	r := require.New(t)
+
+	ended := make(chan error, 1)
+	var srv FakeHandler
+	srv.HandledCalls(func(m Method) bool { return true })
+	srv.HandleCallCalls(func(ctx context.Context, req *Request) {
+		snk, err := req.ResponseSink()
+		if err != nil {
+			req.CloseWithError(err)
+			return
+		}
+		snk.Write([]byte("one"))
+		// nothing follows, until the caller gives up on the stream
+		<-ctx.Done()
+		ended <- ctx.Err()
+	})
+
+	client, _ := connectPair(t, &FakeHandler{}, &srv,
+		[]HandleOption{WithoutManifest(), WithLogger(NopLogger()), WithStreamIdleTimeout(30 * time.Millisecond)},
+		[]HandleOption{WithoutManifest(), WithLogger(NopLogger())},
+	)
+
+	ctx := context.Background()
+	src, err := client.Source(ctx, TypeString, Method{"slow"})
+	r.NoError(err)
+	r.True(src.Next(ctx))
+	_, err = src.Bytes()
+	r.NoError(err)
+
+	r.False(src.Next(ctx))
+	r.True(errors.Is(src.Err(), ErrStreamStalled), "wrong error: %v", src.Err())
+
+	// the call is closed on both sides
+	select {
+	case <-ended:
+	case <-time.After(time.Second):
+		t.Fatal("the remote didn't learn about the stalled stream")
+	}
+	es := client.Stats()
+	r.Zero(es.ActiveStreams)
+	r.EqualValues(1, es.StalledStreams)
+}
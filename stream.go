@@ -102,10 +102,7 @@ func newEndOkayPacket(req int32, stream bool) codec.Packet {
 }
 
 func newEndErrPacket(req int32, stream bool, err error) (codec.Packet, error) {
-	body, err := json.Marshal(CallError{
-		Message: err.Error(),
-		Name:    "Error",
-	})
+	body, err := json.Marshal(newCallError(err))
 	if err != nil {
 		return codec.Packet{}, fmt.Errorf("error marshaling value: %w", err)
 	}
@@ -0,0 +1,55 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+//go:build go1.23
+// +build go1.23
+
+package muxrpc
+
+import (
+	"context"
+	"encoding/json"
+	"iter"
+)
+
+// Frames returns the remaining frames of the source for use with range:
+//
+//	for b, err := range src.Frames(ctx) {
+//		if err != nil {
+//			return err
+//		}
+//		...
+//	}
+//
+// If the stream fails, the last iteration carries the error. Breaking out of the loop leaves the stream open, use Cancel to end it.
+// The slices are not reused and stay valid after the iteration.
+func (bs *ByteSource) Frames(ctx context.Context) iter.Seq2[[]byte, error] {
+	return func(yield func([]byte, error) bool) {
+		for bs.Next(ctx) {
+			b, err := bs.Bytes()
+			if !yield(b, err) || err != nil {
+				return
+			}
+		}
+		if err := bs.Err(); err != nil {
+			yield(nil, err)
+		}
+	}
+}
+
+// FramesOf is like ByteSource.Frames but decodes every frame as JSON into a T.
+// A frame that fails to decode ends the iteration with its error.
+func FramesOf[T any](ctx context.Context, src *ByteSource) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		for b, err := range src.Frames(ctx) {
+			var v T
+			if err == nil {
+				err = json.Unmarshal(b, &v)
+			}
+			if !yield(v, err) || err != nil {
+				return
+			}
+		}
+	}
+}
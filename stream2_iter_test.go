@@ -0,0 +1,72 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+//go:build go1.23
+// +build go1.23
+
+package muxrpc
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ssbc/go-muxrpc/v2/codec"
+)
+
+func TestFrames(t *testing.T) {
+	r := require.New(t)
+
+	ctx := context.Background()
+	bpool := codec.NewTieredPool()
+
+	fill := func(frames ...string) *ByteSource {
+		src := newByteSource(ctx, bpool)
+		for _, frame := range frames {
+			r.NoError(src.consume(uint32(len(frame)), codec.FlagStream|codec.FlagJSON, strings.NewReader(frame)))
+		}
+		return src
+	}
+
+	src := fill(`1`, `2`, `3`)
+	src.end(nil)
+	var got []string
+	for b, err := range src.Frames(ctx) {
+		r.NoError(err)
+		got = append(got, string(b))
+	}
+	r.Equal([]string{"1", "2", "3"}, got)
+
+	// the error of the stream comes last
+	src = fill(`{"seq":1}`)
+	src.end(errors.New("broken"))
+	var seqs []int
+	var last error
+	for v, err := range FramesOf[struct{ Seq int }](ctx, src) {
+		if err != nil {
+			last = err
+			break
+		}
+		seqs = append(seqs, v.Seq)
+	}
+	r.Equal([]int{1}, seqs)
+	r.EqualError(last, "broken")
+
+	// frames that don't decode end the iteration
+	src = fill(`1`, `"two"`, `3`)
+	src.end(nil)
+	var ints []int
+	for v, err := range FramesOf[int](ctx, src) {
+		if err != nil {
+			last = err
+			break
+		}
+		ints = append(ints, v)
+	}
+	r.Equal([]int{1}, ints)
+	r.Error(last)
+}
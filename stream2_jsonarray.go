@@ -0,0 +1,119 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// AsJSONArrayStream reads the source as one JSON array, whose elements it returns one at a time.
+// Some JS sources send their results like that instead of one value per frame, split into frames wherever it suits them.
+// Arrays that follow each other are read as one. The source must not be read otherwise once this was called.
+func (bs *ByteSource) AsJSONArrayStream() *JSONArrayStream {
+	rd := &frameReader{src: bs}
+	return &JSONArrayStream{
+		rd:  rd,
+		dec: json.NewDecoder(rd),
+	}
+}
+
+// JSONArrayStream returns the elements of a JSON array that is spread over the frames of a source, see ByteSource.AsJSONArrayStream.
+type JSONArrayStream struct {
+	rd  *frameReader
+	dec *json.Decoder
+
+	inArray bool
+	cur     json.RawMessage
+	err     error
+}
+
+// Next blocks until the next element of the array was read.
+// It returns false at the end of the stream or if it failed, see Err.
+func (js *JSONArrayStream) Next(ctx context.Context) bool {
+	if js.err != nil {
+		return false
+	}
+	js.rd.ctx = ctx
+
+	for !js.inArray || !js.dec.More() {
+		tok, err := js.dec.Token()
+		if err == io.EOF && !js.inArray {
+			js.err = io.EOF
+			return false
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			js.err = fmt.Errorf("muxrpc: failed to read JSON array: %w", err)
+			return false
+		}
+
+		switch {
+		case !js.inArray && tok == json.Delim('['):
+			js.inArray = true
+		case js.inArray && tok == json.Delim(']'):
+			js.inArray = false
+		default:
+			js.err = fmt.Errorf("muxrpc: expected a JSON array, got %v", tok)
+			return false
+		}
+	}
+
+	js.cur = nil
+	if err := js.dec.Decode(&js.cur); err != nil {
+		js.err = fmt.Errorf("muxrpc: failed to read JSON array element: %w", err)
+		return false
+	}
+	return true
+}
+
+// Bytes returns the JSON encoding of the element that Next read.
+func (js *JSONArrayStream) Bytes() json.RawMessage { return js.cur }
+
+// Decode unmarshals the element that Next read into v.
+func (js *JSONArrayStream) Decode(v interface{}) error {
+	return json.Unmarshal(js.cur, v)
+}
+
+// Err returns why Next returned false, or nil if the stream ended after a complete array.
+func (js *JSONArrayStream) Err() error {
+	if js.err == io.EOF {
+		return nil
+	}
+	return js.err
+}
+
+// frameReader reads the frames of a source as one stream of bytes
+type frameReader struct {
+	src *ByteSource
+	ctx context.Context
+
+	// inFrame is true while the frame that Next announced wasn't read to its end
+	inFrame bool
+}
+
+func (fr *frameReader) Read(b []byte) (int, error) {
+	for {
+		if fr.inFrame {
+			n, err := fr.src.Read(b)
+			if err != io.EOF {
+				return n, err
+			}
+			fr.inFrame = false
+		}
+
+		if !fr.src.Next(fr.ctx) {
+			if err := fr.src.Err(); err != nil {
+				return 0, err
+			}
+			return 0, io.EOF
+		}
+		fr.inFrame = true
+	}
+}
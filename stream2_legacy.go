@@ -13,8 +13,6 @@ import (
 	"reflect"
 
 	"github.com/ssbc/go-luigi"
-
-	"github.com/ssbc/go-muxrpc/v2/codec"
 )
 
 // AsStream returns a legacy stream adapter for luigi code
@@ -45,7 +43,7 @@ func (stream *streamSource) Next(ctx context.Context) (interface{}, error) {
 	}
 
 	// TODO: flag is known at creation tyme and doesnt change other then end
-	if stream.source.hdrFlag.Get(codec.FlagJSON) {
+	if enc := stream.source.Encoding(); enc == TypeJSON {
 		var (
 			dst     interface{}
 			ptrType bool
@@ -77,7 +75,7 @@ func (stream *streamSource) Next(ctx context.Context) (interface{}, error) {
 			dst = reflect.ValueOf(dst).Elem().Interface()
 		}
 		return dst, nil
-	} else if stream.source.hdrFlag.Get(codec.FlagString) {
+	} else if enc == TypeString {
 		buf, err := stream.source.Bytes()
 		if err != nil {
 			return nil, err
@@ -20,27 +20,28 @@ func NewTestSink(w io.Writer) *ByteSink {
 		Req: 666,
 	}
 	bs.w = codec.NewWriter(w)
+	bs.clock = RealClock()
 
 	return &bs
 }
 
 func NewTestSource(bodies ...[]byte) *ByteSource {
 	fb := &frameBuffer{
-		store: &bytes.Buffer{},
+		store: newRingBuffer(nil),
 	}
 
 	for _, b := range bodies {
-		err := fb.copyBody(uint32(len(b)), bytes.NewReader(b))
+		err := fb.copyBody(uint32(len(b)), 0, bytes.NewReader(b))
 		if err != nil {
 			panic(err)
 		}
 
 	}
 	bs := &ByteSource{
-		bpool:  nil,
 		buf:    fb,
 		closed: make(chan struct{}),
 	}
+	bs.useClock(RealClock())
 	bs.streamCtx, bs.cancel = context.WithCancel(context.TODO())
 
 	return bs
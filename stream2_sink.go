@@ -6,6 +6,7 @@ package muxrpc
 
 import (
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -32,18 +33,69 @@ type ByteSink struct {
 	w *codec.Writer
 
 	closedMu sync.Mutex
-	closed   error
+	// closed is why nothing can be written anymore, if a write failed or the sink was closed with an error
+	closed error
+	// phase is how far the sink got with closing, closedByUser is set once Close or CloseWithError were called
+	phase        sinkPhase
+	closedByUser bool
 
 	streamCtx context.Context
 
 	pkt codec.Packet
+
+	// while corked, writes are collected in pending and sent together by Uncork
+	corked  bool
+	pending []codec.Packet
+
+	// seq is the number of the next frame, only used with strictAccounting
+	seq uint32
+
+	// wrote is set after the first packet went out
+	wrote bool
+
+	// trace is told about every packet that went out, if the endpoint has a Tracer
+	trace CallTrace
+
+	// queue takes the writes of all the sinks of the session to the connection, ordered by their prio (see Priority).
+	// last is the job of the previous write, the next one is only queued once the writer picked it up.
+	// Sinks without a queue write to w directly.
+	queue *writeQueue
+	last  *writeJob
+	prio  Priority
+
+	// quantum is how many bytes of a batch are written before other streams get a turn (see WithWriteQuantum)
+	quantum int
+
+	// chunkSize is the largest body of a packet, larger writes are split up (see SetChunkSize)
+	chunkSize int
+
+	// compressAbove is the size from which on bodies are compressed (see SetCompression)
+	compressAbove int
+
+	// readFromSize is how many bytes ReadFrom puts into a packet, zero means defaultReadFromSize
+	readFromSize int
+
+	// writeDeadline is when writes give up waiting for room in the queue (see SetWriteDeadline)
+	writeDeadline time.Time
+	clock         Clock
+
+	// used is called after packets went out, if it is set (see WithIdleTimeout)
+	used func()
+
+	// resumed is closed once the remote wants the data of the stream again, nil while it isn't paused (see HighWaterPause)
+	flowMu  sync.Mutex
+	resumed chan struct{}
+
+	// panicOnBug is set by WithPanicOnBug
+	panicOnBug bool
 }
 
 func newByteSink(ctx context.Context, w *codec.Writer) *ByteSink {
 	return &ByteSink{
 		streamCtx: ctx,
 
-		w: w,
+		w:     w,
+		clock: RealClock(),
 
 		pkt: codec.Packet{},
 	}
@@ -54,19 +106,161 @@ func (bs *ByteSink) SetEncoding(re RequestEncoding) {
 	defer bs.closedMu.Unlock()
 	encFlag, err := re.asCodecFlag()
 	if err != nil {
-		panic(err)
-	}
-	if re == TypeBinary {
-		bs.pkt.Flag = bs.pkt.Flag.Clear(codec.FlagJSON)
+		// the writes that follow would go out with the wrong encoding
+		if bs.closed == nil {
+			bs.closed = newBug(bs.panicOnBug, "sink set to %s", err)
+		}
+		return
 	}
-	bs.pkt.Flag = bs.pkt.Flag.Set(encFlag)
+	bs.pkt.Flag = bs.pkt.Flag.Clear(codec.FlagJSON | codec.FlagString).Set(encFlag)
 }
 
 func (bs *ByteSink) Write(b []byte) (int, error) {
+	return bs.write(b, untilDeadline)
+}
+
+// TryWrite is like Write but returns ErrWouldBlock instead of waiting if the previous write of the sink is still queued,
+// for instance because the remote doesn't keep up with reading, or if the remote paused the stream (see HighWaterPause).
+// Writes that are split into several turns (see SetChunkSize) only fail if the first one can't be queued right away.
+func (bs *ByteSink) TryWrite(b []byte) (int, error) {
+	return bs.write(b, noWait)
+}
+
+// SetWriteDeadline makes writes fail with ErrWriteTimeout if they can't be queued before t, because the connection is busy.
+// Nothing is sent then and the stream stays open. Writes return once they are queued, see WithWriteQueue.
+// The zero time disables it, which is the default. Closing the sink always waits for room.
+func (bs *ByteSink) SetWriteDeadline(t time.Time) {
 	bs.closedMu.Lock()
 	defer bs.closedMu.Unlock()
-	if bs.closed != nil {
-		return 0, bs.closed
+	bs.writeDeadline = t
+}
+
+// waitMode is how long a write waits for room in the queue
+type waitMode uint8
+
+const (
+	untilDeadline waitMode = iota // until the write deadline, if there is one
+	noWait                        // not at all (see TryWrite)
+	always                        // no matter what, like for the end of the stream
+)
+
+// send queues pkts to be written in one go, once the previous packets of the sink were picked up by the writer,
+// so that a stream never overtakes itself and the streams of a priority take turns. closedMu needs to be held.
+func (bs *ByteSink) send(mode waitMode, pkts ...codec.Packet) error {
+	var expired <-chan time.Time
+	if mode == untilDeadline && !bs.writeDeadline.IsZero() {
+		left := bs.writeDeadline.Sub(bs.clock.Now())
+		if left <= 0 {
+			return ErrWriteTimeout
+		}
+		t := bs.clock.NewTimer(left)
+		defer t.Stop()
+		expired = t.C()
+	}
+
+	// the end of the stream goes out even while the remote paused it
+	if mode != always {
+		if err := bs.waitForResume(mode, expired); err != nil {
+			return err
+		}
+	}
+
+	if bs.queue == nil {
+		if len(pkts) == 1 {
+			return bs.w.WritePacket(pkts[0])
+		}
+		return bs.w.WritePackets(pkts...)
+	}
+
+	if bs.last != nil {
+		if mode == noWait {
+			select {
+			case <-bs.last.taken:
+			default:
+				return ErrWouldBlock
+			}
+		} else {
+			select {
+			case <-bs.last.taken:
+			case <-expired:
+				return ErrWriteTimeout
+			case <-bs.queue.stop:
+				return ErrSessionTerminated
+			}
+		}
+	}
+
+	job := newWriteJob(pkts...)
+	if err := bs.queue.enqueue(bs.prio, job, mode, expired); err != nil {
+		return err
+	}
+	bs.last = job
+	return nil
+}
+
+// pause holds back writes until resume is called, because the remote buffered too much of the stream
+func (bs *ByteSink) pause() {
+	bs.flowMu.Lock()
+	defer bs.flowMu.Unlock()
+	if bs.resumed == nil {
+		bs.resumed = make(chan struct{})
+	}
+}
+
+func (bs *ByteSink) resume() {
+	bs.flowMu.Lock()
+	defer bs.flowMu.Unlock()
+	if bs.resumed != nil {
+		close(bs.resumed)
+		bs.resumed = nil
+	}
+}
+
+// waitForResume waits while the remote paused the stream, like send waits for room in the queue. closedMu needs to be held.
+func (bs *ByteSink) waitForResume(mode waitMode, expired <-chan time.Time) error {
+	bs.flowMu.Lock()
+	resumed := bs.resumed
+	bs.flowMu.Unlock()
+	if resumed == nil {
+		return nil
+	}
+	if mode == noWait {
+		return ErrWouldBlock
+	}
+
+	var stop <-chan struct{}
+	if bs.queue != nil {
+		stop = bs.queue.stop
+	}
+	select {
+	case <-resumed:
+		return nil
+	case <-expired:
+		return ErrWriteTimeout
+	case <-stop:
+		return ErrSessionTerminated
+	case <-bs.streamCtx.Done():
+		return bs.streamCtx.Err()
+	}
+}
+
+// sendFirst queues the packet that starts the call of the sink, ahead of what is written to it.
+func (bs *ByteSink) sendFirst(pkt codec.Packet) error {
+	bs.closedMu.Lock()
+	defer bs.closedMu.Unlock()
+	return bs.send(always, pkt)
+}
+
+// isBackpressure is true for the errors of writes that weren't queued in time, which leave the stream open
+func isBackpressure(err error) bool {
+	return err == ErrWouldBlock || err == ErrWriteTimeout
+}
+
+func (bs *ByteSink) write(b []byte, mode waitMode) (int, error) {
+	bs.closedMu.Lock()
+	defer bs.closedMu.Unlock()
+	if err := bs.writable(); err != nil {
+		return 0, err
 	}
 
 	// check if the sink was closed since the last write
@@ -79,25 +273,332 @@ func (bs *ByteSink) Write(b []byte) (int, error) {
 	}
 
 	if bs.pkt.Req == 0 {
-		return -1, fmt.Errorf("req ID not set (Flag: %s)", bs.pkt.Flag)
+		return -1, newBug(bs.panicOnBug, "req ID not set (Flag: %s)", bs.pkt.Flag)
 	}
 
-	bs.pkt.Body = b
-	err := bs.w.WritePacket(bs.pkt)
+	pkt, err := bs.packet(b)
 	if err != nil {
+		return -1, err
+	}
+
+	if bs.chunkSize > 0 && len(pkt.Body) > bs.chunkSize {
+		if err := bs.writeChunks(pkt, mode); err != nil {
+			return -1, err
+		}
+		return len(b), nil
+	}
+
+	if bs.corked {
+		// the caller might reuse b after we return
+		pkt.Body = append([]byte(nil), pkt.Body...)
+		bs.pending = append(bs.pending, bs.sequence(pkt))
+		return len(b), nil
+	}
+
+	pkt = bs.sequence(pkt)
+	if err := bs.send(mode, pkt); err != nil {
+		if isBackpressure(err) {
+			bs.unsequence([]codec.Packet{pkt})
+			return 0, err
+		}
 		bs.closed = err
 		return -1, err
 	}
+	bs.wrote = true
+	if bs.used != nil {
+		bs.used()
+	}
+	if bs.trace != nil {
+		bs.trace.PacketSent(pkt.Flag, len(pkt.Body))
+	}
 	return len(b), nil
 }
 
+// packet returns the packet for a write of b, compressed if the sink is set up for it. closedMu needs to be held.
+func (bs *ByteSink) packet(b []byte) (codec.Packet, error) {
+	pkt := bs.pkt
+	pkt.Body = b
+	if bs.compressAbove <= 0 || len(b) <= bs.compressAbove {
+		return pkt, nil
+	}
+
+	zb, err := compressBody(b)
+	if err != nil {
+		return codec.Packet{}, err
+	}
+	// not worth it if it doesn't get smaller
+	if len(zb) < len(b) {
+		pkt.Body = zb
+		pkt.Flag = pkt.Flag.Set(codec.FlagGzip)
+	}
+	return pkt, nil
+}
+
+// SetChunkSize makes the sink split writes that are larger than n bytes into packets of at most n bytes,
+// so that huge frames don't hold up the other streams of the connection or run into the size limit of a packet.
+// All but the last chunk are flagged with codec.FlagMore and the receiving ByteSource puts them back together into one frame.
+// Only use it if the session negotiated FeatureChunking (see WithHello), endpoints refuse chunks otherwise
+// and JS muxrpc would see every chunk as a frame of its own.
+// Zero (the default) disables it.
+func (bs *ByteSink) SetChunkSize(n int) {
+	bs.closedMu.Lock()
+	defer bs.closedMu.Unlock()
+	bs.chunkSize = n
+}
+
+// defaultReadFromSize is how many bytes ReadFrom puts into a packet, unless SetReadFromSize says otherwise
+const defaultReadFromSize = 32 * 1024
+
+// readFromBuffers holds buffers of defaultReadFromSize for ReadFrom
+var readFromBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, defaultReadFromSize)
+		return &b
+	},
+}
+
+// SetReadFromSize sets how many bytes ReadFrom reads into each packet, the default is 32KiB.
+func (bs *ByteSink) SetReadFromSize(n int) {
+	bs.closedMu.Lock()
+	defer bs.closedMu.Unlock()
+	bs.readFromSize = n
+}
+
+var _ io.ReaderFrom = (*ByteSink)(nil)
+
+// ReadFrom reads r until EOF and writes what it read as consecutive packets of the size set with SetReadFromSize.
+// Together with io.Copy this uploads a file as a blob in one line. The sink is not closed afterwards.
+func (bs *ByteSink) ReadFrom(r io.Reader) (int64, error) {
+	bs.closedMu.Lock()
+	size := bs.readFromSize
+	bs.closedMu.Unlock()
+
+	var buf []byte
+	if size <= 0 || size == defaultReadFromSize {
+		pooled := readFromBuffers.Get().(*[]byte)
+		defer readFromBuffers.Put(pooled)
+		buf = *pooled
+	} else {
+		buf = make([]byte, size)
+	}
+
+	var read int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		read += int64(n)
+		if n > 0 {
+			if _, werr := bs.Write(buf[:n]); werr != nil {
+				return read, werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return read, nil
+		}
+		if err != nil {
+			return read, err
+		}
+	}
+}
+
+// writeChunks splits the body of whole into packets of chunkSize and writes them like a batch. closedMu needs to be held.
+func (bs *ByteSink) writeChunks(whole codec.Packet, mode waitMode) error {
+	b := whole.Body
+	if bs.corked {
+		// the caller might reuse b after we return
+		b = append([]byte(nil), b...)
+	}
+	for off := 0; off < len(b); off += bs.chunkSize {
+		pkt := whole
+		end := off + bs.chunkSize
+		if end < len(b) {
+			pkt.Flag = pkt.Flag.Set(codec.FlagMore)
+		} else {
+			end = len(b)
+		}
+		pkt.Body = b[off:end]
+		bs.pending = append(bs.pending, bs.sequence(pkt))
+	}
+	if bs.corked {
+		return nil
+	}
+	return bs.flushPending(mode)
+}
+
+// Cork holds back all following writes until Uncork is called, which sends them with a single write to the connection.
+func (bs *ByteSink) Cork() {
+	bs.closedMu.Lock()
+	defer bs.closedMu.Unlock()
+	bs.corked = true
+}
+
+// Uncork sends all the writes since Cork and lets following writes through directly again.
+func (bs *ByteSink) Uncork() error {
+	bs.closedMu.Lock()
+	defer bs.closedMu.Unlock()
+	bs.corked = false
+	return bs.flushPending(untilDeadline)
+}
+
+// WriteBatch sends each of the passed bodies as a packet on this stream, using a single write to the connection.
+func (bs *ByteSink) WriteBatch(bodies [][]byte) error {
+	bs.closedMu.Lock()
+	defer bs.closedMu.Unlock()
+	if err := bs.writable(); err != nil {
+		return err
+	}
+
+	if bs.pkt.Req == 0 {
+		return newBug(bs.panicOnBug, "req ID not set (Flag: %s)", bs.pkt.Flag)
+	}
+
+	start := len(bs.pending)
+	for _, b := range bodies {
+		pkt, err := bs.packet(b)
+		if err != nil {
+			bs.pending = bs.pending[:start]
+			return err
+		}
+		bs.pending = append(bs.pending, bs.sequence(pkt))
+	}
+	if bs.corked {
+		// the caller might reuse the bodies after we return
+		for i := len(bs.pending) - len(bodies); i < len(bs.pending); i++ {
+			bs.pending[i].Body = append([]byte(nil), bs.pending[i].Body...)
+		}
+		return nil
+	}
+	return bs.flushPending(untilDeadline)
+}
+
+// state returns if anything was written and if the stream was closed.
+func (bs *ByteSink) state() (wrote, ended bool) {
+	bs.closedMu.Lock()
+	defer bs.closedMu.Unlock()
+	return bs.wrote, bs.phase == sinkClosed || bs.closed != nil
+}
+
+// pendingBytes returns the size of the bodies that are held back by Cork.
+func (bs *ByteSink) pendingBytes() int {
+	bs.closedMu.Lock()
+	defer bs.closedMu.Unlock()
+	var n int
+	for _, pkt := range bs.pending {
+		n += len(pkt.Body)
+	}
+	return n
+}
+
+// sequence appends the frame counter to stream packets if strictAccounting is enabled. closedMu needs to be held.
+func (bs *ByteSink) sequence(pkt codec.Packet) codec.Packet {
+	if !strictAccounting || !pkt.Flag.Get(codec.FlagStream) {
+		return pkt
+	}
+
+	body := make([]byte, len(pkt.Body)+seqTrailerLen)
+	copy(body, pkt.Body)
+	binary.BigEndian.PutUint32(body[len(pkt.Body):], bs.seq)
+	bs.seq++
+
+	pkt.Body = body
+	pkt.Flag = pkt.Flag.Set(codec.FlagSeq)
+	return pkt
+}
+
+// unsequence takes back the frame numbers of pkts, which weren't sent. closedMu needs to be held.
+func (bs *ByteSink) unsequence(pkts []codec.Packet) {
+	for _, pkt := range pkts {
+		if pkt.Flag.Get(codec.FlagSeq) {
+			bs.seq--
+		}
+	}
+}
+
+// flushPending queues the collected packets. Only the first turn waits for room as mode says,
+// once that was queued the others wait for theirs no matter what, so that a batch isn't cut in half. closedMu needs to be held.
+func (bs *ByteSink) flushPending(mode waitMode) error {
+	if len(bs.pending) == 0 {
+		return nil
+	}
+	pkts := bs.pending
+	bs.pending = nil
+
+	if bs.closed != nil {
+		return bs.closed
+	}
+
+	for len(pkts) > 0 {
+		n := bs.turnSize(pkts)
+
+		err := bs.send(mode, pkts[:n]...)
+		if isBackpressure(err) {
+			// nothing was sent, the frame numbers are given out again
+			bs.unsequence(pkts)
+			return err
+		}
+		if err != nil {
+			bs.closed = err
+			return err
+		}
+		mode = always
+		bs.wrote = true
+		if bs.used != nil {
+			bs.used()
+		}
+		if bs.trace != nil {
+			for _, pkt := range pkts[:n] {
+				bs.trace.PacketSent(pkt.Flag, len(pkt.Body))
+			}
+		}
+		pkts = pkts[n:]
+	}
+	return nil
+}
+
+// turnSize returns how many of pkts are written in one turn, at least one.
+func (bs *ByteSink) turnSize(pkts []codec.Packet) int {
+	if bs.quantum <= 0 {
+		return len(pkts)
+	}
+	size := 0
+	for i, pkt := range pkts {
+		size += codec.HeaderLength + len(pkt.Body)
+		if size > bs.quantum && i > 0 {
+			return i
+		}
+	}
+	return len(pkts)
+}
+
+// CloseWithError ends the stream with err, which is sent to the remote. Closing it again returns ErrAlreadyClosed.
 func (bs *ByteSink) CloseWithError(err error) error {
+	return bs.end(err, true)
+}
+
+// end sends the end of the stream. Sinks that were already closed by the endpoint, like after the remote ended the call,
+// can still be closed once by their user without an error.
+func (bs *ByteSink) end(err error, byUser bool) error {
 	bs.closedMu.Lock()
 	defer bs.closedMu.Unlock()
 
+	if bs.phase != sinkOpen {
+		if byUser && bs.closedByUser {
+			return ErrAlreadyClosed
+		}
+		bs.closedByUser = bs.closedByUser || byUser
+		return bs.closed
+	}
 	if bs.closed != nil {
 		return bs.closed
 	}
+	bs.phase = sinkEnding
+	bs.closedByUser = byUser
+
+	// send what was held back before the end of the stream
+	bs.corked = false
+	if err := bs.flushPending(always); err != nil {
+		bs.phase = sinkClosed
+		return err
+	}
 
 	var closePkt codec.Packet
 	var isStream = bs.pkt.Flag.Get(codec.FlagStream)
@@ -107,6 +608,7 @@ func (bs *ByteSink) CloseWithError(err error) error {
 		var epkt error
 		closePkt, epkt = newEndErrPacket(bs.pkt.Req, isStream, err)
 		if epkt != nil {
+			bs.phase = sinkOpen
 			return fmt.Errorf("close bytesink: error building error packet for %s: %w", err, epkt)
 		}
 		bs.closed = err
@@ -115,16 +617,24 @@ func (bs *ByteSink) CloseWithError(err error) error {
 	// tollerate timeout in writing closed packets
 	var errc = make(chan error)
 	go func() {
-		errc <- bs.w.WritePacket(closePkt)
+		errc <- bs.send(always, closePkt)
 	}()
 
 	select {
 	case werr := <-errc:
+		bs.phase = sinkClosed
 		if werr != nil {
 			bs.closed = werr
+		} else {
+			if bs.used != nil {
+				bs.used()
+			}
+			if bs.trace != nil {
+				bs.trace.PacketSent(closePkt.Flag, len(closePkt.Body))
+			}
 		}
 		return werr
-	case <-time.After(10 * time.Second):
+	case <-time.After(closeTimeout):
 		bs.closed = errors.New("muxrpc: close timeout exceeded")
 		return bs.closed
 	}
@@ -133,6 +643,26 @@ func (bs *ByteSink) CloseWithError(err error) error {
 	return nil
 }
 
+// closeTimeout is how long the end of a stream or the session waits for the connection to take what was queued
+const closeTimeout = 10 * time.Second
+
 func (bs *ByteSink) Close() error {
 	return bs.CloseWithError(io.EOF)
 }
+
+// sinkPhase tracks the end of a ByteSink: open, ending while its end is sent and closed once it went out.
+type sinkPhase uint8
+
+const (
+	sinkOpen sinkPhase = iota
+	sinkEnding
+	sinkClosed
+)
+
+// writable returns why nothing can be written to the sink, if that is the case. closedMu needs to be held.
+func (bs *ByteSink) writable() error {
+	if bs.phase != sinkOpen {
+		return writeAfterCloseError{cause: bs.closed}
+	}
+	return bs.closed
+}
@@ -14,8 +14,8 @@ import (
 	"io/ioutil"
 	"sync"
 	"sync/atomic"
+	"time"
 
-	"github.com/karrick/bufpool"
 	"github.com/ssbc/go-muxrpc/v2/codec"
 )
 
@@ -35,27 +35,65 @@ var _ ByteSourcer = (*ByteSource)(nil)
 
 // ByteSource is inspired by sql.Rows but without the Scan(), it just reads plain []bytes, one per muxrpc packet.
 type ByteSource struct {
-	bpool bufpool.FreeList
-	buf   *frameBuffer
+	buf *frameBuffer
 
-	mu     sync.Mutex
-	closed chan struct{}
-	failed error
+	// mu guards failed and released.
+	// failed is set exactly once, by fail, which also closes closed.
+	mu       sync.Mutex
+	closed   chan struct{}
+	failed   error
+	released bool
 
-	hdrFlag codec.Flag
+	// settled is closed once the first frame arrived or the stream ended, if anyone asked for it (see Call.Done)
+	settled    chan struct{}
+	hasSettled bool
+
+	// received is set to 1 once the first frame arrived
+	received uint32
+
+	// seq is the number of the next frame that is expected with codec.FlagSeq, only used by consume
+	seq uint32
+
+	// maxFrame is the largest frame a compressed body may inflate to or chunks may add up to, zero means defaultFrameLimit (see WithMaxPacketSize)
+	maxFrame uint32
+
+	// features reports the protocol extensions the session negotiated (see WithHello).
+	// It is nil for sources that don't belong to a session, which accept all of them.
+	features func(Feature) bool
+
+	// chunks collects the bodies of packets with codec.FlagMore until the last chunk of the frame arrives, only used by consume.
+	// chunksHeld is what they reserved in the memory budget so far, it is guarded by mu.
+	chunks     []byte
+	chunksHeld int64
+
+	// idle is how long Next waits for a new frame before the stream is considered stalled.
+	// lastFrame holds the unix nanos of when the last frame arrived (or the stream was created), accessed atomically.
+	idle      time.Duration
+	lastFrame int64
+
+	// stalled is called once the stream failed with ErrStreamStalled, so that the endpoint can close the call (see rpc.watchStall)
+	stalled func(error)
+
+	// readDeadline bounds how long Next waits for a frame, without ending the stream (see SetReadDeadline).
+	// timedOut is set if the last call to Next gave up because of it. Both are guarded by mu.
+	readDeadline time.Time
+	timedOut     bool
+
+	// clock is used for the idle timeout and the frame TTL
+	clock Clock
 
 	streamCtx context.Context
 	cancel    context.CancelFunc
 }
 
-func newByteSource(ctx context.Context, pool bufpool.FreeList) *ByteSource {
+func newByteSource(ctx context.Context, pool codec.BufferPool) *ByteSource {
 	bs := &ByteSource{
-		bpool: pool,
 		buf: &frameBuffer{
-			store: pool.Get(),
+			store: newRingBuffer(pool),
 		},
 		closed: make(chan struct{}),
 	}
+	bs.useClock(RealClock())
 	bs.streamCtx, bs.cancel = context.WithCancel(ctx)
 
 	return bs
@@ -63,27 +101,98 @@ func newByteSource(ctx context.Context, pool bufpool.FreeList) *ByteSource {
 
 // Cancel stops reading and terminates the request.
 // Sometimes we want to close a query early before it is drained.
+// The frames that were buffered but not read yet are dropped, which also closes the spill file of the stream (see WithDiskSpill).
+// That includes a frame that Next announced but that wasn't handed out yet, Bytes and Reader fail for it then.
 func (bs *ByteSource) Cancel(err error) {
+	bs.end(err)
+	bs.buf.discard()
+}
+
+// end is like Cancel but keeps the buffered frames, so that they can still be read.
+// It is used when the remote ended the stream or the session is gone.
+func (bs *ByteSource) end(err error) {
+	if err == nil {
+		err = io.EOF
+	}
+
 	bs.mu.Lock()
 	defer bs.mu.Unlock()
+	bs.fail(err)
+}
 
+// fail ends the stream with err, unless it already ended. It returns true if it did. bs.mu needs to be held.
+func (bs *ByteSource) fail(err error) bool {
 	if bs.failed != nil {
+		return false
+	}
+	bs.failed = err
+	close(bs.closed)
+	bs.settle()
+	bs.buf.releaseBudget()
+	bs.buf.budget.release(bs.chunksHeld)
+	bs.chunksHeld = 0
+	return true
+}
+
+// settle closes settled, once. bs.mu needs to be held.
+func (bs *ByteSource) settle() {
+	if bs.settled == nil || bs.hasSettled {
 		return
 	}
+	bs.hasSettled = true
+	close(bs.settled)
+}
 
-	if err == nil {
-		bs.failed = io.EOF
-	} else {
-		bs.failed = err
+// whenSettled returns a channel that is closed once there is a frame to read or the stream ended.
+// Unlike Next it doesn't need a goroutine to wait on it.
+func (bs *ByteSource) whenSettled() <-chan struct{} {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if bs.settled == nil {
+		bs.settled = make(chan struct{})
+		if bs.failed != nil || bs.buf.Frames() > 0 {
+			bs.settle()
+		}
 	}
-	close(bs.closed)
+	return bs.settled
+}
+
+// release returns the buffer of the stream to the pool, once it ended and was drained. bs.mu needs to be held.
+func (bs *ByteSource) release() {
+	if bs.released {
+		return
+	}
+	bs.released = true
+	bs.buf.mu.Lock()
+	bs.buf.store.release()
+	if bs.buf.spill != nil {
+		bs.buf.spill.close()
+	}
+	bs.buf.mu.Unlock()
+}
+
+// ended is true once the stream was canceled or the remote closed it.
+func (bs *ByteSource) ended() bool {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return bs.failed != nil
 }
 
-// Err returns nill or an error when processing fails or the context was canceled
+// Err returns nill or an error when processing fails or the context was canceled.
+// It returns ErrReadTimeout if the last call to Next ran into the read deadline and the stream is still open.
 func (bs *ByteSource) Err() error {
 	bs.mu.Lock()
 	defer bs.mu.Unlock()
 
+	if bs.failed == nil && bs.timedOut {
+		return ErrReadTimeout
+	}
+
+	// a dead connection is always reported, even if it ended with EOF
+	if errors.Is(bs.failed, ErrSessionTerminated) {
+		return bs.failed
+	}
+
 	if errors.Is(bs.failed, io.EOF) || errors.Is(bs.failed, context.Canceled) {
 		return nil
 	}
@@ -91,37 +200,160 @@ func (bs *ByteSource) Err() error {
 	return bs.failed
 }
 
+// useClock sets the clock of the source, the idle timeout starts over
+func (bs *ByteSource) useClock(c Clock) {
+	bs.clock = c
+	bs.buf.clock = c
+	atomic.StoreInt64(&bs.lastFrame, c.Now().UnixNano())
+}
+
+// SetFrameTTL makes the source drop frames that were buffered for longer then ttl, instead of returning them from Next.
+// This is useful for live streams where delayed updates are worthless if the consumer lags behind. Zero disables it.
+func (bs *ByteSource) SetFrameTTL(ttl time.Duration) {
+	bs.buf.mu.Lock()
+	defer bs.buf.mu.Unlock()
+
+	bs.buf.ttl = ttl
+	if ttl <= 0 {
+		bs.buf.arrived = nil
+		return
+	}
+
+	// frames that are already buffered count as arrived now
+	now := bs.clock.Now()
+	for uint32(len(bs.buf.arrived)) < bs.buf.Frames() {
+		bs.buf.arrived = append(bs.buf.arrived, now)
+	}
+}
+
+// SetIdleTimeout makes the stream fail with ErrStreamStalled if no frame arrived for d while the consumer waits in Next.
+// Zero disables it.
+func (bs *ByteSource) SetIdleTimeout(d time.Duration) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.idle = d
+}
+
+// SetReadDeadline makes Next return false if no frame arrived by t, without canceling the stream like the context of Next would.
+// Err returns ErrReadTimeout then and Next can be called again, for instance after the deadline was moved. The zero time disables it.
+func (bs *ByteSource) SetReadDeadline(t time.Time) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.readDeadline = t
+}
+
+// stall fails the stream with ErrStreamStalled, unless it already ended otherwise
+func (bs *ByteSource) stall(idle time.Duration) {
+	err := fmt.Errorf("%w: no frame for %s", ErrStreamStalled, idle)
+	bs.mu.Lock()
+	failed := bs.fail(err)
+	stalled := bs.stalled
+	bs.mu.Unlock()
+
+	if failed && stalled != nil {
+		stalled(err)
+	}
+}
+
+// Dropped returns the number of frames that were dropped because they were older then the frame TTL.
+func (bs *ByteSource) Dropped() uint64 {
+	bs.buf.mu.Lock()
+	defer bs.buf.mu.Unlock()
+	return bs.buf.dropped
+}
+
+// Encoding returns the encoding of the frame that Next announced, the one that Bytes, Reader and Read return.
+// Each frame keeps its own, so a stream can mix them.
+func (bs *ByteSource) Encoding() RequestEncoding {
+	flag := bs.buf.flag()
+	switch {
+	case flag.Get(codec.FlagJSON):
+		return TypeJSON
+	case flag.Get(codec.FlagString):
+		return TypeString
+	default:
+		return TypeBinary
+	}
+}
+
 // Next blocks until there are new muxrpc frames for this stream
 func (bs *ByteSource) Next(ctx context.Context) bool {
+	return bs.next(ctx, time.Time{})
+}
+
+// NextWithTimeout is like Next but gives up if no frame arrived within d, without canceling the stream.
+// Err returns ErrReadTimeout then. An earlier read deadline (see SetReadDeadline) still applies.
+func (bs *ByteSource) NextWithTimeout(ctx context.Context, d time.Duration) bool {
+	return bs.next(ctx, bs.clock.Now().Add(d))
+}
+
+// next waits for a frame until the stream ends, ctx is done or the earlier of deadline and the read deadline passed.
+// A zero deadline doesn't limit it.
+func (bs *ByteSource) next(ctx context.Context, deadline time.Time) bool {
+	bs.buf.nextFrame()
+	bs.buf.dropStale()
+
 	bs.mu.Lock()
-	if bs.failed != nil && bs.buf.frames == 0 {
+	bs.timedOut = false
+	if bs.failed != nil && bs.buf.Frames() == 0 {
 		// don't return buffer before stream is empty
 		// TODO: what if a stream isn't fully drained?!
-		bs.bpool.Put(bs.buf.store)
+		bs.release()
 		bs.mu.Unlock()
 		return false
 	}
-	if bs.buf.frames > 0 {
+	if bs.buf.Frames() > 0 {
 		bs.mu.Unlock()
 		return true
 	}
+	idle := bs.idle
+	if rd := bs.readDeadline; !rd.IsZero() && (deadline.IsZero() || rd.Before(deadline)) {
+		deadline = rd
+	}
 	bs.mu.Unlock()
 
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		t := bs.clock.NewTimer(deadline.Sub(bs.clock.Now()))
+		defer t.Stop()
+		expired = t.C()
+	}
+
+	var stalled <-chan time.Time
+	if idle > 0 {
+		last := time.Unix(0, atomic.LoadInt64(&bs.lastFrame))
+		t := bs.clock.NewTimer(idle - bs.clock.Now().Sub(last))
+		defer t.Stop()
+		stalled = t.C()
+	}
+
 	select {
-	case <-bs.streamCtx.Done():
+	case <-expired:
+		if bs.buf.Frames() > 0 {
+			return true
+		}
 		bs.mu.Lock()
 		defer bs.mu.Unlock()
-		if bs.failed == nil {
-			bs.failed = bs.streamCtx.Err()
+		bs.timedOut = bs.failed == nil
+		return false
+
+	case <-stalled:
+		if bs.buf.Frames() > 0 {
+			return true
 		}
+		bs.stall(idle)
+		return false
+
+	case <-bs.streamCtx.Done():
+		bs.mu.Lock()
+		defer bs.mu.Unlock()
+		bs.fail(bs.streamCtx.Err())
 		return bs.buf.Frames() > 0
 
 	case <-ctx.Done():
 		bs.mu.Lock()
 		defer bs.mu.Unlock()
-		if bs.failed == nil {
-			bs.failed = ctx.Err()
-		}
+		bs.fail(ctx.Err())
 		return false
 
 	case <-bs.closed:
@@ -142,10 +374,21 @@ func (bs *ByteSource) Reader(fn ReadFn) error {
 
 	bs.buf.mu.Lock()
 	err = fn(rd)
+	bs.buf.drained()
 	bs.buf.mu.Unlock()
 	return err
 }
 
+var _ io.Reader = (*ByteSource)(nil)
+
+// Read reads the body of the frame that Next announced, in as many calls as the caller needs for it.
+// It returns io.EOF once the frame was read to its end, call Next to get to the following one.
+// Unlike Bytes it doesn't need to hold the whole frame at once, so even large frames can be read with a small buffer.
+// If Next is called before the frame was read to its end, the rest of it is skipped.
+func (bs *ByteSource) Read(b []byte) (int, error) {
+	return bs.buf.read(b)
+}
+
 // Bytes returns the full slice of bytes from the next frame.
 func (bs *ByteSource) Bytes() ([]byte, error) {
 	_, rd, err := bs.buf.getNextFrameReader()
@@ -154,44 +397,320 @@ func (bs *ByteSource) Bytes() ([]byte, error) {
 	}
 	bs.buf.mu.Lock()
 	b, err := ioutil.ReadAll(rd)
+	bs.buf.drained()
 	bs.buf.mu.Unlock()
 	return b, err
 }
 
+// Peek returns a copy of the next frame without consuming it, for instance to decide how to decode it.
+// Like Bytes it needs a frame that Next announced. The following call to Bytes or Reader returns the same frame.
+func (bs *ByteSource) Peek() ([]byte, error) {
+	return bs.buf.peek()
+}
+
+// NextSize returns the size of the body of the next frame without consuming it, or -1 if there is none buffered.
+func (bs *ByteSource) NextSize() int {
+	size, err := bs.buf.peekLen()
+	if err != nil {
+		return -1
+	}
+	return int(size)
+}
+
+var _ io.WriterTo = (*ByteSource)(nil)
+
+// WriteTo copies the bodies of all remaining frames into w, one after the other, until the stream ends.
+// The frames are copied straight from the buffer of the stream, which makes it the cheapest way to save a blob to a file.
+func (bs *ByteSource) WriteTo(w io.Writer) (int64, error) {
+	return bs.WriteDelimitedTo(w, nil)
+}
+
+// WriteDelimitedTo is like WriteTo but writes delim after every frame, for instance a newline to get one JSON value per line.
+func (bs *ByteSource) WriteDelimitedTo(w io.Writer, delim []byte) (int64, error) {
+	var written int64
+	for bs.Next(bs.streamCtx) {
+		err := bs.Reader(func(rd io.Reader) error {
+			n, err := io.Copy(w, rd)
+			written += n
+			return err
+		})
+		if err != nil {
+			return written, err
+		}
+
+		if len(delim) > 0 {
+			n, err := w.Write(delim)
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, bs.Err()
+}
+
 func (bs *ByteSource) consume(pktLen uint32, flag codec.Flag, r io.Reader) error {
+	if flag.Get(codec.FlagSeq) {
+		body, err := bs.checkSequence(pktLen, r)
+		if err != nil {
+			return err
+		}
+		pktLen, r = uint32(len(body)), bytes.NewReader(body)
+	}
+
+	if flag.Get(codec.FlagMore) || bs.chunks != nil {
+		if !bs.allows(FeatureChunking) {
+			return fmt.Errorf("muxrpc: chunked frame without chunking: %w", ErrFeatureNotNegotiated)
+		}
+		body, done, err := bs.collectChunk(pktLen, flag, r)
+		if err != nil || !done {
+			return err
+		}
+		pktLen, r = uint32(len(body)), bytes.NewReader(body)
+		flag = flag.Clear(codec.FlagMore)
+	}
+
+	if flag.Get(codec.FlagGzip) {
+		if !bs.allows(FeatureCompression) {
+			return fmt.Errorf("muxrpc: compressed frame without compression: %w", ErrFeatureNotNegotiated)
+		}
+		max, overBudget := bs.frameLimit(), false
+		if room := bs.buf.budget.headroom(); room >= 0 && room < int64(max) {
+			max, overBudget = uint32(room), true
+		}
+		body, err := inflateBody(pktLen, r, max)
+		if err != nil {
+			if overBudget && errors.Is(err, ErrPacketTooLarge) {
+				return fmt.Errorf("muxrpc: can't buffer inflated frame: %w", ErrMemoryBudgetExceeded)
+			}
+			return err
+		}
+		pktLen, r = uint32(len(body)), bytes.NewReader(body)
+		flag = flag.Clear(codec.FlagGzip)
+	}
+
+	// frames beyond the spill threshold go to disk and don't count against the memory budget
+	toDisk := bs.buf.wantsSpill(pktLen)
+
+	// a consumer that fell behind only costs its own stream, the others keep going
+	if bs.buf.highWaterFail && !bs.buf.hasSpace() {
+		return fmt.Errorf("muxrpc: can't buffer frame of %d bytes: %w", pktLen, ErrSourceHighWater)
+	}
+
+	// account for the frame and its length prefix
+	need := int64(pktLen) + 4
+	if toDisk {
+		need = 0
+	}
+	if err := bs.reserve(need); err != nil {
+		return err
+	}
+
 	bs.mu.Lock()
 	defer bs.mu.Unlock()
 
 	if bs.failed != nil {
+		bs.buf.budget.release(need)
 		return fmt.Errorf("muxrpc: byte source canceled: %w", bs.failed)
 	}
 
-	bs.hdrFlag = flag
+	atomic.StoreUint32(&bs.received, 1)
+	atomic.StoreInt64(&bs.lastFrame, bs.clock.Now().UnixNano())
 
-	err := bs.buf.copyBody(pktLen, r)
+	var err error
+	if toDisk {
+		err = bs.buf.spillBody(pktLen, flag, r)
+	} else {
+		err = bs.buf.copyBody(pktLen, flag, r)
+	}
 	if err != nil {
+		bs.buf.budget.release(need)
 		return err
 	}
 
+	bs.settle()
+	return nil
+}
+
+// seqTrailerLen is the size of the frame counter that is appended to bodies with codec.FlagSeq
+const seqTrailerLen = 4
+
+// checkSequence reads a body with a frame counter and returns it without the counter, if it is the expected one.
+func (bs *ByteSource) checkSequence(pktLen uint32, r io.Reader) ([]byte, error) {
+	if pktLen < seqTrailerLen {
+		return nil, fmt.Errorf("muxrpc: packet too short for frame counter (%d)", pktLen)
+	}
+
+	body := make([]byte, pktLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("muxrpc: failed to read counted frame: %w", err)
+	}
+
+	n := len(body) - seqTrailerLen
+	got := binary.BigEndian.Uint32(body[n:])
+	if got != bs.seq {
+		return nil, fmt.Errorf("%w: expected frame %d but got %d", ErrFrameLoss, bs.seq, got)
+	}
+	bs.seq++
+
+	return body[:n], nil
+}
+
+// reserve accounts for n bytes in the memory budget of the connection.
+// Depending on its policy, it waits until there is enough room or fails right away.
+func (bs *ByteSource) reserve(n int64) error {
+	for n > 0 {
+		ok, freed := bs.buf.budget.reserve(n)
+		if ok {
+			return nil
+		}
+		if !bs.buf.budget.block {
+			return fmt.Errorf("muxrpc: can't buffer %d more bytes: %w", n, ErrMemoryBudgetExceeded)
+		}
+
+		select {
+		case <-freed:
+		case <-bs.closed:
+			bs.mu.Lock()
+			err := bs.failed
+			bs.mu.Unlock()
+			return fmt.Errorf("muxrpc: byte source canceled: %w", err)
+		case <-bs.streamCtx.Done():
+			return fmt.Errorf("muxrpc: byte source canceled: %w", bs.streamCtx.Err())
+		}
+	}
 	return nil
 }
 
+// defaultFrameLimit bounds inflated and chunked frames of sessions without WithMaxPacketSize
+const defaultFrameLimit = 64 << 20
+
+// frameLimit returns the largest frame that chunks may add up to or a compressed body may inflate to
+func (bs *ByteSource) frameLimit() uint32 {
+	if bs.maxFrame > 0 {
+		return bs.maxFrame
+	}
+	return defaultFrameLimit
+}
+
+// allows is true if the session negotiated f, or the source doesn't belong to one
+func (bs *ByteSource) allows(f Feature) bool {
+	return bs.features == nil || bs.features(f)
+}
+
+// collectChunk adds a chunk to the frame that is put back together.
+// Once the last chunk arrived, done is true and body is the whole frame.
+// The chunks count against the memory budget while they are collected, the whole frame is accounted for like any other once it is done.
+func (bs *ByteSource) collectChunk(pktLen uint32, flag codec.Flag, r io.Reader) (body []byte, done bool, err error) {
+	if max := bs.frameLimit(); uint64(len(bs.chunks))+uint64(pktLen) > uint64(max) {
+		bs.dropChunks()
+		return nil, false, fmt.Errorf("muxrpc: chunked frame exceeds %d bytes: %w", max, ErrPacketTooLarge)
+	}
+
+	if err := bs.reserve(int64(pktLen)); err != nil {
+		bs.dropChunks()
+		return nil, false, err
+	}
+	bs.mu.Lock()
+	if bs.failed != nil {
+		// ended while waiting for the budget, fail already gave back what was held before
+		bs.mu.Unlock()
+		bs.buf.budget.release(int64(pktLen))
+		bs.chunks = nil
+		return nil, false, fmt.Errorf("muxrpc: byte source canceled: %w", bs.failed)
+	}
+	bs.chunksHeld += int64(pktLen)
+	bs.mu.Unlock()
+
+	start := len(bs.chunks)
+	if bs.chunks == nil {
+		bs.chunks = make([]byte, 0, pktLen)
+	}
+	bs.chunks = append(bs.chunks, make([]byte, pktLen)...)
+	if _, err := io.ReadFull(r, bs.chunks[start:]); err != nil {
+		bs.dropChunks()
+		return nil, false, fmt.Errorf("muxrpc: failed to read chunk: %w", err)
+	}
+
+	if flag.Get(codec.FlagMore) {
+		// a frame that is still coming in keeps the call from timing out
+		atomic.StoreUint32(&bs.received, 1)
+		atomic.StoreInt64(&bs.lastFrame, bs.clock.Now().UnixNano())
+		return nil, false, nil
+	}
+	body = bs.chunks
+	bs.dropChunks()
+	return body, true, nil
+}
+
+// dropChunks forgets the frame that was put back together and gives back what its chunks reserved
+func (bs *ByteSource) dropChunks() {
+	bs.chunks = nil
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.buf.budget.release(bs.chunksHeld)
+	bs.chunksHeld = 0
+}
+
+// hasReceived returns true if the remote sent data on this stream
+func (bs *ByteSource) hasReceived() bool {
+	return atomic.LoadUint32(&bs.received) == 1
+}
+
 // utils
 
 // frame buffer: a buffer frames and a frame is length+body.
-// it stores muxrpc body packets with their length as one contiguous stream in a bytes.Buffer
+// it stores muxrpc body packets with their length as one contiguous stream in a ringBuffer
 type frameBuffer struct {
 	mu    sync.Mutex
-	store *bytes.Buffer
+	store *ringBuffer
+
+	// spill holds the frames that came in while the store was over the spill threshold, nil if the connection doesn't spill (see WithDiskSpill).
+	// They are always newer than the frames in the store.
+	spill *spillFile
+
+	// cur is where the frame that was handed out last is read from, the store or spill
+	cur io.Reader
 
 	// TODO[weird-chans]: why exactly do you need a list of channels here
 	waiting []chan<- struct{}
 
+	// highWater is the number of bytes in the store after which the remote is asked to pause the stream,
+	// or the stream fails with ErrSourceHighWater if highWaterFail is set (see HighWaterPolicy).
+	// Spilled frames don't count, they are bounded by the disk quota. zero means unbounded.
+	highWater     int
+	highWaterFail bool
+
+	// flow tells the remote to pause or resume sending on the stream, nil if it can't be paused (see rpc.watchFlow).
+	// paused is set while the remote was asked to pause.
+	flow   func(pause bool)
+	paused bool
+
+	// budget is shared by all streams of a connection, nil means unlimited.
+	// unbudgeted is set once the stream ended and the frames it still holds were given back to it.
+	budget     *memoryBudget
+	unbudgeted bool
+
+	// frames older then ttl are dropped instead of handed to the consumer.
+	// arrived holds the arrival time of each buffered frame while a ttl is set.
+	ttl     time.Duration
+	arrived []time.Time
+	dropped uint64
+	clock   Clock
+
 	// how much of the current frame has been read
 	// to advance/skip store correctly
 	currentFrameTotal uint32
 	currentFrameRead  uint32
 
+	// readState is how far ByteSource.Read got with the frame that Next announced
+	readState frameReadState
+
+	// flags holds the header flags of each buffered frame, curFlag those of the frame that was handed out last
+	flags   []codec.Flag
+	curFlag codec.Flag
+
 	frames uint32
 
 	lenBuf [4]byte
@@ -201,23 +720,106 @@ func (fb *frameBuffer) Frames() uint32 {
 	return atomic.LoadUint32(&fb.frames)
 }
 
-func (fb *frameBuffer) copyBody(pktLen uint32, rd io.Reader) error {
+// Buffered returns how many bytes the consumer didn't read yet, including the length prefixes of the frames
+func (fb *frameBuffer) Buffered() int {
 	fb.mu.Lock()
 	defer fb.mu.Unlock()
+	return fb.buffered()
+}
 
-	binary.LittleEndian.PutUint32(fb.lenBuf[:], uint32(pktLen))
-	fb.store.Write(fb.lenBuf[:])
+// buffered is Buffered without locking, fb.mu needs to be held
+func (fb *frameBuffer) buffered() int {
+	if fb.spill == nil {
+		return fb.store.Len()
+	}
+	return fb.store.Len() + fb.spill.Len()
+}
 
-	copied, err := io.Copy(fb.store, rd)
-	if err != nil {
+// next returns where the next frame is read from, fb.mu needs to be held
+func (fb *frameBuffer) next() io.Reader {
+	if fb.store.Len() > 0 || fb.spill == nil || fb.spill.Len() == 0 {
+		return fb.store
+	}
+	return fb.spill
+}
+
+// wantsSpill is true if a frame of pktLen bytes should go to disk.
+// Once a frame was spilled, all the following ones are too, until the consumer read them all, so that they stay in order.
+func (fb *frameBuffer) wantsSpill(pktLen uint32) bool {
+	if fb.spill == nil {
+		return false
+	}
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	return fb.spill.Len() > 0 || fb.store.Len()+int(pktLen)+4 > fb.spill.cfg.threshold
+}
+
+// spillBody is like copyBody but appends the frame to the spill file
+func (fb *frameBuffer) spillBody(pktLen uint32, flag codec.Flag, rd io.Reader) error {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	need := int64(pktLen) + 4
+	if err := fb.spill.reserve(need); err != nil {
 		return err
 	}
+	start := fb.spill.wr
+
+	binary.LittleEndian.PutUint32(fb.lenBuf[:], uint32(pktLen))
+	_, err := fb.spill.Write(fb.lenBuf[:])
+	if err != nil {
+		fb.spill.unwrite(start, need)
+		return fmt.Errorf("muxrpc: failed to spill frame: %w", err)
+	}
 
+	copied, err := io.Copy(fb.spill, rd)
+	if err != nil {
+		fb.spill.unwrite(start, need)
+		return fmt.Errorf("muxrpc: failed to spill frame: %w", err)
+	}
 	if uint32(copied) != pktLen {
+		fb.spill.unwrite(start, need)
 		return errors.New("frameBuffer: failed to consume whole body")
 	}
 
+	fb.added(flag)
+	return nil
+}
+
+func (fb *frameBuffer) copyBody(pktLen uint32, flag codec.Flag, rd io.Reader) error {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	binary.LittleEndian.PutUint32(fb.lenBuf[:], uint32(pktLen))
+	fb.store.Grow(len(fb.lenBuf) + int(pktLen))
+	fb.store.Write(fb.lenBuf[:])
+
+	err := fb.store.readFull(rd, int(pktLen))
+	if err != nil {
+		// drop the length again, so that the frames stay readable
+		fb.store.truncate(len(fb.lenBuf))
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return errors.New("frameBuffer: failed to consume whole body")
+		}
+		return err
+	}
+
+	fb.added(flag)
+	return nil
+}
+
+// added accounts for a new frame and wakes up the consumers that wait for it. fb.mu needs to be held.
+func (fb *frameBuffer) added(flag codec.Flag) {
 	atomic.AddUint32(&fb.frames, 1)
+	fb.flags = append(fb.flags, flag)
+	if fb.ttl > 0 {
+		fb.arrived = append(fb.arrived, fb.clock.Now())
+	}
+
+	if fb.flow != nil && !fb.paused && fb.highWater > 0 && fb.store.Len() >= fb.highWater {
+		fb.paused = true
+		fb.flow(true)
+	}
 
 	// TODO[weird-chans]: why exactly do you need a list of channels here
 	if n := len(fb.waiting); n > 0 {
@@ -226,7 +828,6 @@ func (fb *frameBuffer) copyBody(pktLen uint32, rd io.Reader) error {
 		}
 		fb.waiting = make([]chan<- struct{}, 0)
 	}
-	return nil
 }
 
 func (fb *frameBuffer) waitForMore() <-chan struct{} {
@@ -245,38 +846,273 @@ func (fb *frameBuffer) waitForMore() <-chan struct{} {
 	return ch
 }
 
+func (fb *frameBuffer) hasSpace() bool {
+	if fb.highWater <= 0 {
+		return true
+	}
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	return fb.store.Len() < fb.highWater
+}
+
+// drained resumes a paused remote once the consumer read the stream down to half of the high-water mark,
+// so that it isn't paused and resumed for every frame. fb.mu needs to be held.
+func (fb *frameBuffer) drained() {
+	if fb.paused && fb.store.Len() <= fb.highWater/2 {
+		fb.paused = false
+		fb.flow(false)
+	}
+}
+
 func (fb *frameBuffer) getNextFrameReader() (uint32, io.Reader, error) {
 	fb.mu.Lock()
 	defer fb.mu.Unlock()
 
+	pktLen, err := fb.openFrame()
+	fb.drained()
+	if err != nil {
+		return 0, nil, err
+	}
+	fb.readState = frameHandedOut
+
+	rd := &countingReader{
+		rd:   io.LimitReader(fb.cur, int64(pktLen)),
+		read: &fb.currentFrameRead,
+	}
+	return pktLen, rd, nil
+}
+
+// openFrame skips what is left of the current frame and makes the next one the current one. fb.mu needs to be held.
+func (fb *frameBuffer) openFrame() (uint32, error) {
+	fb.skipCurrentFrame()
+
+	src := fb.next()
+	_, err := io.ReadFull(src, fb.lenBuf[:])
+	if err != nil {
+		return 0, fmt.Errorf("muxrpc: didnt get length of next body (frames:%d): %w", fb.frames, err)
+	}
+	pktLen := binary.LittleEndian.Uint32(fb.lenBuf[:])
+
+	// the frame is handed to the consumer, stop accounting for it
+	fb.unreserve(src, pktLen)
+	if len(fb.arrived) > 0 {
+		fb.arrived = fb.arrived[1:]
+	}
+	fb.curFlag, fb.flags = fb.flags[0], fb.flags[1:]
+
+	fb.cur = src
+	fb.currentFrameRead = 0
+	fb.currentFrameTotal = pktLen
+
+	// fb.frames--
+	atomic.AddUint32(&fb.frames, ^uint32(0))
+	return pktLen, nil
+}
+
+// read copies the next bytes of the current frame into b, see ByteSource.Read
+func (fb *frameBuffer) read(b []byte) (int, error) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	switch fb.readState {
+	case frameHandedOut:
+		return 0, io.EOF
+	case frameUnread:
+		if _, err := fb.openFrame(); err != nil {
+			return 0, err
+		}
+		fb.readState = frameReading
+	}
+
+	left := fb.currentFrameTotal - fb.currentFrameRead
+	if left == 0 {
+		fb.readState = frameHandedOut
+		return 0, io.EOF
+	}
+	if uint32(len(b)) > left {
+		b = b[:left]
+	}
+
+	n, err := fb.cur.Read(b)
+	fb.currentFrameRead += uint32(n)
+	fb.drained()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// nextFrame makes the following call to Read start on the next frame
+func (fb *frameBuffer) nextFrame() {
+	fb.mu.Lock()
+	fb.readState = frameUnread
+	fb.mu.Unlock()
+}
+
+// flag returns the header flags of the frame that Next announced
+func (fb *frameBuffer) flag() codec.Flag {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	if fb.readState == frameUnread && len(fb.flags) > 0 {
+		return fb.flags[0]
+	}
+	return fb.curFlag
+}
+
+// peekLen returns the length of the next frame without consuming it
+func (fb *frameBuffer) peekLen() (uint32, error) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	pktLen, _, _, err := fb.peekFrame()
+	return pktLen, err
+}
+
+// peek returns a copy of the body of the next frame without consuming it
+func (fb *frameBuffer) peek() ([]byte, error) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	pktLen, src, off, err := fb.peekFrame()
+	if err != nil {
+		return nil, err
+	}
+
+	body := make([]byte, pktLen)
+	if n := src.peekAt(body, off+len(fb.lenBuf)); n != len(body) {
+		return nil, fmt.Errorf("muxrpc: frame of %d bytes is incomplete (%d)", pktLen, n)
+	}
+	return body, nil
+}
+
+// peeker is what the next frame can be read from without consuming it, the store or the spill file
+type peeker interface {
+	peekAt(b []byte, off int) int
+}
+
+// peekFrame returns the length of the next frame and where it starts, behind what is left of the current one.
+// Since the current frame might still be read with Read, nothing is consumed. fb.mu needs to be held.
+func (fb *frameBuffer) peekFrame() (uint32, peeker, int, error) {
+	if fb.frames == 0 {
+		return 0, nil, 0, fmt.Errorf("muxrpc: no frame to peek: %w", io.EOF)
+	}
+
+	src, off := fb.next().(peeker), 0
+	if rest := int(fb.currentFrameTotal - fb.currentFrameRead); rest > 0 {
+		src, off = fb.cur.(peeker), rest
+		// the spilled frames start where the store ends
+		if fb.cur == io.Reader(fb.store) && fb.store.Len() == rest {
+			src, off = fb.spill, 0
+		}
+	}
+
+	var lenBuf [4]byte
+	if n := src.peekAt(lenBuf[:], off); n != len(lenBuf) {
+		return 0, nil, 0, fmt.Errorf("muxrpc: didnt get length of next body (frames:%d): %w", fb.frames, io.ErrUnexpectedEOF)
+	}
+	return binary.LittleEndian.Uint32(lenBuf[:]), src, off, nil
+}
+
+// unreserve gives back what a frame that was read from src reserved in the memory budget.
+// Spilled frames didn't reserve anything. fb.mu needs to be held.
+func (fb *frameBuffer) unreserve(src io.Reader, pktLen uint32) {
+	if src == io.Reader(fb.store) && !fb.unbudgeted {
+		fb.budget.release(int64(pktLen) + 4)
+	}
+}
+
+// releaseBudget gives back all that the buffered frames reserved in the memory budget, once the stream ended.
+// They can still be read but don't keep the other streams of the connection from buffering anymore.
+func (fb *frameBuffer) releaseBudget() {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	if fb.budget == nil || fb.unbudgeted {
+		return
+	}
+	fb.unbudgeted = true
+
+	// the frame that is read right now was already given back
+	held := fb.store.Len()
+	if rest := int(fb.currentFrameTotal - fb.currentFrameRead); rest > 0 && fb.cur == io.Reader(fb.store) {
+		held -= rest
+	}
+	fb.budget.release(int64(held))
+}
+
+// discard drops the frames that weren't read yet and gives back their memory and disk space
+func (fb *frameBuffer) discard() {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	fb.store.release()
+	if fb.spill != nil {
+		fb.spill.close()
+	}
+	atomic.StoreUint32(&fb.frames, 0)
+	fb.arrived = nil
+	fb.flags = nil
+	fb.cur = nil
+	fb.currentFrameTotal, fb.currentFrameRead = 0, 0
+	fb.readState = frameHandedOut
+}
+
+// skipCurrentFrame discards what wasn't read of the last frame that was handed out. fb.mu needs to be held.
+func (fb *frameBuffer) skipCurrentFrame() {
 	if fb.currentFrameTotal != 0 {
 		// if the last frame hasn't been fully read
 		diff := int64(fb.currentFrameTotal - fb.currentFrameRead)
 		if diff > 0 {
 			// seek it into /dev/null
-			io.Copy(ioutil.Discard, io.LimitReader(fb.store, diff))
+			io.Copy(ioutil.Discard, io.LimitReader(fb.cur, diff))
 		}
+		fb.currentFrameTotal = 0
+		fb.currentFrameRead = 0
 	}
+}
 
-	_, err := fb.store.Read(fb.lenBuf[:])
-	if err != nil {
-		return 0, nil, fmt.Errorf("muxrpc: didnt get length of next body (frames:%d): %w", fb.frames, err)
+// dropStale discards all frames that are older then the ttl
+func (fb *frameBuffer) dropStale() {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	if fb.ttl <= 0 || len(fb.arrived) == 0 {
+		return
 	}
-	pktLen := binary.LittleEndian.Uint32(fb.lenBuf[:])
 
-	fb.currentFrameRead = 0
-	fb.currentFrameTotal = pktLen
+	now := fb.clock.Now()
+	for len(fb.arrived) > 0 && now.Sub(fb.arrived[0]) > fb.ttl {
+		fb.skipCurrentFrame()
 
-	rd := &countingReader{
-		rd:   io.LimitReader(fb.store, int64(pktLen)),
-		read: &fb.currentFrameRead,
-	}
+		src := fb.next()
+		_, err := io.ReadFull(src, fb.lenBuf[:])
+		if err != nil {
+			return
+		}
+		pktLen := binary.LittleEndian.Uint32(fb.lenBuf[:])
+		io.Copy(ioutil.Discard, io.LimitReader(src, int64(pktLen)))
 
-	// fb.frames--
-	atomic.AddUint32(&fb.frames, ^uint32(0))
-	return pktLen, rd, nil
+		fb.unreserve(src, pktLen)
+		fb.arrived = fb.arrived[1:]
+		fb.flags = fb.flags[1:]
+		atomic.AddUint32(&fb.frames, ^uint32(0))
+		fb.dropped++
+	}
+	fb.drained()
 }
 
+// frameReadState tracks the frame that is read with ByteSource.Read
+type frameReadState uint8
+
+const (
+	// frameUnread means the next call to Read starts on the next frame
+	frameUnread frameReadState = iota
+
+	// frameReading means Read is in the middle of the current frame
+	frameReading
+
+	// frameHandedOut means the current frame was read to its end, or handed out with Bytes or Reader
+	frameHandedOut
+)
+
 type countingReader struct {
 	rd io.Reader
 
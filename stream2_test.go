@@ -7,17 +7,21 @@ package muxrpc
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 
-	"github.com/karrick/bufpool"
 	"github.com/pkg/errors"
 	"github.com/ssbc/go-muxrpc/v2/codec"
 	"github.com/ssbc/go-muxrpc/v2/debug"
@@ -30,8 +34,7 @@ func TestSourceBytesFill(t *testing.T) {
 
 	ctx := context.Background()
 
-	bpool, err := bufpool.NewLockPool()
-	r.NoError(err)
+	bpool := codec.NewTieredPool()
 	var bs = newByteSource(ctx, bpool)
 
 	var exp = [][]byte{
@@ -64,13 +67,54 @@ func TestSourceBytesFill(t *testing.T) {
 	}
 }
 
+// TestSourceAllocs guards the allocations of the hot path of a source: buffering a frame, Next and reading it.
+func TestSourceAllocs(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+
+	bpool := codec.NewTieredPool()
+	bs := newByteSource(ctx, bpool)
+
+	body := bytes.Repeat([]byte("a"), 512)
+	rd := bytes.NewReader(body)
+	consume := func() {
+		rd.Reset(body)
+		if err := bs.consume(uint32(len(body)), codec.FlagStream, rd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := make([]byte, len(body))
+	read := func() {
+		err := bs.Reader(func(rd io.Reader) error {
+			_, err := io.ReadFull(rd, buf)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r.Zero(testing.AllocsPerRun(100, consume), "consume")
+	r.Zero(testing.AllocsPerRun(100, func() {
+		if !bs.Next(ctx) {
+			t.Fatal("no frame")
+		}
+	}), "Next with a buffered frame")
+
+	// the limited reader of the frame
+	r.LessOrEqual(testing.AllocsPerRun(100, func() {
+		consume()
+		bs.Next(ctx)
+		read()
+	}), 2.0, "frame round trip")
+}
+
 func TestSourceBytesOneByOne(t *testing.T) {
 	r := require.New(t)
 
 	ctx := context.Background()
 
-	bpool, err := bufpool.NewLockPool()
-	r.NoError(err)
+	bpool := codec.NewTieredPool()
 	var bs = newByteSource(ctx, bpool)
 
 	var exp = [][]byte{
@@ -105,8 +149,7 @@ func TestSourceBytesDontReadAll(t *testing.T) {
 
 	ctx := context.Background()
 
-	bpool, err := bufpool.NewLockPool()
-	r.NoError(err)
+	bpool := codec.NewTieredPool()
 	var bs = newByteSource(ctx, bpool)
 
 	var exp = [][]byte{
@@ -126,7 +169,7 @@ func TestSourceBytesDontReadAll(t *testing.T) {
 		has := bs.Next(ctx)
 		r.True(has, "expected more from source")
 
-		err = bs.Reader(func(rd io.Reader) error {
+		err := bs.Reader(func(rd io.Reader) error {
 			n, err := rd.Read(buf)
 			r.NoError(err)
 			r.Equal(1, n)
@@ -199,8 +242,10 @@ func setupSource(t testing.TB, expRx []map[string]interface{}) Endpoint {
 	ctx := context.Background()
 
 	var rpc2 Endpoint
+	rpc2started := make(chan struct{})
 	go func() {
 		rpc2 = Handle(NewPacker(c2), &fh2)
+		close(rpc2started)
 		serve(ctx, rpc2.(Server), errc, serve2)
 	}()
 
@@ -219,6 +264,7 @@ func setupSource(t testing.TB, expRx []map[string]interface{}) Endpoint {
 	case <-time.After(2 * time.Second):
 		t.Fatal("connect timeout")
 	}
+	<-rpc2started
 
 	t.Cleanup(func() {
 		err := rpc1.Terminate()
@@ -352,3 +398,1044 @@ func BenchmarkSourceByte(b *testing.B) {
 		// r.Equal(expIdx, count, "expected more items")
 	}
 }
+
+func TestSourceHighWaterMark(t *testing.T) {
+	r := require.New(t)
+
+	ctx := context.Background()
+
+	bpool := codec.NewTieredPool()
+	var bs = newByteSource(ctx, bpool)
+	bs.buf.highWater = 20
+
+	var signals []bool
+	bs.buf.flow = func(pause bool) { signals = append(signals, pause) }
+
+	// 4 bytes length prefix + 6 body = 10 bytes
+	r.NoError(bs.consume(6, codec.FlagStream, strings.NewReader("first!")))
+	r.Empty(signals)
+	r.NoError(bs.consume(6, codec.FlagStream, strings.NewReader("second")))
+	r.Equal([]bool{true}, signals)
+
+	// frames that were already underway are still taken, without asking again
+	r.NoError(bs.consume(6, codec.FlagStream, strings.NewReader("third!")))
+	r.Equal([]bool{true}, signals)
+
+	// the remote is resumed once the consumer read half of it
+	for i, want := range []string{"first!", "second"} {
+		r.True(bs.Next(ctx))
+		b, err := bs.Bytes()
+		r.NoError(err)
+		r.Equal(want, string(b))
+		if i == 0 {
+			r.Equal([]bool{true}, signals)
+		}
+	}
+	r.Equal([]bool{true, false}, signals)
+}
+
+func TestSourceHighWaterMarkFail(t *testing.T) {
+	r := require.New(t)
+
+	ctx := context.Background()
+
+	bpool := codec.NewTieredPool()
+	var bs = newByteSource(ctx, bpool)
+	bs.buf.highWater = 10
+	bs.buf.highWaterFail = true
+
+	// 4 bytes length prefix + 6 body = 10 bytes
+	r.NoError(bs.consume(6, codec.FlagStream, strings.NewReader("first!")))
+
+	// the stream fails instead of holding up the connection
+	err := bs.consume(6, codec.FlagStream, strings.NewReader("second"))
+	r.True(errors.Is(err, ErrSourceHighWater), "unexpected error: %v", err)
+
+	// once the consumer caught up there is space again
+	r.True(bs.Next(ctx))
+	b, err := bs.Bytes()
+	r.NoError(err)
+	r.Equal("first!", string(b))
+	r.NoError(bs.consume(6, codec.FlagStream, strings.NewReader("third!")))
+}
+
+// countingServer answers source calls with n frames for the method "slow" and 3 for the others.
+// written counts the frames of the slow stream that were queued.
+func countingServer(n int, written *int64) *FakeHandler {
+	var srv FakeHandler
+	srv.HandledCalls(func(Method) bool { return true })
+	srv.HandleCallCalls(func(ctx context.Context, req *Request) {
+		snk, err := req.ResponseSink()
+		if err != nil {
+			req.CloseWithError(err)
+			return
+		}
+		snk.SetEncoding(TypeString)
+		slow := req.Method.String() == "slow"
+		frames := 3
+		if slow {
+			frames = n
+		}
+		for i := 0; i < frames; i++ {
+			if _, err := fmt.Fprintf(snk, "%s %d", req.Method, i); err != nil {
+				return
+			}
+			if slow {
+				atomic.AddInt64(written, 1)
+			}
+		}
+		snk.Close()
+	})
+	return &srv
+}
+
+func TestSourceHighWaterMarkSession(t *testing.T) {
+	r := require.New(t)
+
+	const n = 100000
+	var written int64
+	srv := countingServer(n, &written)
+
+	opts := []HandleOption{WithoutManifest(), WithLogger(NopLogger()), WithHello(FeatureFlowControl)}
+	edp, _ := connectPair(t, &FakeHandler{}, srv, append(opts, WithSourceHighWaterMark(1024, HighWaterPause)), opts)
+
+	ctx := context.Background()
+	slow, err := edp.Source(ctx, TypeString, Method{"slow"})
+	r.NoError(err)
+
+	// the stream that isn't read doesn't hold up the other one
+	fast, err := edp.Source(ctx, TypeString, Method{"fast"})
+	r.NoError(err)
+	for i := 0; i < 3; i++ {
+		r.True(fast.Next(ctx), "frame %d", i)
+		b, err := fast.Bytes()
+		r.NoError(err)
+		r.Equal(fmt.Sprintf("fast %d", i), string(b))
+	}
+	r.False(fast.Next(ctx))
+	r.NoError(fast.Err())
+
+	// the remote stops sending on the slow one, instead of it buffering everything
+	var last int64 = -1
+	for i := 0; i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		if now := atomic.LoadInt64(&written); now == last {
+			break
+		} else {
+			last = now
+		}
+	}
+	r.Less(atomic.LoadInt64(&written), int64(n), "remote wasn't paused")
+	r.Less(slow.buf.Buffered(), n*4)
+
+	// a slow consumer still gets every frame
+	for i := 0; i < n; i++ {
+		r.True(slow.Next(ctx), "frame %d", i)
+		b, err := slow.Bytes()
+		r.NoError(err)
+		r.Equal(fmt.Sprintf("slow %d", i), string(b))
+	}
+	r.False(slow.Next(ctx))
+	r.NoError(slow.Err())
+}
+
+func TestSourceHighWaterMarkFailSession(t *testing.T) {
+	r := require.New(t)
+
+	var written int64
+	srv := countingServer(20, &written)
+
+	opts := []HandleOption{WithoutManifest(), WithLogger(NopLogger())}
+	edp, _ := connectPair(t, &FakeHandler{}, srv, append(opts, WithSourceHighWaterMark(64, HighWaterFailStream)), opts)
+
+	ctx := context.Background()
+	slow, err := edp.Source(ctx, TypeString, Method{"slow"})
+	r.NoError(err)
+
+	// the stream that isn't read doesn't hold up the other one
+	fast, err := edp.Source(ctx, TypeString, Method{"fast"})
+	r.NoError(err)
+	for i := 0; i < 3; i++ {
+		r.True(fast.Next(ctx), "frame %d", i)
+		b, err := fast.Bytes()
+		r.NoError(err)
+		r.Equal(fmt.Sprintf("fast %d", i), string(b))
+	}
+	r.False(fast.Next(ctx))
+	r.NoError(fast.Err())
+
+	for slow.Next(ctx) {
+		slow.Bytes()
+	}
+	r.True(errors.Is(slow.Err(), ErrSourceHighWater), "unexpected error: %v", slow.Err())
+}
+
+func TestSourceMemoryBudget(t *testing.T) {
+	ctx := context.Background()
+
+	bpool := codec.NewTieredPool()
+
+	mkSources := func(policy BudgetPolicy) (*memoryBudget, *ByteSource, *ByteSource) {
+		var e rpc
+		e.bpool = bpool
+		WithMemoryBudget(20, policy)(&e)
+		return e.budget, e.newSource(ctx), e.newSource(ctx)
+	}
+
+	t.Run("fail", func(t *testing.T) {
+		r := require.New(t)
+		budget, bs1, bs2 := mkSources(BudgetFailStream)
+
+		r.NoError(bs1.consume(10, codec.FlagStream, strings.NewReader("0123456789")))
+		r.EqualValues(14, budget.Used())
+
+		err := bs2.consume(10, codec.FlagStream, strings.NewReader("abcdefghij"))
+		r.True(errors.Is(err, ErrMemoryBudgetExceeded), "wrong error: %v", err)
+
+		r.True(bs1.Next(ctx))
+		_, err = bs1.Bytes()
+		r.NoError(err)
+		r.EqualValues(0, budget.Used())
+
+		r.NoError(bs2.consume(10, codec.FlagStream, strings.NewReader("abcdefghij")))
+		r.EqualValues(14, budget.Used())
+	})
+
+	t.Run("block", func(t *testing.T) {
+		r := require.New(t)
+		budget, bs1, bs2 := mkSources(BudgetBlock)
+
+		r.NoError(bs1.consume(10, codec.FlagStream, strings.NewReader("0123456789")))
+
+		consumed := make(chan error)
+		go func() {
+			consumed <- bs2.consume(10, codec.FlagStream, strings.NewReader("abcdefghij"))
+		}()
+
+		select {
+		case err := <-consumed:
+			t.Fatal("expected consume to block", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		r.True(bs1.Next(ctx))
+		_, err := bs1.Bytes()
+		r.NoError(err)
+
+		select {
+		case err := <-consumed:
+			r.NoError(err)
+		case <-time.After(time.Second):
+			t.Fatal("consume didn't continue after the budget was freed")
+		}
+		r.EqualValues(14, budget.Used())
+	})
+
+	t.Run("ended", func(t *testing.T) {
+		r := require.New(t)
+		var e rpc
+		e.bpool = bpool
+		WithMemoryBudget(50, BudgetFailStream)(&e)
+		budget, bs1, bs2 := e.budget, e.newSource(ctx), e.newSource(ctx)
+
+		r.NoError(bs1.consume(10, codec.FlagStream, strings.NewReader("0123456789")))
+		r.NoError(bs1.consume(10, codec.FlagStream, strings.NewReader("abcdefghij")))
+		r.NoError(bs1.consume(10, codec.FlagStream, strings.NewReader("klmnopqrst")))
+		r.EqualValues(42, budget.Used())
+
+		// half of a frame is read
+		r.True(bs1.Next(ctx))
+		r.NoError(bs1.Reader(func(rd io.Reader) error {
+			_, err := rd.Read(make([]byte, 5))
+			return err
+		}))
+		r.EqualValues(28, budget.Used())
+
+		// a stream that ended doesn't hold on to the budget, even if it wasn't drained
+		bs1.mu.Lock()
+		bs1.fail(io.EOF)
+		bs1.mu.Unlock()
+		r.EqualValues(0, budget.Used())
+
+		// what is left can still be read, without giving it back twice
+		r.True(bs1.Next(ctx))
+		b, err := bs1.Bytes()
+		r.NoError(err)
+		r.Equal("abcdefghij", string(b))
+		r.EqualValues(0, budget.Used())
+
+		r.NoError(bs2.consume(10, codec.FlagStream, strings.NewReader("0123456789")))
+		r.EqualValues(14, budget.Used())
+	})
+}
+
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	cw.writes++
+	return cw.Buffer.Write(b)
+}
+
+func TestSinkCork(t *testing.T) {
+	r := require.New(t)
+
+	var out countingWriter
+	snk := NewTestSink(&out)
+
+	snk.Cork()
+	buf := []byte("aaa")
+	for _, b := range []string{"one", "two", "six"} {
+		copy(buf, b)
+		_, err := snk.Write(buf)
+		r.NoError(err)
+	}
+	r.Equal(0, out.writes, "expected nothing to be written while corked")
+
+	r.NoError(snk.Uncork())
+	r.Equal(1, out.writes, "expected one write for all corked packets")
+
+	r.NoError(snk.WriteBatch([][]byte{[]byte("ten"), []byte("eleven")}))
+	r.Equal(2, out.writes)
+
+	pkts, err := codec.ReadAllPackets(codec.NewReader(&out.Buffer))
+	r.NoError(err)
+	r.Len(pkts, 5)
+	for i, exp := range []string{"one", "two", "six", "ten", "eleven"} {
+		r.Equal(exp, string(pkts[i].Body))
+		r.EqualValues(666, pkts[i].Req)
+	}
+}
+
+func TestSinkWriteDeadline(t *testing.T) {
+	r := require.New(t)
+
+	out := newStuckWriter()
+	snk := NewTestSink(nil)
+	snk.queue = startWriteQueue(t, out)
+	snk.pkt.Req = 1
+
+	// the remote doesn't read, the first write is stuck and the second one waits in the queue
+	_, err := snk.Write([]byte("one"))
+	r.NoError(err)
+	<-out.entered
+	_, err = snk.Write([]byte("two"))
+	r.NoError(err)
+
+	_, err = snk.TryWrite([]byte("try"))
+	r.True(errors.Is(err, ErrWouldBlock), "wrong error: %v", err)
+
+	snk.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	start := time.Now()
+	_, err = snk.Write([]byte("late"))
+	r.True(errors.Is(err, ErrWriteTimeout), "wrong error: %v", err)
+	r.True(time.Since(start) >= 15*time.Millisecond, "gave up too early")
+
+	err = snk.WriteBatch([][]byte{[]byte("a"), []byte("b")})
+	r.True(errors.Is(err, ErrWriteTimeout), "wrong error: %v", err)
+
+	// the stream is still usable once the remote reads again
+	snk.SetWriteDeadline(time.Time{})
+	close(out.release)
+	_, err = snk.Write([]byte("three"))
+	r.NoError(err)
+	r.NoError(snk.WriteBatch([][]byte{[]byte("a"), []byte("b")}))
+	r.NoError(snk.Close())
+
+	r.NoError(snk.queue.flush(false, time.Second))
+	pkts, err := codec.ReadAllPackets(codec.NewReader(&out.buf))
+	r.NoError(err)
+	var bodies []string
+	for _, pkt := range pkts[:len(pkts)-1] {
+		bodies = append(bodies, string(pkt.Body))
+	}
+	r.Equal([]string{"one", "two", "three", "a", "b"}, bodies)
+	r.True(pkts[len(pkts)-1].Flag.Get(codec.FlagEndErr))
+}
+
+func TestSinkPaused(t *testing.T) {
+	r := require.New(t)
+
+	var out bytes.Buffer
+	snk := NewTestSink(&out)
+	snk.pkt.Req = 1
+
+	snk.pause()
+	_, err := snk.TryWrite([]byte("try"))
+	r.True(errors.Is(err, ErrWouldBlock), "wrong error: %v", err)
+
+	snk.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err = snk.Write([]byte("late"))
+	r.True(errors.Is(err, ErrWriteTimeout), "wrong error: %v", err)
+	snk.SetWriteDeadline(time.Time{})
+
+	// writes wait until the remote resumes the stream
+	wrote := make(chan error)
+	go func() {
+		_, err := snk.Write([]byte("one"))
+		wrote <- err
+	}()
+	select {
+	case err := <-wrote:
+		t.Fatal("expected the write to wait", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	snk.resume()
+	r.NoError(<-wrote)
+
+	// the end of the stream isn't held back
+	snk.pause()
+	r.NoError(snk.Close())
+
+	pkts, err := codec.ReadAllPackets(codec.NewReader(&out))
+	r.NoError(err)
+	r.Len(pkts, 2)
+	r.Equal("one", string(pkts[0].Body))
+	r.True(pkts[1].Flag.Get(codec.FlagEndErr))
+}
+
+func TestSourceFrameTTL(t *testing.T) {
+	r := require.New(t)
+
+	ctx := context.Background()
+
+	bpool := codec.NewTieredPool()
+	var bs = newByteSource(ctx, bpool)
+	bs.SetFrameTTL(20 * time.Millisecond)
+
+	for _, b := range []string{"old1", "old2", "old3"} {
+		r.NoError(bs.consume(uint32(len(b)), codec.FlagStream, strings.NewReader(b)))
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	r.NoError(bs.consume(5, codec.FlagStream, strings.NewReader("fresh")))
+
+	r.True(bs.Next(ctx))
+	b, err := bs.Bytes()
+	r.NoError(err)
+	r.Equal("fresh", string(b))
+	r.EqualValues(3, bs.Dropped())
+
+	// all stale: wait for the next one
+	r.NoError(bs.consume(5, codec.FlagStream, strings.NewReader("stale")))
+	time.Sleep(40 * time.Millisecond)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		bs.consume(4, codec.FlagStream, strings.NewReader("live"))
+	}()
+	r.True(bs.Next(ctx))
+	b, err = bs.Bytes()
+	r.NoError(err)
+	r.Equal("live", string(b))
+	r.EqualValues(4, bs.Dropped())
+}
+
+func TestSourceIdleTimeout(t *testing.T) {
+	r := require.New(t)
+
+	ctx := context.Background()
+
+	bpool := codec.NewTieredPool()
+	var bs = newByteSource(ctx, bpool)
+	bs.SetIdleTimeout(30 * time.Millisecond)
+
+	// frames that keep coming in time keep the stream alive
+	go func() {
+		for _, b := range []string{"one", "two", "three"} {
+			time.Sleep(10 * time.Millisecond)
+			bs.consume(uint32(len(b)), codec.FlagStream, strings.NewReader(b))
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		r.True(bs.Next(ctx), "frame %d", i)
+		_, err := bs.Bytes()
+		r.NoError(err)
+	}
+
+	start := time.Now()
+	r.False(bs.Next(ctx))
+	r.True(time.Since(start) >= 15*time.Millisecond, "stalled too early")
+
+	err := bs.Err()
+	r.True(errors.Is(err, ErrStreamStalled), "wrong error: %v", err)
+	r.False(errors.Is(err, context.DeadlineExceeded))
+
+	// the remote can't push more frames into it
+	r.Error(bs.consume(4, codec.FlagStream, strings.NewReader("late")))
+}
+
+func TestSourceReadDeadline(t *testing.T) {
+	r := require.New(t)
+
+	ctx := context.Background()
+
+	bpool := codec.NewTieredPool()
+	var bs = newByteSource(ctx, bpool)
+
+	// nothing arrives in time, but the stream stays open
+	start := time.Now()
+	r.False(bs.NextWithTimeout(ctx, 20*time.Millisecond))
+	r.True(time.Since(start) >= 15*time.Millisecond, "gave up too early")
+	r.True(errors.Is(bs.Err(), ErrReadTimeout), "wrong error: %v", bs.Err())
+
+	r.NoError(bs.consume(3, codec.FlagStream, strings.NewReader("one")))
+	r.True(bs.NextWithTimeout(ctx, 20*time.Millisecond))
+	r.NoError(bs.Err())
+	b, err := bs.Bytes()
+	r.NoError(err)
+	r.Equal("one", string(b))
+
+	// a deadline in the past doesn't hide buffered frames
+	bs.SetReadDeadline(time.Now().Add(-time.Second))
+	r.NoError(bs.consume(3, codec.FlagStream, strings.NewReader("two")))
+	r.True(bs.Next(ctx))
+	_, err = bs.Bytes()
+	r.NoError(err)
+	r.False(bs.Next(ctx))
+	r.True(errors.Is(bs.Err(), ErrReadTimeout))
+
+	// moving the deadline lets Next wait again
+	bs.SetReadDeadline(time.Now().Add(time.Minute))
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		bs.consume(5, codec.FlagStream, strings.NewReader("three"))
+	}()
+	r.True(bs.Next(ctx))
+	_, err = bs.Bytes()
+	r.NoError(err)
+
+	// the earlier deadline wins
+	start = time.Now()
+	r.False(bs.NextWithTimeout(ctx, 20*time.Millisecond))
+	r.True(time.Since(start) < 10*time.Second)
+
+	bs.SetReadDeadline(time.Time{})
+	bs.Cancel(nil)
+	r.False(bs.Next(ctx))
+	r.NoError(bs.Err(), "the stream ended normally")
+}
+
+func TestSourcePeek(t *testing.T) {
+	ctx := context.Background()
+
+	for _, spill := range []bool{false, true} {
+		t.Run(fmt.Sprintf("spill=%v", spill), func(t *testing.T) {
+			r := require.New(t)
+
+			var e rpc
+			e.bpool = codec.NewTieredPool()
+			if spill {
+				WithDiskSpill(t.TempDir(), 0, 1024)(&e)
+			}
+			bs := e.newSource(ctx)
+
+			r.Equal(-1, bs.NextSize())
+			_, err := bs.Peek()
+			r.True(errors.Is(err, io.EOF), "wrong error: %v", err)
+
+			r.NoError(bs.consume(4, codec.FlagStream, strings.NewReader("note")))
+			r.NoError(bs.consume(7, codec.FlagStream, strings.NewReader("message")))
+
+			r.True(bs.Next(ctx))
+			r.Equal(4, bs.NextSize())
+			for i := 0; i < 2; i++ {
+				b, err := bs.Peek()
+				r.NoError(err)
+				r.Equal("note", string(b))
+			}
+
+			// peeking doesn't skip the frame
+			b, err := bs.Bytes()
+			r.NoError(err)
+			r.Equal("note", string(b))
+
+			// the rest of a frame that was read partially doesn't show up
+			r.True(bs.Next(ctx))
+			r.NoError(bs.Reader(func(rd io.Reader) error {
+				_, err := rd.Read(make([]byte, 3))
+				return err
+			}))
+			r.Equal(-1, bs.NextSize())
+
+			r.NoError(bs.consume(3, codec.FlagStream, strings.NewReader("end")))
+			r.Equal(3, bs.NextSize())
+			b, err = bs.Peek()
+			r.NoError(err)
+			r.Equal("end", string(b))
+			r.True(bs.Next(ctx))
+			b, err = bs.Bytes()
+			r.NoError(err)
+			r.Equal("end", string(b))
+		})
+	}
+}
+
+func TestSourceRead(t *testing.T) {
+	ctx := context.Background()
+
+	for _, spill := range []bool{false, true} {
+		t.Run(fmt.Sprintf("spill=%v", spill), func(t *testing.T) {
+			r := require.New(t)
+
+			var e rpc
+			e.bpool = codec.NewTieredPool()
+			if spill {
+				WithDiskSpill(t.TempDir(), 0, 1<<20)(&e)
+			}
+			bs := e.newSource(ctx)
+
+			large := bytes.Repeat([]byte("0123456789"), 1000)
+			r.NoError(bs.consume(uint32(len(large)), codec.FlagStream, bytes.NewReader(large)))
+			r.NoError(bs.consume(0, codec.FlagStream, bytes.NewReader(nil)))
+			r.NoError(bs.consume(6, codec.FlagStream, strings.NewReader("second")))
+			r.NoError(bs.consume(5, codec.FlagStream, strings.NewReader("third")))
+
+			// a frame larger than the buffer takes several reads
+			r.True(bs.Next(ctx))
+			var got []byte
+			buf := make([]byte, 7)
+			reads := 0
+			for {
+				n, err := bs.Read(buf)
+				got = append(got, buf[:n]...)
+				if err == io.EOF {
+					break
+				}
+				r.NoError(err)
+				reads++
+
+				// peeking in between doesn't disturb the frame that is read
+				if reads == 3 {
+					r.Equal(0, bs.NextSize())
+				}
+			}
+			r.Equal(large, got)
+			r.Greater(reads, 1000)
+
+			n, err := bs.Read(buf)
+			r.Equal(0, n)
+			r.Equal(io.EOF, err, "the frame stays at its end until Next")
+
+			// empty frame
+			r.True(bs.Next(ctx))
+			_, err = bs.Read(buf)
+			r.Equal(io.EOF, err)
+
+			// Next skips the rest of a frame that wasn't read to its end
+			r.True(bs.Next(ctx))
+			n, err = bs.Read(buf[:3])
+			r.NoError(err)
+			r.Equal("sec", string(buf[:n]))
+			r.Equal(5, bs.NextSize())
+
+			r.True(bs.Next(ctx))
+			b, err := ioutil.ReadAll(bs)
+			r.NoError(err)
+			r.Equal("third", string(b))
+
+			// the frames of a source reader are read piece by piece as well
+			for _, f := range []string{"one", "", "two", "three"} {
+				r.NoError(bs.consume(uint32(len(f)), codec.FlagStream, strings.NewReader(f)))
+			}
+			bs.end(nil)
+			b, err = ioutil.ReadAll(iotest.OneByteReader(NewSourceReader(bs)))
+			r.NoError(err)
+			r.Equal("onetwothree", string(b))
+		})
+	}
+}
+
+// countingPool counts how often buffers are taken from and returned to it
+type countingPool struct {
+	codec.BufferPool
+	gets, puts int32
+}
+
+func (p *countingPool) Get(size int) *bytes.Buffer {
+	atomic.AddInt32(&p.gets, 1)
+	return p.BufferPool.Get(size)
+}
+
+func (p *countingPool) Put(b *bytes.Buffer) {
+	atomic.AddInt32(&p.puts, 1)
+	p.BufferPool.Put(b)
+}
+
+func TestSourceConcurrentCancel(t *testing.T) {
+	r := require.New(t)
+
+	ctx := context.Background()
+
+	for i := 0; i < 50; i++ {
+		bpool := codec.NewTieredPool()
+		pool := &countingPool{BufferPool: bpool}
+		var bs = newByteSource(ctx, pool)
+
+		var wg sync.WaitGroup
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if bs.consume(4, codec.FlagStream|codec.FlagString, strings.NewReader("fram")) != nil {
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			time.Sleep(time.Duration(i*10) * time.Microsecond)
+			bs.Cancel(nil)
+			bs.Cancel(fmt.Errorf("second cancel"))
+		}()
+		go func() {
+			defer wg.Done()
+			for !bs.ended() {
+				bs.Encoding()
+				bs.Err()
+			}
+		}()
+
+		for bs.Next(ctx) {
+			_, err := bs.Bytes()
+			if err != nil {
+				// the frame that Next announced was dropped by Cancel in the meantime
+				r.True(errors.Is(err, io.EOF), "wrong error: %v", err)
+				r.True(bs.ended())
+				break
+			}
+		}
+		wg.Wait()
+		r.False(bs.Next(ctx))
+
+		r.NoError(bs.Err(), "the first cancel decides the error")
+		r.Error(bs.consume(4, codec.FlagStream, strings.NewReader("late")))
+		r.Equal(atomic.LoadInt32(&pool.gets), atomic.LoadInt32(&pool.puts), "every buffer should be returned exactly once")
+	}
+
+	// giving up on the stream from the context of Next closes it, like Cancel
+	bpool := codec.NewTieredPool()
+	var bs = newByteSource(ctx, bpool)
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	r.False(bs.Next(cctx))
+	select {
+	case <-bs.closed:
+	default:
+		r.Fail("stream still open after its context was canceled")
+	}
+	r.NoError(bs.Err(), "canceling is not an error")
+}
+
+func TestSourceFrameLoss(t *testing.T) {
+	r := require.New(t)
+
+	ctx := context.Background()
+
+	bpool := codec.NewTieredPool()
+	var bs = newByteSource(ctx, bpool)
+
+	counted := func(body string, seq uint32) (uint32, io.Reader) {
+		b := append([]byte(body), 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(b[len(body):], seq)
+		return uint32(len(b)), bytes.NewReader(b)
+	}
+
+	flag := codec.FlagString | codec.FlagStream | codec.FlagSeq
+	for i, body := range []string{"zero", "one"} {
+		n, rd := counted(body, uint32(i))
+		r.NoError(bs.consume(n, flag, rd))
+
+		r.True(bs.Next(ctx))
+		b, err := bs.Bytes()
+		r.NoError(err)
+		r.Equal(body, string(b), "counter not stripped")
+	}
+
+	// frame 2 went missing
+	n, rd := counted("three", 3)
+	err := bs.consume(n, flag, rd)
+	r.True(errors.Is(err, ErrFrameLoss), "wrong error: %v", err)
+}
+
+// readSinkPackets reads all packets that a test sink wrote to rd.
+// The frame counters of muxrpcdebug builds are taken off, so that the bodies are what was written to the sink.
+func readSinkPackets(t *testing.T, rd io.Reader) []*codec.Packet {
+	t.Helper()
+	pkts, err := codec.ReadAllPackets(codec.NewReader(rd))
+	require.NoError(t, err)
+	for _, pkt := range pkts {
+		if pkt.Flag.Get(codec.FlagSeq) {
+			pkt.Body = pkt.Body[:len(pkt.Body)-seqTrailerLen]
+			pkt.Flag = pkt.Flag.Clear(codec.FlagSeq)
+		}
+	}
+	return pkts
+}
+
+func TestSinkChunks(t *testing.T) {
+	r := require.New(t)
+
+	var out bytes.Buffer
+	snk := NewTestSink(&out)
+	snk.pkt.Flag = codec.FlagStream
+	snk.SetChunkSize(4)
+
+	_, err := snk.Write([]byte("0123456789"))
+	r.NoError(err)
+	_, err = snk.Write([]byte("abcd"))
+	r.NoError(err)
+
+	pkts := readSinkPackets(t, &out)
+	r.Len(pkts, 4)
+	for i, exp := range []string{"0123", "4567", "89", "abcd"} {
+		r.Equal(exp, string(pkts[i].Body))
+		r.Equal(i < 2, pkts[i].Flag.Get(codec.FlagMore), "packet %d", i)
+	}
+
+	ctx := context.Background()
+	bpool := codec.NewTieredPool()
+	src := newByteSource(ctx, bpool)
+	for _, pkt := range pkts {
+		r.NoError(src.consume(uint32(len(pkt.Body)), pkt.Flag, bytes.NewReader(pkt.Body)))
+	}
+	r.EqualValues(2, src.buf.Frames())
+
+	for _, exp := range []string{"0123456789", "abcd"} {
+		r.True(src.Next(ctx))
+		b, err := src.Bytes()
+		r.NoError(err)
+		r.Equal(exp, string(b))
+	}
+}
+
+func TestSourceChunkLimits(t *testing.T) {
+	ctx := context.Background()
+	chunk := strings.Repeat("x", 100)
+
+	t.Run("max frame", func(t *testing.T) {
+		r := require.New(t)
+		src := newByteSource(ctx, codec.NewTieredPool())
+		src.maxFrame = 250
+		for i := 0; i < 2; i++ {
+			r.NoError(src.consume(100, codec.FlagStream|codec.FlagMore, strings.NewReader(chunk)))
+		}
+		err := src.consume(100, codec.FlagStream|codec.FlagMore, strings.NewReader(chunk))
+		r.True(errors.Is(err, ErrPacketTooLarge), "unexpected error: %v", err)
+	})
+
+	t.Run("budget", func(t *testing.T) {
+		r := require.New(t)
+		budget := &memoryBudget{limit: 150, freed: make(chan struct{})}
+		src := newByteSource(ctx, codec.NewTieredPool())
+		src.buf.budget = budget
+		r.NoError(src.consume(100, codec.FlagStream|codec.FlagMore, strings.NewReader(chunk)))
+		r.EqualValues(100, budget.Used())
+		err := src.consume(100, codec.FlagStream|codec.FlagMore, strings.NewReader(chunk))
+		r.True(errors.Is(err, ErrMemoryBudgetExceeded), "unexpected error: %v", err)
+		r.EqualValues(0, budget.Used(), "the chunks were given back")
+	})
+
+	t.Run("ended while collecting", func(t *testing.T) {
+		r := require.New(t)
+		budget := &memoryBudget{limit: 1000, freed: make(chan struct{})}
+		src := newByteSource(ctx, codec.NewTieredPool())
+		src.buf.budget = budget
+		r.NoError(src.consume(100, codec.FlagStream|codec.FlagMore, strings.NewReader(chunk)))
+		src.end(nil)
+		r.EqualValues(0, budget.Used())
+	})
+
+	t.Run("not negotiated", func(t *testing.T) {
+		r := require.New(t)
+		src := newByteSource(ctx, codec.NewTieredPool())
+		src.features = func(f Feature) bool { return f != FeatureChunking }
+		err := src.consume(100, codec.FlagStream|codec.FlagMore, strings.NewReader(chunk))
+		r.True(errors.Is(err, ErrFeatureNotNegotiated), "unexpected error: %v", err)
+	})
+}
+
+func TestJSONArrayStream(t *testing.T) {
+	r := require.New(t)
+
+	ctx := context.Background()
+	bpool := codec.NewTieredPool()
+
+	src := newByteSource(ctx, bpool)
+	for _, frame := range []string{`[{"seq":1},{"se`, `q":2}`, `, 3, "four"]`, ` [5]`} {
+		r.NoError(src.consume(uint32(len(frame)), codec.FlagStream|codec.FlagJSON, strings.NewReader(frame)))
+	}
+	src.end(nil)
+
+	var got []string
+	js := src.AsJSONArrayStream()
+	for js.Next(ctx) {
+		got = append(got, string(js.Bytes()))
+	}
+	r.NoError(js.Err())
+	r.Equal([]string{`{"seq":1}`, `{"seq":2}`, `3`, `"four"`, `5`}, got)
+
+	// a truncated array is an error
+	src = newByteSource(ctx, bpool)
+	frame := `[1, {"seq"`
+	r.NoError(src.consume(uint32(len(frame)), codec.FlagStream|codec.FlagJSON, strings.NewReader(frame)))
+	src.end(nil)
+
+	js = src.AsJSONArrayStream()
+	r.True(js.Next(ctx))
+	var v int
+	r.NoError(js.Decode(&v))
+	r.Equal(1, v)
+	r.False(js.Next(ctx))
+	r.Error(js.Err())
+}
+
+func TestSourceEncoding(t *testing.T) {
+	r := require.New(t)
+
+	ctx := context.Background()
+	src := newByteSource(ctx, codec.NewTieredPool())
+	r.Equal(TypeBinary, src.Encoding())
+
+	flags := []codec.Flag{codec.FlagJSON, codec.FlagString, 0, codec.FlagJSON}
+	for _, f := range flags {
+		r.NoError(src.consume(2, codec.FlagStream|f, strings.NewReader("{}")))
+	}
+
+	// every frame keeps its own encoding, not the one of the last frame that came in
+	want := []RequestEncoding{TypeJSON, TypeString, TypeBinary, TypeJSON}
+	for i, enc := range want {
+		r.True(src.Next(ctx))
+		r.Equal(enc, src.Encoding(), "frame %d", i)
+		_, err := src.Bytes()
+		r.NoError(err)
+		r.Equal(enc, src.Encoding(), "frame %d after reading it", i)
+	}
+}
+
+func TestSourceWriteTo(t *testing.T) {
+	r := require.New(t)
+
+	ctx := context.Background()
+	bpool := codec.NewTieredPool()
+
+	fill := func() *ByteSource {
+		src := newByteSource(ctx, bpool)
+		for _, frame := range []string{"one", "two", "three"} {
+			r.NoError(src.consume(uint32(len(frame)), codec.FlagStream, strings.NewReader(frame)))
+		}
+		src.end(nil)
+		return src
+	}
+
+	var buf bytes.Buffer
+	n, err := fill().WriteTo(&buf)
+	r.NoError(err)
+	r.EqualValues(11, n)
+	r.Equal("onetwothree", buf.String())
+
+	buf.Reset()
+	n, err = fill().WriteDelimitedTo(&buf, []byte("\n"))
+	r.NoError(err)
+	r.EqualValues(14, n)
+	r.Equal("one\ntwo\nthree\n", buf.String())
+
+	// errors of the stream are returned
+	src := newByteSource(ctx, bpool)
+	r.NoError(src.consume(3, codec.FlagStream, strings.NewReader("one")))
+	src.end(errors.New("broken"))
+	buf.Reset()
+	_, err = src.WriteTo(&buf)
+	r.EqualError(err, "broken")
+	r.Equal("one", buf.String())
+}
+
+func TestSinkReadFrom(t *testing.T) {
+	r := require.New(t)
+
+	var out bytes.Buffer
+	snk := NewTestSink(&out)
+	snk.pkt.Flag = codec.FlagStream
+	snk.SetReadFromSize(4)
+
+	n, err := snk.ReadFrom(strings.NewReader("0123456789"))
+	r.NoError(err)
+	r.EqualValues(10, n)
+
+	pkts := readSinkPackets(t, &out)
+	r.Len(pkts, 3)
+	for i, exp := range []string{"0123", "4567", "89"} {
+		r.Equal(exp, string(pkts[i].Body))
+		r.False(pkts[i].Flag.Get(codec.FlagMore))
+	}
+
+	// the default size uses pooled buffers
+	out.Reset()
+	snk.SetReadFromSize(0)
+	blob := bytes.Repeat([]byte("x"), defaultReadFromSize+1)
+	_, err = snk.ReadFrom(bytes.NewReader(blob))
+	r.NoError(err)
+	pkts = readSinkPackets(t, &out)
+	r.Len(pkts, 2)
+	r.Len(pkts[0].Body, defaultReadFromSize)
+	r.Len(pkts[1].Body, 1)
+}
+
+func TestSinkClosed(t *testing.T) {
+	r := require.New(t)
+
+	var out bytes.Buffer
+	snk := NewTestSink(&out)
+	snk.pkt.Flag = codec.FlagStream
+
+	_, err := snk.Write([]byte("one"))
+	r.NoError(err)
+	r.NoError(snk.Close())
+
+	_, err = snk.Write([]byte("two"))
+	r.True(errors.Is(err, ErrWriteAfterClose), "unexpected error: %v", err)
+	err = snk.WriteBatch([][]byte{[]byte("three")})
+	r.True(errors.Is(err, ErrWriteAfterClose), "unexpected error: %v", err)
+	r.Equal(ErrAlreadyClosed, snk.Close())
+	r.Equal(ErrAlreadyClosed, snk.CloseWithError(errors.New("too late")))
+
+	// only the first write and the end went out
+	pkts := readSinkPackets(t, &out)
+	r.Len(pkts, 2)
+	r.Equal("one", string(pkts[0].Body))
+	r.True(pkts[1].Flag.Get(codec.FlagEndErr))
+
+	// sinks that the endpoint closed can still be closed once, writes wrap why they were closed
+	snk = NewTestSink(&out)
+	snk.pkt.Flag = codec.FlagStream
+	r.NoError(snk.end(ErrSessionTerminated, false))
+	_, err = snk.Write([]byte("one"))
+	r.True(errors.Is(err, ErrWriteAfterClose), "unexpected error: %v", err)
+	r.True(errors.Is(err, ErrSessionTerminated), "unexpected error: %v", err)
+	r.Equal(ErrSessionTerminated, snk.Close())
+	r.Equal(ErrAlreadyClosed, snk.Close())
+}
+
+func TestSinkBug(t *testing.T) {
+	r := require.New(t)
+
+	var out bytes.Buffer
+	snk := NewTestSink(&out)
+	snk.pkt.Req = 0
+	_, err := snk.Write([]byte("one"))
+	r.True(errors.Is(err, ErrBug), "unexpected error: %v", err)
+
+	// an unknown encoding fails the sink instead of sending with the wrong flags
+	snk = NewTestSink(&out)
+	snk.SetEncoding(RequestEncoding(99))
+	_, err = snk.Write([]byte("one"))
+	r.True(errors.Is(err, ErrBug), "unexpected error: %v", err)
+	r.Zero(out.Len())
+
+	snk = NewTestSink(&out)
+	snk.panicOnBug = true
+	r.Panics(func() { snk.SetEncoding(RequestEncoding(99)) })
+
+	r.False(IsServer(&FakeEndpoint{}))
+}
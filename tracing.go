@@ -0,0 +1,52 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"net"
+
+	"github.com/ssbc/go-muxrpc/v2/codec"
+)
+
+// Tracer follows the calls of a connection, see WithTracer. The oteltrace package has one for OpenTelemetry.
+type Tracer interface {
+	// StartCall is called with the context of the caller before an outgoing call is sent
+	// and with the context of the session before an incoming call is passed to the handler, which gets the returned context.
+	// Metadata that the tracer puts into the returned context of an outgoing call is sent along with it, see ContextWithMetadata.
+	StartCall(ctx context.Context, call TracedCall) (context.Context, CallTrace)
+}
+
+// TracedCall describes the call that a trace is started for.
+type TracedCall struct {
+	Method Method
+	Type   CallType
+
+	// Incoming is true for calls that the remote made
+	Incoming bool
+
+	// Meta is what the remote sent along with an incoming call
+	Meta Metadata
+
+	Remote net.Addr
+}
+
+// CallTrace is told what happens to a single call. Like a StatsHandler it must not block.
+type CallTrace interface {
+	// PacketSent and PacketReceived are called for every packet of the call, except the one that starts it.
+	// size is the length of the body.
+	PacketSent(flag codec.Flag, size int)
+	PacketReceived(flag codec.Flag, size int)
+
+	// End is called once, when the call is closed by either side or the connection ended.
+	End(err error)
+}
+
+// WithTracer sets the Tracer of the connection.
+func WithTracer(t Tracer) HandleOption {
+	return func(r *rpc) {
+		r.tracer = t
+	}
+}
@@ -0,0 +1,190 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Transport establishes the connections muxrpc sessions run over.
+// Backends like TCP, TLS, WebSocket, QUIC or stdio implement it, secret-handshake and other wrappers are added with StackTransport.
+type Transport interface {
+	// Dial connects to the peer at addr. The format of addr depends on the transport.
+	Dial(ctx context.Context, addr string) (TransportConn, error)
+
+	// Accept waits for the next incoming connection.
+	Accept(ctx context.Context) (TransportConn, error)
+}
+
+// TransportConn is a connection made by a Transport.
+// It carries the packet-stream and what the transport knows about the peer.
+type TransportConn interface {
+	io.ReadWriteCloser
+
+	Info() ConnInfo
+}
+
+// ConnInfo is the metadata of a connection.
+type ConnInfo struct {
+	// Remote is the address of the peer
+	Remote net.Addr
+
+	// Local is the address of this end of the connection
+	Local net.Addr
+
+	// Identity is the authenticated key of the peer, if the transport has one, like secret-handshake.
+	Identity []byte
+
+	// Meta holds other transport specific information, like the negotiated TLS version.
+	Meta map[string]string
+}
+
+// TransportLayer wraps a connection, usually to authenticate and encrypt it.
+// isServer is true for connections from Accept.
+type TransportLayer func(ctx context.Context, conn TransportConn, isServer bool) (TransportConn, error)
+
+// StackTransport returns a transport that wraps the connections of base with the layers, the first layer is applied first.
+func StackTransport(base Transport, layers ...TransportLayer) Transport {
+	return stackedTransport{base: base, layers: layers}
+}
+
+type stackedTransport struct {
+	base   Transport
+	layers []TransportLayer
+}
+
+func (st stackedTransport) Dial(ctx context.Context, addr string) (TransportConn, error) {
+	conn, err := st.base.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return st.wrap(ctx, conn, false)
+}
+
+func (st stackedTransport) Accept(ctx context.Context) (TransportConn, error) {
+	conn, err := st.base.Accept(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return st.wrap(ctx, conn, true)
+}
+
+func (st stackedTransport) wrap(ctx context.Context, conn TransportConn, isServer bool) (TransportConn, error) {
+	for i, layer := range st.layers {
+		wrapped, err := layer(ctx, conn, isServer)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("muxrpc: transport layer %d failed: %w", i, err)
+		}
+		conn = wrapped
+	}
+	return conn, nil
+}
+
+// NetTransport is a Transport for stream oriented networks of the net package, like "tcp" or "unix".
+// TLS works by passing a listener from tls.NewListener and a tls.Dialer.
+type NetTransport struct {
+	Network string
+
+	// Listener is used by Accept, it can be nil if the transport is only used for dialing.
+	Listener net.Listener
+
+	// Dialer is used by Dial, a zero net.Dialer is used if it is nil.
+	Dialer interface {
+		DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+	}
+}
+
+func (nt NetTransport) Dial(ctx context.Context, addr string) (TransportConn, error) {
+	var d = nt.Dialer
+	if d == nil {
+		d = &net.Dialer{}
+	}
+	conn, err := d.DialContext(ctx, nt.Network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewTransportConn(conn, ConnInfo{Remote: conn.RemoteAddr(), Local: conn.LocalAddr()}), nil
+}
+
+func (nt NetTransport) Accept(ctx context.Context) (TransportConn, error) {
+	if nt.Listener == nil {
+		return nil, fmt.Errorf("muxrpc: no listener to accept %s connections", nt.Network)
+	}
+
+	type accepted struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan accepted, 1)
+	go func() {
+		conn, err := nt.Listener.Accept()
+		ch <- accepted{conn, err}
+	}()
+
+	select {
+	case a := <-ch:
+		if a.err != nil {
+			return nil, a.err
+		}
+		return NewTransportConn(a.conn, ConnInfo{Remote: a.conn.RemoteAddr(), Local: a.conn.LocalAddr()}), nil
+	case <-ctx.Done():
+		// the pending Accept still takes the next connection, close it once it arrives
+		go func() {
+			if a := <-ch; a.conn != nil {
+				a.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// NewTransportConn attaches the metadata to a connection, like stdio of a child process or a connection that was dialed elsewhere.
+func NewTransportConn(rwc io.ReadWriteCloser, info ConnInfo) TransportConn {
+	return transportConn{ReadWriteCloser: rwc, info: info}
+}
+
+type transportConn struct {
+	io.ReadWriteCloser
+	info ConnInfo
+}
+
+func (tc transportConn) Info() ConnInfo { return tc.info }
+
+// DialEndpoint connects to addr using the transport and starts a session on the connection in the client role.
+func DialEndpoint(ctx context.Context, tr Transport, addr string, handler Handler, opts ...HandleOption) (Endpoint, error) {
+	conn, err := tr.Dial(ctx, addr)
+	if err != nil {
+		return nil, fmt.Errorf("muxrpc: failed to dial %s: %w", addr, err)
+	}
+	return Handle(NewPacker(conn), handler, append([]HandleOption{WithIsServer(false)}, opts...)...), nil
+}
+
+// AcceptEndpoint waits for the next connection of the transport and starts a session on it in the server role.
+func AcceptEndpoint(ctx context.Context, tr Transport, handler Handler, opts ...HandleOption) (Endpoint, error) {
+	conn, err := tr.Accept(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("muxrpc: failed to accept: %w", err)
+	}
+	return Handle(NewPacker(conn), handler, append([]HandleOption{WithIsServer(true)}, opts...)...), nil
+}
+
+// RemoteInfo returns the metadata of the connection of the endpoint,
+// which is only known if its packer was created from a TransportConn.
+func RemoteInfo(edp Endpoint) (ConnInfo, bool) {
+	rpc, ok := asRPC(edp)
+	if !ok {
+		return ConnInfo{}, false
+	}
+
+	tc, ok := rpc.pkr.c.(TransportConn)
+	if !ok {
+		return ConnInfo{}, false
+	}
+	return tc.Info(), true
+}
@@ -0,0 +1,126 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// xorLayer stands in for an encrypting layer like secret-handshake
+func xorLayer(key byte, identity string) TransportLayer {
+	return func(ctx context.Context, conn TransportConn, isServer bool) (TransportConn, error) {
+		info := conn.Info()
+		info.Identity = []byte(identity)
+		return NewTransportConn(xorConn{TransportConn: conn, key: key}, info), nil
+	}
+}
+
+type xorConn struct {
+	TransportConn
+	key byte
+}
+
+func (xc xorConn) Read(b []byte) (int, error) {
+	n, err := xc.TransportConn.Read(b)
+	for i := range b[:n] {
+		b[i] ^= xc.key
+	}
+	return n, err
+}
+
+func (xc xorConn) Write(b []byte) (int, error) {
+	enc := make([]byte, len(b))
+	for i := range b {
+		enc[i] = b[i] ^ xc.key
+	}
+	return xc.TransportConn.Write(enc)
+}
+
+func TestTransportStack(t *testing.T) {
+	r := require.New(t)
+
+	l, err := net.Listen("tcp", "localhost:0")
+	r.NoError(err)
+	t.Cleanup(func() { l.Close() })
+
+	srvTransport := StackTransport(NetTransport{Network: "tcp", Listener: l}, xorLayer(0x42, "client"))
+	clientTransport := StackTransport(NetTransport{Network: "tcp"}, xorLayer(0x42, "server"))
+
+	var srv FakeHandler
+	srv.HandledCalls(func(m Method) bool { return true })
+	srv.HandleCallCalls(func(ctx context.Context, req *Request) {
+		if req.Method.String() == "manifest" {
+			req.CloseWithError(ErrNoSuchMethod{req.Method})
+			return
+		}
+		edp, _ := EndpointFromContext(ctx)
+		info, ok := RemoteInfo(edp)
+		if !ok {
+			req.CloseWithError(errors.New("no conn info"))
+			return
+		}
+		req.Return(ctx, string(info.Identity))
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srvEdp := make(chan Endpoint, 1)
+	go func() {
+		edp, err := AcceptEndpoint(ctx, srvTransport, &srv)
+		if err != nil {
+			t.Error(err)
+			close(srvEdp)
+			return
+		}
+		go edp.(Server).Serve()
+		srvEdp <- edp
+	}()
+
+	var client FakeHandler
+	client.HandledCalls(methodChecker("manifest"))
+	client.HandleCallCalls(func(ctx context.Context, req *Request) {
+		req.CloseWithError(ErrNoSuchMethod{req.Method})
+	})
+	edp, err := DialEndpoint(ctx, clientTransport, l.Addr().String(), &client)
+	r.NoError(err)
+	go edp.(Server).Serve()
+
+	info, ok := RemoteInfo(edp)
+	r.True(ok)
+	r.Equal("server", string(info.Identity))
+	r.Equal(l.Addr().String(), edp.Remote().String())
+
+	var who string
+	r.NoError(edp.Async(ctx, &who, TypeString, Method{"whoami"}))
+	r.Equal("client", who)
+
+	s := <-srvEdp
+	r.NotNil(s)
+	r.True(IsServer(s))
+
+	r.NoError(edp.Terminate())
+	s.Terminate()
+}
+
+func TestNetTransportAcceptCanceled(t *testing.T) {
+	r := require.New(t)
+
+	l, err := net.Listen("tcp", "localhost:0")
+	r.NoError(err)
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err = NetTransport{Network: "tcp", Listener: l}.Accept(ctx)
+	r.True(errors.Is(err, context.DeadlineExceeded), "unexpected error: %v", err)
+}
@@ -0,0 +1,73 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+//go:build go1.18
+// +build go1.18
+
+package muxrpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// TypedSource decodes every frame of a source into a T.
+type TypedSource[T any] struct {
+	src    *ByteSource
+	decode func([]byte) (T, error)
+
+	cur T
+	err error
+}
+
+// NewTypedSource returns a TypedSource that decodes the frames of src as JSON.
+func NewTypedSource[T any](src *ByteSource) *TypedSource[T] {
+	return NewTypedSourceFunc(src, func(b []byte) (T, error) {
+		var v T
+		err := json.Unmarshal(b, &v)
+		return v, err
+	})
+}
+
+// NewTypedSourceFunc returns a TypedSource that decodes the frames of src with decode.
+func NewTypedSourceFunc[T any](src *ByteSource, decode func([]byte) (T, error)) *TypedSource[T] {
+	return &TypedSource[T]{src: src, decode: decode}
+}
+
+// Next blocks until the next frame was decoded. It returns false at the end of the stream or if it failed, see Err.
+// A frame that doesn't decode cancels the stream.
+func (ts *TypedSource[T]) Next(ctx context.Context) bool {
+	if ts.err != nil || !ts.src.Next(ctx) {
+		return false
+	}
+
+	b, err := ts.src.Bytes()
+	if err == nil {
+		ts.cur, err = ts.decode(b)
+		if err != nil {
+			err = fmt.Errorf("muxrpc: failed to decode frame: %w", err)
+			ts.src.Cancel(err)
+		}
+	}
+	if err != nil {
+		ts.err = err
+		return false
+	}
+	return true
+}
+
+// Value returns what Next decoded.
+func (ts *TypedSource[T]) Value() T { return ts.cur }
+
+// Err returns why Next returned false, or nil if the remote ended the stream.
+func (ts *TypedSource[T]) Err() error {
+	if ts.err != nil {
+		return ts.err
+	}
+	return ts.src.Err()
+}
+
+// Cancel ends the stream early, see ByteSource.Cancel.
+func (ts *TypedSource[T]) Cancel(err error) { ts.src.Cancel(err) }
@@ -0,0 +1,44 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+//go:build go1.18
+// +build go1.18
+
+package muxrpc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTypedSource(t *testing.T) {
+	r := require.New(t)
+
+	opts := []HandleOption{WithoutManifest(), WithLogger(NopLogger())}
+	client, _ := NewPipe(&FakeHandler{}, Echo, WithPipeHandleOptions(opts, opts))
+	defer client.Terminate()
+
+	ctx := context.Background()
+	type item struct{ N int }
+
+	src, err := client.Source(ctx, TypeJSON, Method{"echo"}, item{1}, item{2})
+	r.NoError(err)
+	ts := NewTypedSource[item](src)
+	var got []int
+	for ts.Next(ctx) {
+		got = append(got, ts.Value().N)
+	}
+	r.NoError(ts.Err())
+	r.Equal([]int{1, 2}, got)
+
+	// frames that don't decode end the stream
+	src, err = client.Source(ctx, TypeJSON, Method{"echo"}, item{1}, "two", item{3})
+	r.NoError(err)
+	ts = NewTypedSource[item](src)
+	r.True(ts.Next(ctx))
+	r.False(ts.Next(ctx))
+	r.Error(ts.Err())
+}
@@ -0,0 +1,85 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package typemux
+
+import (
+	"sync"
+
+	"github.com/ssbc/go-muxrpc/v2"
+)
+
+// Deprecated marks a method or alias as deprecated. Calls to it still work, but they are logged with note,
+// which should say what to use instead, and counted (see DeprecatedCalls).
+func Deprecated(note string) RegisterOption {
+	return func(reg *registration) {
+		reg.deprecated = &note
+	}
+}
+
+// RegisterAlias makes calls to alias go to the handler of target, for instance to keep an old name of a method working.
+// The alias is resolved on every call, so it follows a new registration or Swap of target. The handler sees the method as it was called.
+// Aliases are listed in the manifest with the type of their target. Only Deprecated applies to them.
+func (hm *HandlerMux) RegisterAlias(alias, target muxrpc.Method, opts ...RegisterOption) {
+	reg := applyRegisterOptions(opts)
+
+	hm.r.mu.Lock()
+	defer hm.r.mu.Unlock()
+	hm.r.current.aliases[alias.String()] = target
+	if reg.deprecated != nil {
+		hm.r.current.deprecated[alias.String()] = *reg.deprecated
+	}
+}
+
+// DeprecatedCalls returns how often each deprecated method or alias was called, by its name. It is shared by the copies of the mux and kept across a Swap.
+func (hm *HandlerMux) DeprecatedCalls() map[string]uint64 {
+	return hm.r.deprecatedCalls.snapshot()
+}
+
+// callCounter counts calls by method name
+type callCounter struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+func (cc *callCounter) inc(name string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.counts == nil {
+		cc.counts = make(map[string]uint64)
+	}
+	cc.counts[name]++
+}
+
+func (cc *callCounter) snapshot() map[string]uint64 {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	counts := make(map[string]uint64, len(cc.counts))
+	for name, n := range cc.counts {
+		counts[name] = n
+	}
+	return counts
+}
+
+// resolve is like lookupName but follows an alias of m.
+// via is the name of the alias, if one was followed.
+func (rt *routeTable) resolve(m muxrpc.Method) (name, via string, ok bool) {
+	if target, isAlias := rt.aliases[m.String()]; isAlias {
+		name, ok = rt.lookupName(target)
+		return name, m.String(), ok
+	}
+	name, ok = rt.lookupName(m)
+	return name, "", ok
+}
+
+// deprecation returns the note of the alias or, without one, of the method it leads to, if either is deprecated.
+func (rt *routeTable) deprecation(name, via string) (string, string, bool) {
+	if via != "" {
+		if note, ok := rt.deprecated[via]; ok {
+			return via, note, true
+		}
+	}
+	note, ok := rt.deprecated[name]
+	return name, note, ok
+}
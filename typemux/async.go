@@ -8,8 +8,6 @@ import (
 	"context"
 
 	"github.com/ssbc/go-muxrpc/v2"
-	"go.mindeco.de/log"
-	"go.mindeco.de/log/level"
 )
 
 var _ AsyncHandler = (*AsyncFunc)(nil)
@@ -25,9 +23,11 @@ type AsyncHandler interface {
 }
 
 type asyncStub struct {
-	logger log.Logger
+	logger muxrpc.Logger
 
 	h AsyncHandler
+
+	enc encoding
 }
 
 func (hm asyncStub) HandleCall(ctx context.Context, req *muxrpc.Request) {
@@ -39,9 +39,13 @@ func (hm asyncStub) HandleCall(ctx context.Context, req *muxrpc.Request) {
 		return
 	}
 
-	err = req.Return(ctx, v)
+	if hm.enc.set {
+		err = req.ReturnEncoded(ctx, hm.enc.re, v)
+	} else {
+		err = req.Return(ctx, v)
+	}
 	if err != nil {
-		level.Error(hm.logger).Log("evt", "return failed", "err", err, "method", req.Method.String())
+		hm.logger.Log(muxrpc.LevelKey, muxrpc.LevelError, "evt", "return failed", "err", err, "method", req.Method.String())
 	}
 }
 
@@ -0,0 +1,250 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package typemux
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ssbc/go-muxrpc/v2"
+)
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// Bind registers the exported methods of svc that take a context as their first argument, under namespace,
+// which can be empty or contain dots. Their names start with a lower case letter, so svc.WhoAmI becomes namespace.whoAmI.
+//
+// The methods take the context of the call and optionally the first argument of the call, which is decoded from JSON into its type.
+// They return a value and an error:
+//
+//	func (s *Service) Get(ctx context.Context, args GetArgs) (Item, error)              // async
+//	func (s *Service) Feed(ctx context.Context, args FeedArgs) (<-chan Item, error)     // source
+//	func (s *Service) Log(ctx context.Context) (func(yield func(Item, error) bool), error) // source
+//
+// Channels and iterators (iter.Seq or iter.Seq2 with an error) are sent as sources, anything else is the answer of an async call.
+// Every value is sent as JSON. A channel has to be closed by the method, which should stop once ctx is done.
+// Bind fails if a method takes a context but doesn't fit these rules, and registers nothing then.
+func (hm *HandlerMux) Bind(namespace string, svc interface{}) error {
+	var prefix muxrpc.Method
+	if namespace != "" {
+		prefix = strings.Split(namespace, ".")
+	}
+
+	v := reflect.ValueOf(svc)
+	type binding struct {
+		m     muxrpc.Method
+		fn    reflect.Value
+		async bool
+		types methodTypes
+	}
+	var bindings []binding
+	for i := 0; i < v.NumMethod(); i++ {
+		name := v.Type().Method(i).Name
+		fn := v.Method(i)
+		t := fn.Type()
+		if t.NumIn() == 0 || t.In(0) != contextType {
+			continue
+		}
+
+		if t.NumIn() > 2 || t.NumOut() != 2 || t.Out(1) != errorType {
+			return fmt.Errorf("typemux: can't bind %s, it needs to be func(context.Context[, args]) (T, error)", name)
+		}
+
+		first, size := utf8.DecodeRuneInString(name)
+		m := append(append(muxrpc.Method{}, prefix...), string(unicode.ToLower(first))+name[size:])
+		b := binding{m: m, fn: fn, async: !isSourceType(t.Out(0))}
+		if t.NumIn() == 2 {
+			b.types.args = t.In(1)
+		}
+		b.types.ret = itemType(t.Out(0))
+		bindings = append(bindings, b)
+	}
+
+	for _, b := range bindings {
+		opts := []RegisterOption{WithEncoding(muxrpc.TypeJSON), func(reg *registration) { reg.types = b.types }}
+		if b.async {
+			hm.RegisterAsync(b.m, boundAsync(b.fn), opts...)
+		} else {
+			hm.RegisterSource(b.m, boundSource(b.fn), opts...)
+		}
+	}
+	return nil
+}
+
+// isSourceType is true for channels that can be received from and for iterators
+func isSourceType(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Chan:
+		return t.ChanDir()&reflect.RecvDir != 0
+	case reflect.Func:
+		_, ok := yieldType(t)
+		return ok
+	}
+	return false
+}
+
+// itemType returns the type of the items of a channel or iterator, or t itself if it is neither
+func itemType(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Chan {
+		return t.Elem()
+	}
+	if y, ok := yieldType(t); ok {
+		return y.In(0)
+	}
+	return t
+}
+
+// yieldType returns the type of the yield function of an iter.Seq or of an iter.Seq2 whose second value is an error
+func yieldType(t reflect.Type) (reflect.Type, bool) {
+	if t.Kind() != reflect.Func || t.NumIn() != 1 || t.NumOut() != 0 {
+		return nil, false
+	}
+	y := t.In(0)
+	if y.Kind() != reflect.Func || y.NumOut() != 1 || y.Out(0).Kind() != reflect.Bool {
+		return nil, false
+	}
+	switch {
+	case y.NumIn() == 1:
+		return y, true
+	case y.NumIn() == 2 && y.In(1) == errorType:
+		return y, true
+	}
+	return nil, false
+}
+
+// callBound decodes the arguments of req for fn and calls it
+func callBound(ctx context.Context, fn reflect.Value, req *muxrpc.Request) (reflect.Value, error) {
+	in := []reflect.Value{reflect.ValueOf(ctx)}
+	if t := fn.Type(); t.NumIn() == 2 {
+		arg, err := decodeArg(t.In(1), req.RawArgs)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		in = append(in, arg)
+	}
+
+	out := fn.Call(in)
+	if err, _ := out[1].Interface().(error); err != nil {
+		return reflect.Value{}, err
+	}
+	return out[0], nil
+}
+
+// decodeArg decodes the first argument of a call into a new value of type t.
+// Calls without arguments get the zero value. Types that implement muxrpc.ArgValidator are validated.
+func decodeArg(t reflect.Type, raw json.RawMessage) (reflect.Value, error) {
+	var args []json.RawMessage
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &args); err != nil {
+			return reflect.Value{}, fmt.Errorf("typemux: invalid arguments: %w", err)
+		}
+	}
+
+	ptr := t.Kind() == reflect.Ptr
+	if ptr {
+		t = t.Elem()
+	}
+	val := reflect.New(t)
+	if len(args) > 0 {
+		if err := json.Unmarshal(args[0], val.Interface()); err != nil {
+			return reflect.Value{}, fmt.Errorf("typemux: invalid arguments: %w", err)
+		}
+	}
+	if av, ok := val.Interface().(muxrpc.ArgValidator); ok {
+		if err := av.Validate(); err != nil {
+			return reflect.Value{}, fmt.Errorf("typemux: invalid arguments: %w", err)
+		}
+	}
+
+	if ptr {
+		return val, nil
+	}
+	return val.Elem(), nil
+}
+
+func boundAsync(fn reflect.Value) AsyncFunc {
+	return func(ctx context.Context, req *muxrpc.Request) (interface{}, error) {
+		ret, err := callBound(ctx, fn, req)
+		if err != nil {
+			return nil, err
+		}
+		return ret.Interface(), nil
+	}
+}
+
+func boundSource(fn reflect.Value) SourceFunc {
+	return func(ctx context.Context, req *muxrpc.Request, snk *muxrpc.ByteSink) error {
+		ret, err := callBound(ctx, fn, req)
+		if err != nil {
+			return err
+		}
+
+		send := func(v reflect.Value) error {
+			b, err := json.Marshal(v.Interface())
+			if err != nil {
+				return fmt.Errorf("typemux: failed to encode item of %s: %w", req.Method, err)
+			}
+			_, err = snk.Write(b)
+			return err
+		}
+
+		if ret.Kind() == reflect.Chan {
+			err = sendChan(ctx, ret, send)
+		} else {
+			err = sendSeq(ret, send)
+		}
+		if err != nil {
+			return err
+		}
+		return snk.Close()
+	}
+}
+
+// sendChan sends the values of ch until it is closed or ctx is done
+func sendChan(ctx context.Context, ch reflect.Value, send func(reflect.Value) error) error {
+	cases := []reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: ch},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+	}
+	for {
+		chosen, v, ok := reflect.Select(cases)
+		if chosen == 1 {
+			return ctx.Err()
+		}
+		if !ok {
+			return nil
+		}
+		if err := send(v); err != nil {
+			return err
+		}
+	}
+}
+
+// sendSeq sends the values of an iterator until it stops, yields an error or sending fails
+func sendSeq(seq reflect.Value, send func(reflect.Value) error) error {
+	yt, _ := yieldType(seq.Type())
+
+	var err error
+	yield := reflect.MakeFunc(yt, func(args []reflect.Value) []reflect.Value {
+		if len(args) == 2 {
+			if yerr, _ := args[1].Interface().(error); yerr != nil {
+				err = yerr
+				return []reflect.Value{reflect.ValueOf(false)}
+			}
+		}
+		err = send(args[0])
+		return []reflect.Value{reflect.ValueOf(err == nil)}
+	})
+	seq.Call([]reflect.Value{yield})
+	return err
+}
@@ -0,0 +1,191 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package typemux
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ssbc/go-muxrpc/v2"
+)
+
+type greetArgs struct {
+	Name string `json:"name"`
+}
+
+func (a greetArgs) Validate() error {
+	if a.Name == "nobody" {
+		return errors.New("nobody can't be greeted")
+	}
+	return nil
+}
+
+type service struct{}
+
+type whoami struct {
+	ID string `json:"id"`
+}
+
+func (service) WhoAmI(ctx context.Context) (whoami, error) { return whoami{ID: "@alice"}, nil }
+
+func (service) Greet(ctx context.Context, args greetArgs) (map[string]string, error) {
+	return map[string]string{"hello": args.Name}, nil
+}
+
+func (service) Count(ctx context.Context, args *struct{ To int }) (<-chan int, error) {
+	ch := make(chan int)
+	go func() {
+		defer close(ch)
+		for i := 0; i < args.To; i++ {
+			select {
+			case ch <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (service) Letters(ctx context.Context) (func(yield func(string, error) bool), error) {
+	return func(yield func(string, error) bool) {
+		for _, l := range []string{"a", "b", "c"} {
+			if !yield(l, nil) {
+				return
+			}
+		}
+		yield("", fmt.Errorf("out of letters"))
+	}, nil
+}
+
+// not bound, it doesn't take a context
+func (service) Helper() {}
+
+type badService struct{}
+
+func (badService) Broken(ctx context.Context) error { return nil }
+
+func TestBind(t *testing.T) {
+	r := require.New(t)
+
+	mux := New(muxrpc.NopLogger())
+	r.NoError(mux.Bind("svc", service{}))
+	r.Error(mux.Bind("bad", badService{}))
+
+	r.Equal(Manifest{
+		"whoAmI":  "async",
+		"greet":   "async",
+		"count":   "source",
+		"letters": "source",
+	}, mux.Manifest()["svc"])
+	r.False(mux.Handled(muxrpc.Method{"svc", "helper"}))
+	r.False(mux.Handled(muxrpc.Method{"bad", "broken"}))
+
+	client := serveMux(t, &mux)
+	ctx := context.Background()
+
+	var who whoami
+	r.NoError(client.Async(ctx, &who, muxrpc.TypeJSON, muxrpc.Method{"svc", "whoAmI"}))
+	r.Equal("@alice", who.ID)
+
+	var greeting map[string]string
+	r.NoError(client.Async(ctx, &greeting, muxrpc.TypeJSON, muxrpc.Method{"svc", "greet"}, greetArgs{Name: "bob"}))
+	r.Equal("bob", greeting["hello"])
+
+	err := client.Async(ctx, &greeting, muxrpc.TypeJSON, muxrpc.Method{"svc", "greet"}, greetArgs{Name: "nobody"})
+	r.Error(err)
+	r.Contains(err.Error(), "nobody can't be greeted")
+
+	src, err := client.Source(ctx, muxrpc.TypeJSON, muxrpc.Method{"svc", "count"}, map[string]int{"To": 4})
+	r.NoError(err)
+	var got []int
+	for src.Next(ctx) {
+		b, err := src.Bytes()
+		r.NoError(err)
+		var n int
+		r.NoError(json.Unmarshal(b, &n))
+		got = append(got, n)
+	}
+	r.NoError(src.Err())
+	r.Equal([]int{0, 1, 2, 3}, got)
+
+	src, err = client.Source(ctx, muxrpc.TypeJSON, muxrpc.Method{"svc", "letters"})
+	r.NoError(err)
+	var letters string
+	for src.Next(ctx) {
+		b, err := src.Bytes()
+		r.NoError(err)
+		var l string
+		r.NoError(json.Unmarshal(b, &l))
+		letters += l
+	}
+	r.Equal("abc", letters)
+	r.Error(src.Err())
+	r.Contains(src.Err().Error(), "out of letters")
+}
+
+func TestDescribe(t *testing.T) {
+	r := require.New(t)
+
+	type page struct {
+		Limit  int    `json:"limit,omitempty"`
+		Cursor string `json:"cursor"`
+	}
+	type note struct {
+		page
+		Text string   `json:"text"`
+		Tags []string `json:"tags,omitempty"`
+		Raw  []byte
+		Next *note `json:"next,omitempty"`
+	}
+
+	mux := New(muxrpc.NopLogger())
+	r.NoError(mux.Bind("svc", service{}))
+	get := AsyncFunc(func(ctx context.Context, req *muxrpc.Request) (interface{}, error) { return note{}, nil })
+	mux.RegisterAsync(muxrpc.Method{"notes", "get"}, get, WithTypes(page{}, (*note)(nil)))
+	mux.RegisterAlias(muxrpc.Method{"notes", "fetch"}, muxrpc.Method{"notes", "get"}, Deprecated("use notes.get"))
+
+	desc := mux.Describe()
+	var names []string
+	byName := make(map[string]MethodDescription)
+	for _, md := range desc.Methods {
+		names = append(names, md.Name)
+		byName[md.Name] = md
+	}
+	r.Equal([]string{"notes.fetch", "notes.get", "svc.count", "svc.greet", "svc.letters", "svc.whoAmI"}, names)
+
+	greet := byName["svc.greet"]
+	r.Equal(muxrpc.CallType("async"), greet.Type)
+	r.Equal("json", greet.Encoding)
+	r.Equal([]string{"name"}, greet.Args["required"])
+	r.Equal(Schema{"type": "object", "additionalProperties": Schema{"type": "string"}}, greet.Returns)
+	r.Nil(byName["svc.whoAmI"].Args)
+
+	// sources are described by their items
+	r.Equal(Schema{"type": "integer"}, byName["svc.count"].Returns)
+	r.Equal(Schema{"type": "string"}, byName["svc.letters"].Returns)
+
+	notes := byName["notes.get"]
+	r.Equal([]string{"cursor"}, notes.Args["required"])
+	props := notes.Returns["properties"].(map[string]interface{})
+	r.Contains(props, "limit", "embedded fields are lifted")
+	r.Equal(Schema{"type": "string", "contentEncoding": "base64"}, props["Raw"])
+	r.Equal(Schema{}, props["next"], "recursion stops")
+	r.Equal([]string{"cursor", "text", "Raw"}, notes.Returns["required"])
+
+	fetch := byName["notes.fetch"]
+	r.Equal("notes.get", fetch.AliasOf)
+	r.Equal("use notes.get", fetch.Deprecated)
+	r.Equal(notes.Returns, fetch.Returns)
+
+	b, err := json.Marshal(desc)
+	r.NoError(err)
+	r.Contains(string(b), `"aliasOf":"notes.get"`)
+}
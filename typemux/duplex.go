@@ -27,6 +27,8 @@ var _ DuplexHandler = (*DuplexFunc)(nil)
 
 type duplexStub struct {
 	h DuplexHandler
+
+	enc encoding
 }
 
 func (hm duplexStub) HandleCall(ctx context.Context, req *muxrpc.Request) {
@@ -43,6 +45,9 @@ func (hm duplexStub) HandleCall(ctx context.Context, req *muxrpc.Request) {
 		req.CloseWithError(err)
 		return
 	}
+	if hm.enc.set {
+		w.SetEncoding(hm.enc.re)
+	}
 
 	err = hm.h.HandleDuplex(ctx, req, r, w)
 	if err != nil {
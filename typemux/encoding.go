@@ -0,0 +1,49 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package typemux
+
+import (
+	"github.com/ssbc/go-muxrpc/v2"
+)
+
+// RegisterOption changes how a method is registered.
+type RegisterOption func(*registration)
+
+type registration struct {
+	enc encoding
+
+	// deprecated is the note of a deprecated method, nil if it isn't (see Deprecated)
+	deprecated *string
+
+	types methodTypes
+}
+
+// encoding is the default encoding of a method, if set is true
+type encoding struct {
+	re  muxrpc.RequestEncoding
+	set bool
+}
+
+// WithEncoding records the encoding of the data a method sends.
+// Async and source handlers of it answer with that encoding and clients can use it through Encoding.
+func WithEncoding(re muxrpc.RequestEncoding) RegisterOption {
+	return func(reg *registration) {
+		reg.enc = encoding{re: re, set: true}
+	}
+}
+
+// Encoding returns the encoding that was registered for m, following the same patterns as the calls.
+// It can be passed to muxrpc.CallEncodings so that calls to the methods of the mux use the right encoding.
+func (hm *HandlerMux) Encoding(m muxrpc.Method) (muxrpc.RequestEncoding, bool) {
+	hm.r.mu.RLock()
+	defer hm.r.mu.RUnlock()
+
+	name, _, ok := hm.r.current.resolve(m)
+	if !ok {
+		return 0, false
+	}
+	enc := hm.r.current.encodings[name]
+	return enc.re, enc.set
+}
@@ -0,0 +1,67 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package typemux
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ssbc/go-muxrpc/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodings(t *testing.T) {
+	r := require.New(t)
+
+	blob := []byte{0, 1, 2, 0xff}
+
+	mux := New(muxrpc.NopLogger())
+	mux.RegisterAsync(muxrpc.Method{"blobs", "raw"}, AsyncFunc(func(context.Context, *muxrpc.Request) (interface{}, error) {
+		return blob, nil
+	}), WithEncoding(muxrpc.TypeBinary))
+	mux.RegisterSource(muxrpc.Method{"blobs", Wildcard}, SourceFunc(func(ctx context.Context, req *muxrpc.Request, snk *muxrpc.ByteSink) error {
+		snk.Write(blob)
+		return snk.Close()
+	}), WithEncoding(muxrpc.TypeBinary))
+	mux.RegisterAsync(muxrpc.Method{"whoami"}, AsyncFunc(func(context.Context, *muxrpc.Request) (interface{}, error) {
+		return map[string]string{"id": "me"}, nil
+	}))
+
+	re, ok := mux.Encoding(muxrpc.Method{"blobs", "raw"})
+	r.True(ok)
+	r.Equal(muxrpc.TypeBinary, re)
+	re, ok = mux.Encoding(muxrpc.Method{"blobs", "get"})
+	r.True(ok, "patterns should have the encoding, too")
+	r.Equal(muxrpc.TypeBinary, re)
+	_, ok = mux.Encoding(muxrpc.Method{"whoami"})
+	r.False(ok)
+
+	ctx := context.Background()
+	client := serveMux(t, &mux)
+
+	// the encoding passed to the call doesn't match what the method sends
+	var got []byte
+	err := client.Async(ctx, &got, muxrpc.TypeJSON, muxrpc.Method{"blobs", "raw"})
+	r.Error(err)
+
+	// unless the view looks it up
+	typed := client.WithOptions(muxrpc.CallEncodings(mux.Encoding))
+	err = typed.Async(ctx, &got, muxrpc.TypeJSON, muxrpc.Method{"blobs", "raw"})
+	r.NoError(err)
+	r.Equal(blob, got)
+
+	src, err := typed.Source(ctx, muxrpc.TypeJSON, muxrpc.Method{"blobs", "get"})
+	r.NoError(err)
+	r.True(src.Next(ctx))
+	r.Equal(muxrpc.TypeBinary, src.Encoding())
+	got, err = src.Bytes()
+	r.NoError(err)
+	r.Equal(blob, got)
+
+	// methods without an encoding keep the one of the call
+	var who struct{ ID string }
+	r.NoError(typed.Async(ctx, &who, muxrpc.TypeJSON, muxrpc.Method{"whoami"}))
+	r.Equal("me", who.ID)
+}
@@ -0,0 +1,87 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package typemux
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/ssbc/go-muxrpc/v2"
+)
+
+// Manifest is the description of the methods a peer offers, in the nested format of JS muxrpc:
+//
+//	{"whoami": "async", "blobs": {"get": "source", "add": "sink"}}
+type Manifest map[string]interface{}
+
+// Manifest builds the manifest of all registered methods. It is also what the mux answers to manifest calls,
+// unless a handler for "manifest" was registered. It lists muxrpc.HelloMethod and muxrpc.FlowMethod, which the endpoint answers.
+//
+// Patterns are listed with their Wildcard, which Go peers understand and JS peers ignore.
+// Methods that are also a group, like "blobs" next to "blobs.get", are left out since JS can't represent them.
+func (hm *HandlerMux) Manifest() Manifest {
+	hm.r.mu.RLock()
+	defer hm.r.mu.RUnlock()
+	return hm.r.current.manifest()
+}
+
+func (rt *routeTable) manifest() Manifest {
+	types := make(map[string]muxrpc.CallType, len(rt.types)+len(rt.aliases))
+	for name, ct := range rt.types {
+		types[name] = ct
+	}
+	for alias, target := range rt.aliases {
+		if name, ok := rt.lookupName(target); ok {
+			types[alias] = rt.types[name]
+		}
+	}
+
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	// longer names first, so that groups exist before a method with the same name could take their place
+	sort.Slice(names, func(i, j int) bool {
+		return strings.Count(names[i], ".") > strings.Count(names[j], ".")
+	})
+
+	m := make(Manifest)
+	for _, name := range names {
+		path := strings.Split(name, ".")
+		group := m
+		for _, p := range path[:len(path)-1] {
+			sub, ok := group[p].(Manifest)
+			if !ok {
+				sub = make(Manifest)
+				group[p] = sub
+			}
+			group = sub
+		}
+
+		last := path[len(path)-1]
+		if _, taken := group[last]; taken {
+			continue
+		}
+		group[last] = string(types[name])
+	}
+
+	// JS peers list it as well, some clients check for it
+	if _, has := m["manifest"]; !has {
+		m["manifest"] = "sync"
+	}
+	// every endpoint answers hello and flow calls (see muxrpc.WithHello), they share a group
+	group := muxrpc.HelloMethod[0]
+	if _, has := m[group]; !has {
+		m[group] = Manifest{
+			muxrpc.HelloMethod[1]: "sync",
+			muxrpc.FlowMethod[1]:  "sync",
+		}
+	}
+	return m
+}
+
+func isManifestCall(m muxrpc.Method) bool {
+	return len(m) == 1 && m[0] == "manifest"
+}
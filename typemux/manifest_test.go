@@ -0,0 +1,55 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package typemux
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/ssbc/go-muxrpc/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifest(t *testing.T) {
+	r := require.New(t)
+
+	mux := New(muxrpc.NopLogger())
+	mux.RegisterAsync(muxrpc.Method{"whoami"}, AsyncFunc(func(context.Context, *muxrpc.Request) (interface{}, error) {
+		return "me", nil
+	}))
+	mux.RegisterSource(muxrpc.Method{"blobs", "get"}, SourceFunc(func(context.Context, *muxrpc.Request, *muxrpc.ByteSink) error {
+		return nil
+	}))
+	mux.RegisterSink(muxrpc.Method{"blobs", "add"}, SinkFunc(func(context.Context, *muxrpc.Request, *muxrpc.ByteSource) error {
+		return nil
+	}))
+	mux.RegisterDuplex(muxrpc.Method{"tunnel", "connect"}, DuplexFunc(func(context.Context, *muxrpc.Request, *muxrpc.ByteSource, *muxrpc.ByteSink) error {
+		return nil
+	}))
+	mux.RegisterAsync(muxrpc.Method{"tunnel", Wildcard}, AsyncFunc(func(context.Context, *muxrpc.Request) (interface{}, error) {
+		return nil, nil
+	}))
+	// can't be represented next to the blobs group
+	mux.RegisterAsync(muxrpc.Method{"blobs"}, AsyncFunc(func(context.Context, *muxrpc.Request) (interface{}, error) {
+		return nil, nil
+	}))
+
+	want := `{"blobs":{"add":"sink","get":"source"},"manifest":"sync","muxrpc":{"flow":"sync","hello":"sync"},"tunnel":{"*":"async","connect":"duplex"},"whoami":"async"}`
+	got, err := json.Marshal(mux.Manifest())
+	r.NoError(err)
+	r.Equal(want, string(got))
+
+	client := serveMux(t, &mux)
+
+	var served json.RawMessage
+	r.NoError(client.Async(context.Background(), &served, muxrpc.TypeJSON, muxrpc.Method{"manifest"}))
+	r.Equal(want, string(served))
+
+	// the client picked it up when connecting
+	r.True(muxrpc.HasMethod(client, muxrpc.Method{"blobs", "get"}))
+	r.True(muxrpc.HasMethod(client, muxrpc.Method{"tunnel", "announce"}))
+	r.False(muxrpc.HasMethod(client, muxrpc.Method{"blobs", "has"}))
+}
@@ -4,15 +4,14 @@
 
 // Package typemux offers an improved muxrpc.HandlerMux (think HTTP router).
 // compared to the first draft, this one offers specialed handler functions for the different call types (async, source, sink)
-// to reduce boilerplate in handlers.
+// to reduce boilerplate in handlers. Methods can be registered exactly or as a prefix pattern that ends with Wildcard.
 package typemux
 
 import (
 	"context"
-	"fmt"
+	"sync"
 
 	"github.com/ssbc/go-muxrpc/v2"
-	"go.mindeco.de/log"
 )
 
 // the handlers passed to typemux are checked bu this muxer and dont need the Handled() function
@@ -21,72 +20,243 @@ type handler interface {
 	muxrpc.ConnectHandler
 }
 
+// Wildcard can be used as the last element of a registered method to handle all methods under that prefix.
+// For instance muxrpc.Method{"blobs", Wildcard} handles blobs.get and blobs.has, unless they are registered themselves.
+const Wildcard = "*"
+
 type HandlerMux struct {
-	logger log.Logger
+	logger muxrpc.Logger
+
+	// shared by all copies of the mux, so that a Swap is seen by all of them
+	r *router
+}
+
+type router struct {
+	mu      sync.RWMutex
+	current *routeTable
+
+	deprecatedCalls callCounter
+}
+
+// routeTable is one generation of handlers. calls tracks the calls that are dispatched to them.
+type routeTable struct {
+	handlers  map[string]handler
+	types     map[string]muxrpc.CallType
+	encodings map[string]encoding
+	calls     sync.WaitGroup
 
-	handlers map[string]handler
+	// aliases maps the name of an alias to the method it stands for, deprecated the names of deprecated methods and aliases to their note
+	aliases    map[string]muxrpc.Method
+	deprecated map[string]string
+
+	// goTypes are the Go types of the arguments and answers of methods, if they are known (see WithTypes)
+	goTypes map[string]methodTypes
+}
+
+func newRouteTable(size int) *routeTable {
+	return &routeTable{
+		handlers:  make(map[string]handler, size),
+		types:     make(map[string]muxrpc.CallType, size),
+		encodings: make(map[string]encoding, size),
+
+		aliases:    make(map[string]muxrpc.Method),
+		deprecated: make(map[string]string),
+		goTypes:    make(map[string]methodTypes),
+	}
 }
 
 var _ muxrpc.Handler = (*HandlerMux)(nil)
 
-func New(log log.Logger) HandlerMux {
+func New(log muxrpc.Logger) HandlerMux {
 	return HandlerMux{
-		handlers: make(map[string]handler),
-		logger:   log,
+		logger: log,
+		r: &router{
+			current: newRouteTable(0),
+		},
 	}
 }
 
 func (hm *HandlerMux) Handled(m muxrpc.Method) bool {
-	_, has := hm.handlers[m.String()]
+	hm.r.mu.RLock()
+	defer hm.r.mu.RUnlock()
+	if isManifestCall(m) {
+		return true
+	}
+	_, _, has := hm.r.current.resolve(m)
 	return has
 }
 
+// lookupName returns the name under which the handler for m was registered.
+// An exact registration wins over a pattern, longer patterns win over shorter ones.
+func (rt *routeTable) lookupName(m muxrpc.Method) (string, bool) {
+	if _, ok := rt.handlers[m.String()]; ok {
+		return m.String(), true
+	}
+
+	for i := len(m) - 1; i >= 0; i-- {
+		pattern := append(m[:i:i], Wildcard).String()
+		if _, ok := rt.handlers[pattern]; ok {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
 func (hm *HandlerMux) HandleCall(ctx context.Context, req *muxrpc.Request) {
+	hm.r.mu.RLock()
+	table := hm.r.current
+	table.calls.Add(1)
+	hm.r.mu.RUnlock()
+	defer table.calls.Done()
+
+	if _, registered := table.handlers[req.Method.String()]; isManifestCall(req.Method) && !registered {
+		err := req.Return(ctx, table.manifest())
+		if err != nil {
+			hm.logger.Log(muxrpc.LevelKey, muxrpc.LevelError, "evt", "manifest return failed", "err", err)
+		}
+		return
+	}
+
+	if name, via, ok := table.resolve(req.Method); ok {
+		if called, note, deprecated := table.deprecation(name, via); deprecated {
+			hm.r.deprecatedCalls.inc(called)
+			hm.logger.Log(muxrpc.LevelKey, muxrpc.LevelWarn, "evt", "deprecated method called", "method", called, "note", note)
+		}
+		if declared := table.types[name]; !callTypeFits(declared, req.Type) {
+			req.CloseWithError(muxrpc.ErrWrongCallType{Method: req.Method, Called: string(req.Type), Declared: string(declared)})
+			return
+		}
+		table.handlers[name].HandleCall(ctx, req)
+		return
+	}
+
 	for i := len(req.Method); i > 0; i-- {
 		m := req.Method[:i]
-		h, ok := hm.handlers[m.String()]
+		h, ok := table.handlers[m.String()]
 		if ok {
 			h.HandleCall(ctx, req)
 			return
 		}
 	}
-	req.CloseWithError(fmt.Errorf("no such command: %v", req.Method))
+	req.CloseWithError(muxrpc.ErrNoSuchMethod{Method: req.Method})
+}
+
+// callTypeFits is true if a call of type called can be answered by a handler registered as declared.
+// JS peers call sync methods as async, so these are treated the same. Calls without a type are let through.
+func callTypeFits(declared, called muxrpc.CallType) bool {
+	if called == "" {
+		return true
+	}
+	if declared == "sync" {
+		declared = "async"
+	}
+	if called == "sync" {
+		called = "async"
+	}
+	return declared == called
 }
 
 func (hm *HandlerMux) HandleConnect(ctx context.Context, edp muxrpc.Endpoint) {
-	for _, h := range hm.handlers {
+	hm.r.mu.RLock()
+	defer hm.r.mu.RUnlock()
+	for _, h := range hm.r.current.handlers {
 		go h.HandleConnect(ctx, edp)
 	}
 }
 
+// Swap atomically replaces all the registered handlers with the ones of next, for example after a configuration reload.
+// New calls are dispatched to the new handlers right away while calls that are already running continue on the old ones.
+// The returned channel is closed once all calls to the old handlers returned.
+// HandleConnect of the new handlers is not called for connections that are already established.
+func (hm *HandlerMux) Swap(next HandlerMux) <-chan struct{} {
+	next.r.mu.RLock()
+	table := newRouteTable(len(next.r.current.handlers))
+	for name, h := range next.r.current.handlers {
+		table.handlers[name] = h
+		table.types[name] = next.r.current.types[name]
+		table.encodings[name] = next.r.current.encodings[name]
+	}
+	for alias, target := range next.r.current.aliases {
+		table.aliases[alias] = target
+	}
+	for name, note := range next.r.current.deprecated {
+		table.deprecated[name] = note
+	}
+	for name, mt := range next.r.current.goTypes {
+		table.goTypes[name] = mt
+	}
+	next.r.mu.RUnlock()
+
+	hm.r.mu.Lock()
+	old := hm.r.current
+	hm.r.current = table
+	hm.r.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		old.calls.Wait()
+		close(drained)
+	}()
+	return drained
+}
+
+func (hm *HandlerMux) register(m muxrpc.Method, ct muxrpc.CallType, h handler, reg registration) {
+	hm.r.mu.Lock()
+	defer hm.r.mu.Unlock()
+	hm.r.current.handlers[m.String()] = h
+	hm.r.current.types[m.String()] = ct
+	hm.r.current.encodings[m.String()] = reg.enc
+	if reg.deprecated != nil {
+		hm.r.current.deprecated[m.String()] = *reg.deprecated
+	} else {
+		delete(hm.r.current.deprecated, m.String())
+	}
+	hm.r.current.goTypes[m.String()] = reg.types
+}
+
+func applyRegisterOptions(opts []RegisterOption) registration {
+	var reg registration
+	for _, o := range opts {
+		o(&reg)
+	}
+	return reg
+}
+
 // RegisterAsync registers a 'async' call for name method
-func (hm *HandlerMux) RegisterAsync(m muxrpc.Method, h AsyncHandler) {
-	hm.handlers[m.String()] = asyncStub{
+func (hm *HandlerMux) RegisterAsync(m muxrpc.Method, h AsyncHandler, opts ...RegisterOption) {
+	reg := applyRegisterOptions(opts)
+	hm.register(m, "async", asyncStub{
 		logger: hm.logger,
 		h:      h,
-	}
+		enc:    reg.enc,
+	}, reg)
 }
 
 // RegisterSource registers a 'source' call for name method
-func (hm *HandlerMux) RegisterSource(m muxrpc.Method, h SourceHandler) {
-	hm.handlers[m.String()] = sourceStub{
+func (hm *HandlerMux) RegisterSource(m muxrpc.Method, h SourceHandler, opts ...RegisterOption) {
+	reg := applyRegisterOptions(opts)
+	hm.register(m, "source", sourceStub{
 		// logger: hm.logger,
-		h: h,
-	}
+		h:   h,
+		enc: reg.enc,
+	}, reg)
 }
 
 // RegisterSink registers a 'sink' call for name method
-func (hm *HandlerMux) RegisterSink(m muxrpc.Method, h SinkHandler) {
-	hm.handlers[m.String()] = sinkStub{
+func (hm *HandlerMux) RegisterSink(m muxrpc.Method, h SinkHandler, opts ...RegisterOption) {
+	reg := applyRegisterOptions(opts)
+	hm.register(m, "sink", sinkStub{
 		// logger: hm.logger,
 		h: h,
-	}
+	}, reg)
 }
 
 // RegisterDuplex registers a 'sink' call for name method
-func (hm *HandlerMux) RegisterDuplex(m muxrpc.Method, h DuplexHandler) {
-	hm.handlers[m.String()] = duplexStub{
+func (hm *HandlerMux) RegisterDuplex(m muxrpc.Method, h DuplexHandler, opts ...RegisterOption) {
+	reg := applyRegisterOptions(opts)
+	hm.register(m, "duplex", duplexStub{
 		// logger: hm.logger,
-		h: h,
-	}
+		h:   h,
+		enc: reg.enc,
+	}, reg)
 }
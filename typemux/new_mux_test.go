@@ -0,0 +1,237 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package typemux
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ssbc/go-muxrpc/v2"
+	"github.com/stretchr/testify/require"
+)
+
+type nopConnect struct{}
+
+func (nopConnect) Handled(muxrpc.Method) bool                        { return false }
+func (nopConnect) HandleCall(_ context.Context, req *muxrpc.Request) { req.CloseWithError(nil) }
+func (nopConnect) HandleConnect(context.Context, muxrpc.Endpoint)    {}
+
+func TestSwap(t *testing.T) {
+	r := require.New(t)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	old := New(muxrpc.NopLogger())
+	old.RegisterAsync(muxrpc.Method{"version"}, AsyncFunc(func(ctx context.Context, req *muxrpc.Request) (interface{}, error) {
+		close(started)
+		<-release
+		return "old", nil
+	}))
+
+	client := serveMux(t, &old)
+
+	ctx := context.Background()
+
+	oldRes := make(chan string, 1)
+	go func() {
+		var v string
+		if err := client.Async(ctx, &v, muxrpc.TypeString, muxrpc.Method{"version"}); err != nil {
+			v = err.Error()
+		}
+		oldRes <- v
+	}()
+	<-started
+
+	next := New(muxrpc.NopLogger())
+	next.RegisterAsync(muxrpc.Method{"version"}, AsyncFunc(func(ctx context.Context, req *muxrpc.Request) (interface{}, error) {
+		return "new", nil
+	}))
+	drained := old.Swap(next)
+
+	// new calls go to the new handlers while the old one is still busy
+	var v string
+	r.NoError(client.Async(ctx, &v, muxrpc.TypeString, muxrpc.Method{"version"}))
+	r.Equal("new", v)
+
+	select {
+	case <-drained:
+		t.Fatal("drained before the old call returned")
+	default:
+	}
+
+	close(release)
+	r.Equal("old", <-oldRes)
+
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("old handlers never drained")
+	}
+}
+
+func TestPatterns(t *testing.T) {
+	r := require.New(t)
+
+	mux := New(muxrpc.NopLogger())
+	named := func(name string) AsyncFunc {
+		return func(context.Context, *muxrpc.Request) (interface{}, error) { return name, nil }
+	}
+	mux.RegisterAsync(muxrpc.Method{"blobs", "get"}, named("exact"))
+	mux.RegisterAsync(muxrpc.Method{"blobs", Wildcard}, named("blobs"))
+	mux.RegisterAsync(muxrpc.Method{"blobs", "sub", Wildcard}, named("sub"))
+
+	r.True(mux.Handled(muxrpc.Method{"blobs", "has"}))
+	r.False(mux.Handled(muxrpc.Method{"blobs"}), "the pattern needs something after the prefix")
+	r.False(mux.Handled(muxrpc.Method{"whoami"}))
+
+	// everything else can be caught as well
+	mux.RegisterAsync(muxrpc.Method{Wildcard}, named("fallback"))
+
+	client := serveMux(t, &mux)
+	ctx := context.Background()
+
+	for method, want := range map[string]muxrpc.Method{
+		"exact": {"blobs", "get"},
+		"blobs": {"blobs", "has"},
+		"sub":   {"blobs", "sub", "deeper", "still"},
+	} {
+		var got string
+		r.NoError(client.Async(ctx, &got, muxrpc.TypeString, want))
+		r.Equal(method, got, "wrong handler for %s", want)
+	}
+
+	var got string
+	r.NoError(client.Async(ctx, &got, muxrpc.TypeString, muxrpc.Method{"whoami"}))
+	r.Equal("fallback", got)
+}
+
+func TestWrongCallType(t *testing.T) {
+	r := require.New(t)
+
+	mux := New(muxrpc.NopLogger())
+	mux.RegisterSource(muxrpc.Method{"feed"}, SourceFunc(func(ctx context.Context, req *muxrpc.Request, snk *muxrpc.ByteSink) error {
+		return snk.Close()
+	}))
+
+	ctx := context.Background()
+	var v string
+
+	// without the manifest the server has to refuse the call
+	client := serveMux(t, &mux, muxrpc.WithoutManifest())
+	err := client.Async(ctx, &v, muxrpc.TypeString, muxrpc.Method{"feed"})
+	r.True(errors.Is(err, muxrpc.ErrCallTypeMismatch), "unexpected error: %v", err)
+	var ce *muxrpc.CallError
+	r.True(errors.As(err, &ce))
+	r.Equal(muxrpc.CodeWrongCallType, ce.Code)
+
+	err = client.Async(ctx, &v, muxrpc.TypeString, muxrpc.Method{"nope"})
+	r.True(errors.Is(err, muxrpc.ErrMethodNotFound), "unexpected error: %v", err)
+	r.False(errors.Is(err, muxrpc.ErrCallTypeMismatch))
+
+	// with it the client already knows
+	client = serveMux(t, &mux)
+	err = client.Async(ctx, &v, muxrpc.TypeString, muxrpc.Method{"feed"})
+	r.True(errors.Is(err, muxrpc.ErrCallTypeMismatch), "unexpected error: %v", err)
+	var wct muxrpc.ErrWrongCallType
+	r.True(errors.As(err, &wct))
+	r.Equal("source", wct.Declared)
+}
+
+func serveMux(t *testing.T, mux *HandlerMux, clientOpts ...muxrpc.HandleOption) muxrpc.Endpoint {
+	c1, c2 := tcpPair(t)
+	srvc := make(chan muxrpc.Endpoint)
+	go func() {
+		srvc <- muxrpc.Handle(muxrpc.NewPacker(c2), mux)
+	}()
+	client := muxrpc.Handle(muxrpc.NewPacker(c1), nopConnect{}, clientOpts...)
+	server := <-srvc
+	t.Cleanup(func() {
+		client.Terminate()
+		server.Terminate()
+	})
+	return client
+}
+
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	r := require.New(t)
+
+	lis, err := net.Listen("tcp4", "localhost:0")
+	r.NoError(err)
+	defer lis.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		c, err := lis.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- c
+	}()
+
+	c1, err := net.Dial("tcp", lis.Addr().String())
+	r.NoError(err)
+
+	c2, ok := <-accepted
+	r.True(ok, "accept failed")
+
+	return c1, c2
+}
+
+func TestAliases(t *testing.T) {
+	r := require.New(t)
+
+	mux := New(muxrpc.NopLogger())
+	mux.RegisterAsync(muxrpc.Method{"conn", "ping"}, AsyncFunc(func(ctx context.Context, req *muxrpc.Request) (interface{}, error) {
+		return "pong " + req.Method.String(), nil
+	}), WithEncoding(muxrpc.TypeString))
+	mux.RegisterAsync(muxrpc.Method{"whoami"}, AsyncFunc(func(ctx context.Context, req *muxrpc.Request) (interface{}, error) {
+		return "me", nil
+	}), Deprecated("use hello"))
+	mux.RegisterAlias(muxrpc.Method{"gossip", "ping"}, muxrpc.Method{"conn", "ping"}, Deprecated("use conn.ping"))
+	mux.RegisterAlias(muxrpc.Method{"ping"}, muxrpc.Method{"conn", "ping"})
+	mux.RegisterAlias(muxrpc.Method{"nowhere"}, muxrpc.Method{"missing"})
+
+	r.True(mux.Handled(muxrpc.Method{"gossip", "ping"}))
+	r.False(mux.Handled(muxrpc.Method{"nowhere"}), "aliases of unknown methods are not handled")
+	enc, ok := mux.Encoding(muxrpc.Method{"ping"})
+	r.True(ok)
+	r.Equal(muxrpc.TypeString, enc)
+
+	man := mux.Manifest()
+	r.Equal("async", man["ping"])
+	r.Equal(Manifest{"ping": "async"}, man["gossip"])
+	r.NotContains(man, "nowhere")
+
+	client := serveMux(t, &mux)
+	ctx := context.Background()
+
+	for _, m := range []muxrpc.Method{{"conn", "ping"}, {"gossip", "ping"}, {"ping"}, {"gossip", "ping"}} {
+		var got string
+		r.NoError(client.Async(ctx, &got, muxrpc.TypeString, m))
+		r.Equal("pong "+m.String(), got)
+	}
+	var got string
+	r.NoError(client.Async(ctx, &got, muxrpc.TypeString, muxrpc.Method{"whoami"}))
+	r.Equal("me", got)
+
+	r.Equal(map[string]uint64{"gossip.ping": 2, "whoami": 1}, mux.DeprecatedCalls())
+
+	// aliases survive a swap and follow the new handler, so do the counts
+	next := New(muxrpc.NopLogger())
+	next.RegisterAsync(muxrpc.Method{"conn", "ping"}, AsyncFunc(func(ctx context.Context, req *muxrpc.Request) (interface{}, error) {
+		return "new", nil
+	}))
+	next.RegisterAlias(muxrpc.Method{"gossip", "ping"}, muxrpc.Method{"conn", "ping"}, Deprecated("use conn.ping"))
+	<-mux.Swap(next)
+
+	r.NoError(client.Async(ctx, &got, muxrpc.TypeString, muxrpc.Method{"gossip", "ping"}))
+	r.Equal("new", got)
+	r.Equal(map[string]uint64{"gossip.ping": 3, "whoami": 1}, mux.DeprecatedCalls())
+}
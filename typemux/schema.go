@@ -0,0 +1,212 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package typemux
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ssbc/go-muxrpc/v2"
+)
+
+// methodTypes are the Go types of the first argument and of the answer or the items of a method, nil if unknown
+type methodTypes struct {
+	args, ret reflect.Type
+}
+
+// WithTypes records the types of the first argument of a method and of its answer, or of the items it streams, for Describe.
+// args and ret are values of the types or pointers to them, nil if there is nothing to describe. Bind records them by itself.
+//
+//	mux.RegisterAsync(muxrpc.Method{"blobs", "has"}, has, typemux.WithTypes("", false))
+func WithTypes(args, ret interface{}) RegisterOption {
+	return func(reg *registration) {
+		reg.types = methodTypes{args: derefType(args), ret: derefType(ret)}
+	}
+}
+
+func derefType(v interface{}) reflect.Type {
+	t := reflect.TypeOf(v)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// Description describes the registered methods for documentation and code generators, see Describe.
+type Description struct {
+	Methods []MethodDescription `json:"methods"`
+}
+
+// MethodDescription describes one method. Args and Returns are JSON schemas, nil if the types aren't known.
+type MethodDescription struct {
+	Name     string          `json:"name"`
+	Type     muxrpc.CallType `json:"type"`
+	Encoding string          `json:"encoding,omitempty"`
+
+	Args    Schema `json:"args,omitempty"`
+	Returns Schema `json:"returns,omitempty"`
+
+	// AliasOf is the method an alias leads to (see RegisterAlias)
+	AliasOf    string `json:"aliasOf,omitempty"`
+	Deprecated string `json:"deprecated,omitempty"`
+}
+
+// Schema is a JSON schema.
+type Schema map[string]interface{}
+
+// Describe returns the methods of the mux, sorted by name, with JSON schemas of their arguments and answers if they were registered with WithTypes or Bind.
+// Returns describes the items of sources and duplex calls. It is meant to be marshaled to JSON.
+func (hm *HandlerMux) Describe() Description {
+	hm.r.mu.RLock()
+	defer hm.r.mu.RUnlock()
+	rt := hm.r.current
+
+	var desc Description
+	describe := func(name, target string) {
+		md := MethodDescription{
+			Name:       name,
+			Type:       rt.types[target],
+			Deprecated: rt.deprecated[name],
+		}
+		if name != target {
+			md.AliasOf = target
+		}
+		if enc := rt.encodings[target]; enc.set {
+			md.Encoding = encodingName(enc.re)
+		}
+		mt := rt.goTypes[target]
+		md.Args = schemaOf(mt.args)
+		md.Returns = schemaOf(mt.ret)
+		desc.Methods = append(desc.Methods, md)
+	}
+
+	for name := range rt.types {
+		describe(name, name)
+	}
+	for alias, target := range rt.aliases {
+		if name, ok := rt.lookupName(target); ok {
+			describe(alias, name)
+		}
+	}
+	sort.Slice(desc.Methods, func(i, j int) bool { return desc.Methods[i].Name < desc.Methods[j].Name })
+	return desc
+}
+
+func encodingName(re muxrpc.RequestEncoding) string {
+	switch re {
+	case muxrpc.TypeJSON:
+		return "json"
+	case muxrpc.TypeString:
+		return "string"
+	case muxrpc.TypeBinary:
+		return "binary"
+	}
+	return ""
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage(nil))
+	marshalerType  = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// schemaOf returns the JSON schema of the values of t, as encoding/json marshals them
+func schemaOf(t reflect.Type) Schema {
+	if t == nil {
+		return nil
+	}
+	return schemaOfType(t, make(map[reflect.Type]bool))
+}
+
+// schemaOfType describes t. Types that contain themselves are described as anything where they repeat.
+func schemaOfType(t reflect.Type, seen map[reflect.Type]bool) Schema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return Schema{"type": "string", "format": "date-time"}
+	case t == rawMessageType, t.Implements(marshalerType), reflect.PtrTo(t).Implements(marshalerType):
+		// it can be anything
+		return Schema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return Schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return Schema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return Schema{"type": "number"}
+	case reflect.String:
+		return Schema{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return Schema{"type": "string", "contentEncoding": "base64"}
+		}
+		return Schema{"type": "array", "items": schemaOfType(t.Elem(), seen)}
+	case reflect.Map:
+		return Schema{"type": "object", "additionalProperties": schemaOfType(t.Elem(), seen)}
+	case reflect.Struct:
+		if seen[t] {
+			return Schema{}
+		}
+		seen[t] = true
+		defer delete(seen, t)
+
+		props := make(map[string]interface{})
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" && !f.Anonymous {
+				continue
+			}
+			name, opts := f.Name, ""
+			if tag, ok := f.Tag.Lookup("json"); ok {
+				if tag == "-" {
+					continue
+				}
+				name, opts = tag, ""
+				if i := strings.Index(tag, ","); i >= 0 {
+					name, opts = tag[:i], tag[i:]
+				}
+				if name == "" {
+					name = f.Name
+				}
+			}
+			if _, tagged := f.Tag.Lookup("json"); f.Anonymous && !tagged {
+				// encoding/json lifts the fields of embedded structs
+				if embedded := schemaOfType(f.Type, seen); embedded["type"] == "object" {
+					for n, p := range embedded["properties"].(map[string]interface{}) {
+						props[n] = p
+					}
+					if req, ok := embedded["required"].([]string); ok {
+						required = append(required, req...)
+					}
+					continue
+				}
+			}
+			if f.PkgPath != "" {
+				continue
+			}
+			props[name] = schemaOfType(f.Type, seen)
+			if !strings.Contains(opts, "omitempty") {
+				required = append(required, name)
+			}
+		}
+		s := Schema{"type": "object", "properties": props}
+		if len(required) > 0 {
+			s["required"] = required
+		}
+		return s
+	}
+	// interfaces and whatever else
+	return Schema{}
+}
@@ -25,6 +25,8 @@ type SourceHandler interface {
 
 type sourceStub struct {
 	h SourceHandler
+
+	enc encoding
 }
 
 func (hm sourceStub) HandleCall(ctx context.Context, req *muxrpc.Request) {
@@ -35,6 +37,9 @@ func (hm sourceStub) HandleCall(ctx context.Context, req *muxrpc.Request) {
 		req.CloseWithError(err)
 		return
 	}
+	if hm.enc.set {
+		w.SetEncoding(hm.enc.re)
+	}
 
 	err = hm.h.HandleSource(ctx, req, w)
 	if err != nil {
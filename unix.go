@@ -0,0 +1,94 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// UnixOption configures ListenUnix.
+type UnixOption func(*unixConfig)
+
+type unixConfig struct {
+	mode os.FileMode
+}
+
+// WithSocketMode sets the permissions of the socket file. The default is 0600, so that only the user running the server can connect.
+// Use 0660 to let the group of the file connect, too.
+func WithSocketMode(mode os.FileMode) UnixOption {
+	return func(uc *unixConfig) {
+		uc.mode = mode
+	}
+}
+
+// ListenUnix listens on a unix socket at path, like ssb-server does with ~/.ssb/socket for its local API.
+//
+// A socket file that was left behind by a server that didn't shut down is removed first.
+// If a server still answers on it, or path is not a socket, it fails instead.
+// The socket file is removed again when the listener is closed.
+func ListenUnix(path string, opts ...UnixOption) (net.Listener, error) {
+	uc := unixConfig{mode: 0600}
+	for _, o := range opts {
+		o(&uc)
+	}
+
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("muxrpc: failed to listen on %s: %w", path, err)
+	}
+	// there is a short window before this where the socket has the permissions of the umask
+	if err := os.Chmod(path, uc.mode); err != nil {
+		lis.Close()
+		return nil, fmt.Errorf("muxrpc: failed to set permissions of %s: %w", path, err)
+	}
+	return lis, nil
+}
+
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("muxrpc: failed to check %s: %w", path, err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("muxrpc: %s exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("muxrpc: socket %s is in use", path)
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("muxrpc: failed to remove stale socket %s: %w", path, err)
+	}
+	return nil
+}
+
+// ServeUnix listens on a unix socket at path with ListenUnix and defaults and runs Serve on it.
+// Use ListenUnix and Serve to set the permissions of the socket.
+func ServeUnix(ctx context.Context, path string, hf HandlerFactory, opts ...ServeOption) error {
+	lis, err := ListenUnix(path)
+	if err != nil {
+		return err
+	}
+	return Serve(ctx, lis, hf, opts...)
+}
+
+// DialUnix connects to the unix socket at path and starts a session on it in the client role.
+func DialUnix(ctx context.Context, path string, handler Handler, opts ...HandleOption) (Endpoint, error) {
+	return DialEndpoint(ctx, NetTransport{Network: "unix"}, path, handler, opts...)
+}
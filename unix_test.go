@@ -0,0 +1,87 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeUnix(t *testing.T) {
+	r := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "socket")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- ServeUnix(ctx, path, func(net.Conn) (Handler, error) { return Echo, nil },
+			WithServeLogger(NopLogger()),
+			WithHandleOptions(WithoutManifest(), WithLogger(NopLogger())),
+		)
+	}()
+	r.Eventually(func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}, time.Second, 5*time.Millisecond)
+
+	fi, err := os.Stat(path)
+	r.NoError(err)
+	r.Equal(os.FileMode(0600), fi.Mode().Perm())
+
+	edp, err := DialUnix(ctx, path, &FakeHandler{}, WithoutManifest(), WithLogger(NopLogger()))
+	r.NoError(err)
+	defer edp.Terminate()
+
+	var v map[string]string
+	r.NoError(edp.Async(ctx, &v, TypeJSON, Method{"echo"}, map[string]string{"via": "socket"}))
+	r.Equal("socket", v["via"])
+
+	cancel()
+	r.NoError(<-served)
+	_, err = os.Stat(path)
+	r.True(os.IsNotExist(err), "socket file should be removed, got %v", err)
+}
+
+func TestListenUnixStale(t *testing.T) {
+	r := require.New(t)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "socket")
+
+	// a server that crashed leaves its socket file behind
+	crashed, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	r.NoError(err)
+	crashed.SetUnlinkOnClose(false)
+	crashed.Close()
+	_, err = os.Stat(path)
+	r.NoError(err)
+
+	lis, err := ListenUnix(path, WithSocketMode(0660))
+	r.NoError(err)
+	defer lis.Close()
+
+	fi, err := os.Stat(path)
+	r.NoError(err)
+	r.Equal(os.FileMode(0660), fi.Mode().Perm())
+
+	_, err = ListenUnix(path)
+	r.Error(err, "socket is in use")
+
+	notSocket := filepath.Join(dir, "file")
+	r.NoError(ioutil.WriteFile(notSocket, []byte("important"), 0600))
+	_, err = ListenUnix(notSocket)
+	r.Error(err)
+	content, err := ioutil.ReadFile(notSocket)
+	r.NoError(err)
+	r.Equal("important", string(content))
+}
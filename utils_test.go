@@ -14,7 +14,6 @@ import (
 
 	"github.com/ssbc/go-muxrpc/v2/debug"
 	"github.com/stretchr/testify/require"
-	"go.mindeco.de/log"
 )
 
 // for some reason you can't use t.Fatal // t.Error in goroutines... :-/
@@ -37,7 +36,7 @@ func mkCheck(errc chan<- error) func(err error) {
 	}
 }
 
-func rewrap(l log.Logger, p *Packer) *Packer {
+func rewrap(l Logger, p *Packer) *Packer {
 	rwc, ok := p.c.(io.ReadWriteCloser)
 	if !ok {
 		panic(fmt.Sprintf("expected RWC: %T", p.c))
@@ -73,3 +72,44 @@ func loPipe(t testing.TB) (net.Conn, net.Conn) {
 
 	return c1, c2
 }
+
+// connectPair wires up two endpoints over loopback networking and tears them down once the test is done.
+// h1 is served by the first returned endpoint, h2 by the second one.
+func connectPair(t testing.TB, h1, h2 Handler, opts1, opts2 []HandleOption) (Endpoint, Endpoint) {
+	c1, c2 := loPipe(t)
+
+	errc := make(chan error, 2)
+	serve1 := make(chan struct{})
+	serve2 := make(chan struct{})
+	ctx := context.Background()
+
+	var rpc2 Endpoint
+	rpc2ready := make(chan struct{})
+	go func() {
+		rpc2 = Handle(NewPacker(c2), h2, opts2...)
+		close(rpc2ready)
+		serve(ctx, rpc2.(Server), errc, serve2)
+	}()
+
+	rpc1 := Handle(NewPacker(c1), h1, opts1...)
+	go serve(ctx, rpc1.(Server), errc, serve1)
+	<-rpc2ready
+
+	t.Cleanup(func() {
+		rpc1.Terminate()
+		rpc2.Terminate()
+
+		for serve1 != nil || serve2 != nil {
+			select {
+			case err := <-errc:
+				t.Error("serve failed:", err)
+			case <-serve1:
+				serve1 = nil
+			case <-serve2:
+				serve2 = nil
+			}
+		}
+	})
+
+	return rpc1, rpc2
+}
@@ -0,0 +1,298 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package muxrpc
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/ssbc/go-muxrpc/v2/codec"
+)
+
+// defaultWriteQueue is the WithWriteQueue of new sessions
+const defaultWriteQueue = 64
+
+// WithWriteQueue sets how many writes of each priority can wait for the connection, the default is 64.
+// Writes to sinks return once they are queued. If the queue is full, because the remote doesn't keep up with reading,
+// they wait for room until their write deadline (see ByteSink.SetWriteDeadline) and TryWrite fails.
+func WithWriteQueue(n int) HandleOption {
+	return func(r *rpc) {
+		r.writeQueueLen = n
+	}
+}
+
+// writeQueue is the outgoing side of a session. A single goroutine owns the codec.Writer and writes what the sinks and the endpoint queue up,
+// the packets with the highest priority first. Writes of the same priority go out in order. Since a sink only queues its next packets
+// once the previous ones were picked up (see ByteSink.send), a stream with a lot to send doesn't hold up the others of its priority.
+//
+// Writes are asynchronous, the first error of the connection is returned to the writes that follow it.
+type writeQueue struct {
+	w    *codec.Writer
+	jobs [priorityLevels]chan *writeJob
+
+	// clock times flush, it is the one of the session
+	clock Clock
+
+	// stop is closed by close, done once run returned
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+
+	// mu guards err, the first write that failed, and queued, the body bytes that wait to be written
+	mu     sync.Mutex
+	err    error
+	queued int
+}
+
+// writeJob is a batch of packets that are written in one go.
+type writeJob struct {
+	pkts []codec.Packet
+	size int
+
+	// barrier jobs wait until everything that was queued before them, of any priority, was written.
+	// goodbye ends the packet stream then.
+	barrier bool
+	goodbye bool
+
+	// taken is closed once the writer picked the job up, result gets the error of the write
+	taken  chan struct{}
+	result chan error
+}
+
+// newWriteJob copies pkts into a job, the caller can reuse the bodies afterwards
+func newWriteJob(pkts ...codec.Packet) *writeJob {
+	job := &writeJob{
+		pkts:   make([]codec.Packet, len(pkts)),
+		taken:  make(chan struct{}),
+		result: make(chan error, 1),
+	}
+	for _, pkt := range pkts {
+		job.size += len(pkt.Body)
+	}
+	bodies := make([]byte, 0, job.size)
+	for i, pkt := range pkts {
+		start := len(bodies)
+		bodies = append(bodies, pkt.Body...)
+		pkt.Body = bodies[start:len(bodies):len(bodies)]
+		job.pkts[i] = pkt
+	}
+	return job
+}
+
+func newWriteQueue(w *codec.Writer, depth int, clock Clock) *writeQueue {
+	if depth < 1 {
+		depth = 1
+	}
+	q := &writeQueue{
+		w:     w,
+		clock: clock,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	for lvl := range q.jobs {
+		q.jobs[lvl] = make(chan *writeJob, depth)
+	}
+	return q
+}
+
+// run writes the queued jobs until close is called.
+func (q *writeQueue) run() {
+	defer close(q.done)
+	for {
+		job := q.next()
+		if job == nil {
+			return
+		}
+		q.do(job)
+
+		// a buffered writer hands its packets over once there is nothing more to write.
+		// The sinks queue their next packets as soon as the previous ones were taken, so give them a chance to first.
+		if q.idle() && q.w.Buffered() > 0 {
+			runtime.Gosched()
+		}
+		if q.idle() {
+			if err := q.w.Flush(); err != nil {
+				q.fail(err)
+			}
+		}
+	}
+}
+
+// next waits for the queued job with the highest priority. It returns nil once the queue was closed.
+func (q *writeQueue) next() *writeJob {
+	select {
+	case <-q.stop:
+		return nil
+	default:
+	}
+	if job := q.poll(); job != nil {
+		return job
+	}
+
+	select {
+	case job := <-q.jobs[PriorityHigh.level()]:
+		return job
+	case job := <-q.jobs[PriorityNormal.level()]:
+		return job
+	case job := <-q.jobs[PriorityLow.level()]:
+		return job
+	case <-q.stop:
+		return nil
+	}
+}
+
+// poll returns the queued job with the highest priority or nil if there is none
+func (q *writeQueue) poll() *writeJob {
+	for lvl := priorityLevels - 1; lvl >= 0; lvl-- {
+		select {
+		case job := <-q.jobs[lvl]:
+			return job
+		default:
+		}
+	}
+	return nil
+}
+
+// idle is true if no job waits
+func (q *writeQueue) idle() bool {
+	for _, jobs := range q.jobs {
+		if len(jobs) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// do writes the packets of job, unless an earlier write failed, and passes on the result.
+func (q *writeQueue) do(job *writeJob) {
+	close(job.taken)
+	if job.barrier {
+		for other := q.poll(); other != nil; other = q.poll() {
+			q.do(other)
+		}
+	}
+
+	err := q.failed()
+	if err == nil {
+		switch {
+		case job.goodbye:
+			err = q.w.Goodbye()
+		case len(job.pkts) == 1:
+			err = q.w.WritePacket(job.pkts[0])
+		case len(job.pkts) > 1:
+			err = q.w.WritePackets(job.pkts...)
+		}
+		if err != nil {
+			q.fail(err)
+		}
+	}
+
+	q.mu.Lock()
+	q.queued -= job.size
+	q.mu.Unlock()
+	job.result <- err
+}
+
+// enqueue puts job into the queue of priority p. Unless mode is noWait, it waits for room until expired fires.
+func (q *writeQueue) enqueue(p Priority, job *writeJob, mode waitMode, expired <-chan time.Time) error {
+	select {
+	case <-q.stop:
+		return ErrSessionTerminated
+	default:
+	}
+	if err := q.failed(); err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	q.queued += job.size
+	q.mu.Unlock()
+
+	err := q.push(q.jobs[p.level()], job, mode, expired)
+	if err != nil {
+		q.mu.Lock()
+		q.queued -= job.size
+		q.mu.Unlock()
+	}
+	return err
+}
+
+func (q *writeQueue) push(jobs chan<- *writeJob, job *writeJob, mode waitMode, expired <-chan time.Time) error {
+	if mode == noWait {
+		select {
+		case <-q.stop:
+			return ErrSessionTerminated
+		case jobs <- job:
+			return nil
+		default:
+			return ErrWouldBlock
+		}
+	}
+
+	select {
+	case <-q.stop:
+		return ErrSessionTerminated
+	case jobs <- job:
+		return nil
+	case <-expired:
+		return ErrWriteTimeout
+	}
+}
+
+// write queues pkts without waiting for them to go out
+func (q *writeQueue) write(p Priority, pkts ...codec.Packet) error {
+	return q.enqueue(p, newWriteJob(pkts...), always, nil)
+}
+
+// flush waits until everything that was queued so far was written, at most for timeout.
+// If goodbye is set the packet stream is ended afterwards.
+func (q *writeQueue) flush(goodbye bool, timeout time.Duration) error {
+	job := newWriteJob()
+	job.barrier = true
+	job.goodbye = goodbye
+
+	// a full queue counts against the timeout as well
+	t := q.clock.NewTimer(timeout)
+	defer t.Stop()
+	if err := q.enqueue(PriorityHigh, job, always, t.C()); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-job.result:
+		return err
+	case <-q.done:
+		return ErrSessionTerminated
+	case <-t.C():
+		return ErrWriteTimeout
+	}
+}
+
+// close stops the writer, what wasn't written yet is dropped. It returns how many body bytes that were.
+// The writer might be stuck in a write to the connection, which needs to be closed first.
+func (q *writeQueue) close() int {
+	q.stopOnce.Do(func() { close(q.stop) })
+	<-q.done
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.queued
+}
+
+// failed returns the error of the first write that failed
+func (q *writeQueue) failed() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.err
+}
+
+func (q *writeQueue) fail(err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err == nil {
+		q.err = err
+	}
+}
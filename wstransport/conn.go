@@ -0,0 +1,264 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package wstransport
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// frame opcodes, see RFC 6455 section 5.2
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// maxControlPayload is the largest payload a control frame may have
+const maxControlPayload = 125
+
+// closeTimeout is how long Close waits for the close frame to go out
+const closeTimeout = time.Second
+
+// errProtocol is returned for frames that break the websocket protocol
+var errProtocol = errors.New("wstransport: protocol error")
+
+// conn is a websocket connection that carries a byte stream.
+// Every Write is sent as one binary message, reads return the data of the messages the remote sent, in order.
+type conn struct {
+	nc net.Conn
+	br *bufio.Reader
+
+	// isClient connections mask what they send and expect unmasked frames
+	isClient bool
+
+	rmu sync.Mutex
+	// left is what is left of the payload of the current data frame
+	left    uint64
+	mask    [4]byte
+	masked  bool
+	maskPos int
+	// final is set if the current data frame is the last of its message
+	final   bool
+	readErr error
+
+	wmu       sync.Mutex
+	closeSent bool
+}
+
+func newConn(nc net.Conn, br *bufio.Reader, isClient bool) *conn {
+	return &conn{nc: nc, br: br, isClient: isClient, final: true}
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for c.left == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		if err := c.nextFrame(); err != nil {
+			c.readErr = err
+			return 0, err
+		}
+	}
+
+	if uint64(len(b)) > c.left {
+		b = b[:c.left]
+	}
+	n, err := c.br.Read(b)
+	if c.masked {
+		for i := range b[:n] {
+			b[i] ^= c.mask[c.maskPos%4]
+			c.maskPos++
+		}
+	}
+	c.left -= uint64(n)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		c.readErr = err
+	}
+	return n, err
+}
+
+// nextFrame reads frame headers and handles control frames until a data frame starts
+func (c *conn) nextFrame() error {
+	for {
+		var hdr [2]byte
+		if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+			return err
+		}
+		fin, op := hdr[0]&0x80 != 0, hdr[0]&0x0f
+		if hdr[0]&0x70 != 0 {
+			// no extensions were negotiated
+			return c.fail(1002, errProtocol)
+		}
+		masked := hdr[1]&0x80 != 0
+		if masked == c.isClient {
+			// clients mask, servers don't
+			return c.fail(1002, errProtocol)
+		}
+
+		length := uint64(hdr[1] & 0x7f)
+		switch length {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+				return err
+			}
+			length = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+				return err
+			}
+			length = binary.BigEndian.Uint64(ext[:])
+			if length>>63 != 0 {
+				// the most significant bit has to be zero
+				return c.fail(1002, errProtocol)
+			}
+		}
+
+		var mask [4]byte
+		if masked {
+			if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+				return err
+			}
+		}
+
+		switch op {
+		case opBinary, opText, opContinuation:
+			// a continuation has to follow an unfinished message and a new message a finished one
+			if (op == opContinuation) == c.final {
+				return c.fail(1002, errProtocol)
+			}
+			c.left, c.mask, c.masked, c.maskPos, c.final = length, mask, masked, 0, fin
+			if length > 0 {
+				return nil
+			}
+
+		case opClose, opPing, opPong:
+			if !fin || length > maxControlPayload {
+				return c.fail(1002, errProtocol)
+			}
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(c.br, payload); err != nil {
+				return err
+			}
+			if masked {
+				for i := range payload {
+					payload[i] ^= mask[i%4]
+				}
+			}
+
+			switch op {
+			case opPing:
+				if err := c.writeFrame(opPong, payload); err != nil {
+					return err
+				}
+			case opClose:
+				// answer with the same status code, if there was one
+				if len(payload) > 2 {
+					payload = payload[:2]
+				}
+				c.writeClose(payload)
+				return io.EOF
+			}
+
+		default:
+			return c.fail(1002, errProtocol)
+		}
+	}
+}
+
+// fail closes the connection with a status code, after the remote broke the protocol
+func (c *conn) fail(code uint16, err error) error {
+	var payload [2]byte
+	binary.BigEndian.PutUint16(payload[:], code)
+	c.writeClose(payload[:])
+	c.nc.Close()
+	return err
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(opBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *conn) writeFrame(op byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return io.ErrClosedPipe
+	}
+	if op == opClose {
+		c.closeSent = true
+	}
+
+	hdr := make([]byte, 2, 14+len(payload))
+	hdr[0] = 0x80 | op
+	switch n := len(payload); {
+	case n < 126:
+		hdr[1] = byte(n)
+	case n <= 0xffff:
+		hdr[1] = 126
+		hdr = append(hdr, 0, 0)
+		binary.BigEndian.PutUint16(hdr[2:], uint16(n))
+	default:
+		hdr[1] = 127
+		hdr = append(hdr, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(hdr[2:], uint64(n))
+	}
+
+	frame := hdr
+	if c.isClient {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return fmt.Errorf("wstransport: failed to make mask: %w", err)
+		}
+		frame[1] |= 0x80
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range frame[start:] {
+			frame[start+i] ^= mask[i%4]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	_, err := c.nc.Write(frame)
+	return err
+}
+
+func (c *conn) writeClose(payload []byte) {
+	c.nc.SetWriteDeadline(time.Now().Add(closeTimeout))
+	c.writeFrame(opClose, payload)
+	c.nc.SetWriteDeadline(time.Time{})
+}
+
+// Close sends a normal closure and closes the underlying connection.
+// It doesn't wait for the remote to answer, muxrpc already said goodbye on its own.
+func (c *conn) Close() error {
+	c.writeClose([]byte{0x03, 0xe8}) // 1000
+	return c.nc.Close()
+}
+
+func (c *conn) RemoteAddr() net.Addr { return c.nc.RemoteAddr() }
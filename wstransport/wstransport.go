@@ -0,0 +1,278 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+// Package wstransport carries muxrpc over WebSocket, like ssb-ws and browser peers do.
+// The packet-stream is sent as binary messages, every write of the endpoint becomes one message.
+//
+// A Transport dials ws:// and wss:// URLs and is an http.Handler for the other side:
+//
+//	tr := wstransport.New()
+//	http.Handle("/", tr)
+//	go http.ListenAndServe(":8989", nil)
+//	for {
+//		edp, err := muxrpc.AcceptEndpoint(ctx, tr, handler)
+//		// ...
+//	}
+package wstransport
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ssbc/go-muxrpc/v2"
+)
+
+// keyGUID is appended to the key of the client to compute the accept header, see RFC 6455 section 1.3
+const keyGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Transport is a muxrpc.Transport over WebSocket.
+type Transport struct {
+	// TLSConfig is used to dial wss:// URLs, nil means the default configuration.
+	TLSConfig *tls.Config
+
+	// CheckOrigin decides if a request from a browser is accepted, nil accepts all of them.
+	CheckOrigin func(r *http.Request) bool
+
+	// HandshakeTimeout limits the upgrade of dialed connections, when the context of Dial has no deadline. Zero means 10 seconds.
+	HandshakeTimeout time.Duration
+
+	accepted chan muxrpc.TransportConn
+}
+
+var (
+	_ muxrpc.Transport = (*Transport)(nil)
+	_ http.Handler     = (*Transport)(nil)
+)
+
+// New returns a Transport that holds up to 16 upgraded connections that weren't accepted yet.
+// Requests beyond that are answered with 503 Service Unavailable.
+func New() *Transport {
+	return &Transport{accepted: make(chan muxrpc.TransportConn, 16)}
+}
+
+// Dial connects to the websocket URL addr, like ws://localhost:8989 or wss://example.com/muxrpc.
+func (t *Transport) Dial(ctx context.Context, addr string) (muxrpc.TransportConn, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("wstransport: invalid address: %w", err)
+	}
+	var secure bool
+	switch u.Scheme {
+	case "ws":
+	case "wss":
+		secure = true
+	default:
+		return nil, fmt.Errorf("wstransport: unsupported scheme %q, need ws or wss", u.Scheme)
+	}
+
+	hostport := u.Host
+	if u.Port() == "" {
+		if secure {
+			hostport = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			hostport = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		timeout := t.HandshakeTimeout
+		if timeout == 0 {
+			timeout = 10 * time.Second
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", hostport)
+	if err != nil {
+		return nil, err
+	}
+	if secure {
+		cfg := t.TLSConfig.Clone()
+		if cfg == nil {
+			cfg = &tls.Config{}
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = u.Hostname()
+		}
+		tc := tls.Client(nc, cfg)
+		deadline, _ := ctx.Deadline()
+		tc.SetDeadline(deadline)
+		err := tc.Handshake()
+		tc.SetDeadline(time.Time{})
+		if err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("wstransport: tls handshake failed: %w", err)
+		}
+		nc = tc
+	}
+
+	c, err := clientHandshake(ctx, nc, u)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return muxrpc.NewTransportConn(c, muxrpc.ConnInfo{
+		Remote: nc.RemoteAddr(),
+		Local:  nc.LocalAddr(),
+		Meta:   map[string]string{"url": u.String()},
+	}), nil
+}
+
+func clientHandshake(ctx context.Context, nc net.Conn, u *url.URL) (*conn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		nc.SetDeadline(deadline)
+		defer nc.SetDeadline(time.Time{})
+	}
+
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, fmt.Errorf("wstransport: failed to make key: %w", err)
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Upgrade":               {"websocket"},
+			"Connection":            {"Upgrade"},
+			"Sec-WebSocket-Key":     {key},
+			"Sec-WebSocket-Version": {"13"},
+		},
+		Host: u.Host,
+	}
+	if err := req.Write(nc); err != nil {
+		return nil, fmt.Errorf("wstransport: failed to send upgrade request: %w", err)
+	}
+
+	br := bufio.NewReader(nc)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("wstransport: failed to read upgrade response: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("wstransport: upgrade refused: %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		return nil, fmt.Errorf("wstransport: upgrade response with wrong accept key")
+	}
+
+	return newConn(nc, br, true), nil
+}
+
+// ServeHTTP upgrades the request to a websocket connection and hands it to Accept.
+func (t *Transport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		w.Header().Set("Upgrade", "websocket")
+		http.Error(w, "expected a websocket upgrade", http.StatusUpgradeRequired)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusBadRequest)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing websocket key", http.StatusBadRequest)
+		return
+	}
+	if t.CheckOrigin != nil && !t.CheckOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	if len(t.accepted) == cap(t.accepted) {
+		http.Error(w, "too many pending connections", http.StatusServiceUnavailable)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection can't be upgraded", http.StatusInternalServerError)
+		return
+	}
+	nc, rw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	if _, err := rw.WriteString(resp); err != nil {
+		nc.Close()
+		return
+	}
+	if err := rw.Flush(); err != nil {
+		nc.Close()
+		return
+	}
+
+	meta := map[string]string{"path": r.URL.Path}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		meta["origin"] = origin
+	}
+	tc := muxrpc.NewTransportConn(newConn(nc, rw.Reader, false), muxrpc.ConnInfo{
+		Remote: nc.RemoteAddr(),
+		Local:  nc.LocalAddr(),
+		Meta:   meta,
+	})
+
+	select {
+	case t.accepted <- tc:
+	default:
+		// filled up since the check above
+		tc.Close()
+	}
+}
+
+// Accept returns the next connection that was upgraded by ServeHTTP.
+func (t *Transport) Accept(ctx context.Context) (muxrpc.TransportConn, error) {
+	if t.accepted == nil {
+		return nil, fmt.Errorf("wstransport: transport was not made with New")
+	}
+	select {
+	case tc := <-t.accepted:
+		return tc, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func acceptKey(key string) string {
+	h := sha1.Sum([]byte(key + keyGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// headerContains checks if one of the comma separated tokens of the header is token, ignoring case
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
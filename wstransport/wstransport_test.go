@@ -0,0 +1,150 @@
+// SPDX-FileCopyrightText: 2021 Henry Bubert
+//
+// SPDX-License-Identifier: MIT
+
+package wstransport
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ssbc/go-muxrpc/v2"
+)
+
+func TestTransport(t *testing.T) {
+	r := require.New(t)
+
+	tr := New()
+	srv := httptest.NewServer(tr)
+	defer srv.Close()
+
+	ctx := context.Background()
+	opts := []muxrpc.HandleOption{muxrpc.WithLogger(muxrpc.NopLogger()), muxrpc.WithoutManifest()}
+	srvEdp := make(chan muxrpc.Endpoint, 1)
+	go func() {
+		edp, err := muxrpc.AcceptEndpoint(ctx, tr, muxrpc.Echo, opts...)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		srvEdp <- edp
+	}()
+
+	client, err := muxrpc.DialEndpoint(ctx, New(), "ws"+strings.TrimPrefix(srv.URL, "http")+"/muxrpc", muxrpc.Echo, opts...)
+	r.NoError(err)
+	server := <-srvEdp
+	defer server.Terminate()
+	defer client.Terminate()
+
+	info, ok := muxrpc.RemoteInfo(server)
+	r.True(ok)
+	r.Equal("/muxrpc", info.Meta["path"])
+
+	var v map[string]int
+	r.NoError(client.Async(ctx, &v, muxrpc.TypeJSON, muxrpc.Method{"echo"}, map[string]int{"a": 1}))
+	r.Equal(1, v["a"])
+
+	// bigger than the 16 bit length of a frame
+	big := strings.Repeat("x", 100*1024)
+	src, err := client.Source(ctx, muxrpc.TypeJSON, muxrpc.Method{"echo"}, big, "small")
+	r.NoError(err)
+	var got []string
+	for src.Next(ctx) {
+		b, err := src.Bytes()
+		r.NoError(err)
+		got = append(got, string(b))
+	}
+	r.NoError(src.Err())
+	r.Equal([]string{`"` + big + `"`, `"small"`}, got)
+}
+
+func TestNoUpgrade(t *testing.T) {
+	srv := httptest.NewServer(New())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUpgradeRequired, resp.StatusCode)
+}
+
+// maskedFrame encodes a frame like a client would send it
+func maskedFrame(fin bool, op byte, payload string) []byte {
+	b0 := op
+	if fin {
+		b0 |= 0x80
+	}
+	mask := [4]byte{1, 2, 3, 4}
+	frame := []byte{b0, 0x80 | byte(len(payload))}
+	frame = append(frame, mask[:]...)
+	for i := range payload {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	return frame
+}
+
+func TestFragmentsAndPings(t *testing.T) {
+	r := require.New(t)
+
+	srvSide, clientSide := net.Pipe()
+	c := newConn(srvSide, bufio.NewReader(srvSide), false)
+
+	// a ping in the middle of a fragmented message
+	go func() {
+		clientSide.Write(maskedFrame(false, opBinary, "hel"))
+		clientSide.Write(maskedFrame(true, opPing, "are you there"))
+		clientSide.Write(maskedFrame(true, opContinuation, "lo"))
+		clientSide.Write(maskedFrame(true, opClose, "\x03\xe8"))
+	}()
+	pong := make(chan []byte, 1)
+	closed := make(chan []byte, 1)
+	go func() {
+		br := bufio.NewReader(clientSide)
+		for _, ch := range []chan []byte{pong, closed} {
+			var hdr [2]byte
+			io.ReadFull(br, hdr[:])
+			frame := make([]byte, hdr[1])
+			io.ReadFull(br, frame)
+			ch <- append(hdr[:], frame...)
+		}
+	}()
+
+	data, err := ioutil.ReadAll(c)
+	r.NoError(err)
+	r.Equal("hello", string(data))
+	r.Equal(append([]byte{0x80 | opPong, 13}, "are you there"...), <-pong)
+	r.Equal([]byte{0x80 | opClose, 2, 0x03, 0xe8}, <-closed)
+}
+
+func TestUnmaskedFromClient(t *testing.T) {
+	srvSide, clientSide := net.Pipe()
+	c := newConn(srvSide, bufio.NewReader(srvSide), false)
+	go func() {
+		clientSide.Write([]byte{0x80 | opBinary, 2, 'h', 'i'})
+		io.Copy(ioutil.Discard, clientSide)
+	}()
+
+	_, err := c.Read(make([]byte, 10))
+	require.ErrorIs(t, err, errProtocol)
+}
+
+func TestLengthWithHighBit(t *testing.T) {
+	srvSide, clientSide := net.Pipe()
+	c := newConn(srvSide, bufio.NewReader(srvSide), false)
+	go func() {
+		clientSide.Write([]byte{0x80 | opBinary, 0x80 | 127, 0x80, 0, 0, 0, 0, 0, 0, 1})
+		io.Copy(ioutil.Discard, clientSide)
+	}()
+
+	_, err := c.Read(make([]byte, 10))
+	require.ErrorIs(t, err, errProtocol)
+}